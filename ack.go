@@ -0,0 +1,273 @@
+package gochunker
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ackCheckInterval bounds how often unacknowledged events are checked for
+// an expired AckTimeout
+const ackCheckInterval = 10 * time.Millisecond
+
+// pendingAck is an event sent to a provider that has not acknowledged it
+type pendingAck struct {
+	id       string
+	sentAt   time.Time
+	attempts int  // times it was sent, see Config.MaxSendAttempts
+	due      bool // queued in the provider's resend list
+}
+
+// markSentLocked records that the events at indexes are done with for p,
+// sent with the sequence numbers in seqs, see recordSeqsLocked, or, when
+// seqs is nil, skipped.
+// When acks are required sent events stay buffered until p acknowledges
+// them, unless they expired and are not worth sending again. c.mu must be
+// held.
+func (c *Controller) markSentLocked(p *provider, indexes []int, seqs []uint64) {
+	now := c.now()
+	if p.sentAbove == nil {
+		p.sentAbove = make(map[int]struct{})
+	}
+	if seqs != nil {
+		recordSeqsLocked(p, indexes, seqs)
+	}
+	for _, idx := range indexes {
+		if c.cfg.RequireAcks || c.tracer != nil {
+			if event, ok := c.events.get(idx); ok {
+				expired := event.expired(c.now())
+				if c.cfg.RequireAcks && !expired && seqs != nil {
+					c.awaitAckLocked(p, idx, event.ID, now)
+				}
+				if c.tracer != nil {
+					c.traceSentLocked(p, idx, event, expired, c.cfg.RequireAcks)
+				}
+			}
+		}
+		if idx >= p.sentIndex {
+			p.sentAbove[idx] = struct{}{}
+		}
+	}
+	c.advanceSentLocked(p)
+	advanceAckedLocked(p)
+	c.releaseLocked()
+}
+
+// advanceSentLocked moves p.sentIndex past every event that was sent or
+// dropped from the buffer. c.mu must be held.
+func (c *Controller) advanceSentLocked(p *provider) {
+	for p.sentIndex < c.events.next() {
+		_, sent := p.sentAbove[p.sentIndex]
+		if !sent && p.sentIndex >= c.events.first {
+			return
+		}
+		delete(p.sentAbove, p.sentIndex)
+		p.sentIndex++
+	}
+}
+
+// awaitAckLocked starts or restarts the wait for p to acknowledge the event
+// at idx. c.mu must be held.
+func (c *Controller) awaitAckLocked(p *provider, idx int, id string, now time.Time) {
+	if p.unacked == nil {
+		p.unacked = make(map[int]*pendingAck)
+		p.ackIDs = make(map[string][]int)
+	}
+	if pa, ok := p.unacked[idx]; ok {
+		pa.sentAt = now
+		pa.due = false
+		pa.attempts++
+		c.traceResentLocked(p, idx)
+		return
+	}
+	p.unacked[idx] = &pendingAck{id: id, sentAt: now, attempts: 1}
+	p.ackIDs[id] = append(p.ackIDs[id], idx)
+}
+
+// ack handles p acknowledging event id, releasing its buffer slot once no
+// other provider needs it. It reports false if no such ack was awaited, as
+// for a duplicate ack.
+func (c *Controller) ack(p *provider, id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	indexes, ok := p.ackIDs[id]
+	if !ok {
+		return false
+	}
+	delete(p.ackIDs, id)
+	for _, idx := range indexes {
+		delete(p.unacked, idx)
+		c.traceAckedLocked(p, idx, true)
+	}
+	advanceAckedLocked(p)
+	c.releaseLocked()
+	c.inFlightFreedLocked(p)
+	return true
+}
+
+// forgetLocked stops waiting for an ack of the event at idx
+func (c *Controller) forgetLocked(p *provider, idx int) {
+	pa, ok := p.unacked[idx]
+	if !ok {
+		return
+	}
+	delete(p.unacked, idx)
+	c.traceAckedLocked(p, idx, false)
+	indexes := p.ackIDs[pa.id]
+	for i, other := range indexes {
+		if other == idx {
+			indexes = append(indexes[:i], indexes[i+1:]...)
+			break
+		}
+	}
+	if len(indexes) == 0 {
+		delete(p.ackIDs, pa.id)
+	} else {
+		p.ackIDs[pa.id] = indexes
+	}
+	advanceAckedLocked(p)
+	c.inFlightFreedLocked(p)
+}
+
+// inFlightFullLocked reports whether p has MaxInFlight events awaiting its
+// ack, counting extra events about to be sent along with them. Once it
+// does, only resends go out to p until acks arrive or unacknowledged
+// events are dead-lettered. With ProviderConnections above 1 the other
+// connections may each have a batch on its way on top. c.mu must be held.
+func (c *Controller) inFlightFullLocked(p *provider, extra int) bool {
+	return c.cfg.MaxInFlight > 0 && len(p.unacked)+extra >= c.cfg.MaxInFlight
+}
+
+// inFlightFreedLocked wakes p's worker, which may be held back at
+// MaxInFlight, after an event stopped awaiting an ack. c.mu must be held.
+func (c *Controller) inFlightFreedLocked(p *provider) {
+	if c.cfg.MaxInFlight <= 0 || p.feed == nil {
+		return
+	}
+	select {
+	case p.feed <- struct{}{}:
+	default:
+	}
+}
+
+// advanceAckedLocked moves p.ackedIndex past every sent event that is no
+// longer awaiting an ack
+func advanceAckedLocked(p *provider) {
+	for p.ackedIndex < p.sentIndex {
+		if _, open := p.unacked[p.ackedIndex]; open {
+			return
+		}
+		p.ackedIndex++
+	}
+}
+
+// resendUnackedLocked queues every event p has not acknowledged since
+// before cutoff to be sent again, lowest index first, and wakes its worker.
+// It returns how many were queued. c.mu must be held.
+func (c *Controller) resendUnackedLocked(p *provider, cutoff time.Time) int {
+	var due []int
+	for idx, pa := range p.unacked {
+		if !pa.due && pa.sentAt.Before(cutoff) {
+			due = append(due, idx)
+		}
+	}
+	if len(due) == 0 {
+		return 0
+	}
+	sort.Ints(due)
+	for _, idx := range due {
+		p.unacked[idx].due = true
+	}
+	p.resend = append(p.resend, due...)
+	if p.feed != nil {
+		select {
+		case p.feed <- struct{}{}:
+		default:
+		}
+	}
+	return len(due)
+}
+
+// nextResendLocked pops the next event queued for resending to p together
+// with its index. Events acknowledged in the meantime are skipped, as are
+// expired events and those dropped from the buffer. Events already sent
+// MaxSendAttempts times are dead-lettered instead. c.mu must be held.
+func (c *Controller) nextResendLocked(p *provider) (int, Event, bool) {
+	for len(p.resend) > 0 {
+		idx := p.resend[0]
+		p.resend = p.resend[1:]
+		pa, ok := p.unacked[idx]
+		if !ok || !pa.due {
+			continue
+		}
+		event, ok := c.events.get(idx)
+		if !ok {
+			c.log.Warn("unacknowledged event was dropped from the buffer before it could be resent", "provider", p.name, "index", idx)
+			c.forgetLocked(p, idx)
+			c.releaseLocked()
+			continue
+		}
+		if c.expiredLocked(p, event) {
+			c.forgetLocked(p, idx)
+			c.releaseLocked()
+			continue
+		}
+		if max := c.cfg.MaxSendAttempts; max > 0 && pa.attempts >= max {
+			c.deadLetterLocked(p.name, event, fmt.Sprintf("%s did not acknowledge it after %d attempts", p.name, pa.attempts))
+			c.noteDropLocked(event, DropDeadLettered)
+			c.forgetLocked(p, idx)
+			c.releaseLocked()
+			continue
+		}
+		return idx, event, true
+	}
+	return 0, Event{}, false
+}
+
+// watchAcks queues events p has not acknowledged within AckTimeout for
+// resending, until the controller stops
+func (c *Controller) watchAcks(p *provider) {
+	interval := c.cfg.AckTimeout / 4
+	if interval < ackCheckInterval {
+		interval = ackCheckInterval
+	}
+	ticker := c.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-c.ctx.Done():
+			return
+		}
+		c.mu.Lock()
+		n := c.resendUnackedLocked(p, c.now().Add(-c.cfg.AckTimeout))
+		c.mu.Unlock()
+		if n > 0 {
+			c.log.Warn("ack timed out, resending events", "provider", p.name, "events", n)
+		}
+	}
+}
+
+// abandonUnackedLocked dead-letters every event a provider has yet to
+// acknowledge when shutdown gives up waiting for it. They are not released:
+// a write-ahead log keeps them to be sent again after a restart. c.mu must
+// be held.
+func (c *Controller) abandonUnackedLocked() {
+	for _, p := range c.providers() {
+		if len(p.unacked) == 0 {
+			continue
+		}
+		indexes := make([]int, 0, len(p.unacked))
+		for idx := range p.unacked {
+			indexes = append(indexes, idx)
+		}
+		sort.Ints(indexes)
+		c.log.Warn("shutdown timed out, abandoning unacknowledged events", "provider", p.name, "events", len(indexes))
+		for _, idx := range indexes {
+			if event, ok := c.events.get(idx); ok {
+				c.deadLetterLocked(p.name, event, fmt.Sprintf("%s had not acknowledged it when shutdown timed out", p.name))
+				c.noteDropLocked(event, DropDeadLettered)
+			}
+		}
+	}
+}
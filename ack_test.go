@@ -0,0 +1,84 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// acker makes fp acknowledge events the way reply decides: reply returns
+// how many acks to send for an event seen for the n-th time, counting from 1
+func acker(fp *fakeProvider, reply func(id string, n int) int) {
+	seen := make(map[string]int)
+	fp.onMessage = func(conn *websocket.Conn, msg []byte) {
+		var event Event
+		if json.Unmarshal(msg, &event) != nil || event.ID == "" {
+			return
+		}
+		seen[event.ID]++
+		for i := reply(event.ID, seen[event.ID]); i > 0; i-- {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"ack":"`+event.ID+`"}`))
+		}
+	}
+}
+
+// startAcking starts a controller requiring acks from a main provider
+// answering as reply decides, and sends it three events
+func startAcking(t *testing.T, reply func(id string, n int) int) (*Controller, *fakeProvider) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	acker(main, reply)
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.AckTimeout = 100 * time.Millisecond
+	c := startController(t, cfg)
+	sendEvents(t, dialApp(t, c), "e", 3)
+	return c, main
+}
+
+// settled reports whether main has acknowledged everything sent to it
+func settled(c *Controller) bool {
+	p := c.Status().Providers[0]
+	return p.SentIndex == 3 && p.Unacked == 0
+}
+
+func TestAckHappyPath(t *testing.T) {
+	c, main := startAcking(t, func(string, int) int { return 1 })
+	if !waitUntil(2*time.Second, func() bool { return settled(c) }) {
+		t.Fatalf("main never acknowledged everything: %+v", c.Status().Providers[0])
+	}
+	time.Sleep(300 * time.Millisecond) // past AckTimeout, nothing is resent
+	if n := main.count(); n != 3 {
+		t.Fatalf("main got %d events, want 3", n)
+	}
+}
+
+func TestAckLost(t *testing.T) {
+	c, main := startAcking(t, func(id string, n int) int {
+		if id == "e1" && n == 1 {
+			return 0
+		}
+		return 1
+	})
+	if !waitUntil(2*time.Second, func() bool { return settled(c) && main.count() == 4 }) {
+		t.Fatalf("main got %v, want e1 resent once its ack timed out", main.ids())
+	}
+	if ids := main.ids(); ids[3] != "e1" {
+		t.Fatalf("main got %v, want e1 resent last", ids)
+	}
+}
+
+func TestAckDuplicate(t *testing.T) {
+	c, main := startAcking(t, func(string, int) int { return 2 })
+	if !waitUntil(2*time.Second, func() bool { return settled(c) }) {
+		t.Fatalf("main never acknowledged everything: %+v", c.Status().Providers[0])
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := main.count(); n != 3 {
+		t.Fatalf("main got %d events, want 3", n)
+	}
+	if p := c.Status().Providers[0]; p.Unacked != 0 || p.SentIndex != 3 {
+		t.Fatalf("duplicate acks left %+v", p)
+	}
+}
@@ -0,0 +1,155 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOversizedAppMessageClosesCleanly(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.MaxMessageBytes = 1024
+	c := startController(t, cfg)
+	app := dialApp(t, c)
+	sendEvents(t, app, "ok", 1)
+	big := `{"id":"big","payload":"` + strings.Repeat("x", 2048) + `"}`
+	if err := app.WriteMessage(websocket.TextMessage, []byte(big)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The app is told why, then the connection is closed
+	app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := app.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nack eventRejection
+	if err := json.Unmarshal(msg, &nack); err != nil || nack.Error != "invalid event" {
+		t.Fatalf("got %s, want a rejection", msg)
+	}
+	if _, _, err := app.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("read %v, want a message-too-big close", err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 0 }) {
+		t.Fatal("app still counted as connected")
+	}
+	// Events before the oversized one still go out
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatalf("main got %v, want ok0", main.ids())
+	}
+	if n := c.Status().Rejected; n != 1 {
+		t.Fatalf("rejected %d, want 1", n)
+	}
+}
+
+func TestTwoAppsConcurrently(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.RateLimit = 10000
+	cfg.RateLimitInterval = time.Second
+	c := startController(t, cfg)
+	apps := []*websocket.Conn{dialApp(t, c), dialApp(t, c)}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 2 }) {
+		t.Fatalf("%d apps connected, want 2", c.Status().Apps)
+	}
+	var wg sync.WaitGroup
+	for i, app := range apps {
+		wg.Add(1)
+		go func(prefix string, app *websocket.Conn) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				msg := fmt.Sprintf(`{"id":"%s%d","payload":"x"}`, prefix, j)
+				if err := app.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(fmt.Sprintf("app%d-", i), app)
+	}
+	wg.Wait()
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 100 }) {
+		t.Fatalf("main got %d events, want 100", main.count())
+	}
+	// Each app's events stay in the order it sent them
+	next := make(map[string]int)
+	for _, id := range main.ids() {
+		prefix, n := id[:5], 0
+		fmt.Sscanf(id[5:], "%d", &n)
+		if n != next[prefix] {
+			t.Fatalf("%s arrived when %s%d was due", id, prefix, next[prefix])
+		}
+		next[prefix]++
+	}
+
+	apps[0].Close()
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 1 }) {
+		t.Fatalf("%d apps connected after one left, want 1", c.Status().Apps)
+	}
+	sendEvents(t, apps[1], "late", 1)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 101 }) {
+		t.Fatal("remaining app's event not sent")
+	}
+}
+
+func TestMalformedHandshakesAnswered(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	url := srv.URL + "/app/ws"
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		header map[string]string
+		want   int
+	}{
+		{"plain GET", http.MethodGet, nil, http.StatusUpgradeRequired},
+		{"no key", http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+		{"old version", http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, http.StatusBadRequest},
+		{"POST", http.MethodPost, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, http.StatusMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(tc.method, url, nil)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s answered %d %q, want %d", tc.name, resp.StatusCode, body, tc.want)
+		}
+		if !strings.Contains(string(body), "websocket") {
+			t.Errorf("%s answered %q, want why", tc.name, body)
+		}
+		if tc.want == http.StatusUpgradeRequired && resp.Header.Get("Upgrade") != "websocket" {
+			t.Errorf("%s answered without Upgrade: websocket", tc.name)
+		}
+	}
+
+	// Garbage that isn't even HTTP
+	raw, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Write([]byte("\x00\x01\x02 not a request\r\n\r\n"))
+	raw.Close()
+
+	sendEvents(t, dialApp(t, c), "e", 1)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatalf("main got %v after the malformed handshakes, want e0", main.ids())
+	}
+}
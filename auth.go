@@ -0,0 +1,197 @@
+package gochunker
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// HeaderFunc returns the headers sent on the handshake with the provider
+// at url. It is called for every dial, reconnects included, so it can hand
+// out a freshly rotated token each time.
+type HeaderFunc func(ctx context.Context, url string) (http.Header, error)
+
+// WithHeaderFunc adds the headers fn returns to every provider handshake,
+// on top of ProviderHeaders and ProviderTokenFile
+func WithHeaderFunc(fn HeaderFunc) Option {
+	return func(c *Controller) {
+		c.headerFunc = fn
+	}
+}
+
+// WithCheckOrigin decides which app connections are accepted by their
+// Origin header with fn instead of the AllowedOrigins setting
+func WithCheckOrigin(fn func(r *http.Request) bool) Option {
+	return func(c *Controller) {
+		c.checkOrigin = fn
+	}
+}
+
+// originAllowed reports whether the app connection r may be upgraded, and
+// if not why. Requests without an Origin header don't come from a browser
+// and are let through. Without AllowedOrigins only same-origin requests are
+// accepted, like the websocket package's default.
+func (c *Controller) originAllowed(r *http.Request) (bool, string) {
+	if c.checkOrigin != nil {
+		if !c.checkOrigin(r) {
+			return false, "origin refused by check"
+		}
+		return true, ""
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true, ""
+	}
+	if c.origins == nil {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return false, "malformed Origin header"
+		}
+		if !strings.EqualFold(u.Host, r.Host) {
+			return false, "cross-origin request without an allow-list"
+		}
+		return true, ""
+	}
+	return c.origins.match(origin)
+}
+
+// appToken returns the token apps must present, re-reading AppTokenFile so
+// the token can be rotated without a restart. An empty token means apps
+// are not authenticated.
+func (c *Controller) appToken() (string, error) {
+	return readToken(c.cfg.AppToken, c.cfg.AppTokenFile, "app")
+}
+
+// adminToken returns the token admin requests must present, re-reading
+// AdminTokenFile like appToken. An empty token disables the admin
+// endpoints.
+func (c *Controller) adminToken() (string, error) {
+	return readToken(c.cfg.AdminToken, c.cfg.AdminTokenFile, "admin")
+}
+
+// readToken returns the contents of file if set, token otherwise
+func readToken(token, file, what string) (string, error) {
+	if file == "" {
+		return token, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading %s token: %w", what, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// presentedToken returns the bearer token of r's Authorization header, or
+// the token query parameter if query is set and there is no such header
+func presentedToken(r *http.Request, query bool) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if query {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// authorizeApp checks the token the app connection r presents, either as a
+// bearer token in its Authorization header or in the token query parameter.
+// On failure it writes the error response and returns false.
+func (c *Controller) authorizeApp(w http.ResponseWriter, r *http.Request) bool {
+	want, err := c.appToken()
+	if err != nil {
+		c.log.Error("app token unavailable", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if want == "" {
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(presentedToken(r, true)), []byte(want)) != 1 {
+		c.log.Warn("app connection rejected, bad or missing token", "remote", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// authorizeAdmin checks the bearer token of the admin request r. Without
+// an AdminToken every admin request is refused, as they can take the
+// controller out of service. On failure it writes the error response and
+// returns false.
+func (c *Controller) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	want, err := c.adminToken()
+	if err != nil {
+		c.log.Error("admin token unavailable", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if want == "" {
+		http.Error(w, "admin endpoints are disabled without an admin token", http.StatusForbidden)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(presentedToken(r, false)), []byte(want)) != 1 {
+		c.log.Warn("admin request rejected, bad or missing token", "remote", r.RemoteAddr, "path", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// dialHeaders builds the handshake headers for dialing url. The token file
+// and header callback are consulted anew on each call.
+func (c *Controller) dialHeaders(url string) (http.Header, error) {
+	h := make(http.Header)
+	for name, value := range c.cfg.ProviderHeaders {
+		h.Set(name, value)
+	}
+	if c.cfg.ProviderTokenFile != "" {
+		token, err := os.ReadFile(c.cfg.ProviderTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading provider token: %w", err)
+		}
+		h.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	if c.headerFunc != nil {
+		extra, err := c.headerFunc(c.ctx, url)
+		if err != nil {
+			return nil, fmt.Errorf("building provider headers: %w", err)
+		}
+		for name, values := range extra {
+			h[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return h, nil
+}
+
+// parseList splits a comma separated list, dropping empty entries
+func parseList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseHeaders parses a comma separated list of Name:value pairs
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("header %q is not of the form Name:value", pair)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
@@ -0,0 +1,139 @@
+package gochunker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// handshakes returns the headers of every handshake fp accepted
+func handshakes(fp *fakeProvider) []http.Header {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return append([]http.Header(nil), fp.headers...)
+}
+
+func TestProviderHandshakeHeaders(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	dropAfter(main, 1, false)
+	cfg := testConfig(main, backup)
+	cfg.ProviderHeaders = map[string]string{"X-Tenant": "acme"}
+	var mu sync.Mutex
+	dials := make(map[string]int)
+	rotating := func(ctx context.Context, url string) (http.Header, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dials[url]++
+		h := make(http.Header)
+		h.Set("Authorization", fmt.Sprintf("Bearer token-%d", dials[url]))
+		return h, nil
+	}
+	c := startController(t, cfg, WithHeaderFunc(rotating), withBackoffBase(time.Millisecond))
+	// The first event makes main drop the connection and get redialed
+	sendEvents(t, dialApp(t, c), "e", 1)
+	if !waitUntil(2*time.Second, func() bool { return len(handshakes(main)) == 2 }) {
+		t.Fatalf("main accepted %d handshakes, want 2", len(handshakes(main)))
+	}
+	for i, h := range handshakes(main) {
+		if got := h.Get("X-Tenant"); got != "acme" {
+			t.Errorf("handshake %d: X-Tenant %q, want acme", i, got)
+		}
+		if got, want := h.Get("Authorization"), fmt.Sprintf("Bearer token-%d", i+1); got != want {
+			t.Errorf("handshake %d: Authorization %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	got, err := parseHeaders("X-Tenant: acme, Authorization:Bearer abc,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["X-Tenant"] != "acme" || got["Authorization"] != "Bearer abc" {
+		t.Fatalf("parsed %v", got)
+	}
+	if _, err := parseHeaders("no-colon"); err == nil {
+		t.Fatal("header without a value accepted")
+	}
+}
+
+// handshakeStatus dials url with header and returns the status the
+// handshake was answered with
+func handshakeStatus(t *testing.T, url string, header http.Header) int {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil {
+		conn.Close()
+		return resp.StatusCode
+	}
+	if resp == nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestAppTokenAndOrigin(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AppToken = "s3cret"
+	cfg.AllowedOrigins = []string{"https://ok.example"}
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	url := serveApps(t, c)
+	for _, tc := range []struct {
+		name          string
+		query, origin string
+		auth          string
+		want          int
+	}{
+		{"token in query", "?token=s3cret", "https://ok.example", "", http.StatusSwitchingProtocols},
+		{"bearer token", "", "https://ok.example", "Bearer s3cret", http.StatusSwitchingProtocols},
+		{"no origin", "", "", "Bearer s3cret", http.StatusSwitchingProtocols},
+		{"rejected origin", "?token=s3cret", "https://evil.example", "", http.StatusForbidden},
+		{"missing token", "", "https://ok.example", "", http.StatusUnauthorized},
+		{"wrong token", "?token=nope", "", "", http.StatusUnauthorized},
+	} {
+		h := http.Header{}
+		if tc.origin != "" {
+			h.Set("Origin", tc.origin)
+		}
+		if tc.auth != "" {
+			h.Set("Authorization", tc.auth)
+		}
+		if got := handshakeStatus(t, url+tc.query, h); got != tc.want {
+			t.Errorf("%s: answered %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAppTokenFileIsReread(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(file, []byte("first\n"), 0o600)
+	cfg := DefaultConfig()
+	cfg.AppTokenFile = file
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	url := serveApps(t, c)
+	if got := handshakeStatus(t, url+"?token=first", nil); got != http.StatusSwitchingProtocols {
+		t.Fatalf("current token answered %d", got)
+	}
+	os.WriteFile(file, []byte("second\n"), 0o600)
+	if got := handshakeStatus(t, url+"?token=first", nil); got != http.StatusUnauthorized {
+		t.Fatalf("rotated out token answered %d", got)
+	}
+	if got := handshakeStatus(t, url+"?token=second", nil); got != http.StatusSwitchingProtocols {
+		t.Fatalf("rotated in token answered %d", got)
+	}
+}
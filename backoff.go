@@ -0,0 +1,43 @@
+package gochunker
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff produces exponentially growing delays with random jitter so that
+// independent workers retrying the same thing don't wake in lockstep
+type Backoff struct {
+	Base   time.Duration // first delay
+	Max    time.Duration // cap on the un-jittered delay
+	Jitter float64       // fraction of the delay added at random, 0 to 1
+	Rand   *rand.Rand    // jitter source, the global one when nil
+
+	attempt int
+}
+
+// Next returns the delay for the next attempt and advances the backoff
+func (b *Backoff) Next() time.Duration {
+	d := b.Base
+	for i := 0; i < b.attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.attempt++
+
+	if b.Jitter > 0 {
+		f := rand.Float64
+		if b.Rand != nil {
+			f = b.Rand.Float64
+		}
+		d += time.Duration(b.Jitter * f() * float64(d))
+	}
+	return d
+}
+
+// Reset starts the backoff over from Base
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,43 @@
+package gochunker
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowsAndCaps(t *testing.T) {
+	b := &Backoff{Base: 100 * time.Millisecond, Max: time.Second}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if d := b.Next(); d != w*time.Millisecond {
+			t.Fatalf("attempt %d: delay %s, want %s", i, d, w*time.Millisecond)
+		}
+	}
+	b.Reset()
+	if d := b.Next(); d != 100*time.Millisecond {
+		t.Fatalf("delay after Reset %s, want 100ms", d)
+	}
+}
+
+func TestBackoffJitterIsSeeded(t *testing.T) {
+	delays := func() []time.Duration {
+		b := &Backoff{Base: 100 * time.Millisecond, Max: time.Minute, Jitter: 0.5, Rand: rand.New(rand.NewSource(42))}
+		var ds []time.Duration
+		for i := 0; i < 5; i++ {
+			ds = append(ds, b.Next())
+		}
+		return ds
+	}
+	first, second := delays(), delays()
+	base := 100 * time.Millisecond
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("attempt %d: %s then %s with the same seed", i, first[i], second[i])
+		}
+		if first[i] < base || first[i] > base+base/2 {
+			t.Fatalf("attempt %d: delay %s outside [%s, %s]", i, first[i], base, base+base/2)
+		}
+		base *= 2
+	}
+}
@@ -0,0 +1,93 @@
+package gochunker
+
+// controlMessage tells an app to stop or resume sending
+type controlMessage struct {
+	Type string `json:"type"` // "pause" or "resume"
+}
+
+// backpressureLocked returns a channel that is closed once apps may send
+// again, or nil if they may send now. Reaching BufferHighWater pending
+// events, or their share of MaxBufferBytes in pending bytes, starts a
+// pause that lasts until no more than BufferLowWater events and their
+// share of the bytes are pending. c.mu must be held.
+func (c *Controller) backpressureLocked() <-chan struct{} {
+	if c.cfg.BufferHighWater <= 0 {
+		return nil
+	}
+	if c.resume != nil {
+		return c.resume
+	}
+	n, bytes := c.pendingLocked()
+	if n >= c.cfg.BufferHighWater || (c.cfg.MaxBufferBytes > 0 && bytes >= c.waterBytes(c.cfg.BufferHighWater)) {
+		c.resume = make(chan struct{})
+		c.log.Warn("buffer reached high-water mark, pausing apps", "pending", n, "pending_bytes", bytes, "high_water", c.cfg.BufferHighWater)
+	}
+	return c.resume
+}
+
+// relieveLocked ends a pause once no more than BufferLowWater events, and
+// their share of MaxBufferBytes, are pending. c.mu must be held.
+func (c *Controller) relieveLocked() {
+	if c.resume == nil {
+		return
+	}
+	n, bytes := c.pendingLocked()
+	if n > c.cfg.BufferLowWater || (c.cfg.MaxBufferBytes > 0 && bytes > c.waterBytes(c.cfg.BufferLowWater)) {
+		return
+	}
+	close(c.resume)
+	c.resume = nil
+	c.log.Info("buffer drained to low-water mark, resuming apps", "pending", n, "pending_bytes", bytes, "low_water", c.cfg.BufferLowWater)
+}
+
+// waterBytes scales a water mark of events to MaxBufferBytes, taking the
+// same share of it as of BufferSize
+func (c *Controller) waterBytes(events int) int {
+	return int(int64(c.cfg.MaxBufferBytes) * int64(events) / int64(c.cfg.BufferSize))
+}
+
+// pendingLocked counts the buffered events the providers whose worker is
+// running have yet to send, or to get acknowledged, and their payload
+// bytes. Events only kept for a
+// backup that hasn't started don't count: under BackupAfterMain it only
+// starts once the apps are gone, so waiting for it would pause them for
+// good. Before any worker runs every buffered event is pending. c.mu must
+// be held.
+func (c *Controller) pendingLocked() (events, bytes int) {
+	oldest, active := c.events.next(), false
+	for _, p := range c.providers() {
+		if p.feed != nil {
+			active = true
+			if p.ackedIndex < oldest {
+				oldest = p.ackedIndex
+			}
+		}
+	}
+	if !active || oldest < c.events.first {
+		oldest = c.events.first
+	}
+	return c.events.next() - oldest, c.events.bytesFrom(oldest)
+}
+
+// pauseApp stops reading from app until resume is closed, telling the app
+// to hold off in the meantime. Messages it sends anyway wait in the
+// connection until reading resumes.
+func (c *Controller) pauseApp(app *appConn, resume <-chan struct{}) {
+	c.sendControl(app, "pause")
+	select {
+	case <-resume:
+	case <-c.ctx.Done():
+		return
+	}
+	c.sendControl(app, "resume")
+}
+
+func (c *Controller) sendControl(app *appConn, typ string) {
+	msg, err := app.codec.Marshal(controlMessage{Type: typ})
+	if err != nil {
+		return
+	}
+	if err := app.write(msg, c.cfg.WriteTimeout); err != nil {
+		c.log.Warn("sending control message to app failed", "type", typ, "err", err)
+	}
+}
@@ -0,0 +1,92 @@
+package gochunker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackpressurePausesAndResumesApp(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup) // BackupAfterMain: the backup idles while the app is connected
+	cfg.BufferSize = 40
+	cfg.BufferHighWater = 5
+	cfg.BufferLowWater = 2
+	cfg.DropPolicy = RejectNewest
+	cfg.RateLimit = 1
+	cfg.RateLimitInterval = 20 * time.Millisecond
+	c := startController(t, cfg)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatal("main never connected")
+	}
+
+	app := dialApp(t, c)
+	control := make(chan string, 10)
+	go func() {
+		for {
+			_, msg, err := app.ReadMessage()
+			if err != nil {
+				close(control)
+				return
+			}
+			control <- string(msg)
+		}
+	}()
+	sendEvents(t, app, "e", 30)
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case msg := <-control:
+			if msg != want {
+				t.Fatalf("app got %s, want %s", msg, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("app never got %s", want)
+		}
+	}
+	expect(`{"type":"pause"}`)
+	expect(`{"type":"resume"}`)
+
+	if !waitUntil(10*time.Second, func() bool { return main.count() == 30 }) {
+		t.Fatalf("main got %d events, want 30", main.count())
+	}
+	if st := c.Status(); st.Dropped != 0 {
+		t.Fatalf("dropped %d events", st.Dropped)
+	}
+}
+
+func TestBackpressureIgnoresIdleBackup(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.BufferHighWater = 3
+	cfg.BufferLowWater = 1
+	c := startController(t, cfg)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatal("main never connected")
+	}
+
+	app := dialApp(t, c)
+	sendEvents(t, app, "e", 10)
+	// The buffer keeps every event for the backup, but once main has sent
+	// them nothing is pending and the app must not stay paused
+	if !waitUntil(5*time.Second, func() bool { return main.count() == 10 && !c.Status().Paused }) {
+		t.Fatal("app stayed paused after main caught up")
+	}
+}
+
+func TestBackpressureConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BufferHighWater = cfg.BufferSize + 1
+	if err := cfg.Validate(); err == nil {
+		t.Error("high-water mark above the buffer size accepted")
+	}
+	cfg.BufferHighWater = 10
+	cfg.BufferLowWater = 10
+	if err := cfg.Validate(); err == nil {
+		t.Error("low-water mark at the high-water mark accepted")
+	}
+	cfg.BufferLowWater = 4
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
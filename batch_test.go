@@ -0,0 +1,80 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// batches returns the event IDs of each batch message fp received
+func batches(fp *fakeProvider) [][]string {
+	var out [][]string
+	for _, msg := range fp.messages() {
+		var batch batchMessage
+		if json.Unmarshal([]byte(msg), &batch) != nil || batch.Type != "batch" {
+			continue
+		}
+		var ids []string
+		for _, event := range batch.Events {
+			ids = append(ids, event.ID)
+		}
+		out = append(out, ids)
+	}
+	return out
+}
+
+// startBatching starts a controller grouping up to size events per message
+// and waiting at most flush for a batch to fill
+func startBatching(t *testing.T, size int, flush time.Duration) (*Controller, *fakeProvider) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.BatchSize = size
+	cfg.FlushInterval = flush
+	return startController(t, cfg), main
+}
+
+func TestBatchSizeTrigger(t *testing.T) {
+	c, main := startBatching(t, 3, time.Hour)
+	sendEvents(t, dialApp(t, c), "e", 6)
+	if !waitUntil(2*time.Second, func() bool { return len(batches(main)) == 2 }) {
+		t.Fatalf("main got batches %v, want 2", batches(main))
+	}
+	if got := fmt.Sprint(batches(main)); got != "[[e0 e1 e2] [e3 e4 e5]]" {
+		t.Fatalf("main got batches %s", got)
+	}
+}
+
+func TestBatchFlushInterval(t *testing.T) {
+	c, main := startBatching(t, 10, 50*time.Millisecond)
+	sendEvents(t, dialApp(t, c), "e", 2)
+	if !waitUntil(2*time.Second, func() bool { return len(batches(main)) == 1 }) {
+		t.Fatal("partial batch not flushed after the flush interval")
+	}
+	if got := fmt.Sprint(batches(main)); got != "[[e0 e1]]" {
+		t.Fatalf("main got batches %s", got)
+	}
+}
+
+func TestBatchFlushedOnClose(t *testing.T) {
+	c, main := startBatching(t, 10, time.Hour)
+	sendEvents(t, dialApp(t, c), "e", 2)
+	collected := func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.events.len() == 2 && c.pool.members[0].queue.Len() == 0
+	}
+	if !waitUntil(2*time.Second, collected) {
+		t.Fatal("worker never picked up the events")
+	}
+	if main.count() != 0 {
+		t.Fatal("partial batch sent before the flush interval")
+	}
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return len(batches(main)) == 1 }) {
+		t.Fatal("partial batch lost on Close")
+	}
+}
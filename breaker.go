@@ -0,0 +1,78 @@
+package gochunker
+
+import (
+	"fmt"
+	"time"
+)
+
+// BreakerState is where a provider's circuit breaker stands, see
+// Config.BreakerFailures
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // dialing as usual
+	BreakerOpen                         // too many dials failed, none is made until the cooldown ends
+	BreakerHalfOpen                     // the cooldown ended, a trial dial decides whether to close or reopen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// breaker stops dialing a provider that keeps refusing for a while rather
+// than hammering it. Guarded by Controller.mu.
+type breaker struct {
+	state    BreakerState
+	failures int       // consecutive failed dials
+	openedAt time.Time // when the breaker last opened
+}
+
+// breakerWaitLocked returns how long the breaker of p holds dials back, or
+// zero if p may be dialed now. A breaker whose cooldown ended turns
+// half-open for the dial that follows. c.mu must be held.
+func (c *Controller) breakerWaitLocked(p *provider) time.Duration {
+	if p.breaker.state != BreakerOpen {
+		return 0
+	}
+	if wait := c.cfg.BreakerCooldown - c.now().Sub(p.breaker.openedAt); wait > 0 {
+		return wait
+	}
+	p.breaker.state = BreakerHalfOpen
+	c.log.Info("circuit breaker half-open, trying provider", "provider", p.name)
+	return 0
+}
+
+// breakerFailedLocked counts a failed dial of p, opening its breaker after
+// BreakerFailures in a row or a failed trial. It reports whether the
+// breaker is open now. c.mu must be held.
+func (c *Controller) breakerFailedLocked(p *provider, err error) bool {
+	if c.cfg.BreakerFailures <= 0 {
+		return false
+	}
+	p.breaker.failures++
+	if p.breaker.state != BreakerHalfOpen && p.breaker.failures < c.cfg.BreakerFailures {
+		return false
+	}
+	p.breaker.state = BreakerOpen
+	p.breaker.openedAt = c.now()
+	c.metrics.breakerOpens.WithLabelValues(p.name).Inc()
+	c.log.Warn("circuit breaker open, pausing dials", "provider", p.name, "failures", p.breaker.failures, "cooldown", c.cfg.BreakerCooldown, "err", err)
+	return true
+}
+
+// breakerSucceededLocked closes p's breaker after a successful dial. c.mu
+// must be held.
+func (c *Controller) breakerSucceededLocked(p *provider) {
+	if p.breaker.state != BreakerClosed {
+		c.log.Info("circuit breaker closed, provider reachable again", "provider", p.name)
+	}
+	p.breaker = breaker{}
+}
@@ -0,0 +1,97 @@
+package gochunker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyDialer refuses the first fail dials, then holds the next one until
+// release is closed and connects it over a memPipe
+type flakyDialer struct {
+	fail    int
+	release chan struct{}
+
+	mu    sync.Mutex
+	dials int
+}
+
+func (fd *flakyDialer) dial(ctx context.Context, url string, header http.Header) (Conn, error) {
+	fd.mu.Lock()
+	fd.dials++
+	n := fd.dials
+	fd.mu.Unlock()
+	if n <= fd.fail {
+		return nil, errors.New("connection refused")
+	}
+	select {
+	case <-fd.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	client, _ := newMemPipe()
+	return client, nil
+}
+
+func (fd *flakyDialer) count() int {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.dials
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	fd := &flakyDialer{fail: 4, release: make(chan struct{})}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.BreakerFailures = 3
+	cfg.BreakerCooldown = 200 * time.Millisecond
+	c := startController(t, cfg, WithDialFunc(fd.dial), withBackoffBase(time.Millisecond))
+	breakerState := func() string { return c.Status().Providers[0].Breaker }
+
+	// Three refusals in a row open the breaker, and no dial is made while
+	// it cools down
+	if !waitUntil(time.Second, func() bool { return breakerState() == "open" }) {
+		t.Fatalf("breaker %s after %d dials, want open", breakerState(), fd.count())
+	}
+	if n := fd.count(); n != 3 {
+		t.Fatalf("dialed %d times before opening, want 3", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := fd.count(); n != 3 {
+		t.Fatalf("dialed %d times while open, want still 3", n)
+	}
+
+	// The trial after the cooldown fails and reopens it at once
+	if !waitUntil(time.Second, func() bool { return fd.count() == 4 }) {
+		t.Fatal("no trial dial after the cooldown")
+	}
+	if !waitUntil(100*time.Millisecond, func() bool { return breakerState() == "open" }) {
+		t.Fatalf("breaker %s after a failed trial, want open", breakerState())
+	}
+
+	// The next trial is held half-open until the provider answers
+	if !waitUntil(time.Second, func() bool { return fd.count() == 5 }) {
+		t.Fatal("no second trial dial")
+	}
+	if s := breakerState(); s != "half-open" {
+		t.Fatalf("breaker %s during the trial, want half-open", s)
+	}
+	close(fd.release)
+	if !waitUntil(time.Second, func() bool { return breakerState() == "closed" && c.Status().Providers[0].Connected }) {
+		t.Fatalf("breaker %s after the provider recovered, want closed", breakerState())
+	}
+	if mf := gather(t, c, "gochunker_breaker_opens_total"); mf == nil || mf.GetMetric()[0].GetCounter().GetValue() != 2 {
+		t.Fatalf("breaker opens metric %v, want 2", mf)
+	}
+}
+
+func TestBreakerDisabledByDefault(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	if st := c.Status().Providers[0]; st.Breaker != "" {
+		t.Fatalf("breaker state %q without BreakerFailures", st.Breaker)
+	}
+}
@@ -0,0 +1,262 @@
+package gochunker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DropPolicy decides what happens to an event arriving at a full buffer
+type DropPolicy int
+
+const (
+	DropOldest   DropPolicy = iota // evict the oldest buffered event to make room
+	RejectNewest                   // discard the incoming event
+)
+
+func (p DropPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case RejectNewest:
+		return "reject-newest"
+	}
+	return fmt.Sprintf("DropPolicy(%d)", int(p))
+}
+
+// ParseDropPolicy parses the String form of a DropPolicy
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch s {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "reject-newest":
+		return RejectNewest, nil
+	}
+	return 0, fmt.Errorf("unknown drop policy %q", s)
+}
+
+// eventRing is a fixed-capacity FIFO of events addressed by absolute index:
+// the n-th event ever pushed has index n whether or not it is still held.
+// Absolute indexes keep provider sent indexes meaningful as the ring wraps.
+type eventRing struct {
+	buf   []Event
+	first int // absolute index of the oldest held event
+	count int
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{buf: make([]Event, size)}
+}
+
+// len returns the number of events held
+func (r *eventRing) len() int {
+	return r.count
+}
+
+// next returns the absolute index the next pushed event will get
+func (r *eventRing) next() int {
+	return r.first + r.count
+}
+
+func (r *eventRing) full() bool {
+	return r.count == len(r.buf)
+}
+
+// push appends e, the caller must make room first if the ring is full
+func (r *eventRing) push(e Event) {
+	r.buf[(r.first+r.count)%len(r.buf)] = e
+	r.count++
+}
+
+// pop discards the oldest held event and returns it
+func (r *eventRing) pop() Event {
+	slot := r.first % len(r.buf)
+	e := r.buf[slot]
+	r.buf[slot] = Event{}
+	r.first++
+	r.count--
+	return e
+}
+
+// get returns the event at absolute index i if it is still held
+func (r *eventRing) get(i int) (Event, bool) {
+	if i < r.first || i >= r.next() {
+		return Event{}, false
+	}
+	return r.buf[i%len(r.buf)], true
+}
+
+// ErrStoreFull is returned by MemoryStore.Append when every slot holds an
+// unconsumed event
+var ErrStoreFull = errors.New("store is full")
+
+// MemoryStore is the default Store, holding events in a fixed-size ring in
+// memory. Nothing survives a restart. It is safe for concurrent use.
+type MemoryStore struct {
+	mu    sync.Mutex
+	ring  *eventRing
+	acked map[int]struct{} // consumed indexes still in the ring behind an unconsumed one
+}
+
+// NewMemoryStore returns a store holding up to size events
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{ring: newEventRing(size), acked: make(map[int]struct{})}
+}
+
+// Append adds e at the next index
+func (s *MemoryStore) Append(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ring.full() {
+		return ErrStoreFull
+	}
+	s.ring.push(e)
+	return nil
+}
+
+// Range calls fn with the unconsumed events from index from on
+func (s *MemoryStore) Range(from int, fn func(Event) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if from < s.ring.first {
+		from = s.ring.first
+	}
+	for i := from; i < s.ring.next(); i++ {
+		if _, done := s.acked[i]; done {
+			continue
+		}
+		e, _ := s.ring.get(i)
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+// Ack consumes the event at index, freeing its slot once every older event
+// is consumed too
+func (s *MemoryStore) Ack(index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if index < s.ring.first || index >= s.ring.next() {
+		return nil
+	}
+	s.acked[index] = struct{}{}
+	for s.ring.len() > 0 {
+		if _, done := s.acked[s.ring.first]; !done {
+			break
+		}
+		delete(s.acked, s.ring.first)
+		s.ring.pop()
+	}
+	return nil
+}
+
+// Close does nothing, a MemoryStore holds no resources
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// buffer is the controller's view of the Store holding its events. The
+// controller consumes events strictly oldest first, so the store holds
+// exactly the events from index first up to next and the controller can
+// track its bounds without asking.
+type buffer struct {
+	store    Store
+	size     int // most events held at once
+	maxBytes int // most payload bytes held at once, no limit when zero
+	first    int // index of the oldest held event
+	count    int
+
+	pushed int   // payload bytes of every event ever pushed
+	starts []int // pushed before each held event, oldest first
+}
+
+// len returns the number of events held
+func (b *buffer) len() int {
+	return b.count
+}
+
+// next returns the index the next pushed event will get
+func (b *buffer) next() int {
+	return b.first + b.count
+}
+
+// bytes returns the payload bytes held
+func (b *buffer) bytes() int {
+	return b.bytesFrom(b.first)
+}
+
+// bytesFrom returns the payload bytes of the held events from index i on
+func (b *buffer) bytesFrom(i int) int {
+	if i < b.first {
+		i = b.first
+	}
+	if i >= b.next() {
+		return 0
+	}
+	return b.pushed - b.starts[i-b.first]
+}
+
+// tooLarge reports whether e holds more payload bytes than the buffer ever
+// may, so no eviction would make room for it
+func (b *buffer) tooLarge(e Event) bool {
+	return b.maxBytes > 0 && len(e.Payload) > b.maxBytes
+}
+
+// fits reports whether e may be pushed without exceeding either the event
+// or the byte limit
+func (b *buffer) fits(e Event) bool {
+	if b.count >= b.size {
+		return false
+	}
+	return b.maxBytes <= 0 || b.bytes()+len(e.Payload) <= b.maxBytes
+}
+
+// overfull reports whether the buffer holds more than either limit allows,
+// as it may after restoring a store
+func (b *buffer) overfull() bool {
+	return b.count > b.size || (b.maxBytes > 0 && b.bytes() > b.maxBytes)
+}
+
+// push appends e to the store, the caller must make room first unless e
+// fits
+func (b *buffer) push(e Event) error {
+	if err := b.store.Append(e); err != nil {
+		return err
+	}
+	b.held(e)
+	return nil
+}
+
+// held counts e, which the store holds at the next index
+func (b *buffer) held(e Event) {
+	b.starts = append(b.starts, b.pushed)
+	b.pushed += len(e.Payload)
+	b.count++
+}
+
+// pop consumes the oldest held event and returns it. The event is gone
+// from the buffer even if the store fails to record that.
+func (b *buffer) pop() (Event, error) {
+	e, _ := b.get(b.first)
+	err := b.store.Ack(b.first)
+	b.first++
+	b.count--
+	b.starts = b.starts[1:]
+	return e, err
+}
+
+// get returns the event at index i if it is still held
+func (b *buffer) get(i int) (Event, bool) {
+	if i < b.first || i >= b.next() {
+		return Event{}, false
+	}
+	var e Event
+	found := false
+	b.store.Range(i, func(got Event) bool {
+		e, found = got, true
+		return false
+	})
+	return e, found
+}
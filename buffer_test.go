@@ -0,0 +1,220 @@
+package gochunker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// buffered returns the IDs of the events c holds, oldest first
+func buffered(c *Controller) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []string
+	for i := c.events.first; i < c.events.next(); i++ {
+		event, _ := c.events.get(i)
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestDropPolicyAtCapacity(t *testing.T) {
+	for _, tc := range []struct {
+		policy DropPolicy
+		want   []string
+	}{
+		{DropOldest, []string{"e2", "e3", "e4"}},
+		{RejectNewest, []string{"e0", "e1", "e2"}},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.DropPolicy = tc.policy
+			// Never started, so nothing leaves the buffer
+			c, err := NewController(cfg, WithLogger(quietLogger), WithBufferSize(3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close(context.Background())
+			for i := 0; i < 5; i++ {
+				c.mu.Lock()
+				c.bufferLocked(Event{ID: fmt.Sprintf("e%d", i)})
+				c.mu.Unlock()
+			}
+			if got := buffered(c); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("buffer holds %v, want %v", got, tc.want)
+			}
+			if st := c.Status(); st.Dropped != 2 || st.Buffered != 3 {
+				t.Fatalf("dropped %d and buffered %d, want 2 and 3", st.Dropped, st.Buffered)
+			}
+		})
+	}
+}
+
+func TestDropPolicyAtByteLimit(t *testing.T) {
+	for _, tc := range []struct {
+		policy DropPolicy
+		want   []string
+		bytes  int
+	}{
+		{DropOldest, []string{"s2", "b3"}, 70},
+		{RejectNewest, []string{"s0", "b1", "s2"}, 80},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.DropPolicy = tc.policy
+			cfg.BufferSize = 10 // room for every event, the bytes run out first
+			cfg.MaxBufferBytes = 100
+			c, err := NewController(cfg, WithLogger(quietLogger))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close(context.Background())
+			small, big := make([]byte, 10), make([]byte, 60)
+			c.mu.Lock()
+			for _, e := range []Event{
+				{ID: "s0", Payload: small},
+				{ID: "b1", Payload: big},
+				{ID: "s2", Payload: small},
+				{ID: "b3", Payload: big},
+				{ID: "huge", Payload: make([]byte, 101)}, // never fits
+			} {
+				c.bufferLocked(e)
+			}
+			bytes := c.events.bytes()
+			c.mu.Unlock()
+			if got := buffered(c); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("buffer holds %v, want %v", got, tc.want)
+			}
+			if bytes != tc.bytes {
+				t.Fatalf("buffer holds %d bytes, want %d", bytes, tc.bytes)
+			}
+			if st := c.Status(); st.Dropped != uint64(5-len(tc.want)) {
+				t.Fatalf("dropped %d", st.Dropped)
+			}
+		})
+	}
+}
+
+func TestBufferBytesFreedOnceSent(t *testing.T) {
+	main := newFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{main.url()}
+	cfg.MaxBufferBytes = 1 << 10
+	c := startController(t, cfg)
+	for i := 0; i < 3; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("e%d", i), Payload: make([]byte, 300)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return main.count() == 3 && c.events.len() == 0 && c.events.bytes() == 0
+	}) {
+		t.Fatalf("main got %v and %d bytes are still buffered", main.ids(), c.events.bytes())
+	}
+	// Freed bytes make room for as much again
+	if err := c.Enqueue(Event{ID: "e3", Payload: make([]byte, 900)}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 4 }) {
+		t.Fatalf("main got %v", main.ids())
+	}
+	if st := c.Status(); st.Dropped != 0 {
+		t.Fatalf("dropped %d", st.Dropped)
+	}
+}
+
+func TestBackpressureOnBytes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BufferSize = 100
+	cfg.BufferHighWater = 50
+	cfg.BufferLowWater = 10
+	cfg.MaxBufferBytes = 1000 // pauses at 500 pending bytes, resumes at 100
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < 4; i++ {
+		c.bufferLocked(Event{ID: fmt.Sprintf("e%d", i), Payload: make([]byte, 100)})
+		if c.backpressureLocked() != nil {
+			t.Fatalf("paused at %d bytes", c.events.bytes())
+		}
+	}
+	c.bufferLocked(Event{ID: "e4", Payload: make([]byte, 100)})
+	resume := c.backpressureLocked()
+	if resume == nil {
+		t.Fatal("five events of 500 bytes did not pause the apps")
+	}
+	for c.events.bytes() > 100 {
+		c.events.pop()
+		c.relieveLocked()
+		if c.events.bytes() > 100 && c.resume == nil {
+			t.Fatalf("resumed at %d bytes", c.events.bytes())
+		}
+	}
+	select {
+	case <-resume:
+	default:
+		t.Fatal("apps still paused at the low-water mark")
+	}
+}
+
+func TestMemoryStoreConcurrentAppendAndRange(t *testing.T) {
+	const writers, each = 4, 200
+	s := NewMemoryStore(writers * each)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				if err := s.Append(Event{ID: fmt.Sprintf("%d-%d", w, i)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				// Each writer's events show up in the order it appended them
+				last := make(map[string]int)
+				s.Range(0, func(e Event) bool {
+					var w string
+					var n int
+					fmt.Sscanf(e.ID, "%1s-%d", &w, &n)
+					if prev, ok := last[w]; ok && n != prev+1 {
+						t.Errorf("writer %s: event %d follows %d", w, n, prev)
+						return false
+					}
+					last[w] = n
+					return true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := s.Append(Event{}); err != ErrStoreFull {
+		t.Fatalf("append to a full store returned %v, want ErrStoreFull", err)
+	}
+	s.Ack(1)
+	if err := s.Append(Event{}); err != ErrStoreFull {
+		t.Fatal("acking out of order freed a slot")
+	}
+	s.Ack(0)
+	n := 0
+	s.Range(0, func(Event) bool { n++; return true })
+	if n != writers*each-2 {
+		t.Fatalf("%d events left, want %d", n, writers*each-2)
+	}
+	if err := s.Append(Event{}); err != nil {
+		t.Fatalf("append after freeing slots: %v", err)
+	}
+}
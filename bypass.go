@@ -0,0 +1,39 @@
+package gochunker
+
+import (
+	"sync"
+	"time"
+)
+
+// bypassCounter tracks how many events skipped the rate limiters in the
+// current RateLimitInterval, to warn about a flood of them
+type bypassCounter struct {
+	types map[string]bool // Config.BypassTypes, read only once built
+
+	mu          sync.Mutex
+	windowStart time.Time
+	n           int
+	warned      bool // the warning for the current window was logged
+}
+
+// countBypassed records n events that went to p without rate limiting,
+// warning once per RateLimitInterval in which more than BypassWarnLimit
+// were sent
+func (c *Controller) countBypassed(p *provider, n int) {
+	c.metrics.bypassed.WithLabelValues(p.name).Add(float64(n))
+	if c.cfg.BypassWarnLimit <= 0 {
+		return
+	}
+	b := &c.bypass
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := c.now()
+	if now.Sub(b.windowStart) >= c.cfg.RateLimitInterval {
+		b.windowStart, b.n, b.warned = now, 0, false
+	}
+	b.n += n
+	if b.n > c.cfg.BypassWarnLimit && !b.warned {
+		b.warned = true
+		c.log.Warn("events bypassing the rate limit exceed the soft limit", "provider", p.name, "events", b.n, "limit", c.cfg.BypassWarnLimit, "interval", c.cfg.RateLimitInterval)
+	}
+}
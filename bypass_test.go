@@ -0,0 +1,50 @@
+package gochunker
+
+import (
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestBypassTypesSkipRateLimit(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.RateLimit = 2
+	cfg.RateLimitInterval = time.Hour
+	cfg.BypassTypes = []string{"urgent"}
+	cfg.BypassWarnLimit = 3
+	h := &captureHandler{}
+	c := startController(t, cfg, WithLogger(slog.New(h)))
+
+	for _, e := range []Event{
+		{ID: "u0", Type: "urgent"}, {ID: "n0"}, {ID: "u1", Type: "urgent"}, {ID: "n1"},
+		{ID: "u2", Type: "urgent"}, {ID: "u3", Type: "urgent"}, {ID: "u4", Type: "urgent"},
+		{ID: "n2"}, {ID: "u5", Type: "urgent"},
+	} {
+		if err := c.Enqueue(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// n2 finds the bucket empty and holds up what comes after it
+	want := "[u0 n0 u1 n1 u2 u3 u4]"
+	waitUntil(2*time.Second, func() bool { return main.count() == 7 })
+	time.Sleep(50 * time.Millisecond)
+	if got := fmt.Sprint(main.ids()); got != want {
+		t.Fatalf("main got %s, want %s", got, want)
+	}
+
+	if mf := gather(t, c, "gochunker_events_bypassed_total"); mf == nil || mf.GetMetric()[0].GetCounter().GetValue() != 5 {
+		t.Fatalf("bypassed events metric %v, want 5", mf)
+	}
+	if mf := gather(t, c, "gochunker_events_sent_total"); mf == nil || mf.GetMetric()[0].GetCounter().GetValue() != 7 {
+		t.Fatalf("sent events metric %v, want bypassed events counted too", mf)
+	}
+	attrs, ok := h.find("events bypassing the rate limit exceed the soft limit")
+	if !ok {
+		t.Fatal("no warning about the flood of bypassing events")
+	}
+	if got := attrs["events"].Int64(); got != 4 {
+		t.Fatalf("warned at %d events, want the first past the limit of 3", got)
+	}
+}
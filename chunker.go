@@ -0,0 +1,169 @@
+package gochunker
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// ChunkFrame is one ordered piece of an event whose payload was too large to
+// send in a single message
+type ChunkFrame struct {
+	ID    string `json:"id"`
+	Seq   int    `json:"seq"`   // position of this frame, 0 to Total-1
+	Total int    `json:"total"` // number of frames making up the event
+	Chunk []byte `json:"chunk"` // base64 on the wire
+
+	Type     string `json:"type,omitempty"`
+	Encoding string `json:"encoding,omitempty"`  // payload encoding, the chunks join into an encoded payload
+	EventSeq uint64 `json:"event_seq,omitempty"` // the event's sequence number, see Event.Seq
+
+	Metadata map[string]string `json:"metadata,omitempty"` // the event's metadata, on every frame
+}
+
+// Chunker splits event payloads larger than MaxChunkSize bytes into frames
+type Chunker struct {
+	MaxChunkSize int
+}
+
+// Split returns the frames carrying e's payload, a single frame if it fits
+func (ch Chunker) Split(e Event) []ChunkFrame {
+	var chunks [][]byte
+	payload := e.Payload
+	for ch.MaxChunkSize > 0 && len(payload) > ch.MaxChunkSize {
+		chunks = append(chunks, payload[:ch.MaxChunkSize])
+		payload = payload[ch.MaxChunkSize:]
+	}
+	chunks = append(chunks, payload)
+
+	frames := make([]ChunkFrame, len(chunks))
+	for i, chunk := range chunks {
+		frames[i] = ChunkFrame{ID: e.ID, Seq: i, Total: len(chunks), Chunk: chunk, Type: e.Type, Encoding: e.Encoding, EventSeq: e.Seq, Metadata: e.Metadata}
+	}
+	return frames
+}
+
+// recentlyCompleted is how many reassembled event IDs a Reassembler
+// remembers so that late duplicate frames don't rebuild them again
+const recentlyCompleted = 1024
+
+// Reassembler collects chunk frames and rebuilds the events they came from.
+// Frames may arrive in any order; duplicates are ignored. Events whose
+// frames stop arriving are discarded after Timeout, when it is set, and so
+// are events whose payload grows past MaxSize bytes.
+type Reassembler struct {
+	Timeout time.Duration
+	MaxSize int // zero means no limit
+
+	mu        sync.Mutex
+	pending   map[string]*partialEvent
+	completed map[string]struct{}
+	order     []string // completed IDs, oldest first
+}
+
+type partialEvent struct {
+	chunks   [][]byte
+	have     []bool
+	received int
+	size     int // payload bytes received so far
+	typ      string
+	encoding string
+	seq      uint64
+	metadata map[string]string
+	started  time.Time
+}
+
+// Add records f and returns the complete event once its last frame arrives
+func (r *Reassembler) Add(f ChunkFrame) (*Event, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireLocked(time.Now())
+
+	if f.Total <= 0 || f.Seq < 0 || f.Seq >= f.Total {
+		return nil, false
+	}
+	if r.MaxSize > 0 && f.Total > r.MaxSize {
+		// More frames than payload bytes allowed, don't allocate for them
+		return nil, false
+	}
+	if _, done := r.completed[f.ID]; done {
+		return nil, false
+	}
+	if r.pending == nil {
+		r.pending = make(map[string]*partialEvent)
+		r.completed = make(map[string]struct{})
+	}
+	pe, ok := r.pending[f.ID]
+	if ok && len(pe.chunks) != f.Total {
+		// The event was re-split differently, start over with this frame
+		ok = false
+	}
+	if !ok {
+		pe = &partialEvent{
+			chunks:  make([][]byte, f.Total),
+			have:    make([]bool, f.Total),
+			started: time.Now(),
+		}
+		r.pending[f.ID] = pe
+	}
+	if pe.have[f.Seq] {
+		return nil, false
+	}
+	pe.size += len(f.Chunk)
+	if r.MaxSize > 0 && pe.size > r.MaxSize {
+		// Too large to rebuild, ignore the rest of its frames as well
+		delete(r.pending, f.ID)
+		r.completeLocked(f.ID)
+		return nil, false
+	}
+	pe.chunks[f.Seq] = f.Chunk
+	pe.have[f.Seq] = true
+	pe.received++
+	if f.Type != "" {
+		pe.typ = f.Type
+	}
+	if f.Encoding != "" {
+		pe.encoding = f.Encoding
+	}
+	if f.EventSeq != 0 {
+		pe.seq = f.EventSeq
+	}
+	if f.Metadata != nil {
+		pe.metadata = f.Metadata
+	}
+	if pe.received < f.Total {
+		return nil, false
+	}
+
+	delete(r.pending, f.ID)
+	r.completeLocked(f.ID)
+	return &Event{ID: f.ID, Payload: bytes.Join(pe.chunks, nil), Type: pe.typ, Encoding: pe.encoding, Seq: pe.seq, Metadata: pe.metadata}, true
+}
+
+// completeLocked remembers id as done so its late frames are ignored
+func (r *Reassembler) completeLocked(id string) {
+	r.completed[id] = struct{}{}
+	r.order = append(r.order, id)
+	if len(r.order) > recentlyCompleted {
+		delete(r.completed, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// Pending returns the number of events still waiting for frames
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+func (r *Reassembler) expireLocked(now time.Time) {
+	if r.Timeout <= 0 {
+		return
+	}
+	for id, pe := range r.pending {
+		if now.Sub(pe.started) > r.Timeout {
+			delete(r.pending, id)
+		}
+	}
+}
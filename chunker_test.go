@@ -0,0 +1,66 @@
+package gochunker
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	const max = 64
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{0, 1, max - 1, max, max + 1, 3 * max, 3*max + 7, 100 * max} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			payload := make([]byte, size)
+			rng.Read(payload)
+			event := Event{ID: "e", Payload: payload, Type: "t"}
+			frames := Chunker{MaxChunkSize: max}.Split(event)
+			if want := (size + max - 1) / max; len(frames) != want && !(size == 0 && len(frames) == 1) {
+				t.Fatalf("split into %d frames, want %d", len(frames), want)
+			}
+			// Deliver them shuffled, every one twice
+			order := append(rng.Perm(len(frames)), rng.Perm(len(frames))...)
+			var r Reassembler
+			var got *Event
+			for _, i := range order {
+				if e, ok := r.Add(frames[i]); ok {
+					if got != nil {
+						t.Fatal("event reassembled twice")
+					}
+					got = e
+				}
+			}
+			if got == nil {
+				t.Fatal("event never reassembled")
+			}
+			if got.ID != "e" || got.Type != "t" || !bytes.Equal(got.Payload, payload) {
+				t.Fatalf("reassembled %q of type %q with %d payload bytes", got.ID, got.Type, len(got.Payload))
+			}
+			if n := r.Pending(); n != 0 {
+				t.Fatalf("%d events still pending", n)
+			}
+		})
+	}
+}
+
+func TestReassemblerMissingFrame(t *testing.T) {
+	frames := Chunker{MaxChunkSize: 4}.Split(Event{ID: "e", Payload: []byte("0123456789")})
+	var r Reassembler
+	for _, f := range frames[1:] {
+		if _, ok := r.Add(f); ok {
+			t.Fatal("event reassembled with its first frame missing")
+		}
+	}
+	if n := r.Pending(); n != 1 {
+		t.Fatalf("%d events pending, want 1", n)
+	}
+	for _, f := range []ChunkFrame{{ID: "bad", Seq: 2, Total: 2}, {ID: "bad", Seq: -1, Total: 2}, {ID: "bad", Total: 0}} {
+		if _, ok := r.Add(f); ok {
+			t.Fatalf("frame %+v completed an event", f)
+		}
+	}
+	if n := r.Pending(); n != 1 {
+		t.Fatalf("invalid frames left %d events pending, want 1", n)
+	}
+}
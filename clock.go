@@ -0,0 +1,72 @@
+package gochunker
+
+import "time"
+
+// Clock is where the controller and its rate limiters read the time and
+// get their tickers and timeouts from, so tests can drive them
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker delivers ticks every period, as a time.Ticker does
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// Timer calls its function in its own goroutine once its duration passed,
+// as a time.AfterFunc timer does
+type Timer interface {
+	Stop()
+	Reset(d time.Duration)
+}
+
+// SystemClock is the Clock of the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct{ *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) Stop()                 { t.t.Stop() }
+func (t systemTimer) Reset(d time.Duration) { t.t.Reset(d) }
+
+// WithClock makes the controller and its rate limiters keep time with
+// clock rather than SystemClock: event timestamps and expiry, ack timeouts,
+// redial and rate limit waits, the circuit breaker's cooldown, heartbeats,
+// pings, batch flushes, the app idle timeout, SendTimeout, SessionTTL and
+// Drain's polling. Socket deadlines stay on the system clock.
+func WithClock(clock Clock) Option {
+	return func(c *Controller) {
+		c.clock = clock
+		c.now = clock.Now
+	}
+}
+
+// resetTicker restarts t with period d, discarding a tick already due
+func resetTicker(t Ticker, d time.Duration) {
+	t.Reset(d)
+	select {
+	case <-t.C():
+	default:
+	}
+}
@@ -0,0 +1,115 @@
+package gochunker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefillsOnClockTicks(t *testing.T) {
+	fc := newFakeClock()
+	rl := NewRateLimiterWithClock(2, time.Minute, fc)
+	defer rl.Stop()
+	if !rl.AllowN(2) {
+		t.Fatal("fresh bucket refused its capacity")
+	}
+	if ok, wait := rl.Reserve(); ok || wait != 30*time.Second {
+		t.Fatalf("empty bucket reserved %v with wait %v, want a 30s wait", ok, wait)
+	}
+
+	fc.Advance(29 * time.Second)
+	time.Sleep(20 * time.Millisecond)
+	if u := rl.Utilization(); u != 1 {
+		t.Fatalf("utilization %v a second before the refill, want 1", u)
+	}
+	fc.Advance(time.Second)
+	if !waitUntil(time.Second, func() bool { return rl.Utilization() == 0.5 }) {
+		t.Fatalf("utilization %v after the refill tick, want 0.5", rl.Utilization())
+	}
+	if ok, wait := rl.Reserve(); !ok || wait != 0 {
+		t.Fatalf("refilled bucket reserved %v with wait %v", ok, wait)
+	}
+}
+
+func TestRateLimiterWaitUnblockedByClock(t *testing.T) {
+	fc := newFakeClock()
+	rl := NewRateLimiterWithClock(1, time.Hour, fc)
+	defer rl.Stop()
+	rl.Allow()
+	done := make(chan error, 1)
+	go func() { done <- rl.Wait(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("wait returned %v before the clock moved", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fc.Advance(time.Hour)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait still blocked after the refill tick")
+	}
+}
+
+func TestAckTimeoutFollowsClock(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	acker(main, func(id string, n int) int {
+		if id == "e1" && n == 1 {
+			return 0
+		}
+		return 1
+	})
+	fc := newFakeClock()
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.AckTimeout = time.Hour
+	c := startController(t, cfg, WithClock(fc))
+	sendEvents(t, dialApp(t, c), "e", 3)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Unacked == 1 }) {
+		t.Fatalf("main got %v, want e1 left unacknowledged", main.ids())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ids := main.ids(); len(ids) != 3 {
+		t.Fatalf("main got %v before the clock moved, want no resend", ids)
+	}
+
+	fc.Advance(time.Hour + time.Second)
+	if !waitUntil(2*time.Second, func() bool { return settled(c) && len(main.ids()) == 4 }) {
+		t.Fatalf("main got %v, want e1 resent once its ack timed out", main.ids())
+	}
+	if ids := main.ids(); ids[3] != "e1" {
+		t.Fatalf("main got %v, want e1 resent last", ids)
+	}
+}
+
+func TestBreakerCooldownFollowsClock(t *testing.T) {
+	fd := &flakyDialer{fail: 2, release: make(chan struct{})}
+	close(fd.release)
+	fc := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.BreakerFailures = 2
+	cfg.BreakerCooldown = time.Hour
+	c := startController(t, cfg, WithDialFunc(fd.dial), WithClock(fc))
+	// The backoff after the first failed dial waits on fc too
+	if !waitUntil(2*time.Second, func() bool { return fd.count() == 1 }) {
+		t.Fatal("provider never dialed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	fc.Advance(time.Second)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].State == "failed" }) {
+		t.Fatalf("provider %s after failing dials, want failed", c.Status().Providers[0].State)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if st := c.Status().Providers[0]; st.State != "failed" {
+		t.Fatalf("provider %s before the cooldown passed, want failed", st.State)
+	}
+
+	fc.Advance(time.Hour)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatalf("provider %s once the cooldown passed, want connected", c.Status().Providers[0].State)
+	}
+}
@@ -0,0 +1,70 @@
+package gochunker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// errProviderDone is returned by reconnect for a provider that closed its
+// connection with one of Config.FinalCloseCodes
+var errProviderDone = errors.New("provider closed the connection for good")
+
+// closeCode returns the close code a provider's close frame carried in
+// err, zero when err isn't a close. A connection dropped without a close
+// frame is reported as websocket.CloseAbnormalClosure.
+func closeCode(err error) int {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return 0
+}
+
+// reconnectsAfter reports whether a provider closing its connection with
+// code is dialed again. Anything not in FinalCloseCodes is, as is a
+// connection lost without a close.
+func (c *Controller) reconnectsAfter(code int) bool {
+	for _, final := range c.cfg.FinalCloseCodes {
+		if code == final {
+			return false
+		}
+	}
+	return true
+}
+
+// noteCloseLocked records the close code err, which ended the reader of
+// p's connection, carried. c.mu must be held.
+func (c *Controller) noteCloseLocked(p *provider, err error) {
+	code := closeCode(err)
+	if code == 0 {
+		return
+	}
+	p.lastCloseCode = code
+	if !c.reconnectsAfter(code) && !p.done {
+		p.done = true
+		c.log.Warn("provider closed the connection, not reconnecting", "provider", p.name, "code", code)
+	}
+}
+
+// providerDone reports whether p closed its connection for good
+func (c *Controller) providerDone(p *provider) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return p.done
+}
+
+// parseCloseCodes parses a comma separated list of close codes
+func parseCloseCodes(s string) ([]int, error) {
+	var codes []int
+	for _, v := range parseList(s) {
+		code, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("close code %q: %w", v, err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
@@ -0,0 +1,131 @@
+package gochunker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReconnectsAfterCloseCode(t *testing.T) {
+	c := &Controller{cfg: DefaultConfig()}
+	for code, want := range map[int]bool{
+		0:                                true,  // lost without a close
+		websocket.CloseNormalClosure:     false, // done with us
+		websocket.CloseGoingAway:         true,
+		websocket.CloseAbnormalClosure:   true,
+		websocket.CloseInternalServerErr: true,
+		websocket.CloseServiceRestart:    true,
+		websocket.ClosePolicyViolation:   true,
+		4000:                             true,
+	} {
+		if got := c.reconnectsAfter(code); got != want {
+			t.Errorf("close code %d reconnects %v, want %v", code, got, want)
+		}
+	}
+
+	c.cfg.FinalCloseCodes = []int{websocket.ClosePolicyViolation, 4000}
+	for code, want := range map[int]bool{
+		websocket.CloseNormalClosure:   true,
+		websocket.ClosePolicyViolation: false,
+		4000:                           false,
+		4001:                           true,
+	} {
+		if got := c.reconnectsAfter(code); got != want {
+			t.Errorf("with final codes %v, close code %d reconnects %v, want %v", c.cfg.FinalCloseCodes, code, got, want)
+		}
+	}
+}
+
+func TestCloseCodeOf(t *testing.T) {
+	for err, want := range map[error]int{
+		&websocket.CloseError{Code: websocket.CloseNormalClosure}:              1000,
+		fmt.Errorf("reading: %w", &websocket.CloseError{Code: 1011, Text: ""}): 1011,
+		io.ErrUnexpectedEOF:       0,
+		errors.New("i/o timeout"): 0,
+	} {
+		if got := closeCode(err); got != want {
+			t.Errorf("closeCode(%v) = %d, want %d", err, got, want)
+		}
+	}
+}
+
+// startClosingProvider starts a controller with a single provider that
+// closes its connection with code on receiving the event "bye"
+func startClosingProvider(t *testing.T, code int) (*Controller, *fakeProvider) {
+	t.Helper()
+	fp := newFakeProvider(t)
+	fp.onMessage = func(conn *websocket.Conn, msg []byte) {
+		if closeFrameRequested(msg) {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, "bye"))
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{fp.url()}
+	c := startController(t, cfg, withBackoffBase(time.Millisecond))
+	if err := c.Enqueue(Event{ID: "bye"}); err != nil {
+		t.Fatal(err)
+	}
+	return c, fp
+}
+
+// closeFrameRequested reports whether msg is the event "bye"
+func closeFrameRequested(msg []byte) bool {
+	var event Event
+	return JSONCodec{}.Unmarshal(msg, &event) == nil && event.ID == "bye"
+}
+
+func TestProviderNormalClosureStopsReconnects(t *testing.T) {
+	c, fp := startClosingProvider(t, websocket.CloseNormalClosure)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].LastCloseCode == 1000 }) {
+		t.Fatalf("status %+v, want the close code", c.Status().Providers[0])
+	}
+	if err := c.Enqueue(Event{ID: "after"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	fp.mu.Lock()
+	dials := fp.dials
+	fp.mu.Unlock()
+	if dials != 1 {
+		t.Fatalf("provider dialed %d times after closing normally, want once", dials)
+	}
+	if st := c.Status().Providers[0]; st.Connected || st.State != "disconnected" {
+		t.Fatalf("provider %+v, want it left disconnected", st)
+	}
+}
+
+func TestProviderErrorCloseReconnects(t *testing.T) {
+	for _, code := range []int{websocket.CloseInternalServerErr, websocket.CloseGoingAway} {
+		t.Run(fmt.Sprint(code), func(t *testing.T) {
+			c, fp := startClosingProvider(t, code)
+			if !waitUntil(2*time.Second, func() bool {
+				fp.mu.Lock()
+				defer fp.mu.Unlock()
+				return fp.dials == 2
+			}) {
+				t.Fatal("provider not dialed again after closing with an error")
+			}
+			if err := c.Enqueue(Event{ID: "after"}); err != nil {
+				t.Fatal(err)
+			}
+			if !waitUntil(2*time.Second, func() bool { ids := fp.ids(); return len(ids) > 0 && ids[len(ids)-1] == "after" }) {
+				t.Fatalf("provider got %v, want the event after reconnecting", fp.ids())
+			}
+			if got := c.Status().Providers[0].LastCloseCode; got != code {
+				t.Fatalf("last close code %d, want %d", got, code)
+			}
+		})
+	}
+}
+
+func TestFinalCloseCodesValidated(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FinalCloseCodes = []int{999}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("close code 999 accepted")
+	}
+}
@@ -0,0 +1,65 @@
+// Command gochunker runs a controller that relays events from an app to a
+// pool of providers, configured from GOCHUNKER_* environment variables
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/andranikasd/gochunker"
+)
+
+func newLogger(level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+func main() {
+	cfg, err := gochunker.LoadConfig()
+	if err != nil {
+		newLogger(slog.LevelInfo).Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	logger := newLogger(cfg.LogLevel)
+	controller, err := gochunker.NewController(cfg, gochunker.WithLogger(logger))
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	controller.Start()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: controller.Handler(), TLSConfig: controller.ServerTLSConfig()}
+	go func() {
+		logger.Info("controller listening", "addr", cfg.ListenAddr, "tls", srv.TLSConfig != nil)
+		var err error
+		if srv.TLSConfig != nil {
+			// the certificate is already loaded into TLSConfig
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("server failed", "err", err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("server shutdown", "err", err)
+	}
+	if err := controller.Close(shutdownCtx); err != nil {
+		logger.Warn("controller shutdown", "err", err)
+	}
+	logger.Info("controller stopped")
+}
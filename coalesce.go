@@ -0,0 +1,72 @@
+package gochunker
+
+import "container/heap"
+
+// coalesceKeyOf returns the key event is coalesced by, empty if it has none
+// or coalescing is off, see Config.CoalesceKey
+func (c *Controller) coalesceKeyOf(event Event) string {
+	if c.cfg.CoalesceKey == "" {
+		return ""
+	}
+	return event.Metadata[c.cfg.CoalesceKey]
+}
+
+// coalesceLocked makes the event just buffered at idx supersede the last
+// one buffered with the same key: every provider yet to send that one
+// skips it, sending the newer value in its place. Providers that sent it
+// already keep going as they were. The buffer lets the skipped event go
+// as it would a delivered one, so updates to one key hold a single place
+// in it once every provider is past what came before. c.mu must be held.
+func (c *Controller) coalesceLocked(idx int, event Event) {
+	key := c.coalesceKeyOf(event)
+	if key == "" {
+		return
+	}
+	if c.coalesce == nil {
+		c.coalesce = make(map[string]int)
+	}
+	old, ok := c.coalesce[key]
+	c.coalesce[key] = idx
+	if len(c.coalesce) > 2*c.events.size {
+		// Forget keys whose last event left the buffer
+		for k, i := range c.coalesce {
+			if i < c.events.first {
+				delete(c.coalesce, k)
+			}
+		}
+	}
+	if !ok || old < c.events.first {
+		return
+	}
+	superseded := false
+	for _, p := range c.providers() {
+		if c.unqueueLocked(p, old) {
+			c.passLocked(p, old)
+			superseded = true
+		}
+	}
+	if !superseded {
+		return
+	}
+	c.coalesced++
+	c.metrics.coalesced.Inc()
+	if c.onDropped != nil {
+		if e, ok := c.events.get(old); ok {
+			c.noteDropLocked(e, DropCoalesced)
+		}
+	}
+	c.log.Debug("coalesced event", "key", key, "index", old, "by", idx, "event_id", event.ID)
+	c.releaseLocked()
+}
+
+// unqueueLocked takes the event at idx off p's queue, reporting whether p
+// still had it to send. c.mu must be held.
+func (c *Controller) unqueueLocked(p *provider, idx int) bool {
+	for i, qe := range p.queue {
+		if qe.index == idx {
+			heap.Remove(&p.queue, i)
+			return true
+		}
+	}
+	return false
+}
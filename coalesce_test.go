@@ -0,0 +1,115 @@
+package gochunker
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// update returns an event for the state update id of key, or one with no
+// key when key is empty
+func update(id, key string) Event {
+	e := Event{ID: id, Payload: []byte("x")}
+	if key != "" {
+		e.Metadata = map[string]string{"key": key}
+	}
+	return e
+}
+
+func TestCoalescingKeepsTheLatestUnsent(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.CoalesceKey = "key"
+	var mu sync.Mutex
+	var dropped []string
+	c := startController(t, cfg, WithOnDropped(func(e Event, reason string) {
+		mu.Lock()
+		defer mu.Unlock()
+		dropped = append(dropped, e.ID+" "+reason)
+	}))
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatal("main never connected")
+	}
+	if err := c.PauseProvider("Main"); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []Event{update("a1", "a"), update("b1", "b"), update("a2", "a"), update("n", ""), update("a3", "a")} {
+		if err := c.Enqueue(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := c.Status(); st.Coalesced != 2 {
+		t.Fatalf("%d coalesced, want a1 and a2", st.Coalesced)
+	}
+	if err := c.ResumeProvider("Main"); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %v, want b1, n and a3", main.ids())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := main.ids(); !reflect.DeepEqual(got, []string{"b1", "n", "a3"}) {
+		t.Fatalf("main got %v, want b1, n and a3", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(dropped, []string{"a1 coalesced", "a2 coalesced"}) {
+		t.Fatalf("OnDropped got %v, want a1 and a2 coalesced", dropped)
+	}
+}
+
+func TestCoalescingLeavesSentEventsAlone(t *testing.T) {
+	main := newFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{main.url()}
+	cfg.CoalesceKey = "key"
+	c := startController(t, cfg)
+	if err := c.Enqueue(update("a1", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatalf("main got %v, want a1", main.ids())
+	}
+	if err := c.Enqueue(update("a2", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v, want a1 and a2", main.ids())
+	}
+	if st := c.Status(); st.Coalesced != 0 {
+		t.Fatalf("%d coalesced, want none as a1 went out first", st.Coalesced)
+	}
+}
+
+func TestCoalescedEventsFreeTheBuffer(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.CoalesceKey = "key"
+	cfg.BufferSize = 3
+	cfg.DropPolicy = RejectNewest
+	c := startController(t, cfg)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatal("main never connected")
+	}
+	if err := c.PauseProvider("Main"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a1", "a2", "a3", "a4", "a5"} {
+		if err := c.Enqueue(update(id, "a")); err != nil {
+			t.Fatalf("enqueueing %s: %v", id, err)
+		}
+	}
+	if st := c.Status(); st.Buffered != 1 || st.Dropped != 0 || st.Coalesced != 4 {
+		t.Fatalf("%d buffered, %d dropped and %d coalesced, want the latest update alone held", st.Buffered, st.Dropped, st.Coalesced)
+	}
+	if err := c.ResumeProvider("Main"); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatalf("main got %v, want a5", main.ids())
+	}
+	if got := main.ids(); got[0] != "a5" {
+		t.Fatalf("main got %v, want a5", got)
+	}
+}
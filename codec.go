@@ -0,0 +1,69 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Codec turns the messages exchanged with apps and providers into bytes on
+// the wire and back
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes messages as JSON, the default wire format
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Names of the wire formats Config.Codec selects
+const (
+	CodecJSON        = "json"
+	CodecMessagePack = "msgpack"
+)
+
+// Subprotocols a connection's wire format is negotiated with. A peer that
+// selects neither is spoken to in JSON.
+const (
+	subprotocolJSON        = "gochunker.json"
+	subprotocolMessagePack = "gochunker.msgpack"
+)
+
+// checkCodec reports an error unless name is a known Config.Codec
+func checkCodec(name string) error {
+	switch name {
+	case "", CodecJSON, CodecMessagePack:
+		return nil
+	}
+	return fmt.Errorf("unknown codec %q, want %s or %s", name, CodecJSON, CodecMessagePack)
+}
+
+// offeredSubprotocols returns the subprotocols providers are dialed with
+// for the codec called name, preferred first
+func offeredSubprotocols(name string) []string {
+	if name == CodecMessagePack {
+		return []string{subprotocolMessagePack, subprotocolJSON}
+	}
+	return nil
+}
+
+// codecOf returns the codec negotiated for conn
+func codecOf(conn interface{ Subprotocol() string }) Codec {
+	if conn.Subprotocol() == subprotocolMessagePack {
+		return MessagePackCodec{}
+	}
+	return JSONCodec{}
+}
+
+// binaryCodec reports whether codec's messages must go in binary frames
+func binaryCodec(codec Codec) bool {
+	_, ok := codec.(MessagePackCodec)
+	return ok
+}
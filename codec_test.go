@@ -0,0 +1,323 @@
+package gochunker
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var codecs = map[string]Codec{
+	CodecJSON:        JSONCodec{},
+	CodecMessagePack: MessagePackCodec{},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	expires := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	event := Event{
+		ID:         "e1",
+		Payload:    []byte{0, 1, 0xfe, 0xff, 'x'},
+		Type:       "click",
+		Weight:     3,
+		Priority:   -2,
+		Seq:        math.MaxUint64,
+		ExpiresAt:  expires,
+		TraceState: "k=v",
+	}
+	for name, codec := range codecs {
+		msg, err := codec.Marshal(event)
+		if err != nil {
+			t.Fatalf("%s: marshaling an event: %v", name, err)
+		}
+		var got Event
+		if err := codec.Unmarshal(msg, &got); err != nil {
+			t.Fatalf("%s: unmarshaling an event: %v", name, err)
+		}
+		if !got.ExpiresAt.Equal(expires) {
+			t.Errorf("%s: expires_at came back as %v", name, got.ExpiresAt)
+		}
+		got.ExpiresAt = expires
+		if !reflect.DeepEqual(got, event) {
+			t.Errorf("%s: event came back as %+v, want %+v", name, got, event)
+		}
+
+		batch := batchMessage{Type: "batch", Events: []Event{{ID: "a", Payload: []byte("1")}, {ID: "b", Payload: nil}}}
+		msg, err = codec.Marshal(batch)
+		if err != nil {
+			t.Fatalf("%s: marshaling a batch: %v", name, err)
+		}
+		var gotBatch batchMessage
+		if err := codec.Unmarshal(msg, &gotBatch); err != nil {
+			t.Fatalf("%s: unmarshaling a batch: %v", name, err)
+		}
+		if len(gotBatch.Events) != 2 || gotBatch.Events[0].ID != "a" || string(gotBatch.Events[0].Payload) != "1" || gotBatch.Events[1].ID != "b" {
+			t.Errorf("%s: batch came back as %+v", name, gotBatch)
+		}
+
+		frame := ChunkFrame{ID: "big", Seq: 2, Total: 3, Chunk: bytes.Repeat([]byte{0xab}, 70000), EventSeq: 9}
+		msg, err = codec.Marshal(frame)
+		if err != nil {
+			t.Fatalf("%s: marshaling a frame: %v", name, err)
+		}
+		var gotFrame ChunkFrame
+		if err := codec.Unmarshal(msg, &gotFrame); err != nil {
+			t.Fatalf("%s: unmarshaling a frame: %v", name, err)
+		}
+		if !reflect.DeepEqual(gotFrame, frame) {
+			t.Errorf("%s: frame came back with ID %q seq %d/%d, %d chunk bytes", name, gotFrame.ID, gotFrame.Seq, gotFrame.Total, len(gotFrame.Chunk))
+		}
+
+		pm := providerMessage{Ack: "e1", Seq: 1 << 40, ThrottleMs: 250}
+		msg, err = codec.Marshal(pm)
+		if err != nil {
+			t.Fatalf("%s: marshaling a provider message: %v", name, err)
+		}
+		var gotPM providerMessage
+		if err := codec.Unmarshal(msg, &gotPM); err != nil {
+			t.Fatalf("%s: unmarshaling a provider message: %v", name, err)
+		}
+		if gotPM != pm {
+			t.Errorf("%s: provider message came back as %+v, want %+v", name, gotPM, pm)
+		}
+	}
+}
+
+func TestMessagePackPayloadIsBin(t *testing.T) {
+	payload := []byte{0xde, 0xad, 0xbe, 0xef}
+	msg, err := MessagePackCodec{}.Marshal(Event{ID: "e1", Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(msg, append([]byte{0xc4, 4}, payload...)) {
+		t.Fatalf("payload not encoded as bin 8 in % x", msg)
+	}
+	if bytes.Contains(msg, []byte("payload_encoding")) {
+		t.Fatalf("bin payload still marked with its encoding in % x", msg)
+	}
+}
+
+func TestMessagePackWireMatchesJSONForm(t *testing.T) {
+	event := Event{
+		ID:          "e1",
+		Payload:     []byte{0, 1, 0xff},
+		Type:        "click",
+		Weight:      2,
+		Priority:    -1,
+		Encoding:    EncodingGzip,
+		Seq:         math.MaxUint64,
+		Metadata:    map[string]string{"tenant": "a", "region": "eu"},
+		TraceParent: "00-1-2-01",
+		TraceState:  "k=v",
+		ExpiresAt:   time.Date(2026, 3, 1, 12, 0, 0, 5, time.UTC),
+	}
+	for name, v := range map[string]interface{}{
+		"event":       event,
+		"bare event":  Event{},
+		"batch":       batchMessage{Type: "batch", Events: []Event{event, {ID: "e2"}}},
+		"large batch": batchMessage{Type: "batch", Events: make([]Event, 20)},
+	} {
+		direct, err := MessagePackCodec{}.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		viaJSON, err := marshalJSONForm(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(direct, viaJSON) {
+			t.Errorf("%s: encoded directly as % x, want % x", name, direct, viaJSON)
+		}
+	}
+
+	var got Event
+	msg, _ := marshalJSONForm(event)
+	if err := (MessagePackCodec{}).Unmarshal(msg, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.ExpiresAt.Equal(event.ExpiresAt) {
+		t.Fatalf("expires_at came back as %v", got.ExpiresAt)
+	}
+	got.ExpiresAt = event.ExpiresAt
+	if !reflect.DeepEqual(got, event) {
+		t.Fatalf("event came back as %+v, want %+v", got, event)
+	}
+}
+
+func TestMessagePackChunkIsBin(t *testing.T) {
+	chunk := []byte{0xde, 0xad, 0xbe, 0xef}
+	msg, err := MessagePackCodec{}.Marshal(ChunkFrame{ID: "big", Total: 1, Chunk: chunk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(msg, append([]byte{0xa5, 'c', 'h', 'u', 'n', 'k', 0xc4, 4}, chunk...)) {
+		t.Fatalf("chunk not encoded as bin 8 in % x", msg)
+	}
+
+	// Frames from encoders that sent the chunk as base64 still decode
+	old, err := marshalJSONForm(ChunkFrame{ID: "big", Total: 1, Chunk: chunk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frame ChunkFrame
+	if err := (MessagePackCodec{}).Unmarshal(old, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame.Chunk, chunk) {
+		t.Fatalf("base64 chunk came back as % x", frame.Chunk)
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	event := Event{ID: "e1", Payload: bytes.Repeat([]byte("x"), 1024), Type: "click", Seq: 42, Metadata: map[string]string{"tenant": "a"}}
+	batch := batchMessage{Type: "batch", Events: []Event{event, event, event, event}}
+	frame := ChunkFrame{ID: "big", Seq: 1, Total: 4, Chunk: bytes.Repeat([]byte{0xab}, 16<<10), EventSeq: 42}
+	for _, name := range []string{CodecJSON, CodecMessagePack} {
+		codec := codecs[name]
+		for kind, v := range map[string]interface{}{"event": event, "batch": batch, "frame": frame} {
+			msg, err := codec.Marshal(v)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(name+"/marshal/"+kind, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					codec.Marshal(v)
+				}
+			})
+			b.Run(name+"/unmarshal/"+kind, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					switch v.(type) {
+					case Event:
+						var e Event
+						codec.Unmarshal(msg, &e)
+					case batchMessage:
+						var bm batchMessage
+						codec.Unmarshal(msg, &bm)
+					case ChunkFrame:
+						var f ChunkFrame
+						codec.Unmarshal(msg, &f)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMessagePackRejectsMalformed(t *testing.T) {
+	good, err := MessagePackCodec{}.Marshal(Event{ID: "e1", Payload: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"truncated": good[:len(good)-1],
+		"trailing":  append(append([]byte(nil), good...), 0xc0),
+		"int key":   {0x81, 0x01, 0x02},
+		"huge map":  {0xdf, 0xff, 0xff, 0xff, 0xff},
+		"ext type":  {0xd4, 0x01, 0x00},
+	} {
+		var event Event
+		if err := (MessagePackCodec{}).Unmarshal(data, &event); err == nil {
+			t.Errorf("%s: decoded % x without an error", name, data)
+		}
+	}
+}
+
+func TestValidateCodec(t *testing.T) {
+	fp := newFakeProvider(t)
+	cfg := testConfig(fp, fp)
+	cfg.Codec = "protobuf"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("unknown codec accepted")
+	}
+	cfg.Codec = CodecMessagePack
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("msgpack rejected: %v", err)
+	}
+}
+
+func TestProviderNegotiatesMessagePack(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	main.protocols = []string{subprotocolMessagePack}
+	cfg := testConfig(main, backup)
+	cfg.Codec = CodecMessagePack
+	c := startController(t, cfg)
+	sendEvents(t, dialApp(t, c), "e", 2)
+
+	var ids []string
+	waitUntil(2*time.Second, func() bool {
+		main.mu.Lock()
+		defer main.mu.Unlock()
+		ids = ids[:0]
+		for i, msg := range main.msgs {
+			var event Event
+			if main.types[i] != websocket.BinaryMessage {
+				t.Fatalf("message %d went out in a frame of type %d, want binary", i, main.types[i])
+			}
+			if err := (MessagePackCodec{}).Unmarshal([]byte(msg), &event); err != nil {
+				t.Fatalf("message %d is not MessagePack: %v", i, err)
+			}
+			if event.ID != "" {
+				ids = append(ids, event.ID)
+			}
+		}
+		return len(ids) == 2
+	})
+	if len(ids) != 2 || ids[0] != "e0" || ids[1] != "e1" {
+		t.Fatalf("main decoded %v, want [e0 e1]", ids)
+	}
+}
+
+func TestProviderWithoutSubprotocolGetsJSON(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.Codec = CodecMessagePack
+	c := startController(t, cfg)
+	sendEvents(t, dialApp(t, c), "e", 2)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %d events, want 2", main.count())
+	}
+	if ids := main.ids(); len(ids) != 2 {
+		t.Fatalf("main decoded %v from JSON, want 2 events", ids)
+	}
+	main.mu.Lock()
+	defer main.mu.Unlock()
+	for i, typ := range main.types {
+		if typ != websocket.TextMessage {
+			t.Fatalf("message %d went out in a frame of type %d, want text", i, typ)
+		}
+	}
+}
+
+func TestAppSpeaksMessagePack(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocolMessagePack}}
+	app, _, err := dialer.Dial(serveApps(t, c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	if app.Subprotocol() != subprotocolMessagePack {
+		t.Fatalf("app handshake selected %q", app.Subprotocol())
+	}
+
+	msg, err := MessagePackCodec{}.Marshal(Event{ID: "m0", Payload: []byte{0, 0xff}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatalf("main got %d events, want 1", main.count())
+	}
+	var event Event
+	if err := (JSONCodec{}).Unmarshal([]byte(main.messages()[0]), &event); err != nil || event.ID != "m0" || !bytes.Equal(event.Payload, []byte{0, 0xff}) {
+		t.Fatalf("main received %+v, %v", event, err)
+	}
+}
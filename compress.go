@@ -0,0 +1,91 @@
+package gochunker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// EncodingGzip marks an event whose payload is gzip compressed
+const EncodingGzip = "gzip"
+
+// Compressor gzips event payloads larger than Threshold bytes
+type Compressor struct {
+	Threshold int
+	Level     int // gzip level, gzip.DefaultCompression when zero
+}
+
+// Compress returns e with its payload gzipped, or e unchanged if the
+// payload is small, already compressed, or doesn't shrink. An
+// explicit weight is scaled down with the payload so the rate limiter
+// charges for what actually goes on the wire.
+func (c Compressor) Compress(e Event) (Event, error) {
+	if e.Encoding != "" || len(e.Payload) <= c.Threshold {
+		return e, nil
+	}
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return e, err
+	}
+	if _, err := zw.Write(e.Payload); err != nil {
+		return e, err
+	}
+	if err := zw.Close(); err != nil {
+		return e, err
+	}
+	compressed := buf.Bytes()
+	if len(compressed) >= len(e.Payload) {
+		return e, nil
+	}
+
+	if e.Weight > 1 {
+		e.Weight = (e.Weight*len(compressed) + len(e.Payload) - 1) / len(e.Payload)
+	}
+	e.Payload = compressed
+	e.Encoding = EncodingGzip
+	return e, nil
+}
+
+// Decompressor reverses Compressor, refusing payloads that inflate past
+// MaxSize bytes when it is set
+type Decompressor struct {
+	MaxSize int
+}
+
+// Decompress returns e with its original payload restored. Events that were
+// not compressed are returned as is.
+func (d Decompressor) Decompress(e Event) (Event, error) {
+	switch e.Encoding {
+	case "":
+		return e, nil
+	case EncodingGzip:
+	default:
+		return e, fmt.Errorf("unsupported payload encoding %q", e.Encoding)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(e.Payload))
+	if err != nil {
+		return e, fmt.Errorf("decompressing payload: %w", err)
+	}
+	defer zr.Close()
+
+	var r io.Reader = zr
+	if d.MaxSize > 0 {
+		r = io.LimitReader(zr, int64(d.MaxSize)+1)
+	}
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return e, fmt.Errorf("decompressing payload: %w", err)
+	}
+	if d.MaxSize > 0 && len(payload) > d.MaxSize {
+		return e, fmt.Errorf("decompressed payload exceeds %d bytes", d.MaxSize)
+	}
+	e.Payload = payload
+	e.Encoding = ""
+	return e, nil
+}
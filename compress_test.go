@@ -0,0 +1,42 @@
+package gochunker
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("compressible "), 100)
+	event := Event{ID: "e", Payload: payload, Weight: 10}
+	compressed, err := Compressor{Threshold: 64}.Compress(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Encoding != EncodingGzip || len(compressed.Payload) >= len(payload) {
+		t.Fatalf("payload of %d bytes left as %d bytes with encoding %q", len(payload), len(compressed.Payload), compressed.Encoding)
+	}
+	if compressed.Weight >= event.Weight || compressed.Weight < 1 {
+		t.Fatalf("weight %d after compression, want it scaled down from %d", compressed.Weight, event.Weight)
+	}
+	restored, err := Decompressor{}.Decompress(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Encoding != "" || !bytes.Equal(restored.Payload, payload) {
+		t.Fatal("decompressed payload differs from the original")
+	}
+	if _, err := (Decompressor{MaxSize: len(payload) - 1}).Decompress(compressed); err == nil {
+		t.Fatal("payload inflating past MaxSize was accepted")
+	}
+}
+
+func TestCompressLeavesSmallPayloads(t *testing.T) {
+	event := Event{ID: "e", Payload: bytes.Repeat([]byte("a"), 64)}
+	got, err := Compressor{Threshold: 64}.Compress(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Encoding != "" || !bytes.Equal(got.Payload, event.Payload) {
+		t.Fatalf("payload at the threshold was compressed to %q", got.Encoding)
+	}
+}
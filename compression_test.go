@@ -0,0 +1,67 @@
+package gochunker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// negotiated reports whether the handshake response agreed on
+// permessage-deflate
+func negotiated(resp *http.Response) bool {
+	return strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+}
+
+func TestDeflateNegotiation(t *testing.T) {
+	fp := newFakeProvider(t)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer plain.Close()
+
+	for _, tc := range []struct {
+		name        string
+		compression bool
+		url         string
+		want        bool
+	}{
+		{"enabled", true, fp.url(), true},
+		{"disabled", false, fp.url(), false},
+		{"peer without support", true, "ws" + strings.TrimPrefix(plain.URL, "http"), false},
+	} {
+		cfg := DefaultConfig()
+		cfg.Compression = tc.compression
+		c, err := NewController(cfg, WithLogger(quietLogger))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Provider side
+		conn, resp, err := c.dialer.Dial(tc.url, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		conn.Close()
+		if got := negotiated(resp); got != tc.want {
+			t.Errorf("%s: provider negotiated deflate %v, want %v", tc.name, got, tc.want)
+		}
+		// App side, for an app asking for it
+		if tc.url == fp.url() {
+			conn, resp, err := (&websocket.Dialer{EnableCompression: true}).Dial(serveApps(t, c), nil)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			conn.Close()
+			if got := negotiated(resp); got != tc.want {
+				t.Errorf("%s: app negotiated deflate %v, want %v", tc.name, got, tc.want)
+			}
+		}
+		c.Close(context.Background())
+	}
+}
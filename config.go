@@ -0,0 +1,771 @@
+package gochunker
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the addresses the controller listens on and dials, and how
+// it buffers events in between
+type Config struct {
+	ListenAddr        string // address the app-facing server listens on
+	MainProviderURL   string // ws:// or wss:// URL of the main provider, or http:// or https:// for one taking an NDJSON stream, see httpStream
+	BackupProviderURL string // URL of the backup provider, of the same kinds as MainProviderURL
+
+	BackupProviderURLs []string // backups in failover order, replacing BackupProviderURL when set
+
+	ProviderURLs []string     // pool members in order, replacing the main and backup provider when set
+	PoolStrategy PoolStrategy // which pool members get each event
+
+	BufferSize     int        // maximum number of events held for providers
+	MaxBufferBytes int        // maximum payload bytes held for providers, zero bounds the buffer by BufferSize alone
+	DropPolicy     DropPolicy // what to drop when the buffer is full, by events or by bytes
+
+	OutboundQueueSize int            // events queued for a running provider worker at most, zero lets queues grow with the buffer
+	OutboundPolicy    OutboundPolicy // what to do with an event for a provider whose queue is full
+	DedupWindow       int            // how many recent event IDs are checked for repeats, zero disables deduplication
+	CoalesceKey       string         // Metadata key whose value identifies state updates, a newer event with the same value replacing an older one not yet sent; no coalescing when empty
+
+	IngestPolicy  IngestPolicy  // whether apps may send faster than providers deliver
+	IngestWindow  int           // events pending for running providers at which IngestCoupled stops reading apps
+	IngestTimeout time.Duration // longest IngestCoupled holds an app event back before buffering it anyway, zero means no limit
+
+	BufferHighWater int // events pending for running providers at which apps are told to pause, zero disables backpressure; with MaxBufferBytes the same share of it in pending bytes pauses them too
+	BufferLowWater  int // pending events at or below which paused apps resume, their bytes likewise at or below the same share of MaxBufferBytes
+
+	WALPath string // write-ahead log buffered events are persisted in, none when empty
+	WALSync bool   // fsync the log on every write so events survive a machine crash too
+
+	WALSegmentSize    int  // bytes a log segment grows to before the next is started, WALPath then naming a directory of them; zero keeps the log in one file
+	WALCompress       bool // gzip log segments once sealed
+	WALRetainSegments int  // fully consumed sealed segments kept rather than deleted, newest first
+
+	RateLimit          int            // events sent across all providers per RateLimitInterval, zero for no total cap when ProviderRateLimits are set
+	RateLimitInterval  time.Duration  // period the rate limit's budget is refilled over
+	ProviderRateLimits map[string]int // events sent to each named provider per RateLimitInterval, within RateLimit; unnamed providers only share RateLimit
+	TypeRateLimits     map[string]int // events of each type sent per RateLimitInterval on top of RateLimit, DefaultEventType sizing a budget shared by the others
+	BypassTypes        []string       // event types sent without asking any rate limiter, such as heartbeats and emergency commands
+	BypassWarnLimit    int            // bypassing events sent per RateLimitInterval past which a warning is logged, zero never warns
+
+	EventTTL      time.Duration // default lifetime of events that don't set expires_at, zero means no expiry
+	PriorityAging time.Duration // how long a queued event waits to gain a priority level, zero disables aging
+
+	HeartbeatInterval time.Duration // how long a provider may go without a message before a heartbeat is sent, zero disables heartbeats
+
+	ProbeInterval time.Duration // how often an idle provider is sent a probe checking that writes go through, zero disables probing
+	ProbeFailures int           // failed probes in a row after which a provider is marked failed and not dialed again for BreakerCooldown
+
+	PingInterval time.Duration // how often providers are pinged, zero disables keepalive
+	PongTimeout  time.Duration // how long past a ping interval a provider may stay silent
+
+	WriteTimeout time.Duration // deadline for each write, zero means none
+	ReadTimeout  time.Duration // how long the app may stay silent, pongs included; zero means forever
+
+	AppIdleTimeout time.Duration // how long an app may go without sending a message, pongs aside, before it is closed; zero means forever
+
+	MaxApps int // app connections open at once, more are answered with 503; zero means no limit
+
+	SessionTTL time.Duration // how long a disconnected app's session may be resumed, the stream not ending meanwhile; zero forgets it at once
+
+	EventSchemaFile string // JSON Schema app messages must match, no validation when empty
+
+	MaxMessageBytes   int // largest message accepted from the app, zero means no limit
+	MaxChunkSize      int // payloads above this many bytes are sent as chunk frames, zero disables chunking
+	CompressThreshold int // payloads above this many bytes are gzipped, zero disables compression
+
+	Codec        string // wire format offered to providers, CodecJSON or CodecMessagePack; JSON is used with providers that don't pick MessagePack
+	BinaryFrames bool   // send provider messages as binary rather than text frames, always the case for MessagePack
+	Compression  bool   // offer permessage-deflate to providers and accept it from apps
+	AppNDJSON    bool   // JSON text frames from apps may carry several events, one per line
+
+	ProviderSubprotocols []string // subprotocols WebSocket providers are dialed with instead of the codec's, one of which they must select; JSON is spoken unless that is the MessagePack one
+	AppSubprotocols      []string // subprotocols apps are offered instead of the codec's, one of which they must ask for
+
+	BatchSize     int           // events grouped into one message, 0 or 1 disables batching
+	FlushInterval time.Duration // longest a partial batch waits for more events
+
+	RequireAcks bool          // keep events buffered until the provider acknowledges them
+	AckTimeout  time.Duration // resend events not acknowledged within this long, zero waits for a reconnect
+	MaxInFlight int           // events a provider may have unacknowledged before no more are sent to it, zero means no limit
+
+	StrictFailover bool // a backup taking over waits for the failed provider's last acks and resumes at its first unacknowledged event, events going out in buffer order regardless of priority; needs acks required and one connection per provider
+
+	SendTimeout     time.Duration // longest writing one event or batch to a provider may take before it is dead-lettered and the connection replaced, zero means no limit
+	ShutdownTimeout time.Duration // longest Drain waits and Close takes before connections are closed under stuck workers, zero means no limit
+
+	MaxSendAttempts int // times an event is sent to a provider without being acknowledged before it is dead-lettered, zero retries forever
+	DeadLetterSize  int // dead letters kept for inspection and requeueing, the oldest go first once full
+
+	ProviderConnections int // connections opened to each provider, events going out over whichever is free; above 1 events may arrive out of order, see Event.Seq
+
+	BreakerFailures int           // consecutive failed dials after which a provider is left alone for BreakerCooldown, zero disables the breaker
+	BreakerCooldown time.Duration // how long an open breaker holds dials back before a trial dial
+
+	WriteErrorThreshold int           // failed writes to a provider in a row after which each retry waits a cooldown and probes the connection, replacing it only if the probe fails; zero reconnects at once
+	WriteCooldown       time.Duration // first such pause, doubling with every further failed write
+	WriteMaxCooldown    time.Duration // longest such pause
+
+	FinalCloseCodes []int // close codes a provider saying it is done with us closes with, after which it isn't dialed again until a restart; other closes are reconnected after
+
+	ProxyURL         string        // http:// or socks5:// proxy providers are dialed through, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored when empty
+	HandshakeTimeout time.Duration // how long connecting to a provider, handshake included, may take before it is retried; zero means no limit
+
+	ProviderHeaders   map[string]string // headers sent on every provider handshake
+	ProviderTokenFile string            // file holding a bearer token, re-read on every dial so it can be rotated
+
+	AllowedOrigins []string // Origin patterns apps may connect with, see originMatcher; same-origin only when empty
+	AppToken       string   // token apps must present, no authentication when empty
+	AppTokenFile   string   // file holding the app token, re-read on every connection; overrides AppToken
+
+	AdminToken     string // bearer token admin endpoints such as /drain require, which are refused when empty
+	AdminTokenFile string // file holding the admin token, re-read on every request; overrides AdminToken
+
+	TLSCAFile             string // PEM bundle wss:// providers are verified against instead of the system roots
+	TLSCertFile           string // PEM client certificate presented to providers
+	TLSKeyFile            string // PEM key of the client certificate
+	TLSInsecureSkipVerify bool   // accept any provider certificate, for testing only
+
+	ServerCertFile string // PEM certificate the app-facing server serves TLS with, plain HTTP when empty
+	ServerKeyFile  string // PEM key of the server certificate
+
+	LogLevel slog.Level // least severe level logged by the default logger
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:          ":8080",
+		MainProviderURL:     "ws://provider/main",
+		BackupProviderURL:   "ws://provider/backup",
+		BufferSize:          10000,
+		DropPolicy:          DropOldest,
+		DedupWindow:         10000,
+		IngestWindow:        1000,
+		IngestTimeout:       30 * time.Second,
+		RateLimit:           100,
+		RateLimitInterval:   time.Hour,
+		PingInterval:        30 * time.Second,
+		PongTimeout:         30 * time.Second,
+		ProbeFailures:       3,
+		WriteTimeout:        10 * time.Second,
+		ReadTimeout:         90 * time.Second,
+		SessionTTL:          time.Minute,
+		MaxMessageBytes:     16 << 20,
+		FlushInterval:       100 * time.Millisecond,
+		AckTimeout:          30 * time.Second,
+		SendTimeout:         5 * time.Minute,
+		ShutdownTimeout:     30 * time.Second,
+		PriorityAging:       time.Second,
+		HandshakeTimeout:    45 * time.Second,
+		Codec:               CodecJSON,
+		DeadLetterSize:      1000,
+		ProviderConnections: 1,
+		BreakerCooldown:     30 * time.Second,
+		WriteCooldown:       time.Second,
+		WriteMaxCooldown:    time.Minute,
+		FinalCloseCodes:     []int{1000}, // normal closure
+	}
+}
+
+// LoadConfig reads the configuration from GOCHUNKER_* environment
+// variables, falling back to DefaultConfig for anything unset
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+	if v := os.Getenv("GOCHUNKER_LISTEN"); v != "" {
+		cfg.ListenAddr = v
+	}
+	if v := os.Getenv("GOCHUNKER_MAIN_URL"); v != "" {
+		cfg.MainProviderURL = v
+	}
+	if v := os.Getenv("GOCHUNKER_BACKUP_URL"); v != "" {
+		cfg.BackupProviderURL = v
+	}
+	if v := os.Getenv("GOCHUNKER_BACKUP_URLS"); v != "" {
+		cfg.BackupProviderURLs = parseList(v)
+	}
+	if v := os.Getenv("GOCHUNKER_PROVIDER_URLS"); v != "" {
+		cfg.ProviderURLs = parseList(v)
+	}
+	if v := os.Getenv("GOCHUNKER_POOL_STRATEGY"); v != "" {
+		strategy, err := ParsePoolStrategy(v)
+		if err != nil {
+			return cfg, fmt.Errorf("GOCHUNKER_POOL_STRATEGY: %w", err)
+		}
+		cfg.PoolStrategy = strategy
+	}
+	if err := envInt("GOCHUNKER_BUFFER_SIZE", &cfg.BufferSize); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_MAX_BUFFER_BYTES", &cfg.MaxBufferBytes); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_DROP_POLICY"); v != "" {
+		policy, err := ParseDropPolicy(v)
+		if err != nil {
+			return cfg, fmt.Errorf("GOCHUNKER_DROP_POLICY: %w", err)
+		}
+		cfg.DropPolicy = policy
+	}
+	if err := envInt("GOCHUNKER_OUTBOUND_QUEUE_SIZE", &cfg.OutboundQueueSize); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_OUTBOUND_POLICY"); v != "" {
+		policy, err := ParseOutboundPolicy(v)
+		if err != nil {
+			return cfg, fmt.Errorf("GOCHUNKER_OUTBOUND_POLICY: %w", err)
+		}
+		cfg.OutboundPolicy = policy
+	}
+	if err := envInt("GOCHUNKER_DEDUP_WINDOW", &cfg.DedupWindow); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_COALESCE_KEY"); v != "" {
+		cfg.CoalesceKey = v
+	}
+	if v := os.Getenv("GOCHUNKER_INGEST_POLICY"); v != "" {
+		policy, err := ParseIngestPolicy(v)
+		if err != nil {
+			return cfg, fmt.Errorf("GOCHUNKER_INGEST_POLICY: %w", err)
+		}
+		cfg.IngestPolicy = policy
+	}
+	if err := envInt("GOCHUNKER_INGEST_WINDOW", &cfg.IngestWindow); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_INGEST_TIMEOUT", &cfg.IngestTimeout); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_BUFFER_HIGH_WATER", &cfg.BufferHighWater); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_BUFFER_LOW_WATER", &cfg.BufferLowWater); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_WAL_PATH"); v != "" {
+		cfg.WALPath = v
+	}
+	if err := envBool("GOCHUNKER_WAL_SYNC", &cfg.WALSync); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_WAL_SEGMENT_SIZE", &cfg.WALSegmentSize); err != nil {
+		return cfg, err
+	}
+	if err := envBool("GOCHUNKER_WAL_COMPRESS", &cfg.WALCompress); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_WAL_RETAIN_SEGMENTS", &cfg.WALRetainSegments); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_RATE_LIMIT", &cfg.RateLimit); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_RATE_LIMIT_INTERVAL", &cfg.RateLimitInterval); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_PROVIDER_RATE_LIMITS"); v != "" {
+		limits, err := parseRateLimits(v, "provider")
+		if err != nil {
+			return cfg, fmt.Errorf("GOCHUNKER_PROVIDER_RATE_LIMITS: %w", err)
+		}
+		cfg.ProviderRateLimits = limits
+	}
+	if v := os.Getenv("GOCHUNKER_TYPE_RATE_LIMITS"); v != "" {
+		limits, err := parseRateLimits(v, "type")
+		if err != nil {
+			return cfg, fmt.Errorf("GOCHUNKER_TYPE_RATE_LIMITS: %w", err)
+		}
+		cfg.TypeRateLimits = limits
+	}
+	if v := os.Getenv("GOCHUNKER_BYPASS_TYPES"); v != "" {
+		cfg.BypassTypes = parseList(v)
+	}
+	if err := envInt("GOCHUNKER_BYPASS_WARN_LIMIT", &cfg.BypassWarnLimit); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_EVENT_TTL", &cfg.EventTTL); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_PRIORITY_AGING", &cfg.PriorityAging); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_HEARTBEAT_INTERVAL", &cfg.HeartbeatInterval); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_PROBE_INTERVAL", &cfg.ProbeInterval); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_PROBE_FAILURES", &cfg.ProbeFailures); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_PING_INTERVAL", &cfg.PingInterval); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_PONG_TIMEOUT", &cfg.PongTimeout); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_WRITE_TIMEOUT", &cfg.WriteTimeout); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_READ_TIMEOUT", &cfg.ReadTimeout); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_APP_IDLE_TIMEOUT", &cfg.AppIdleTimeout); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_MAX_APPS", &cfg.MaxApps); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_SESSION_TTL", &cfg.SessionTTL); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_EVENT_SCHEMA_FILE"); v != "" {
+		cfg.EventSchemaFile = v
+	}
+	if err := envInt("GOCHUNKER_MAX_MESSAGE_BYTES", &cfg.MaxMessageBytes); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_MAX_CHUNK_SIZE", &cfg.MaxChunkSize); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_COMPRESS_THRESHOLD", &cfg.CompressThreshold); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_CODEC"); v != "" {
+		cfg.Codec = v
+	}
+	if err := envBool("GOCHUNKER_BINARY_FRAMES", &cfg.BinaryFrames); err != nil {
+		return cfg, err
+	}
+	if err := envBool("GOCHUNKER_WS_COMPRESSION", &cfg.Compression); err != nil {
+		return cfg, err
+	}
+	if err := envBool("GOCHUNKER_APP_NDJSON", &cfg.AppNDJSON); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_PROVIDER_SUBPROTOCOLS"); v != "" {
+		cfg.ProviderSubprotocols = parseList(v)
+	}
+	if v := os.Getenv("GOCHUNKER_APP_SUBPROTOCOLS"); v != "" {
+		cfg.AppSubprotocols = parseList(v)
+	}
+	if err := envInt("GOCHUNKER_BATCH_SIZE", &cfg.BatchSize); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_FLUSH_INTERVAL", &cfg.FlushInterval); err != nil {
+		return cfg, err
+	}
+	if err := envBool("GOCHUNKER_REQUIRE_ACKS", &cfg.RequireAcks); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_ACK_TIMEOUT", &cfg.AckTimeout); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_MAX_IN_FLIGHT", &cfg.MaxInFlight); err != nil {
+		return cfg, err
+	}
+	if err := envBool("GOCHUNKER_STRICT_FAILOVER", &cfg.StrictFailover); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_SEND_TIMEOUT", &cfg.SendTimeout); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_MAX_SEND_ATTEMPTS", &cfg.MaxSendAttempts); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_DEAD_LETTER_SIZE", &cfg.DeadLetterSize); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_PROVIDER_CONNECTIONS", &cfg.ProviderConnections); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_BREAKER_FAILURES", &cfg.BreakerFailures); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_BREAKER_COOLDOWN", &cfg.BreakerCooldown); err != nil {
+		return cfg, err
+	}
+	if err := envInt("GOCHUNKER_WRITE_ERRORS", &cfg.WriteErrorThreshold); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_WRITE_COOLDOWN", &cfg.WriteCooldown); err != nil {
+		return cfg, err
+	}
+	if err := envDuration("GOCHUNKER_WRITE_MAX_COOLDOWN", &cfg.WriteMaxCooldown); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_FINAL_CLOSE_CODES"); v != "" {
+		codes, err := parseCloseCodes(v)
+		if err != nil {
+			return cfg, fmt.Errorf("GOCHUNKER_FINAL_CLOSE_CODES: %w", err)
+		}
+		cfg.FinalCloseCodes = codes
+	}
+	if v := os.Getenv("GOCHUNKER_PROXY_URL"); v != "" {
+		cfg.ProxyURL = v
+	}
+	if err := envDuration("GOCHUNKER_HANDSHAKE_TIMEOUT", &cfg.HandshakeTimeout); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_PROVIDER_HEADERS"); v != "" {
+		headers, err := parseHeaders(v)
+		if err != nil {
+			return cfg, fmt.Errorf("GOCHUNKER_PROVIDER_HEADERS: %w", err)
+		}
+		cfg.ProviderHeaders = headers
+	}
+	if v := os.Getenv("GOCHUNKER_PROVIDER_TOKEN_FILE"); v != "" {
+		cfg.ProviderTokenFile = v
+	}
+	if v := os.Getenv("GOCHUNKER_ALLOWED_ORIGINS"); v != "" {
+		cfg.AllowedOrigins = parseList(v)
+	}
+	if v := os.Getenv("GOCHUNKER_APP_TOKEN"); v != "" {
+		cfg.AppToken = v
+	}
+	if v := os.Getenv("GOCHUNKER_APP_TOKEN_FILE"); v != "" {
+		cfg.AppTokenFile = v
+	}
+	if v := os.Getenv("GOCHUNKER_ADMIN_TOKEN"); v != "" {
+		cfg.AdminToken = v
+	}
+	if v := os.Getenv("GOCHUNKER_ADMIN_TOKEN_FILE"); v != "" {
+		cfg.AdminTokenFile = v
+	}
+	if v := os.Getenv("GOCHUNKER_TLS_CA_FILE"); v != "" {
+		cfg.TLSCAFile = v
+	}
+	if v := os.Getenv("GOCHUNKER_TLS_CERT_FILE"); v != "" {
+		cfg.TLSCertFile = v
+	}
+	if v := os.Getenv("GOCHUNKER_TLS_KEY_FILE"); v != "" {
+		cfg.TLSKeyFile = v
+	}
+	if err := envBool("GOCHUNKER_TLS_INSECURE_SKIP_VERIFY", &cfg.TLSInsecureSkipVerify); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("GOCHUNKER_SERVER_CERT_FILE"); v != "" {
+		cfg.ServerCertFile = v
+	}
+	if v := os.Getenv("GOCHUNKER_SERVER_KEY_FILE"); v != "" {
+		cfg.ServerKeyFile = v
+	}
+	if v := os.Getenv("GOCHUNKER_LOG_LEVEL"); v != "" {
+		if err := cfg.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			return cfg, fmt.Errorf("GOCHUNKER_LOG_LEVEL: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// envInt parses the environment variable name into n if it is set
+func envInt(name string, n *int) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*n = parsed
+	return nil
+}
+
+// envBool parses the environment variable name into b if it is set
+func envBool(name string, b *bool) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*b = parsed
+	return nil
+}
+
+// envDuration parses the environment variable name into d if it is set
+func envDuration(name string, d *time.Duration) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*d = parsed
+	return nil
+}
+
+// parseRateLimits parses a comma separated list of key:limit pairs, what
+// naming the keys in errors: an event type or a provider
+func parseRateLimits(s, what string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range parseList(s) {
+		key, v, ok := strings.Cut(pair, ":")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("rate limit %q is not of the form %s:limit", pair, what)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("rate limit of %s %q: %w", what, key, err)
+		}
+		limits[strings.TrimSpace(key)] = limit
+	}
+	return limits, nil
+}
+
+// Validate checks that the configuration is usable
+func (cfg Config) Validate() error {
+	if cfg.ListenAddr == "" {
+		return fmt.Errorf("listen address is empty")
+	}
+	if len(cfg.ProviderURLs) > 0 {
+		for i, u := range cfg.ProviderURLs {
+			if err := validateProviderURL(u); err != nil {
+				return fmt.Errorf("provider %d: %w", i, err)
+			}
+		}
+	} else {
+		if err := validateProviderURL(cfg.MainProviderURL); err != nil {
+			return fmt.Errorf("main provider: %w", err)
+		}
+		for i, u := range cfg.BackupProviderURLs {
+			if err := validateProviderURL(u); err != nil {
+				return fmt.Errorf("backup provider %d: %w", i+1, err)
+			}
+		}
+		if len(cfg.BackupProviderURLs) == 0 {
+			if err := validateProviderURL(cfg.BackupProviderURL); err != nil {
+				return fmt.Errorf("backup provider: %w", err)
+			}
+		}
+	}
+	if _, err := ParsePoolStrategy(cfg.PoolStrategy.String()); err != nil {
+		return err
+	}
+	if cfg.BufferSize <= 0 {
+		return fmt.Errorf("buffer size must be positive, got %d", cfg.BufferSize)
+	}
+	if cfg.MaxBufferBytes < 0 {
+		return fmt.Errorf("max buffer bytes must not be negative, got %d", cfg.MaxBufferBytes)
+	}
+	if cfg.DropPolicy != DropOldest && cfg.DropPolicy != RejectNewest {
+		return fmt.Errorf("invalid drop policy %v", cfg.DropPolicy)
+	}
+	if cfg.OutboundQueueSize < 0 {
+		return fmt.Errorf("outbound queue size must not be negative, got %d", cfg.OutboundQueueSize)
+	}
+	if cfg.OutboundPolicy != OutboundBlock && cfg.OutboundPolicy != OutboundDrop {
+		return fmt.Errorf("invalid outbound policy %v", cfg.OutboundPolicy)
+	}
+	if cfg.IngestPolicy != IngestBuffer && cfg.IngestPolicy != IngestCoupled {
+		return fmt.Errorf("invalid ingest policy %v", cfg.IngestPolicy)
+	}
+	if cfg.IngestPolicy == IngestCoupled && cfg.IngestWindow <= 0 {
+		return fmt.Errorf("coupled ingest needs a positive ingest window, got %d", cfg.IngestWindow)
+	}
+	if cfg.IngestTimeout < 0 {
+		return fmt.Errorf("ingest timeout must not be negative, got %s", cfg.IngestTimeout)
+	}
+	if cfg.DedupWindow < 0 {
+		return fmt.Errorf("dedup window must not be negative, got %d", cfg.DedupWindow)
+	}
+	if cfg.BufferHighWater < 0 || cfg.BufferHighWater > cfg.BufferSize {
+		return fmt.Errorf("buffer high-water mark must be between 0 and the buffer size %d, got %d", cfg.BufferSize, cfg.BufferHighWater)
+	}
+	if cfg.BufferHighWater > 0 && (cfg.BufferLowWater < 0 || cfg.BufferLowWater >= cfg.BufferHighWater) {
+		return fmt.Errorf("buffer low-water mark must be at least 0 and below the high-water mark %d, got %d", cfg.BufferHighWater, cfg.BufferLowWater)
+	}
+	if cfg.WALSegmentSize < 0 {
+		return fmt.Errorf("log segment size must not be negative, got %d", cfg.WALSegmentSize)
+	}
+	if cfg.WALRetainSegments < 0 {
+		return fmt.Errorf("retained log segments must not be negative, got %d", cfg.WALRetainSegments)
+	}
+	if cfg.WALSegmentSize == 0 && (cfg.WALCompress || cfg.WALRetainSegments > 0) {
+		return fmt.Errorf("compressing or retaining log segments needs a segment size")
+	}
+	if cfg.RateLimit < 0 || (cfg.RateLimit == 0 && len(cfg.ProviderRateLimits) == 0) {
+		return fmt.Errorf("rate limit must be positive, got %d", cfg.RateLimit)
+	}
+	if cfg.RateLimitInterval <= 0 {
+		return fmt.Errorf("rate limit interval must be positive, got %s", cfg.RateLimitInterval)
+	}
+	if len(cfg.ProviderRateLimits) > 0 {
+		names := make(map[string]bool)
+		for _, p := range poolMembers(cfg) {
+			names[p.name] = true
+		}
+		for name, limit := range cfg.ProviderRateLimits {
+			if !names[name] {
+				return fmt.Errorf("rate limit of unknown provider %q", name)
+			}
+			if limit <= 0 {
+				return fmt.Errorf("rate limit of provider %q must be positive, got %d", name, limit)
+			}
+		}
+	}
+	for eventType, limit := range cfg.TypeRateLimits {
+		if limit <= 0 {
+			return fmt.Errorf("rate limit of type %q must be positive, got %d", eventType, limit)
+		}
+	}
+	if cfg.BypassWarnLimit < 0 {
+		return fmt.Errorf("bypass warn limit must not be negative, got %d", cfg.BypassWarnLimit)
+	}
+	if cfg.EventTTL < 0 {
+		return fmt.Errorf("event TTL must not be negative, got %s", cfg.EventTTL)
+	}
+	if cfg.PriorityAging < 0 {
+		return fmt.Errorf("priority aging must not be negative, got %s", cfg.PriorityAging)
+	}
+	if cfg.HeartbeatInterval < 0 {
+		return fmt.Errorf("heartbeat interval must not be negative, got %s", cfg.HeartbeatInterval)
+	}
+	if cfg.ProbeInterval < 0 {
+		return fmt.Errorf("probe interval must not be negative, got %s", cfg.ProbeInterval)
+	}
+	if cfg.ProbeInterval > 0 && cfg.ProbeFailures < 1 {
+		return fmt.Errorf("probe failures must be at least 1 when probing, got %d", cfg.ProbeFailures)
+	}
+	if cfg.PingInterval > 0 && cfg.PongTimeout <= 0 {
+		return fmt.Errorf("pong timeout must be positive when pinging, got %s", cfg.PongTimeout)
+	}
+	if cfg.ReadTimeout > 0 && cfg.PingInterval >= cfg.ReadTimeout {
+		// an idle app would be cut off before its first pong could arrive
+		return fmt.Errorf("read timeout %s must exceed ping interval %s", cfg.ReadTimeout, cfg.PingInterval)
+	}
+	if cfg.AppIdleTimeout < 0 {
+		return fmt.Errorf("app idle timeout must not be negative, got %s", cfg.AppIdleTimeout)
+	}
+	if cfg.MaxApps < 0 {
+		return fmt.Errorf("max apps must not be negative, got %d", cfg.MaxApps)
+	}
+	if cfg.SessionTTL < 0 {
+		return fmt.Errorf("session TTL must not be negative, got %s", cfg.SessionTTL)
+	}
+	if cfg.MaxMessageBytes < 0 {
+		return fmt.Errorf("max message bytes must not be negative, got %d", cfg.MaxMessageBytes)
+	}
+	if cfg.MaxChunkSize < 0 {
+		return fmt.Errorf("max chunk size must not be negative, got %d", cfg.MaxChunkSize)
+	}
+	if err := checkCodec(cfg.Codec); err != nil {
+		return err
+	}
+	if err := checkSubprotocols(cfg.ProviderSubprotocols); err != nil {
+		return fmt.Errorf("provider subprotocols: %w", err)
+	}
+	if err := checkSubprotocols(cfg.AppSubprotocols); err != nil {
+		return fmt.Errorf("app subprotocols: %w", err)
+	}
+	if cfg.BatchSize > 1 && cfg.FlushInterval <= 0 {
+		return fmt.Errorf("flush interval must be positive when batching, got %s", cfg.FlushInterval)
+	}
+	if cfg.AckTimeout < 0 {
+		return fmt.Errorf("ack timeout must not be negative, got %s", cfg.AckTimeout)
+	}
+	if cfg.MaxInFlight < 0 {
+		return fmt.Errorf("max in flight must not be negative, got %d", cfg.MaxInFlight)
+	}
+	// Without acks nothing is in flight, and without an ack timeout a
+	// provider that stops acking would hold its events back for good
+	if cfg.MaxInFlight > 0 && (!cfg.RequireAcks || cfg.AckTimeout <= 0) {
+		return fmt.Errorf("max in flight needs acks required and a positive ack timeout")
+	}
+	if cfg.SendTimeout < 0 {
+		return fmt.Errorf("send timeout must not be negative, got %s", cfg.SendTimeout)
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown timeout must not be negative, got %s", cfg.ShutdownTimeout)
+	}
+	if cfg.MaxSendAttempts < 0 {
+		return fmt.Errorf("max send attempts must not be negative, got %d", cfg.MaxSendAttempts)
+	}
+	if cfg.ProviderConnections < 0 {
+		return fmt.Errorf("provider connections must not be negative, got %d", cfg.ProviderConnections)
+	}
+	// Only acks tell which events got through, and lanes deliver out of
+	// order
+	if cfg.StrictFailover && (!cfg.RequireAcks || cfg.ProviderConnections > 1) {
+		return fmt.Errorf("strict failover needs acks required and a single connection per provider")
+	}
+	if cfg.DeadLetterSize <= 0 {
+		return fmt.Errorf("dead letter size must be positive, got %d", cfg.DeadLetterSize)
+	}
+	if cfg.BreakerFailures < 0 {
+		return fmt.Errorf("breaker failures must not be negative, got %d", cfg.BreakerFailures)
+	}
+	if cfg.BreakerFailures > 0 && cfg.BreakerCooldown <= 0 {
+		return fmt.Errorf("breaker cooldown must be positive with a breaker, got %s", cfg.BreakerCooldown)
+	}
+	if cfg.WriteErrorThreshold < 0 {
+		return fmt.Errorf("write error threshold must not be negative, got %d", cfg.WriteErrorThreshold)
+	}
+	if cfg.WriteErrorThreshold > 0 && (cfg.WriteCooldown <= 0 || cfg.WriteMaxCooldown < cfg.WriteCooldown) {
+		return fmt.Errorf("write cooldown must be positive and at most the max cooldown %s, got %s", cfg.WriteMaxCooldown, cfg.WriteCooldown)
+	}
+	for _, code := range cfg.FinalCloseCodes {
+		if code < 1000 || code > 4999 {
+			return fmt.Errorf("final close code must be between 1000 and 4999, got %d", code)
+		}
+	}
+	if cfg.ProxyURL != "" {
+		if _, err := parseProxyURL(cfg.ProxyURL); err != nil {
+			return err
+		}
+	}
+	if cfg.HandshakeTimeout < 0 {
+		return fmt.Errorf("handshake timeout must not be negative, got %s", cfg.HandshakeTimeout)
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("client certificate and key must be set together")
+	}
+	if (cfg.ServerCertFile == "") != (cfg.ServerKeyFile == "") {
+		return fmt.Errorf("server certificate and key must be set together")
+	}
+	return nil
+}
+
+// parseProxyURL parses the URL of a proxy the WebSocket dialer can tunnel
+// through
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %w", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "socks5" {
+		return nil, fmt.Errorf("proxy URL %q must use http or socks5, not %q", raw, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", raw)
+	}
+	return u, nil
+}
+
+func validateProviderURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "ws", "wss", "http", "https":
+	default:
+		return fmt.Errorf("URL %q must use ws, wss, http or https, not %q", raw, u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("URL %q has no host", raw)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package gochunker
+
+import (
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, DefaultConfig()) {
+		t.Fatalf("LoadConfig without environment = %+v, want the defaults", cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("defaults don't validate: %v", err)
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	t.Setenv("GOCHUNKER_LISTEN", ":9090")
+	t.Setenv("GOCHUNKER_MAIN_URL", "wss://main.example/ws")
+	t.Setenv("GOCHUNKER_BACKUP_URL", "ws://backup.example/ws")
+	t.Setenv("GOCHUNKER_BUFFER_SIZE", "50")
+	t.Setenv("GOCHUNKER_DROP_POLICY", "reject-newest")
+	t.Setenv("GOCHUNKER_RATE_LIMIT_INTERVAL", "1m")
+	t.Setenv("GOCHUNKER_REQUIRE_ACKS", "true")
+	t.Setenv("GOCHUNKER_LOG_LEVEL", "debug")
+	t.Setenv("GOCHUNKER_BYPASS_TYPES", "heartbeat, emergency")
+	t.Setenv("GOCHUNKER_BYPASS_WARN_LIMIT", "100")
+	t.Setenv("GOCHUNKER_SESSION_TTL", "5m")
+	t.Setenv("GOCHUNKER_APP_IDLE_TIMEOUT", "2m")
+	t.Setenv("GOCHUNKER_MAX_APPS", "100")
+	t.Setenv("GOCHUNKER_INGEST_POLICY", "coupled")
+	t.Setenv("GOCHUNKER_INGEST_WINDOW", "50")
+	t.Setenv("GOCHUNKER_INGEST_TIMEOUT", "5s")
+	t.Setenv("GOCHUNKER_COALESCE_KEY", "key")
+	t.Setenv("GOCHUNKER_PROVIDER_RATE_LIMITS", "Main:50, Backup:10")
+	t.Setenv("GOCHUNKER_BREAKER_FAILURES", "5")
+	t.Setenv("GOCHUNKER_MAX_IN_FLIGHT", "64")
+	t.Setenv("GOCHUNKER_SEND_TIMEOUT", "2m")
+	t.Setenv("GOCHUNKER_SHUTDOWN_TIMEOUT", "10s")
+	t.Setenv("GOCHUNKER_APP_NDJSON", "true")
+	t.Setenv("GOCHUNKER_FINAL_CLOSE_CODES", "1000, 4000")
+	t.Setenv("GOCHUNKER_WAL_SEGMENT_SIZE", "1048576")
+	t.Setenv("GOCHUNKER_WAL_COMPRESS", "true")
+	t.Setenv("GOCHUNKER_WAL_RETAIN_SEGMENTS", "2")
+	t.Setenv("GOCHUNKER_PROBE_INTERVAL", "15s")
+	t.Setenv("GOCHUNKER_PROBE_FAILURES", "5")
+	t.Setenv("GOCHUNKER_MAX_BUFFER_BYTES", "65536")
+	t.Setenv("GOCHUNKER_WRITE_ERRORS", "4")
+	t.Setenv("GOCHUNKER_WRITE_COOLDOWN", "2s")
+	t.Setenv("GOCHUNKER_WRITE_MAX_COOLDOWN", "30s")
+	t.Setenv("GOCHUNKER_STRICT_FAILOVER", "true")
+	t.Setenv("GOCHUNKER_PROVIDER_SUBPROTOCOLS", "v2.feed, v1.feed")
+	t.Setenv("GOCHUNKER_APP_SUBPROTOCOLS", "events.v1")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.ListenAddr = ":9090"
+	want.MainProviderURL = "wss://main.example/ws"
+	want.BackupProviderURL = "ws://backup.example/ws"
+	want.BufferSize = 50
+	want.DropPolicy = RejectNewest
+	want.RateLimitInterval = time.Minute
+	want.RequireAcks = true
+	want.LogLevel = slog.LevelDebug
+	want.BypassTypes = []string{"heartbeat", "emergency"}
+	want.BypassWarnLimit = 100
+	want.SessionTTL = 5 * time.Minute
+	want.AppIdleTimeout = 2 * time.Minute
+	want.MaxApps = 100
+	want.IngestPolicy = IngestCoupled
+	want.IngestWindow = 50
+	want.IngestTimeout = 5 * time.Second
+	want.CoalesceKey = "key"
+	want.ProviderRateLimits = map[string]int{"Main": 50, "Backup": 10}
+	want.BreakerFailures = 5
+	want.MaxInFlight = 64
+	want.SendTimeout = 2 * time.Minute
+	want.ShutdownTimeout = 10 * time.Second
+	want.AppNDJSON = true
+	want.FinalCloseCodes = []int{1000, 4000}
+	want.WALSegmentSize = 1 << 20
+	want.WALCompress = true
+	want.WALRetainSegments = 2
+	want.ProbeInterval = 15 * time.Second
+	want.ProbeFailures = 5
+	want.MaxBufferBytes = 64 << 10
+	want.WriteErrorThreshold = 4
+	want.WriteCooldown = 2 * time.Second
+	want.WriteMaxCooldown = 30 * time.Second
+	want.StrictFailover = true
+	want.ProviderSubprotocols = []string{"v2.feed", "v1.feed"}
+	want.AppSubprotocols = []string{"events.v1"}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("LoadConfig = %+v\nwant %+v", cfg, want)
+	}
+}
+
+func TestLoadConfigRejectsMalformedEnv(t *testing.T) {
+	for name, value := range map[string]string{
+		"GOCHUNKER_BUFFER_SIZE":          "lots",
+		"GOCHUNKER_DROP_POLICY":          "drop-random",
+		"GOCHUNKER_PING_INTERVAL":        "30",
+		"GOCHUNKER_WS_COMPRESSION":       "maybe",
+		"GOCHUNKER_LOG_LEVEL":            "chatty",
+		"GOCHUNKER_TYPE_RATE_LIMITS":     "bulk",
+		"GOCHUNKER_BUFFER_HIGH_WATER":    "high",
+		"GOCHUNKER_HEARTBEAT_INTERVAL":   "often",
+		"GOCHUNKER_HANDSHAKE_TIMEOUT":    "soon",
+		"GOCHUNKER_BYPASS_WARN_LIMIT":    "many",
+		"GOCHUNKER_MAX_SEND_ATTEMPTS":    "a few",
+		"GOCHUNKER_DEAD_LETTER_SIZE":     "big",
+		"GOCHUNKER_PROVIDER_CONNECTIONS": "two",
+		"GOCHUNKER_SESSION_TTL":          "forever",
+		"GOCHUNKER_APP_IDLE_TIMEOUT":     "idle",
+		"GOCHUNKER_MAX_APPS":             "many",
+		"GOCHUNKER_INGEST_POLICY":        "throttle",
+		"GOCHUNKER_INGEST_WINDOW":        "wide",
+		"GOCHUNKER_INGEST_TIMEOUT":       "soon",
+		"GOCHUNKER_PROVIDER_RATE_LIMITS": "Main",
+		"GOCHUNKER_BREAKER_COOLDOWN":     "a while",
+		"GOCHUNKER_MAX_IN_FLIGHT":        "some",
+		"GOCHUNKER_SEND_TIMEOUT":         "slowly",
+		"GOCHUNKER_SHUTDOWN_TIMEOUT":     "later",
+		"GOCHUNKER_APP_NDJSON":           "lines",
+		"GOCHUNKER_FINAL_CLOSE_CODES":    "normal",
+		"GOCHUNKER_WAL_SEGMENT_SIZE":     "1MB",
+		"GOCHUNKER_WAL_COMPRESS":         "gz",
+		"GOCHUNKER_WAL_RETAIN_SEGMENTS":  "few",
+		"GOCHUNKER_PROBE_INTERVAL":       "often",
+		"GOCHUNKER_PROBE_FAILURES":       "some",
+		"GOCHUNKER_MAX_BUFFER_BYTES":     "64KB",
+		"GOCHUNKER_WRITE_ERRORS":         "lots",
+		"GOCHUNKER_WRITE_COOLDOWN":       "a bit",
+		"GOCHUNKER_WRITE_MAX_COOLDOWN":   "long",
+		"GOCHUNKER_STRICT_FAILOVER":      "strictly",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := LoadConfig(); err == nil {
+				t.Fatalf("%s=%s accepted", name, value)
+			}
+		})
+	}
+}
+
+func TestValidateProviderURLs(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, raw := range []string{"ftp://main.example", "ws://", "http://", "::"} {
+		cfg.MainProviderURL = raw
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("main provider %q accepted", raw)
+		}
+	}
+	// HTTP providers take an NDJSON stream
+	for _, raw := range []string{"http://main.example/events", "https://main.example"} {
+		cfg.MainProviderURL = raw
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("main provider %q rejected: %v", raw, err)
+		}
+	}
+}
+
+func TestValidateProxyURL(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, raw := range []string{"ftp://proxy.example:21", "http://", "::"} {
+		cfg.ProxyURL = raw
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("proxy %q accepted", raw)
+		}
+	}
+}
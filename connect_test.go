@@ -0,0 +1,78 @@
+package gochunker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFailedAppUpgradeIsAnswered(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+
+	// A plain GET lacks the upgrade headers
+	resp, err := http.Get(srv.URL + "/app/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 400 {
+		t.Fatalf("failed upgrade answered %s", resp.Status)
+	}
+	// and the controller keeps serving apps
+	sendEvents(t, dialApp(t, c), "e", 1)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatal("event not sent after a failed upgrade")
+	}
+}
+
+func TestConnectProviderRetries(t *testing.T) {
+	fp := newFakeProvider(t)
+	fp.refuse = 3
+	cfg := DefaultConfig()
+	cfg.MainProviderURL, cfg.BackupProviderURL = fp.url(), fp.url()
+	c, err := NewController(cfg, WithLogger(quietLogger), withBackoffBase(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+
+	conn, err := c.connectProvider(c.pool.members[0], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if fp.dials != 4 {
+		t.Fatalf("dialed %d times, want 3 refusals and a success", fp.dials)
+	}
+}
+
+func TestConnectProviderStopsWithController(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MainProviderURL, cfg.BackupProviderURL = "ws://127.0.0.1:1/main", "ws://127.0.0.1:1/backup"
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.connectProvider(c.pool.members[0], false)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close(context.Background())
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("connectProvider returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connectProvider kept retrying after Close")
+	}
+}
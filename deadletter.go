@@ -0,0 +1,152 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DeadLetter is an event the controller gave up on, with why and when:
+// one a provider never acknowledged or one that failed validation
+type DeadLetter struct {
+	Event  Event     `json:"event"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// deadLetterLocked adds event to the dead letters, dropping the oldest if
+// DeadLetterSize are already kept. provider names the provider that gave up
+// on event, if any. c.mu must be held.
+func (c *Controller) deadLetterLocked(provider string, event Event, reason string) {
+	if len(c.deadLetters) >= c.cfg.DeadLetterSize {
+		old := c.deadLetters[0]
+		c.deadLetters = c.deadLetters[1:]
+		c.log.Warn("dead letter queue full, dropped oldest", "event_id", old.Event.ID, "size", c.cfg.DeadLetterSize)
+	}
+	c.deadLetters = append(c.deadLetters, DeadLetter{Event: event, Reason: reason, At: c.now()})
+	c.deadLettered++
+	c.metrics.deadLettered.WithLabelValues(provider).Inc()
+	c.log.Warn("dead-lettered event", "provider", provider, "event_id", event.ID, "reason", reason)
+	c.notifyLocked(event, appNotice{Type: "deadletter", Provider: provider, Reason: reason})
+}
+
+// deadLetterInvalid dead-letters event, which failed validation with err
+func (c *Controller) deadLetterInvalid(event Event, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadLetterLocked("", event, "invalid: "+err.Error())
+}
+
+// DeadLetters returns the dead letters currently kept, oldest first
+func (c *Controller) DeadLetters() []DeadLetter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]DeadLetter(nil), c.deadLetters...)
+}
+
+// RequeueDeadLetters moves the dead letters with the given IDs, or all of
+// them when ids is empty, back into the buffer to be sent to every provider
+// again. They skip validation and deduplication. It returns how many were
+// requeued; once the buffer rejects one the rest stay dead letters and
+// ErrBufferFull is returned. It returns ErrDraining once the controller
+// drains and ErrClosed once it stops.
+func (c *Controller) RequeueDeadLetters(ids []string) (int, error) {
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	c.mu.Lock()
+	if err := c.stoppedErrLocked(); err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	var kept []DeadLetter
+	n := 0
+	var err error
+	for _, letter := range c.deadLetters {
+		if err != nil || (len(want) > 0 && !want[letter.Event.ID]) {
+			kept = append(kept, letter)
+			continue
+		}
+		if !c.bufferLocked(letter.Event) {
+			kept = append(kept, letter)
+			err = ErrBufferFull
+			continue
+		}
+		n++
+	}
+	c.deadLetters = kept
+	c.appEnded = false
+	c.backpressureLocked()
+	c.mu.Unlock()
+	c.runDropHooks()
+	if n > 0 {
+		c.log.Info("requeued dead letters", "events", n)
+	}
+	return n, err
+}
+
+// handleDeadLetter lists the dead letters. It is an admin endpoint, see
+// authorizeAdmin.
+func (c *Controller) handleDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+	letters := c.DeadLetters()
+	if letters == nil {
+		letters = []DeadLetter{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(letters); err != nil {
+		c.log.Warn("writing dead letters failed", "err", err)
+	}
+}
+
+// requeueRequest picks the dead letters POST /admin/deadletter/requeue
+// moves back into the buffer, all of them when IDs is empty
+type requeueRequest struct {
+	IDs []string `json:"ids,omitempty"`
+}
+
+// requeueResponse is what POST /admin/deadletter/requeue answers with
+type requeueResponse struct {
+	Requeued int `json:"requeued"`
+}
+
+// handleRequeue requeues the dead letters a requeueRequest body, which may
+// be empty, picks. It is an admin endpoint, see authorizeAdmin.
+func (c *Controller) handleRequeue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+	var req requeueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "malformed requeue request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := c.RequeueDeadLetters(req.IDs)
+	if errors.Is(err, ErrDraining) || errors.Is(err, ErrClosed) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		// The buffer filled up part way, still say how many made it
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(requeueResponse{Requeued: n}); err != nil {
+		c.log.Warn("writing requeue response failed", "err", err)
+	}
+}
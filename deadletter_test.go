@@ -0,0 +1,149 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ackAllBut makes the provider acknowledge every event it receives except
+// the one with ID id
+func (fp *fakeProvider) ackAllBut(id string) {
+	fp.onMessage = func(conn *websocket.Conn, msg []byte) {
+		var event Event
+		if json.Unmarshal(msg, &event) == nil && event.ID != "" && event.ID != id {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"ack":"`+event.ID+`"}`))
+		}
+	}
+}
+
+func TestUnacknowledgedEventDeadLetters(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	main.ackAllBut("bad")
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.AckTimeout = 30 * time.Millisecond
+	cfg.MaxSendAttempts = 3
+	cfg.AdminToken = "s3cret"
+	c := startController(t, cfg)
+	for _, id := range []string{"e0", "bad", "e1"} {
+		if err := c.Enqueue(Event{ID: id, Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !waitUntil(2*time.Second, func() bool { return c.Status().DeadLettered == 1 }) {
+		t.Fatalf("main received %v, nothing dead-lettered", main.ids())
+	}
+	if got := strings.Count(strings.Join(main.ids(), " "), "bad"); got != 3 {
+		t.Fatalf("bad was sent %d times, want MaxSendAttempts 3", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := strings.Count(strings.Join(main.ids(), " "), "bad"); got != 3 {
+		t.Fatalf("bad was sent %d times after being dead-lettered", got)
+	}
+	if st := c.Status().Providers[0]; st.Unacked != 0 || st.SentIndex != 3 {
+		t.Fatalf("main has sent index %d and %d unacked after moving past bad", st.SentIndex, st.Unacked)
+	}
+
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/deadletter", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var letters []DeadLetter
+	if err := json.NewDecoder(resp.Body).Decode(&letters); err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Event.ID != "bad" || !strings.Contains(letters[0].Reason, "3 attempts") || letters[0].At.IsZero() {
+		t.Fatalf("dead letters %+v, want bad after 3 attempts", letters)
+	}
+	if mf := gather(t, c, "gochunker_events_dead_lettered_total"); mf == nil || mf.GetMetric()[0].GetCounter().GetValue() != 1 {
+		t.Fatalf("dead-lettered metric %v, want 1", mf)
+	}
+
+	resp, err = http.Get(srv.URL + "/admin/deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dead letters without the admin token answered %d", resp.StatusCode)
+	}
+}
+
+func TestDeadLettersBoundedAndRequeued(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.DeadLetterSize = 2
+	cfg.AdminToken = "s3cret"
+	c := startController(t, cfg, WithValidator(func(raw []byte, e Event) error {
+		if strings.HasPrefix(e.ID, "bad") {
+			return errors.New("bad ID")
+		}
+		return nil
+	}))
+	for _, id := range []string{"bad0", "bad1", "bad2"} {
+		if err := c.Enqueue(Event{ID: id}); err == nil {
+			t.Fatalf("%s passed validation", id)
+		}
+	}
+	// An app's invalid event is dead-lettered too
+	app := dialApp(t, c)
+	app.WriteMessage(websocket.TextMessage, []byte(`{"id":"bad3","payload":"x"}`))
+	if !waitUntil(time.Second, func() bool { return c.Status().DeadLettered == 4 }) {
+		t.Fatalf("%d events dead-lettered, want 4", c.Status().DeadLettered)
+	}
+	letters := c.DeadLetters()
+	if len(letters) != 2 || letters[0].Event.ID != "bad2" || letters[1].Event.ID != "bad3" {
+		t.Fatalf("dead letters %+v, want the newest two", letters)
+	}
+	if !strings.Contains(letters[0].Reason, "bad ID") {
+		t.Fatalf("dead letter reason %q", letters[0].Reason)
+	}
+
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	for _, tc := range []struct {
+		body   string
+		want   int
+		status int
+		left   int
+	}{
+		{`{"ids":["bad3"]}`, 1, http.StatusOK, 1},
+		{``, 1, http.StatusOK, 0},
+		{``, 0, http.StatusOK, 0},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/admin/deadletter/requeue", strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got requeueResponse
+		json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || got.Requeued != tc.want {
+			t.Fatalf("requeue of %q answered %d with %d requeued, want %d with %d", tc.body, resp.StatusCode, got.Requeued, tc.status, tc.want)
+		}
+		if n := len(c.DeadLetters()); n != tc.left {
+			t.Fatalf("%d dead letters left after requeueing %q, want %d", n, tc.body, tc.left)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v, want the requeued events", main.ids())
+	}
+	if got := strings.Join(main.ids(), " "); got != "bad3 bad2" {
+		t.Fatalf("main got %s, want bad3 bad2", got)
+	}
+}
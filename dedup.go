@@ -0,0 +1,34 @@
+package gochunker
+
+// idWindow remembers the most recent event IDs it was given, up to a fixed
+// number, so memory stays flat however long the stream runs
+type idWindow struct {
+	seen map[string]struct{}
+	ids  []string // ring of remembered IDs, the oldest at pos once full
+	pos  int
+}
+
+func newIDWindow(size int) *idWindow {
+	return &idWindow{seen: make(map[string]struct{}, size), ids: make([]string, 0, size)}
+}
+
+// contains reports whether id is in the window
+func (w *idWindow) contains(id string) bool {
+	_, ok := w.seen[id]
+	return ok
+}
+
+// add remembers id, forgetting the oldest ID if the window is full
+func (w *idWindow) add(id string) {
+	if w.contains(id) {
+		return
+	}
+	if len(w.ids) < cap(w.ids) {
+		w.ids = append(w.ids, id)
+	} else {
+		delete(w.seen, w.ids[w.pos])
+		w.ids[w.pos] = id
+		w.pos = (w.pos + 1) % len(w.ids)
+	}
+	w.seen[id] = struct{}{}
+}
@@ -0,0 +1,64 @@
+package gochunker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sendIDs writes one event per ID to conn
+func sendIDs(t *testing.T, conn *websocket.Conn, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"`+id+`","payload":"x"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDedupSkipsRepeatedID(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	sendIDs(t, dialApp(t, c), "a", "b", "a", "c")
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %v, want a b c", main.ids())
+	}
+	if got := fmt.Sprint(main.ids()); got != "[a b c]" {
+		t.Fatalf("main got %s, want [a b c]", got)
+	}
+	if n := c.Status().Deduplicated; n != 1 {
+		t.Fatalf("deduplicated %d, want 1", n)
+	}
+}
+
+func TestDedupWindowEviction(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.DedupWindow = 2
+	c := startController(t, cfg)
+	// c pushes a out of the window, so its repeat goes through
+	sendIDs(t, dialApp(t, c), "a", "b", "c", "a")
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 4 }) {
+		t.Fatalf("main got %v, want a b c a", main.ids())
+	}
+	if n := c.Status().Deduplicated; n != 0 {
+		t.Fatalf("deduplicated %d, want 0", n)
+	}
+}
+
+func TestIDWindow(t *testing.T) {
+	w := newIDWindow(2)
+	w.add("a")
+	w.add("b")
+	w.add("a") // already held, evicts nothing
+	if !w.contains("a") || !w.contains("b") {
+		t.Fatal("window lost an ID before filling up")
+	}
+	w.add("c")
+	w.add("d")
+	if w.contains("a") || w.contains("b") || !w.contains("c") || !w.contains("d") {
+		t.Fatal("window did not evict the oldest IDs")
+	}
+}
@@ -0,0 +1,119 @@
+package gochunker
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// unresponsiveListener accepts TCP connections and never answers on them.
+// It returns the ws:// URL it listens on and how many connections it took.
+func unresponsiveListener(t *testing.T) (string, func() int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return "ws://" + ln.Addr().String(), func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(conns)
+	}
+}
+
+func TestHandshakeTimeoutRetries(t *testing.T) {
+	url, accepted := unresponsiveListener(t)
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{url}
+	cfg.HandshakeTimeout = 50 * time.Millisecond
+	c := startController(t, cfg, withBackoffBase(time.Millisecond))
+
+	if !waitUntil(2*time.Second, func() bool { return accepted() >= 3 }) {
+		t.Fatalf("%d dials within 2s, want a hung handshake to be given up on and retried", accepted())
+	}
+	if c.Status().Providers[0].Connected {
+		t.Fatal("provider reported connected without a handshake")
+	}
+}
+
+// connectProxy is an HTTP proxy that tunnels CONNECT requests. It returns
+// the proxy's URL and the hosts it was asked to connect to.
+func connectProxy(t *testing.T) (string, func() []string) {
+	var mu sync.Mutex
+	var hosts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		mu.Unlock()
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		client, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(upstream, client)
+			upstream.Close()
+		}()
+		io.Copy(client, upstream)
+		client.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), hosts...)
+	}
+}
+
+func TestProviderDialedThroughProxy(t *testing.T) {
+	provider := newFakeProvider(t)
+	proxyURL, hosts := connectProxy(t)
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{provider.url()}
+	cfg.ProxyURL = proxyURL
+	c := startController(t, cfg)
+	sendEvents(t, dialApp(t, c), "e", 2)
+
+	if !waitUntil(2*time.Second, func() bool { return provider.count() == 2 }) {
+		t.Fatalf("provider got %d events through the proxy, want 2", provider.count())
+	}
+	want := strings.TrimPrefix(provider.url(), "ws://")
+	if got := hosts(); len(got) != 1 || got[0] != want {
+		t.Fatalf("proxy asked to connect to %v, want [%s]", got, want)
+	}
+}
@@ -0,0 +1,98 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// drainCheckInterval is how often Drain checks whether the buffer is empty
+const drainCheckInterval = 10 * time.Millisecond
+
+// Drain stops taking new events and waits until every buffered event has
+// been sent, and acknowledged when acks are required, or ctx is done.
+// Connected apps are closed with a going-away frame and new ones refused.
+// Events an app sent before its connection closed are still buffered and
+// sent. The controller stays draining afterwards; Close it once Drain
+// returns. Drain returns ctx's error if ctx is done first or
+// ShutdownTimeout passes, and ErrClosed if the controller stops.
+func (c *Controller) Drain(ctx context.Context) error {
+	if c.cfg.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.ShutdownTimeout)
+		defer cancel()
+	}
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	if !c.draining.Load() {
+		c.draining.Store(true)
+		c.log.Info("draining, no longer accepting events", "buffered", c.events.len())
+	}
+	c.drainProvidersLocked()
+	var apps []*appConn
+	for _, app := range c.apps {
+		apps = append(apps, app)
+	}
+	if len(apps) == 0 && !c.appEnded {
+		// No app will come to end the stream, so end it here for the
+		// workers to finish and hand over to the next provider
+		c.appEnded = true
+		c.fanOutLocked()
+	}
+	c.mu.Unlock()
+	for _, app := range apps {
+		app := app
+		c.goroutines.spawn("app-close", func() {
+			closeConn(app.conn, app.readerDone, websocket.CloseGoingAway, "draining")
+		})
+	}
+
+	ticker := c.clock.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		// An app is only forgotten once its reader has buffered what it
+		// read, so with none left nothing else can arrive
+		drained := len(c.apps) == 0 && c.events.len() == 0
+		c.mu.Unlock()
+		if drained {
+			c.log.Info("drained")
+			return nil
+		}
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.ctx.Done():
+			return ErrClosed
+		}
+	}
+}
+
+// handleDrain drains the controller and reports its status once the
+// buffer is empty, or 503 if the request ends first. It is an admin
+// endpoint, see authorizeAdmin.
+func (c *Controller) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+	if err := c.Drain(r.Context()); err != nil {
+		http.Error(w, "drain incomplete: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.Status()); err != nil {
+		c.log.Warn("writing status failed", "err", err)
+	}
+}
@@ -0,0 +1,112 @@
+package gochunker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// postDrain posts to c's /drain with the bearer token, if any
+func postDrain(t *testing.T, srv *httptest.Server, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/drain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestDrainSendsBufferedEventsAndRefusesApps(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.RateLimit = 100000
+	cfg.RateLimitInterval = time.Second
+	cfg.AdminToken = "s3cret"
+	c := startController(t, cfg)
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/app/ws"
+
+	app, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	sendEvents(t, app, "e", 20)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Buffered == 20 }) {
+		t.Fatalf("buffered %d events, want 20", c.Status().Buffered)
+	}
+
+	if resp := postDrain(t, srv, cfg.AdminToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf("drain answered %s", resp.Status)
+	}
+	// Draining ended the app's stream, so the backup got everything too
+	if main.count() != 20 || backup.count() != 20 {
+		t.Fatalf("main got %d events, backup %d, want 20 each", main.count(), backup.count())
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("app accepted while draining: %v", err)
+	}
+	if st := c.Status(); !st.Draining || st.Buffered != 0 || st.Apps != 0 {
+		t.Fatalf("status after drain: %+v", st)
+	}
+}
+
+func TestDrainRequiresAdminToken(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	for _, tc := range []struct {
+		name, adminToken, presented string
+		want                        int
+	}{
+		{"no admin token configured", "", "", http.StatusForbidden},
+		{"no token presented", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "guess", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig(main, backup)
+			cfg.AdminToken = tc.adminToken
+			c := startController(t, cfg)
+			srv := httptest.NewServer(c.Handler())
+			defer srv.Close()
+			if resp := postDrain(t, srv, tc.presented); resp.StatusCode != tc.want {
+				t.Fatalf("drain answered %s, want %d", resp.Status, tc.want)
+			}
+			if c.Status().Draining {
+				t.Fatal("unauthorized request drained the controller")
+			}
+		})
+	}
+}
+
+func TestDrainTimesOutWithProviderDown(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MainProviderURL, cfg.BackupProviderURL = "ws://127.0.0.1:1/main", "ws://127.0.0.1:1/backup"
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.bufferLocked(Event{ID: "stuck"})
+	c.mu.Unlock()
+	c.Start()
+	defer c.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Drain returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,53 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Enqueue buffers e as if an app had sent it over a WebSocket, for services
+// that embed the controller: it is checked against the schema and the
+// validator, in its JSON form, skipped if it duplicates a recent event, and
+// subject to the drop policy. Enqueue returns ErrInvalidEvent wrapping why
+// e failed validation, ErrBufferFull if the full buffer rejected e or apps
+// are paused at BufferHighWater, in which case the caller should retry
+// later, ErrDraining once the controller drains and ErrClosed once it
+// stops. Under IngestCoupled it first waits, for IngestTimeout at most,
+// for providers to catch up, see waitIngest, and under OutboundBlock for
+// room in the full queues of providers e goes to, see waitOutbound. An event without an ID gets one from the ID generator, after
+// validation. It is safe for concurrent use, alongside connected apps.
+func (c *Controller) Enqueue(e Event) error {
+	if c.schema != nil || c.validator != nil {
+		raw, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidEvent, err)
+		}
+		if err := c.validateEvent(JSONCodec{}, raw, e); err != nil {
+			c.countRejected(e.ID, err)
+			c.deadLetterInvalid(e, err)
+			return fmt.Errorf("%w: %w", ErrInvalidEvent, err)
+		}
+	}
+	c.assignID(&e)
+	c.waitIngest()
+	c.waitOutbound(e)
+	c.mu.Lock()
+	if err := c.stoppedErrLocked(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if c.resume != nil {
+		c.mu.Unlock()
+		return ErrBufferFull
+	}
+	// Like an app connecting, an event reopens a stream the apps ended
+	c.appEnded = false
+	accepted := c.acceptLocked(e)
+	c.backpressureLocked()
+	c.mu.Unlock()
+	c.runDropHooks()
+	if !accepted {
+		return ErrBufferFull
+	}
+	return nil
+}
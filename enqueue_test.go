@@ -0,0 +1,84 @@
+package gochunker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEnqueueAlongsideApps(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	app := dialApp(t, c)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := c.Enqueue(Event{ID: fmt.Sprintf("q%d", i), Payload: []byte("x")}); err != nil {
+				t.Errorf("enqueueing q%d: %v", i, err)
+			}
+		}
+	}()
+	sendEvents(t, app, "s", 20)
+	wg.Wait()
+	// A repeat of an event the app sent is skipped as a duplicate
+	if err := c.Enqueue(Event{ID: "s3", Payload: []byte("x")}); err != nil {
+		t.Fatalf("enqueueing a duplicate: %v", err)
+	}
+
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 40 }) {
+		t.Fatalf("main got %d events, want 40", main.count())
+	}
+	ids := main.ids()
+	sort.Strings(ids)
+	for i := 1; i < len(ids); i++ {
+		if ids[i] == ids[i-1] {
+			t.Fatalf("main got %s twice", ids[i])
+		}
+	}
+	if got := c.Status().Deduplicated; got != 1 {
+		t.Fatalf("deduplicated %d events, want 1", got)
+	}
+}
+
+func TestEnqueueRefusals(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.BufferSize = 2
+	cfg.DropPolicy = RejectNewest
+	c := startController(t, cfg, WithValidator(func(raw []byte, e Event) error {
+		if e.Type == "bad" {
+			return errors.New("bad type")
+		}
+		return nil
+	}))
+
+	if err := c.Enqueue(Event{ID: "v", Type: "bad"}); err == nil {
+		t.Fatal("event failing validation was enqueued")
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("enqueueing event %d: %v", i, err)
+		}
+	}
+	// The backup has yet to send them, so both stay buffered
+	if err := c.Enqueue(Event{ID: "2"}); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("enqueueing into a full buffer returned %v, want ErrBufferFull", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Drain(ctx)
+	if err := c.Enqueue(Event{ID: "3"}); !errors.Is(err, ErrDraining) {
+		t.Fatalf("enqueueing while draining returned %v, want ErrDraining", err)
+	}
+	if got := c.Status().Rejected; got != 1 {
+		t.Fatalf("rejected %d events, want 1", got)
+	}
+}
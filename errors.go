@@ -0,0 +1,42 @@
+package gochunker
+
+import "errors"
+
+// Errors the Controller's methods return, possibly wrapping the cause, for
+// callers to tell apart with errors.Is
+var (
+	// ErrDraining is returned for events offered once Drain was called
+	ErrDraining = errors.New("controller is draining")
+	// ErrClosed is returned once the controller was closed or the context
+	// given to WithContext ended
+	ErrClosed = errors.New("controller is closed")
+	// ErrBufferFull is returned for events the full buffer rejected, or
+	// offered while apps are paused at BufferHighWater; retry them later
+	ErrBufferFull = errors.New("buffer full")
+	// ErrInvalidEvent wraps why an event failed validation
+	ErrInvalidEvent = errors.New("invalid event")
+	// ErrNotConnected is returned when no provider, or not the one asked
+	// for, is connected to act on a request
+	ErrNotConnected = errors.New("provider not connected")
+	// ErrUnknownProvider is returned for a provider name not in the pool
+	ErrUnknownProvider = errors.New("no such provider")
+	// ErrNotBuffered is returned for events no longer, or never, buffered
+	ErrNotBuffered = errors.New("events no longer buffered")
+	// ErrInvalidReplay wraps what is wrong with a ReplayRequest
+	ErrInvalidReplay = errors.New("invalid replay request")
+	// ErrNoRateLimit is returned for changing the total rate limit of a
+	// controller started without one, see Config.RateLimit
+	ErrNoRateLimit = errors.New("no total rate limit")
+)
+
+// stoppedErrLocked returns ErrClosed once the controller stopped and
+// ErrDraining while it drains, nil otherwise. c.mu must be held.
+func (c *Controller) stoppedErrLocked() error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	if c.draining.Load() {
+		return ErrDraining
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package gochunker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestControllerErrors(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.BufferSize = 2
+	cfg.DropPolicy = RejectNewest
+	errBad := errors.New("bad type")
+	c := startController(t, cfg, WithValidator(func(raw []byte, e Event) error {
+		if e.Type == "bad" {
+			return errBad
+		}
+		return nil
+	}))
+
+	err := c.Enqueue(Event{ID: "v", Type: "bad"})
+	if !errors.Is(err, ErrInvalidEvent) || !errors.Is(err, errBad) {
+		t.Fatalf("enqueueing an invalid event returned %v, want ErrInvalidEvent wrapping the validator's error", err)
+	}
+	for _, id := range []string{"e0", "e1"} {
+		if err := c.Enqueue(Event{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Enqueue(Event{ID: "e2"}); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("enqueueing into a full buffer returned %v, want ErrBufferFull", err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v, want e0 e1", main.ids())
+	}
+
+	from, to := 0, 1
+	far := 7
+	for _, tc := range []struct {
+		req  ReplayRequest
+		want error
+	}{
+		{ReplayRequest{From: &from}, ErrInvalidReplay},
+		{ReplayRequest{From: &from, To: &far}, ErrNotBuffered},
+		{ReplayRequest{From: &from, To: &to, Provider: "Elsewhere"}, ErrUnknownProvider},
+		{ReplayRequest{From: &from, To: &to, Provider: "Backup"}, ErrNotConnected},
+	} {
+		if _, err := c.Replay(context.Background(), tc.req); !errors.Is(err, tc.want) {
+			t.Errorf("replay of %+v returned %v, want %v", tc.req, err, tc.want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Drain(ctx)
+	if err := c.Enqueue(Event{ID: "e3"}); !errors.Is(err, ErrDraining) {
+		t.Fatalf("enqueueing while draining returned %v, want ErrDraining", err)
+	}
+	if _, err := c.RequeueDeadLetters(nil); !errors.Is(err, ErrDraining) {
+		t.Fatalf("requeueing while draining returned %v, want ErrDraining", err)
+	}
+
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Enqueue(Event{ID: "e4"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("enqueueing once closed returned %v, want ErrClosed", err)
+	}
+	if err := c.Drain(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("draining once closed returned %v, want ErrClosed", err)
+	}
+	if _, err := c.Replay(context.Background(), ReplayRequest{From: &from, To: &to, Provider: "Main"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("replaying once closed returned %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,62 @@
+package gochunker
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEventBinaryPayloadRoundTrip(t *testing.T) {
+	event := Event{ID: "e", Payload: []byte{0, 0xff, '"', '\n', 0x80}}
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Event
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Payload, event.Payload) {
+		t.Fatalf("payload %v came back as %v", event.Payload, got.Payload)
+	}
+}
+
+func TestEventPlainStringPayload(t *testing.T) {
+	var event Event
+	if err := json.Unmarshal([]byte(`{"id":"e","payload":"hello"}`), &event); err != nil {
+		t.Fatal(err)
+	}
+	if string(event.Payload) != "hello" {
+		t.Fatalf("payload %q, want hello", event.Payload)
+	}
+	if err := json.Unmarshal([]byte(`{"id":"e","payload":"x","payload_encoding":"rot13"}`), &event); err == nil {
+		t.Fatal("unknown payload encoding accepted")
+	}
+}
+
+func TestFrameTypes(t *testing.T) {
+	for _, tc := range []struct {
+		binary bool
+		want   int
+	}{
+		{false, websocket.TextMessage},
+		{true, websocket.BinaryMessage},
+	} {
+		main, backup := newFakeProvider(t), newFakeProvider(t)
+		cfg := testConfig(main, backup)
+		cfg.BinaryFrames = tc.binary
+		sendEvents(t, dialApp(t, startController(t, cfg)), "e", 1)
+		if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+			t.Fatalf("BinaryFrames %v: event not sent", tc.binary)
+		}
+		main.mu.Lock()
+		got := main.types[0]
+		main.mu.Unlock()
+		if got != tc.want {
+			t.Errorf("BinaryFrames %v: frame type %d, want %d", tc.binary, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package gochunker_test
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/andranikasd/gochunker"
+)
+
+// Mounting a Controller under a prefix of a service's own server
+func Example() {
+	cfg := gochunker.DefaultConfig()
+	cfg.ProviderURLs = []string{"wss://provider-a.example/events", "wss://provider-b.example/events"}
+	c, err := gochunker.NewController(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.Start()
+	defer c.Close(context.Background())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("the service's own routes"))
+	})
+	// Apps connect to /chunker/app/ws, metrics are on /chunker/metrics
+	mux.Handle("/chunker/", http.StripPrefix("/chunker", c.Handler()))
+	log.Fatal(http.ListenAndServe(":8080", mux))
+}
@@ -0,0 +1,91 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sendRaw writes each of msgs to conn as is
+func sendRaw(t *testing.T, conn *websocket.Conn, msgs ...string) {
+	t.Helper()
+	for _, msg := range msgs {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpiredEventsAreSkipped(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	sendRaw(t, dialApp(t, c),
+		`{"id":"stale","payload":"x","expires_at":"2000-01-01T00:00:00Z"}`,
+		`{"id":"forever","payload":"x"}`,
+		`{"id":"fresh","payload":"x","expires_at":"2100-01-01T00:00:00Z"}`,
+	)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].SentIndex == 3 }) {
+		t.Fatalf("main stuck at %+v", c.Status().Providers[0])
+	}
+	if got := fmt.Sprint(main.ids()); got != "[forever fresh]" {
+		t.Fatalf("main got %s, want [forever fresh]", got)
+	}
+	if n := c.Status().Expired; n != 1 {
+		t.Fatalf("expired %d, want 1", n)
+	}
+}
+
+func TestEventTTLFollowsControllerClock(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.EventTTL = time.Minute
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	clock := newFakeClock()
+	c.now = clock.Now
+	c.mu.Lock()
+	c.bufferLocked(Event{ID: "stale"})
+	clock.Advance(2 * time.Minute)
+	c.bufferLocked(Event{ID: "fresh"})
+	c.mu.Unlock()
+
+	c.Start()
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].SentIndex == 2 }) {
+		t.Fatalf("main stuck at %+v", c.Status().Providers[0])
+	}
+	if got := fmt.Sprint(main.ids()); got != "[fresh]" {
+		t.Fatalf("main got %s, want [fresh]", got)
+	}
+}
+
+func TestDefaultEventTTL(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.EventTTL = time.Hour
+	clock := newFakeClock()
+	c := startController(t, cfg, func(c *Controller) { c.now = clock.Now })
+	sendRaw(t, dialApp(t, c),
+		`{"id":"default","payload":"x"}`,
+		`{"id":"own","payload":"x","expires_at":"2100-01-01T00:00:00Z"}`,
+	)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v", main.ids())
+	}
+	want := []time.Time{clock.Now().Add(time.Hour), time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)}
+	for i, msg := range main.messages() {
+		var event Event
+		if err := json.Unmarshal([]byte(msg), &event); err != nil {
+			t.Fatal(err)
+		}
+		if !event.ExpiresAt.Equal(want[i]) {
+			t.Errorf("%s expires at %s, want %s", event.ID, event.ExpiresAt, want[i])
+		}
+	}
+}
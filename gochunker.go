@@ -1,174 +1,2405 @@
-// controller_service.go
-package main
+// Package gochunker relays events from an app connected over WebSocket to
+// a pool of WebSocket providers, buffering them while providers are down.
+//
+// A Controller is mounted on the embedding service's own server:
+//
+//	cfg := gochunker.DefaultConfig()
+//	cfg.ProviderURLs = []string{"wss://provider-a/events", "wss://provider-b/events"}
+//	c, err := gochunker.NewController(cfg)
+//	if err != nil {
+//		return err
+//	}
+//	c.Start()
+//	defer c.Close(context.Background())
+//	mux.Handle("/chunker/", http.StripPrefix("/chunker", c.Handler()))
+//
+// The gochunker command in cmd/gochunker runs one configured from the
+// environment.
+package gochunker
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
 	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Event represents an event to be sent to the provider
 type Event struct {
-	ID      string `json:"id"`
-	Payload string `json:"payload"`
+	ID       string `json:"id"`                 // assigned on arrival when empty, see WithIDGenerator
+	Payload  []byte `json:"-"`                  // raw bytes, base64 on the wire, see MarshalJSON
+	Type     string `json:"type,omitempty"`     // event class, selects the per-type rate limit
+	Weight   int    `json:"weight,omitempty"`   // rate-limit tokens consumed, 1 when zero
+	Priority int    `json:"priority,omitempty"` // higher priorities are sent first
+	Encoding string `json:"encoding,omitempty"` // how Payload is compressed, EncodingGzip or plain when empty
+	Seq      uint64 `json:"seq,omitempty"`      // position in the stream sent to a provider, stamped on the way out, see stampLocked
+
+	Metadata map[string]string `json:"metadata,omitempty"` // passed through to providers as is, for routing on tenant, region and the like
+
+	TraceParent string `json:"traceparent,omitempty"` // W3C trace context the event's spans continue, see WithTracerProvider
+	TraceState  string `json:"tracestate,omitempty"`
+
+	ExpiresAt  time.Time `json:"-"` // when the event goes stale and is no longer sent, never when zero
+	EnqueuedAt time.Time `json:"-"` // when the event was buffered, zero for events replayed from a store
+	Submitter  string    `json:"-"` // the app connection or session the event arrived over, which notifications about it go to
+}
+
+// payloadBase64 marks a payload that is base64 encoded on the wire. Events
+// without it carry their payload as plain text.
+const payloadBase64 = "base64"
+
+// eventFields has Event's fields without its JSON methods
+type eventFields Event
+
+// MarshalJSON encodes the payload as base64 so arbitrary bytes survive
+func (e Event) MarshalJSON() ([]byte, error) {
+	wire := struct {
+		eventFields
+		Payload         string     `json:"payload"`
+		PayloadEncoding string     `json:"payload_encoding"`
+		ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	}{
+		eventFields:     eventFields(e),
+		Payload:         base64.StdEncoding.EncodeToString(e.Payload),
+		PayloadEncoding: payloadBase64,
+	}
+	if !e.ExpiresAt.IsZero() {
+		wire.ExpiresAt = &e.ExpiresAt
+	}
+	return json.Marshal(wire)
+}
+
+// UnmarshalJSON accepts base64 payloads as written by MarshalJSON as well as
+// plain string payloads from clients that predate binary support
+func (e *Event) UnmarshalJSON(data []byte) error {
+	wire := struct {
+		*eventFields
+		Payload         string     `json:"payload"`
+		PayloadEncoding string     `json:"payload_encoding"`
+		ExpiresAt       *time.Time `json:"expires_at"`
+	}{eventFields: (*eventFields)(e)}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	if wire.ExpiresAt != nil {
+		e.ExpiresAt = *wire.ExpiresAt
+	}
+	switch wire.PayloadEncoding {
+	case "":
+		e.Payload = []byte(wire.Payload)
+	case payloadBase64:
+		payload, err := base64.StdEncoding.DecodeString(wire.Payload)
+		if err != nil {
+			return fmt.Errorf("decoding payload: %w", err)
+		}
+		e.Payload = payload
+	default:
+		return fmt.Errorf("unsupported payload encoding %q", wire.PayloadEncoding)
+	}
+	return nil
 }
 
-// RateLimiter controls the event sending rate
+// expired reports whether the event was stale at now
+func (e Event) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// weight returns the number of rate-limit tokens the event consumes
+func (e Event) weight() int {
+	if e.Weight <= 0 {
+		return 1
+	}
+	return e.Weight
+}
+
+// minRefillTick is the finest granularity the refill loop ticks at
+const minRefillTick = 10 * time.Millisecond
+
+// RateLimiter controls the event sending rate. It is a token bucket holding
+// at most maxAllowed tokens, refilled at a steady rate of maxAllowed tokens
+// per interval.
 type RateLimiter struct {
 	mu         sync.Mutex
 	tokens     int
 	maxAllowed int
-	ticker     *time.Ticker
+	full       int // capacity set by NewRateLimiter or Reconfigure, SetMax may lower maxAllowed below it for a while
+	addPerTick int
+	interval   time.Duration
+	tick       time.Duration
+	lastTick   time.Time
+	clock      Clock
+	ticker     Ticker
+	refilled   chan struct{} // closed and replaced on every refill to wake waiters
+	changed    chan struct{} // closed and replaced on Reconfigure, waits computed before it no longer hold
+	done       chan struct{}
+	stopOnce   sync.Once
+
+	calls   atomic.Uint64
+	granted atomic.Uint64
+	denied  atomic.Uint64
 }
 
 func NewRateLimiter(max int, interval time.Duration) *RateLimiter {
+	return NewRateLimiterWithClock(max, interval, SystemClock)
+}
+
+// NewRateLimiterWithClock is NewRateLimiter refilling the bucket by the
+// ticks of clock
+func NewRateLimiterWithClock(max int, interval time.Duration, clock Clock) *RateLimiter {
+	tick, addPerTick := refillSchedule(max, interval)
 	rl := &RateLimiter{
 		tokens:     max,
 		maxAllowed: max,
-		ticker:     time.NewTicker(interval),
+		full:       max,
+		addPerTick: addPerTick,
+		interval:   interval,
+		tick:       tick,
+		lastTick:   clock.Now(),
+		clock:      clock,
+		ticker:     clock.NewTicker(tick),
+		refilled:   make(chan struct{}),
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 	go rl.refill()
 	return rl
 }
 
+// refillSchedule spreads max tokens across interval, one token per tick when
+// the resulting tick is coarse enough, otherwise several tokens per
+// minRefillTick
+func refillSchedule(max int, interval time.Duration) (tick time.Duration, addPerTick int) {
+	if max <= 0 {
+		return interval, 0
+	}
+	tick = interval / time.Duration(max)
+	if tick >= minRefillTick {
+		return tick, 1
+	}
+	addPerTick = int(int64(max) * int64(minRefillTick) / int64(interval))
+	if addPerTick < 1 {
+		addPerTick = 1
+	}
+	return time.Duration(int64(interval) * int64(addPerTick) / int64(max)), addPerTick
+}
+
 func (rl *RateLimiter) refill() {
-	for range rl.ticker.C {
+	for {
+		var now time.Time
+		select {
+		case now = <-rl.ticker.C():
+		case <-rl.done:
+			return
+		}
 		rl.mu.Lock()
-		rl.tokens = rl.maxAllowed
+		rl.lastTick = now
+		if rl.tokens < rl.maxAllowed {
+			rl.tokens += rl.addPerTick
+			if rl.tokens > rl.maxAllowed {
+				rl.tokens = rl.maxAllowed
+			}
+			close(rl.refilled)
+			rl.refilled = make(chan struct{})
+		}
 		rl.mu.Unlock()
 	}
 }
 
+// Stop stops the refill ticker and its goroutine. It is safe to call more
+// than once.
+func (rl *RateLimiter) Stop() {
+	rl.stopOnce.Do(func() {
+		rl.ticker.Stop()
+		close(rl.done)
+	})
+}
+
+// Max returns the bucket capacity
+func (rl *RateLimiter) Max() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.maxAllowed
+}
+
+// SetMax changes the bucket capacity, and with it the refill rate, to n
+// tokens per interval. Tokens above the new capacity are discarded.
+func (rl *RateLimiter) SetMax(n int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if n == rl.maxAllowed {
+		return
+	}
+	tick, addPerTick := refillSchedule(n, rl.interval)
+	rl.maxAllowed = n
+	rl.addPerTick = addPerTick
+	if tick != rl.tick {
+		rl.tick = tick
+		rl.ticker.Reset(tick)
+	}
+	if rl.tokens > n {
+		rl.tokens = n
+	}
+}
+
+// Reconfigure changes the limit to max tokens per interval. Tokens already
+// in the bucket are kept, up to the new capacity, and the refill ticker is
+// reset to the new schedule on the fly. Unlike SetMax it changes the size
+// throttled limits ramp back up to.
+func (rl *RateLimiter) Reconfigure(max int, interval time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	tick, addPerTick := refillSchedule(max, interval)
+	rl.maxAllowed = max
+	rl.full = max
+	rl.addPerTick = addPerTick
+	rl.interval = interval
+	if tick != rl.tick {
+		rl.tick = tick
+		rl.ticker.Reset(tick)
+	}
+	if rl.tokens > max {
+		rl.tokens = max
+	}
+	// Waiters for more tokens than the old capacity may be satisfied now
+	close(rl.refilled)
+	rl.refilled = make(chan struct{})
+	close(rl.changed)
+	rl.changed = make(chan struct{})
+}
+
+// reconfigured returns a channel closed by the next Reconfigure
+func (rl *RateLimiter) reconfigured() <-chan struct{} {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.changed
+}
+
+// Interval returns the period the bucket's capacity is refilled over
+func (rl *RateLimiter) Interval() time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.interval
+}
+
+// fullMax returns the capacity set by NewRateLimiter or Reconfigure, the
+// size a limit lowered by SetMax ramps back up to
+func (rl *RateLimiter) fullMax() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.full
+}
+
 func (rl *RateLimiter) Allow() bool {
+	return rl.AllowN(1)
+}
+
+// AllowN atomically consumes n tokens, or consumes nothing and returns false
+// if fewer than n are available. A request for more than maxAllowed tokens
+// can never be satisfied by the bucket alone, so it is granted once the
+// bucket is full and drains it completely.
+func (rl *RateLimiter) AllowN(n int) bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
-	if rl.tokens > 0 {
-		rl.tokens--
+	return rl.takeLocked(n)
+}
+
+func (rl *RateLimiter) takeLocked(n int) bool {
+	rl.calls.Add(1)
+	if n > rl.maxAllowed && rl.maxAllowed > 0 && rl.tokens == rl.maxAllowed {
+		rl.tokens = 0
+		rl.granted.Add(1)
+		return true
+	}
+	if rl.tokens >= n {
+		rl.tokens -= n
+		rl.granted.Add(1)
 		return true
 	}
+	rl.denied.Add(1)
 	return false
 }
 
-// Controller holds state for managing connections and events
-type Controller struct {
-	appConn       *websocket.Conn
-	providerMain  *websocket.Conn
-	providerBackup *websocket.Conn
-	events        []Event
-	ratelimiter   *RateLimiter
-	startBackup   chan struct{}
-	mu            sync.Mutex
+// Stats returns how many token requests were granted and denied so far. It
+// is safe to call concurrently with Allow.
+func (rl *RateLimiter) Stats() (granted, denied uint64) {
+	return rl.granted.Load(), rl.denied.Load()
+}
+
+// Calls returns the total number of token requests made so far
+func (rl *RateLimiter) Calls() uint64 {
+	return rl.calls.Load()
 }
 
-func NewController() *Controller {
-	return &Controller{
-		ratelimiter: NewRateLimiter(100, time.Hour),
-		events:      make([]Event, 0),
-		startBackup: make(chan struct{}),
+// Utilization returns the fraction of the bucket currently consumed, 0 when
+// full and 1 when empty
+func (rl *RateLimiter) Utilization() float64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.maxAllowed <= 0 {
+		return 0
 	}
+	return float64(rl.maxAllowed-rl.tokens) / float64(rl.maxAllowed)
 }
 
-func (c *Controller) handleAppConnection(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{}
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Fatal("Failed to upgrade app connection:", err)
+// Reserve grants a token if one is available. Otherwise it reports how long
+// until the refill schedule makes one available, measured from the
+// position of the current tick.
+func (rl *RateLimiter) Reserve() (ok bool, wait time.Duration) {
+	return rl.reserveN(1)
+}
+
+func (rl *RateLimiter) reserveN(n int) (ok bool, wait time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.takeLocked(n) {
+		return true, 0
 	}
-	c.appConn = conn
-	log.Println("App connected")
-	go c.readEventsFromApp()
+	if rl.addPerTick == 0 {
+		return false, rl.tick
+	}
+	if n > rl.maxAllowed {
+		n = rl.maxAllowed
+	}
+	ticks := (n - rl.tokens + rl.addPerTick - 1) / rl.addPerTick
+	wait = rl.lastTick.Add(time.Duration(ticks) * rl.tick).Sub(rl.clock.Now())
+	if wait < 0 {
+		wait = 0
+	}
+	return false, wait
+}
+
+// Wait blocks until a token is available or ctx is done, in which case it
+// returns ctx.Err()
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	return rl.WaitN(ctx, 1)
 }
 
-func (c *Controller) readEventsFromApp() {
+// WaitN blocks until n tokens can be consumed as by AllowN or ctx is done,
+// in which case it returns ctx.Err()
+func (rl *RateLimiter) WaitN(ctx context.Context, n int) error {
 	for {
-		_, msg, err := c.appConn.ReadMessage()
-		if err != nil {
-			log.Println("App connection closed:", err)
-			return
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		var event Event
-		err = json.Unmarshal(msg, &event)
-		if err != nil {
-			log.Println("Invalid event format:", err)
-			continue
+		rl.mu.Lock()
+		if rl.takeLocked(n) {
+			rl.mu.Unlock()
+			return nil
+		}
+		refilled := rl.refilled
+		rl.mu.Unlock()
+
+		select {
+		case <-refilled:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		c.mu.Lock()
-		c.events = append(c.events, event)
-		c.mu.Unlock()
 	}
 }
 
-func (c *Controller) startWorker(ws *websocket.Conn, label string, triggerBackup bool) {
-	go func() {
-		log.Printf("%s Worker started", label)
-		for i := 0; i < len(c.events); i++ {
-			c.mu.Lock()
-			event := c.events[i]
-			c.mu.Unlock()
+// DefaultEventType is the MultiRateLimiter key sizing the shared bucket used
+// by event types without a budget of their own
+const DefaultEventType = "*"
 
-			for !c.ratelimiter.Allow() {
-				log.Printf("%s rate-limited, sleeping...", label)
-				time.Sleep(1 * time.Minute)
-			}
+// MultiRateLimiter gives each event type an independent budget so a flood of
+// one type cannot starve the others
+type MultiRateLimiter struct {
+	limiters map[string]*RateLimiter
+	fallback *RateLimiter
+}
 
-			eventMsg, _ := json.Marshal(event)
-			err := ws.WriteMessage(websocket.TextMessage, eventMsg)
-			if err != nil {
-				log.Printf("%s worker write error: %v", label, err)
-				return
-			}
+// NewMultiRateLimiter creates one bucket per entry in defaults, each allowing
+// that many events per interval. The DefaultEventType entry, if present,
+// sizes the bucket shared by all other types; without it unknown types are
+// not limited.
+func NewMultiRateLimiter(defaults map[string]int, interval time.Duration) *MultiRateLimiter {
+	return newMultiRateLimiter(defaults, interval, SystemClock)
+}
+
+func newMultiRateLimiter(defaults map[string]int, interval time.Duration, clock Clock) *MultiRateLimiter {
+	m := &MultiRateLimiter{limiters: make(map[string]*RateLimiter, len(defaults))}
+	for eventType, max := range defaults {
+		rl := NewRateLimiterWithClock(max, interval, clock)
+		if eventType == DefaultEventType {
+			m.fallback = rl
+			continue
 		}
+		m.limiters[eventType] = rl
+	}
+	return m
+}
+
+// Limiter returns the bucket for eventType, or nil if the type is unlimited
+func (m *MultiRateLimiter) Limiter(eventType string) *RateLimiter {
+	if rl, ok := m.limiters[eventType]; ok {
+		return rl
+	}
+	return m.fallback
+}
+
+// Allow reports whether an event of eventType may be sent now
+func (m *MultiRateLimiter) Allow(eventType string) bool {
+	rl := m.Limiter(eventType)
+	return rl == nil || rl.Allow()
+}
+
+// Stop stops every bucket's refill goroutine
+func (m *MultiRateLimiter) Stop() {
+	for _, rl := range m.limiters {
+		rl.Stop()
+	}
+	if m.fallback != nil {
+		m.fallback.Stop()
+	}
+}
+
+// rampInterval is how often a throttled rate limit is stepped back up once
+// providers stop sending throttle signals
+const rampInterval = 10 * time.Second
+
+// providerMessage is what a provider sends back: a request to back off for
+// ThrottleMs, or the acknowledgement of the event with ID Ack, optionally
+// referencing the sequence number it was sent with
+type providerMessage struct {
+	ThrottleMs int    `json:"throttle_ms,omitempty"`
+	Ack        string `json:"ack,omitempty"`
+	Seq        uint64 `json:"seq,omitempty"`
+}
+
+// provider is an outbound connection together with the URL to redial it at
+type provider struct {
+	name string
+	url  string
+
+	// guarded by Controller.mu
+	conn       Conn
+	readerDone chan struct{}    // closed once conn's reader stops
+	sentIndex  int              // every event before it went out
+	sentAbove  map[int]struct{} // events at or past sentIndex sent ahead of it by priority
+	queue      eventQueue       // buffered events yet to be sent, by priority
+	feed       chan struct{}    // wakes the worker when events arrive, nil until it starts
+
+	lost      chan Conn     // connections whose reader stopped, for the worker to replace
+	start     chan struct{} // closed once the worker may start, see trigger
+	startOnce sync.Once
+	next      *provider // started once this one finishes or fails, BackupAfterMain only
+
+	// Sequence numbers, guarded by Controller.mu
+	seq      uint64         // last number stamped on an event sent to this provider
+	ackedSeq uint64         // highest number the provider acknowledged in order
+	seqs     map[int]uint64 // numbers buffered events were written with, by index
 
-		log.Printf("%s Worker finished sending events", label)
+	// Acks, guarded by Controller.mu. Without RequireAcks ackedIndex
+	// simply follows sentIndex.
+	ackedIndex int                 // every event before it was sent and acknowledged
+	unacked    map[int]*pendingAck // sent events awaiting an ack, by index
+	ackIDs     map[string][]int    // indexes in unacked by event ID
+	resend     []int               // unacked indexes due to be sent again
 
-		if triggerBackup {
-			log.Println("Triggering backup worker")
-			c.startBackup <- struct{}{}
+	spans map[int]trace.Span // open send spans awaiting an ack, by index
+
+	replays []*replayJob // events to send again on request, guarded by Controller.mu
+
+	jobs  chan laneJob // batches the worker hands to its lanes, nil without any
+	lanes []*lane      // extra connections, see Config.ProviderConnections; guarded by Controller.mu
+
+	limiter *RateLimiter // this provider's own budget from Config.ProviderRateLimits, nil without one
+
+	paused bool // PauseProvider holds its events back, guarded by Controller.mu
+
+	breaker breaker // holds dials back while the provider keeps refusing, guarded by Controller.mu
+
+	probeFailures int          // probes in a row whose write failed, see Config.ProbeFailures; guarded by Controller.mu
+	writeErrors   atomic.Int32 // writes in a row that failed, see Config.WriteErrorThreshold
+
+	lastCloseCode int  // code of the provider's last close frame, guarded by Controller.mu
+	done          bool // closed with one of Config.FinalCloseCodes, no longer dialed; guarded by Controller.mu
+
+	state atomic.Int32 // a ProviderState, see State and setStateLocked
+}
+
+// Controller holds state for managing connections and events.
+//
+// Each connection has a single owner per direction, as gorilla/websocket
+// allows at most one concurrent reader and one concurrent writer. The app
+// connection is only read by its readEventsFromApp goroutine, which buffers
+// events and fans a wake-up out to every active provider's feed channel.
+// Each provider connection is only written by its worker, or the lane
+// goroutine owning it, and only read by its readProviderMessages goroutine.
+type Controller struct {
+	cfg            Config
+	apps           map[*websocket.Conn]*appConn // connected apps, guarded by mu, use addApp and removeApp
+	appSeq         uint64                       // app connections numbered so far, for submitter IDs; guarded by mu
+	pool           *ProviderPool
+	events         *buffer
+	dropped        uint64         // events lost to a full buffer
+	recentIDs      *idWindow      // IDs recently accepted from apps, nil when deduplication is off
+	deduplicated   uint64         // events skipped as repeats of a recent ID
+	coalesce       map[string]int // index of the last event buffered with each key, see Config.CoalesceKey
+	coalesced      uint64         // events a newer one with the same key replaced before some provider sent them
+	rejected       uint64         // app messages that were malformed, too large or failed validation
+	expired        uint64         // events a provider skipped because they went stale
+	deadLetters    []DeadLetter
+	deadLettered   uint64 // events given up on, see deadLetterLocked
+	metrics        *metrics
+	appEnded       bool              // every app that connected has gone, no more events are coming
+	draining       atomic.Bool       // Drain was called, apps are refused; set under mu
+	resume         chan struct{}     // closed when apps paused at BufferHighWater may send again, nil while unpaused; guarded by mu
+	outboundRoom   chan struct{}     // closed when a worker takes an event off its queue, nil while nobody waits; guarded by mu
+	ingestRoom     chan struct{}     // closed when pending events are let go of, nil while no app waits under IngestCoupled; guarded by mu
+	providersUp    atomic.Int32      // providers whose connection is open, see setStateLocked
+	ratelimiter    *RateLimiter      // total cap across providers, nil when RateLimit is zero
+	typeLimiter    *MultiRateLimiter // per-event-type budgets from Config.TypeRateLimits, nil without any
+	bypass         bypassCounter     // events of Config.BypassTypes sent lately
+	throttledUntil time.Time         // end of the most recent provider throttle request
+	backoffBase    time.Duration
+	backoffMax     time.Duration
+	backoffJitter  float64
+	mu             sync.Mutex
+	parent         context.Context // set by WithContext, Background otherwise
+	ctx            context.Context
+	cancel         context.CancelFunc
+	goroutines     goroutines     // every goroutine the controller starts
+	workers        sync.WaitGroup // provider workers only, a subset of goroutines
+	closeOnce      sync.Once
+	log            *slog.Logger
+	tlsConfig      *tls.Config // providers are dialed with this, system defaults when nil
+	serverTLS      *tls.Config // the app-facing server serves TLS with this, plain HTTP when nil
+	dialer         *websocket.Dialer
+	httpClient     *http.Client               // streams events to http:// and https:// providers, see httpStream
+	dialFunc       DialFunc                   // replaces dialer when set, see WithDialFunc
+	headerFunc     HeaderFunc                 // optional extra handshake headers for providers
+	checkOrigin    func(r *http.Request) bool // replaces the AllowedOrigins check when set
+	origins        *originMatcher             // compiled AllowedOrigins, nil when empty
+	clock          Clock                      // tickers and timeouts come from it, see WithClock
+	now            func() time.Time           // reads the clock event timestamps come from, clock.Now unless a test swaps it
+	schema         *jsonschema.Schema         // app messages must match it, nil when EventSchemaFile is unset
+	seedFile       string                     // NDJSON events Start enqueues, see WithSeedFile
+	validator      Validator                  // optional extra check of app events
+	transforms     map[string]Transform       // custom wire formats by provider name, see WithTransform
+	router         Router                     // picks the providers of each event when set, see WithRouter
+	newID          IDGenerator                // names events arriving without an ID
+	tracer         trace.Tracer               // nil unless WithTracerProvider was given
+	spans          map[int]trace.Span         // open event spans, by index
+	onSent         func(provider string, e Event)
+	onDropped      func(e Event, reason string)
+	drops          []droppedEvent         // dropped events whose onDropped call is due, guarded by mu
+	sessions       map[string]*appSession // app sessions by ID, guarded by mu
+}
+
+// Option customizes a Controller built by NewController
+type Option func(*Controller)
+
+// WithStore keeps buffered events in s instead of a MemoryStore, replaying
+// whatever it still holds when the controller is created. It takes
+// precedence over WALPath. The controller closes s when it is closed.
+func WithStore(s Store) Option {
+	return func(c *Controller) {
+		c.events.store = s
+	}
+}
+
+// WithContext ties the controller to ctx: once ctx is done the controller
+// shuts down as if Close had been called, and every goroutine it started
+// exits
+func WithContext(ctx context.Context) Option {
+	return func(c *Controller) {
+		c.parent = ctx
+	}
+}
+
+// WithLogger makes the controller log through l instead of a text logger on
+// stderr at the configured level
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Controller) {
+		c.log = l
+	}
+}
+
+// WithBufferSize overrides Config.BufferSize
+func WithBufferSize(n int) Option {
+	return func(c *Controller) {
+		c.cfg.BufferSize = n
+	}
+}
+
+// WithRateLimit overrides Config.RateLimit and Config.RateLimitInterval,
+// allowing max events per interval across all providers
+func WithRateLimit(max int, interval time.Duration) Option {
+	return func(c *Controller) {
+		c.cfg.RateLimit = max
+		c.cfg.RateLimitInterval = interval
+	}
+}
+
+// WithTypeRateLimits overrides Config.TypeRateLimits, allowing limits[t]
+// events of type t per RateLimitInterval
+func WithTypeRateLimits(limits map[string]int) Option {
+	return func(c *Controller) {
+		c.cfg.TypeRateLimits = limits
+	}
+}
+
+// WithProviderRateLimits overrides Config.ProviderRateLimits, allowing
+// limits[name] events per RateLimitInterval to the provider called name
+func WithProviderRateLimits(limits map[string]int) Option {
+	return func(c *Controller) {
+		c.cfg.ProviderRateLimits = limits
+	}
+}
+
+// WithProviders makes urls the pool members, in order, overriding
+// Config.ProviderURLs and the main and backup provider
+func WithProviders(urls ...string) Option {
+	return func(c *Controller) {
+		c.cfg.ProviderURLs = urls
+	}
+}
+
+// NewController builds a controller from cfg, as adjusted by opts, and
+// replays any events its store still holds. NewController(DefaultConfig())
+// gives a controller with the defaults documented on DefaultConfig. The
+// controller doesn't contact providers until Start.
+func NewController(cfg Config, opts ...Option) (*Controller, error) {
+	c := &Controller{
+		cfg:    cfg,
+		events: &buffer{},
+		clock:  SystemClock,
+		now:    time.Now,
+
+		backoffBase:   100 * time.Millisecond,
+		backoffMax:    time.Minute,
+		backoffJitter: 0.5,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	cfg = c.cfg
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if c.newID == nil {
+		c.newID = newULIDGenerator(func() time.Time { return c.now() })
+	}
+	if c.parent == nil {
+		c.parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(c.parent)
+	c.ctx, c.cancel = ctx, cancel
+	c.pool = newProviderPool(cfg.PoolStrategy, poolMembers(cfg))
+	if err := c.checkTransforms(); err != nil {
+		cancel()
+		return nil, err
+	}
+	c.events.size = cfg.BufferSize
+	c.events.maxBytes = cfg.MaxBufferBytes
+	for _, p := range c.pool.members {
+		p.start = make(chan struct{})
+		p.lost = make(chan Conn, 1)
+	}
+	if cfg.DedupWindow > 0 {
+		c.recentIDs = newIDWindow(cfg.DedupWindow)
+	}
+	if c.log == nil {
+		c.log = newLogger(cfg.LogLevel)
+	}
+	if c.tlsConfig == nil {
+		tc, err := providerTLSConfig(cfg)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.tlsConfig = tc
+	}
+	if len(cfg.AllowedOrigins) > 0 {
+		origins, err := compileOrigins(cfg.AllowedOrigins)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.origins = origins
+	}
+	schema, err := compileSchema(cfg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := checkSeedFile(c.seedFile); err != nil {
+		cancel()
+		return nil, err
+	}
+	c.schema = schema
+	serverTLS, err := serverTLSConfig(cfg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c.serverTLS = serverTLS
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		u, err := parseProxyURL(cfg.ProxyURL)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+	c.dialer = &websocket.Dialer{
+		Subprotocols:     dialSubprotocols(cfg),
+		Proxy:            proxy,
+		HandshakeTimeout: cfg.HandshakeTimeout,
+		TLSClientConfig:  c.tlsConfig,
+		// Peers that don't support the extension just leave it out of
+		// their handshake response and messages go uncompressed
+		EnableCompression: cfg.Compression,
+	}
+	c.httpClient = &http.Client{Transport: &http.Transport{
+		Proxy:           proxy,
+		TLSClientConfig: c.tlsConfig,
+	}}
+	c.metrics = newMetrics(c)
+	switch {
+	case c.events.store != nil:
+	case cfg.WALPath != "" && cfg.WALSegmentSize > 0:
+		store, err := OpenSegmentStore(cfg.WALPath, int64(cfg.WALSegmentSize), cfg.WALCompress, cfg.WALRetainSegments, cfg.WALSync)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("opening write-ahead log: %w", err)
 		}
+		c.events.store = store
+	case cfg.WALPath != "":
+		store, err := OpenFileStore(cfg.WALPath, cfg.WALSync)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("opening write-ahead log: %w", err)
+		}
+		c.events.store = store
+	default:
+		c.events.store = NewMemoryStore(cfg.BufferSize)
+	}
+	if err := c.restore(); err != nil {
+		cancel()
+		c.events.store.Close()
+		return nil, fmt.Errorf("replaying stored events: %w", err)
+	}
+	c.runDropHooks()
+	if cfg.RateLimit > 0 {
+		c.ratelimiter = NewRateLimiterWithClock(cfg.RateLimit, cfg.RateLimitInterval, c.clock)
+	}
+	for _, p := range c.pool.members {
+		if n := cfg.ProviderRateLimits[p.name]; n > 0 {
+			p.limiter = NewRateLimiterWithClock(n, cfg.RateLimitInterval, c.clock)
+		}
+	}
+	if len(cfg.TypeRateLimits) > 0 {
+		c.typeLimiter = newMultiRateLimiter(cfg.TypeRateLimits, cfg.RateLimitInterval, c.clock)
+	}
+	c.bypass.types = make(map[string]bool, len(cfg.BypassTypes))
+	for _, eventType := range cfg.BypassTypes {
+		c.bypass.types[eventType] = true
+	}
+	c.goroutines.spawn("rate-ramp", c.rampRateLimits)
+	if c.parent.Done() != nil {
+		c.goroutines.spawn("parent-watch", func() {
+			select {
+			case <-c.parent.Done():
+				// Connections have to be closed for their readers to
+				// notice, so shut down as Close would
+				c.closeOnce.Do(func() {
+					c.shutdown(context.Background())
+				})
+			case <-ctx.Done():
+			}
+		})
+	}
+	return c, nil
+}
 
-		for {
-			_, msg, err := c.appConn.ReadMessage()
-			if err != nil {
-				log.Printf("%s idle proxy: app disconnected: %v", label, err)
+// Start connects the pool's providers and starts their workers. With
+// BackupAfterMain only the first starts right away and each of the others
+// once the one before it has finished; every other strategy starts them
+// all at once. Given WithSeedFile, it returns once the file's events are
+// enqueued.
+func (c *Controller) Start() {
+	members := c.pool.members
+	c.workers.Add(len(members))
+	for i, p := range members {
+		if c.pool.replicates() && i+1 < len(members) {
+			p.next = members[i+1]
+		}
+		if i == 0 || !c.pool.replicates() {
+			c.trigger(p, nil)
+		}
+		p := p
+		c.goroutines.spawn("provider-worker", func() {
+			defer c.workers.Done()
+			select {
+			case <-p.start:
+			case <-c.ctx.Done():
 				return
 			}
-			err = ws.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				log.Printf("%s idle proxy: provider disconnected: %v", label, err)
+			if _, err := c.connect(p); err != nil {
+				c.log.Error("provider connection failed", "provider", p.name, "err", err)
 				return
 			}
+			c.runWorker(p)
+		})
+	}
+	if c.seedFile != "" {
+		enqueued, skipped := c.seed()
+		c.log.Info("seeded events", "path", c.seedFile, "enqueued", enqueued, "skipped", skipped)
+	}
+}
+
+// trigger lets p's worker start. Only the first call has an effect, later
+// ones find the worker started already. It never blocks, so a worker
+// finishing or reconnecting again, or after p's worker has exited, goes on
+// unhindered. If from is set p takes over from it, skipping the events from
+// got through.
+func (c *Controller) trigger(p, from *provider) {
+	p.startOnce.Do(func() {
+		if from != nil {
+			c.mu.Lock()
+			c.takeOverLocked(p, from)
+			c.mu.Unlock()
 		}
-	}()
+		close(p.start)
+	})
+}
+
+// failOver has p's backup take over from p, whose connection ws failed.
+// Under StrictFailover it first waits for the reader of ws to stop, so no
+// ack from p is still on its way when the backup settles where to resume.
+func (c *Controller) failOver(p *provider, ws Conn) {
+	if c.cfg.StrictFailover {
+		c.mu.Lock()
+		done := c.readerDoneLocked(p, ws)
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+	c.trigger(p.next, p)
+}
+
+// Close stops the workers, closes every connection with a close frame and
+// releases the rate limiters. It blocks until all controller goroutines have
+// exited or ctx is done, for at most ShutdownTimeout. Workers still stuck
+// by then have their connections closed under them, and events providers
+// have yet to acknowledge are dead-lettered, staying in a write-ahead log
+// to be sent again after a restart; Close then returns ctx's error.
+func (c *Controller) Close(ctx context.Context) error {
+	if c.cfg.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.ShutdownTimeout)
+		defer cancel()
+	}
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.shutdown(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	return c.goroutines.wait(ctx)
 }
 
-func main() {
-	controller := NewController()
+// shutdown does the work of Close, once, whether it was called or the
+// context given to WithContext ended
+func (c *Controller) shutdown(ctx context.Context) error {
+	c.cancel()
+	for _, rl := range c.rateLimiters() {
+		rl.Stop()
+	}
+	if c.typeLimiter != nil {
+		c.typeLimiter.Stop()
+	}
 
-	http.HandleFunc("/app/ws", controller.handleAppConnection)
+	// Let workers flush what they hold before their sockets go away
+	err := waitGroup(ctx, &c.workers)
+	forced := err != nil
 
-	go func() {
-		conn1, _, err := websocket.DefaultDialer.Dial("ws://provider/main", nil)
-		if err != nil {
-			log.Fatal("Main provider connection failed:", err)
+	type open struct {
+		conn       Conn
+		readerDone <-chan struct{}
+	}
+	c.mu.Lock()
+	c.drainProvidersLocked()
+	var conns []open
+	for conn, app := range c.apps {
+		conns = append(conns, open{conn, app.readerDone})
+	}
+	for _, p := range c.providers() {
+		if p.conn != nil {
+			conns = append(conns, open{p.conn, p.readerDone})
 		}
-		controller.providerMain = conn1
-		controller.startWorker(conn1, "Main", true)
-	}()
+		for _, l := range p.lanes {
+			if l.conn != nil {
+				conns = append(conns, open{l.conn, l.readerDone})
+			}
+		}
+	}
+	c.mu.Unlock()
+	var closing sync.WaitGroup
+	for _, o := range conns {
+		if forced {
+			// A stalled peer would hold up the close handshake too
+			o.conn.Close()
+			continue
+		}
+		closing.Add(1)
+		go func(o open) {
+			defer closing.Done()
+			closeConn(o.conn, o.readerDone, websocket.CloseNormalClosure, "shutting down")
+		}(o)
+	}
+	closing.Wait()
+	if forced {
+		// The stuck workers fail their writes now, give them a moment to
+		// notice before the store goes away
+		grace, cancel := context.WithTimeout(context.Background(), closeWait)
+		waitGroup(grace, &c.workers)
+		cancel()
+	}
+	c.httpClient.CloseIdleConnections()
+
+	c.mu.Lock()
+	if forced {
+		c.abandonUnackedLocked()
+	}
+	c.traceCloseLocked()
+	if cerr := c.events.store.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("closing event store: %w", cerr)
+	}
+	c.mu.Unlock()
+	c.runDropHooks()
+	return err
+}
 
+// waitGroup waits for wg or until ctx is done
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
 	go func() {
-		<-controller.startBackup // wait until main worker finishes
-		conn2, _, err := websocket.DefaultDialer.Dial("ws://provider/backup", nil)
-		if err != nil {
-			log.Fatal("Backup provider connection failed:", err)
-		}
-		controller.providerBackup = conn2
-		controller.startWorker(conn2, "Backup", false)
+		wg.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeWait is how long closeConn waits for the peer to answer a close
+// frame before dropping the connection
+const closeWait = 250 * time.Millisecond
+
+// closeConn closes conn with a close handshake: it sends a close frame with
+// code and reason, then waits up to closeWait for the peer's reply to stop
+// the connection's reader, which closes readerDone, before closing the
+// socket. A peer that already hung up fails the write and is not waited
+// for, nor is anyone when readerDone is nil because nothing reads conn.
+func closeConn(conn Conn, readerDone <-chan struct{}, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	if err == nil && readerDone != nil {
+		timer := time.NewTimer(closeWait)
+		select {
+		case <-readerDone:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	conn.Close()
+}
 
-	log.Println("Controller listening on :8080")
-	http.ListenAndServe(":8080", nil)
-}
\ No newline at end of file
+// connectProvider dials p until it succeeds, backing off between
+// attempts and holding off altogether while its circuit breaker is open.
+// It only gives up when the controller stops. Dials of p's own connection,
+// as opposed to those of its lanes, are tracked in p's state.
+func (c *Controller) connectProvider(p *provider, track bool) (conn Conn, err error) {
+	setState := func(to ProviderState) {
+		if track {
+			c.mu.Lock()
+			c.setStateLocked(p, to)
+			c.mu.Unlock()
+		}
+	}
+	defer func() {
+		if err != nil {
+			setState(ProviderDisconnected)
+		}
+	}()
+	url := p.url
+	bo := c.newBackoff()
+	for {
+		c.mu.Lock()
+		wait := c.breakerWaitLocked(p)
+		c.mu.Unlock()
+		if wait > 0 {
+			select {
+			case <-c.clock.After(wait):
+			case <-c.ctx.Done():
+				return nil, c.ctx.Err()
+			}
+			continue
+		}
+		setState(ProviderConnecting)
+		header, err := c.dialHeaders(url)
+		if err == nil {
+			conn, err = c.dial(c.ctx, url, header)
+		}
+		if err == nil {
+			if err = c.checkNegotiated(url, conn); err != nil {
+				closeConn(conn, nil, websocket.CloseProtocolError, "no acceptable subprotocol")
+			}
+		}
+		if err == nil {
+			c.mu.Lock()
+			c.breakerSucceededLocked(p)
+			c.mu.Unlock()
+			return conn, nil
+		}
+		if c.ctx.Err() != nil {
+			return nil, c.ctx.Err()
+		}
+		c.mu.Lock()
+		open := c.breakerFailedLocked(p, err)
+		c.mu.Unlock()
+		if open {
+			setState(ProviderFailed)
+			bo.Reset()
+			continue
+		}
+		wait = bo.Next()
+		c.log.Warn("dialing provider failed", "url", url, "retry_in", wait, "err", err)
+		select {
+		case <-c.clock.After(wait):
+		case <-c.ctx.Done():
+			return nil, c.ctx.Err()
+		}
+	}
+}
+
+// connect dials p, replacing any previous connection, and starts reading
+// what the provider sends back
+func (c *Controller) connect(p *provider) (Conn, error) {
+	c.mu.Lock()
+	if p.conn != nil {
+		// The worker gave up on the old connection before its reader
+		// noticed, which now leaves p's state alone
+		p.conn = nil
+		c.setStateLocked(p, ProviderDisconnected)
+	}
+	c.mu.Unlock()
+	conn, err := c.connectProvider(p, true)
+	if err != nil {
+		return nil, err
+	}
+	readerDone := make(chan struct{})
+	c.mu.Lock()
+	p.conn = conn
+	p.readerDone = readerDone
+	if c.draining.Load() {
+		c.setStateLocked(p, ProviderDraining)
+	} else {
+		c.setStateLocked(p, ProviderConnected)
+	}
+	c.mu.Unlock()
+	if c.ctx.Err() != nil {
+		// Close may have run between the dial and recording the conn
+		closeConn(conn, nil, websocket.CloseNormalClosure, "shutting down")
+		return nil, c.ctx.Err()
+	}
+	c.log.Info("provider connected", "provider", p.name)
+	c.goroutines.spawn("provider-reader", func() {
+		defer close(readerDone)
+		c.readProviderMessages(conn, p)
+		c.mu.Lock()
+		if p.conn == conn {
+			c.setStateLocked(p, ProviderDisconnected)
+		}
+		c.mu.Unlock()
+		// An idle worker would only notice on its next write
+		select {
+		case p.lost <- conn:
+		default:
+		}
+	})
+	if c.cfg.PingInterval > 0 {
+		c.goroutines.spawn("provider-keepalive", func() {
+			c.keepAlive(conn, p.name, readerDone)
+		})
+	}
+	return conn, nil
+}
+
+// keepAlive pings conn every PingInterval until its reader stops. The
+// reader's deadline is pushed out by every pong or message, so a slow peer
+// that still answers is kept while a silent one fails the read and gets the
+// connection closed.
+func (c *Controller) keepAlive(conn Conn, label string, readerDone <-chan struct{}) {
+	ticker := c.clock.NewTicker(c.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-readerDone:
+			return
+		case <-c.ctx.Done():
+			return
+		}
+		deadline := time.Now().Add(c.cfg.PongTimeout)
+		if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+			c.log.Warn("ping failed", "conn", label, "err", err)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// extendReadDeadline gives the provider another ping interval plus pong
+// timeout to show it is alive
+func (c *Controller) extendReadDeadline(conn Conn) {
+	if c.cfg.PingInterval > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.cfg.PingInterval + c.cfg.PongTimeout))
+	}
+}
+
+// send writes msg to p, reconnecting and retrying as long as the write
+// fails. Past WriteErrorThreshold failures in a row it pauses and probes ws
+// before each retry, see pauseWrites, reconnecting only if the probe
+// fails. It returns the connection the message went out on, or an error
+// once the controller stops. A write failing because guard closed ws is not
+// retried, send returns errSendTimedOut along with ws instead.
+func (c *Controller) send(p *provider, ws Conn, msg []byte, guard *sendGuard) (Conn, error) {
+	for {
+		if c.cfg.WriteTimeout > 0 {
+			ws.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+		}
+		err := ws.WriteMessage(c.messageType(ws), msg)
+		if err == nil {
+			c.writeSucceeded(p)
+			return ws, nil
+		}
+		if guard.fired() {
+			return ws, errSendTimedOut
+		}
+		if c.writeFailed(p) {
+			switch err := c.pauseWrites(p, ws, guard); err {
+			case nil:
+				continue
+			case errSendTimedOut:
+				return ws, err
+			case errConnLost:
+			default:
+				return nil, err
+			}
+		}
+		c.log.Warn("write failed, reconnecting", "provider", p.name, "err", err)
+		if ws, err = c.reconnect(p, ws); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// reconnect replaces p's failed connection ws with a new one, returning it
+// or an error once the controller stops. Events the provider never
+// acknowledged over ws are queued to be sent again. A provider that closed
+// ws with one of FinalCloseCodes is not dialed again, reconnect
+// returns errProviderDone instead.
+func (c *Controller) reconnect(p *provider, ws Conn) (Conn, error) {
+	if l := c.laneOf(p, ws); l != nil {
+		return c.reconnectLane(p, l, ws)
+	}
+	ws.Close()
+	if p.next != nil {
+		// Don't let the rest of the stream wait for p to come back
+		c.failOver(p, ws)
+	}
+	if c.providerDone(p) {
+		return nil, errProviderDone
+	}
+	ws, err := c.connect(p)
+	if err != nil {
+		return nil, err
+	}
+	c.metrics.reconnects.WithLabelValues(p.name).Inc()
+	c.mu.Lock()
+	n := c.resendUnackedLocked(p, c.now())
+	c.mu.Unlock()
+	if n > 0 {
+		c.log.Info("resending unacknowledged events", "provider", p.name, "events", n)
+	}
+	return ws, nil
+}
+
+// messageType returns the WebSocket frame type messages to the provider on
+// ws go out as
+func (c *Controller) messageType(ws Conn) int {
+	if c.cfg.BinaryFrames || binaryCodec(codecOf(ws)) {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// sendAll writes msgs to p in order. If the connection is replaced part way
+// through, the whole sequence is written again on the new one so a provider
+// never has to piece an event together across connections. Writing the
+// sequence over one connection may take SendTimeout, after which sendAll
+// gives up with errSendTimedOut and the connection it closed.
+func (c *Controller) sendAll(p *provider, ws Conn, msgs [][]byte) (Conn, error) {
+	for {
+		restarted := false
+		guard := c.guardSend(ws)
+		for i, msg := range msgs {
+			next, err := c.send(p, ws, msg, guard)
+			if err != nil {
+				guard.stop()
+				return next, err
+			}
+			if next != ws {
+				ws = next
+				guard.stop()
+				guard = c.guardSend(ws)
+				if i > 0 {
+					restarted = true
+					break
+				}
+			}
+		}
+		guard.stop()
+		if !restarted {
+			return ws, nil
+		}
+	}
+}
+
+// batchMessage carries several events in one frame. Its type tells it apart
+// from a single event.
+type batchMessage struct {
+	Type   string  `json:"type"` // always "batch"
+	Events []Event `json:"events"`
+}
+
+// encodeBatch marshals batch with codec into the messages that carry it to
+// p: a single event as is, or one message per chunk frame when its payload
+// exceeds MaxChunkSize, and several events wrapped in a batchMessage. A
+// provider with a Transform gets each event as it encodes it instead.
+func (c *Controller) encodeBatch(p *provider, codec Codec, batch []Event) ([][]byte, error) {
+	if fn := c.transforms[p.name]; fn != nil {
+		return transformBatch(fn, batch)
+	}
+	if len(batch) > 1 {
+		msg, err := codec.Marshal(batchMessage{Type: "batch", Events: batch})
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{msg}, nil
+	}
+	event := batch[0]
+	if !c.needsChunking(event) {
+		msg, err := codec.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{msg}, nil
+	}
+	frames := Chunker{MaxChunkSize: c.cfg.MaxChunkSize}.Split(event)
+	msgs := make([][]byte, len(frames))
+	for i, frame := range frames {
+		msg, err := codec.Marshal(frame)
+		if err != nil {
+			return nil, err
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+func (c *Controller) handleAppConnection(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeApp(w, r) {
+		return
+	}
+	if ok, reason := c.originAllowed(r); !ok {
+		c.log.Warn("app connection rejected", "remote", r.RemoteAddr, "origin", r.Header.Get("Origin"), "reason", reason)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if c.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if c.appsFull() {
+		c.log.Warn("app connection rejected", "remote", r.RemoteAddr, "reason", "too many apps", "max_apps", c.cfg.MaxApps)
+		http.Error(w, "too many app connections", http.StatusServiceUnavailable)
+		return
+	}
+	session, err := sessionOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	notify, err := notifyOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := c.checkAppSubprotocol(r); err != nil {
+		c.log.Warn("app connection rejected", "remote", r.RemoteAddr, "reason", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upgrader := websocket.Upgrader{
+		CheckOrigin:       func(*http.Request) bool { return true }, // checked above
+		EnableCompression: c.cfg.Compression,
+		Subprotocols:      c.appSubprotocols(),
+		Error:             upgradeError,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		c.log.Warn("app connection upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	app, apps, err := c.addApp(conn, session, notify)
+	if errors.Is(err, errTooManyApps) {
+		// Others connected between the check above and the upgrade
+		c.log.Warn("app connection rejected", "remote", r.RemoteAddr, "reason", "too many apps", "max_apps", c.cfg.MaxApps)
+		closeConn(conn, nil, websocket.CloseTryAgainLater, "too many app connections")
+		return
+	}
+	if err != nil {
+		closeConn(conn, nil, websocket.CloseNormalClosure, "shutting down")
+		return
+	}
+	c.log.Info("app connected", "remote", r.RemoteAddr, "apps", apps, "session", session)
+	if session != "" {
+		old, resumed := c.attachSession(app, session)
+		if old != nil {
+			c.takeOverSession(app, old)
+		}
+		c.greetSession(app, resumed)
+	}
+	c.goroutines.spawn("app-reader", func() {
+		defer close(app.readerDone)
+		c.readEventsFromApp(app)
+	})
+	if notify {
+		c.goroutines.spawn("app-notices", func() {
+			c.writeNotices(app)
+		})
+	}
+	if c.cfg.ReadTimeout > 0 && c.cfg.PingInterval > 0 {
+		// Keep a healthy but quiet app answering pongs inside ReadTimeout
+		c.goroutines.spawn("app-keepalive", func() {
+			c.keepAlive(conn, "App", app.readerDone)
+		})
+	}
+}
+
+// upgradeError answers a handshake the app upgrader refused with status
+// and reason, telling plain HTTP requests that this endpoint speaks
+// WebSocket only with 426 Upgrade Required
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	if status == http.StatusBadRequest && !websocket.IsWebSocketUpgrade(r) {
+		w.Header().Set("Upgrade", "websocket")
+		status = http.StatusUpgradeRequired
+	}
+	http.Error(w, reason.Error(), status)
+}
+
+// appConn is a connected app. Its reader is the only goroutine reading
+// conn; anything writing messages to it goes through write.
+type appConn struct {
+	conn       *websocket.Conn
+	codec      Codec         // negotiated for conn, see codecOf
+	readerDone chan struct{} // closed once the reader stops
+	session    *appSession   // session conn feeds, nil without one; guarded by Controller.mu
+	submitter  string        // stamped on the events it sends, see Event.Submitter
+	notices    chan []byte   // notifications about its events waiting to be written, nil unless it asked for them
+	writeMu    sync.Mutex
+}
+
+// write sends data to the app, in a binary frame if its codec calls for
+// one and a text frame otherwise. It is safe for concurrent use.
+func (a *appConn) write(data []byte, timeout time.Duration) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	if timeout > 0 {
+		a.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	typ := websocket.TextMessage
+	if binaryCodec(a.codec) {
+		typ = websocket.BinaryMessage
+	}
+	return a.conn.WriteMessage(typ, data)
+}
+
+// errTooManyApps refuses an app connection past Config.MaxApps
+var errTooManyApps = errors.New("too many app connections")
+
+// appsFull reports whether MaxApps apps are connected already
+func (c *Controller) appsFull() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg.MaxApps > 0 && len(c.apps) >= c.cfg.MaxApps
+}
+
+// addApp records conn as a connected app feeding session, if not empty,
+// and returns it together with how many are connected now. notify gives
+// it a notification stream. It refuses once the controller is stopping or
+// draining, since the connection would be missed by them and never closed,
+// and with errTooManyApps past MaxApps.
+func (c *Controller) addApp(conn *websocket.Conn, session string, notify bool) (*appConn, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.stoppedErrLocked(); err != nil {
+		return nil, len(c.apps), err
+	}
+	if c.cfg.MaxApps > 0 && len(c.apps) >= c.cfg.MaxApps {
+		return nil, len(c.apps), errTooManyApps
+	}
+	if c.apps == nil {
+		c.apps = make(map[*websocket.Conn]*appConn)
+	}
+	app := &appConn{conn: conn, codec: codecOf(conn), readerDone: make(chan struct{}), submitter: c.submitterLocked(session)}
+	if notify {
+		app.notices = make(chan []byte, noticeQueueSize)
+	}
+	c.apps[conn] = app
+	c.appEnded = false
+	return app, len(c.apps), nil
+}
+
+// removeApp forgets the app on conn. Once the last app is gone, and no
+// session awaits resumption, the stream counts as ended and the workers
+// are woken to act on it. It returns how many apps remain connected.
+func (c *Controller) removeApp(conn *websocket.Conn) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	app, ok := c.apps[conn]
+	if !ok {
+		return len(c.apps)
+	}
+	delete(c.apps, conn)
+	c.detachSessionLocked(app)
+	if len(c.apps) == 0 && !c.awaitingResumeLocked() {
+		c.appEnded = true
+		c.fanOutLocked()
+	}
+	return len(c.apps)
+}
+
+func (c *Controller) readEventsFromApp(app *appConn) {
+	conn := app.conn
+	conn.SetPongHandler(func(string) error {
+		c.extendAppReadDeadline(conn)
+		return nil
+	})
+	idle := c.startIdleTimer(app)
+	defer idle.stop()
+	var index uint64 // events read so far, NDJSON lines included
+	for {
+		c.extendAppReadDeadline(conn)
+		msg, err := c.readAppMessage(conn)
+		if err == errMessageTooLarge {
+			// Nothing more can be read from the stream, tell the app why
+			// before hanging up
+			c.log.Warn("app message exceeds the size limit, closing the connection", "limit", c.cfg.MaxMessageBytes)
+			c.rejectEvent(app, "", 0, fmt.Errorf("message exceeds %d bytes", c.cfg.MaxMessageBytes))
+			msg := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "message too large")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		}
+		if err != nil {
+			conn.Close()
+			c.log.Info("app connection closed", "err", err, "apps", c.removeApp(conn))
+			return
+		}
+		idle.reset()
+		if lines, ok := c.splitNDJSON(app, msg); ok {
+			for i, line := range lines {
+				if len(line) == 0 {
+					continue
+				}
+				c.readAppEvent(app, line, index, i+1)
+				index++
+			}
+			continue
+		}
+		c.readAppEvent(app, msg, index, 0)
+		index++
+	}
+}
+
+// readAppEvent buffers the event in msg, the index-th the app sent over its
+// connection, or tells the app why it was rejected. line is the NDJSON
+// line msg came on, zero for a message of its own.
+func (c *Controller) readAppEvent(app *appConn, msg []byte, index uint64, line int) {
+	var event Event
+	err := app.codec.Unmarshal(msg, &event)
+	if err != nil {
+		c.rejectEvent(app, "", line, fmt.Errorf("malformed event: %w", err))
+		return
+	}
+	event.Submitter = app.submitter
+	if err := c.validateEvent(app.codec, msg, event); err != nil {
+		c.rejectEvent(app, event.ID, line, err)
+		c.deadLetterInvalid(event, err)
+		return
+	}
+	assigned := c.assignID(&event)
+	c.waitIngest()
+	c.waitOutbound(event)
+	c.mu.Lock()
+	accepted := c.acceptLocked(event)
+	if accepted {
+		sessionAcceptedLocked(app, event)
+	}
+	resume := c.backpressureLocked()
+	c.mu.Unlock()
+	c.runDropHooks()
+	if assigned && accepted {
+		c.sendAssignedID(app, event.ID, index)
+	}
+	if resume != nil {
+		c.pauseApp(app, resume)
+	}
+}
+
+// errMessageTooLarge is returned by readAppMessage for a message longer
+// than MaxMessageBytes
+var errMessageTooLarge = errors.New("message too large")
+
+// readAppMessage reads the next message from the app. Only up to
+// MaxMessageBytes of it are ever held in memory; a longer message fails
+// with errMessageTooLarge, after which the stream can't be read further.
+func (c *Controller) readAppMessage(conn *websocket.Conn) ([]byte, error) {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.MaxMessageBytes <= 0 {
+		return io.ReadAll(r)
+	}
+	msg, err := io.ReadAll(io.LimitReader(r, int64(c.cfg.MaxMessageBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > c.cfg.MaxMessageBytes {
+		return nil, errMessageTooLarge
+	}
+	return msg, nil
+}
+
+// acceptLocked buffers event unless it duplicates one accepted recently,
+// remembering its ID to catch later duplicates. It reports false if the
+// buffer rejected event. c.mu must be held.
+func (c *Controller) acceptLocked(event Event) bool {
+	if c.isDuplicateLocked(event) {
+		return true
+	}
+	if !c.bufferLocked(event) {
+		return false
+	}
+	if c.recentIDs != nil && event.ID != "" {
+		c.recentIDs.add(event.ID)
+	}
+	return true
+}
+
+// isDuplicateLocked reports whether an event with the same ID as event was
+// accepted recently, counting it as deduplicated if so. Events without an
+// ID are never duplicates. c.mu must be held.
+func (c *Controller) isDuplicateLocked(event Event) bool {
+	if c.recentIDs == nil || event.ID == "" || !c.recentIDs.contains(event.ID) {
+		return false
+	}
+	c.deduplicated++
+	c.metrics.deduplicated.Inc()
+	c.log.Debug("skipping duplicate event", "event_id", event.ID)
+	return true
+}
+
+// expiredLocked reports whether event went stale before it could be sent to
+// p, counting it if so. c.mu must be held.
+func (c *Controller) expiredLocked(p *provider, event Event) bool {
+	if !event.expired(c.now()) {
+		return false
+	}
+	c.expired++
+	c.metrics.expired.WithLabelValues(p.name).Inc()
+	c.log.Debug("skipping expired event", "provider", p.name, "event_id", event.ID, "expired_at", event.ExpiresAt)
+	c.notifyLocked(event, appNotice{Type: "expired", Provider: p.name})
+	c.noteDropLocked(event, DropExpired)
+	return true
+}
+
+// bufferLocked adds event to the buffer, applying the drop policy if it is
+// full by either event count or payload bytes, and wakes the workers. It
+// reports false if event was rejected, as one larger than MaxBufferBytes
+// always is. An event the router has no provider for is dead-lettered
+// instead. c.mu must be held.
+func (c *Controller) bufferLocked(event Event) bool {
+	event.EnqueuedAt = c.now()
+	if event.ExpiresAt.IsZero() && c.cfg.EventTTL > 0 {
+		event.ExpiresAt = event.EnqueuedAt.Add(c.cfg.EventTTL)
+	}
+	targets := c.routeLocked(event)
+	if targets != nil && len(targets) == 0 {
+		c.deadLetterUnroutedLocked(event)
+		return true
+	}
+	if c.events.tooLarge(event) {
+		c.dropped++
+		c.metrics.dropped.Inc()
+		c.noteDropLocked(event, DropBufferFull)
+		c.log.Warn("event larger than the buffer may hold, rejected it", "event_id", event.ID, "bytes", len(event.Payload), "max_bytes", c.cfg.MaxBufferBytes)
+		return false
+	}
+	if !c.events.fits(event) && c.cfg.DropPolicy == RejectNewest {
+		c.dropped++
+		c.metrics.dropped.Inc()
+		c.noteDropLocked(event, DropBufferFull)
+		c.log.Warn("buffer full, rejected event", "event_id", event.ID, "buffered", c.events.len(), "bytes", c.events.bytes())
+		return false
+	}
+	for !c.events.fits(event) {
+		c.evictLocked()
+	}
+	if err := c.events.push(event); err != nil {
+		c.dropped++
+		c.metrics.dropped.Inc()
+		c.noteDropLocked(event, DropStoreFailed)
+		c.log.Error("storing event failed, dropped it", "event_id", event.ID, "err", err)
+		return false
+	}
+	c.enqueueLocked(c.events.next()-1, event, targets)
+	c.coalesceLocked(c.events.next()-1, event)
+	c.traceBufferedLocked(c.events.next()-1, event)
+	c.metrics.received.Inc()
+	c.fanOutLocked()
+	return true
+}
+
+// observeLatencyLocked records how long each event of batch, just written
+// to p for the first time, waited in the buffer. Events replayed from a
+// store have no enqueue time and are left out. c.mu must be held.
+func (c *Controller) observeLatencyLocked(p *provider, batch []Event) {
+	now := c.now()
+	latency := c.metrics.latency.WithLabelValues(p.name)
+	for _, event := range batch {
+		if !event.EnqueuedAt.IsZero() {
+			latency.Observe(now.Sub(event.EnqueuedAt).Seconds())
+		}
+	}
+}
+
+// evictLocked drops the oldest buffered event to make room. c.mu must be
+// held.
+func (c *Controller) evictLocked() {
+	c.dropped++
+	c.metrics.dropped.Inc()
+	c.traceDoneLocked(c.events.first, "dropped from a full buffer")
+	c.forgetSeqsLocked(c.events.first)
+	old, err := c.events.pop()
+	c.noteDropLocked(old, DropEvicted)
+	c.log.Warn("buffer full, dropped oldest event", "event_id", old.ID, "buffered", c.events.len()+1, "bytes", c.events.bytes())
+	if err != nil {
+		c.log.Error("consuming event in store failed", "event_id", old.ID, "err", err)
+	}
+}
+
+// restore buffers the events the store still holds from a previous run,
+// which it numbers from 0. If there are more than fit the oldest are
+// evicted.
+func (c *Controller) restore() error {
+	var events []Event
+	if err := c.events.store.Range(0, func(e Event) bool {
+		events = append(events, e)
+		return true
+	}); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, event := range events {
+		c.events.held(event)
+	}
+	for c.events.overfull() {
+		c.evictLocked()
+	}
+	for idx := c.events.first; idx < len(events); idx++ {
+		event := events[idx]
+		targets := c.routeLocked(event)
+		if targets != nil && len(targets) == 0 {
+			// Passed by every provider, it goes with the next release
+			c.deadLetterUnroutedLocked(event)
+		}
+		c.enqueueLocked(idx, event, targets)
+		if c.recentIDs != nil && event.ID != "" {
+			c.recentIDs.add(event.ID)
+		}
+	}
+	if len(events) > 0 {
+		c.log.Info("restored events from the store", "events", c.events.len())
+	}
+	return nil
+}
+
+// releaseLocked frees buffer slots of events every provider has sent, and
+// acknowledged when acks are required. c.mu must be held.
+func (c *Controller) releaseLocked() {
+	done := c.events.next()
+	for _, p := range c.providers() {
+		if p.ackedIndex < done {
+			done = p.ackedIndex
+		}
+	}
+	for c.events.first < done {
+		c.traceDoneLocked(c.events.first, "")
+		c.forgetSeqsLocked(c.events.first)
+		if old, err := c.events.pop(); err != nil {
+			c.log.Error("consuming event in store failed", "event_id", old.ID, "err", err)
+		}
+	}
+	c.relieveLocked()
+	c.ingestedLocked()
+}
+
+// extendAppReadDeadline gives the app another ReadTimeout to send something
+func (c *Controller) extendAppReadDeadline(conn *websocket.Conn) {
+	if c.cfg.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.cfg.ReadTimeout))
+	}
+}
+
+// providers returns every provider the controller sends to
+func (c *Controller) providers() []*provider {
+	return c.pool.members
+}
+
+// fanOutLocked wakes the worker of every active provider. c.mu must be held.
+func (c *Controller) fanOutLocked() {
+	for _, p := range c.providers() {
+		if p.feed == nil {
+			continue
+		}
+		select {
+		case p.feed <- struct{}{}:
+		default: // a wake-up is already pending
+		}
+	}
+}
+
+// errConnLost is returned by waitForEvent when the provider connection
+// dropped while the worker had nothing to write
+var errConnLost = errors.New("provider connection lost")
+
+// errUnencodable is returned by deliver for a batch the codec failed on,
+// whose events were reported as dropped
+var errUnencodable = errors.New("events cannot be encoded")
+
+// errStreamEnded is returned by waitForEvent once the app ended its stream
+// and every event it sent was handed out
+var errStreamEnded = errors.New("app ended its stream")
+
+// waitForEvent blocks until there is an event to send to p and returns it
+// together with its index, sleeping on feed in between. An unacknowledged
+// event due to be resent comes first, reported by resend; otherwise the
+// queued event of highest priority is returned. When untilEnd is set it
+// returns errStreamEnded once the app has ended its stream and the queue is
+// empty, errIdle if idle fires while there is nothing to send, errProbe
+// likewise for probe and errConnLost if the reader of p's connection
+// stopped meanwhile. Replay jobs come before everything and are reported
+// by errReplay. It returns the context's error when the controller stops.
+func (c *Controller) waitForEvent(p *provider, feed <-chan struct{}, idle, probe <-chan time.Time, untilEnd bool) (idx int, event Event, resend bool, err error) {
+	// Resends may dead-letter events, see nextResendLocked, and expired
+	// events are dropped
+	defer c.runDropHooks()
+	for {
+		c.mu.Lock()
+		// A paused provider is sent nothing, not even to end the stream,
+		// until it is resumed
+		paused := p.paused
+		// At MaxInFlight queued events wait for acks, resends still go out
+		held := paused || (c.inFlightFullLocked(p, 0) && len(p.queue) > 0)
+		if !paused {
+			if len(p.replays) > 0 {
+				c.mu.Unlock()
+				return 0, Event{}, false, errReplay
+			}
+			if idx, event, ok := c.nextResendLocked(p); ok {
+				c.mu.Unlock()
+				return idx, event, true, nil
+			}
+		}
+		if !held {
+			if idx, event, ok := c.nextQueuedLocked(p, true); ok {
+				c.mu.Unlock()
+				return idx, event, false, nil
+			}
+		}
+		ended := c.appEnded
+		c.mu.Unlock()
+		c.runDropHooks()
+		if untilEnd && ended && !held {
+			return 0, Event{}, false, errStreamEnded
+		}
+
+		select {
+		case <-feed:
+		case <-idle:
+			return 0, Event{}, false, errIdle
+		case <-probe:
+			return 0, Event{}, false, errProbe
+		case conn := <-p.lost:
+			c.mu.Lock()
+			current := conn == p.conn
+			c.mu.Unlock()
+			if current {
+				return 0, Event{}, false, errConnLost
+			}
+		case <-c.ctx.Done():
+			return 0, Event{}, false, c.ctx.Err()
+		}
+	}
+}
+
+// readProviderMessages consumes everything the provider sends back while we
+// push to it, reacting to throttle signals and acks
+func (c *Controller) readProviderMessages(ws Conn, p *provider) {
+	label := p.name
+	c.extendReadDeadline(ws)
+	ws.SetPongHandler(func(string) error {
+		c.extendReadDeadline(ws)
+		return nil
+	})
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			// Unblock the worker's next write so it takes the reconnect path
+			c.log.Info("provider reader stopped", "provider", label, "err", err)
+			if c.ctx.Err() == nil {
+				c.mu.Lock()
+				c.noteCloseLocked(p, err)
+				c.mu.Unlock()
+			}
+			ws.Close()
+			return
+		}
+		c.extendReadDeadline(ws)
+		var pm providerMessage
+		if codecOf(ws).Unmarshal(msg, &pm) != nil {
+			continue
+		}
+		if pm.ThrottleMs > 0 {
+			c.applyThrottle(p, label, time.Duration(pm.ThrottleMs)*time.Millisecond)
+		}
+		if pm.Ack != "" && !c.ack(p, pm.Ack) {
+			c.log.Debug("ignoring ack of an event not awaiting one", "provider", label, "event_id", pm.Ack)
+		}
+		if pm.Ack != "" && pm.Seq != 0 {
+			c.checkAckSeq(p, pm.Seq)
+		}
+	}
+}
+
+// applyThrottle halves the send rate to p, its own limit if it has one and
+// the total cap otherwise, and holds off ramping back up for d
+func (c *Controller) applyThrottle(p *provider, label string, d time.Duration) {
+	rl := p.limiter
+	if rl == nil {
+		rl = c.ratelimiter
+	}
+	if rl == nil {
+		c.log.Warn("provider throttled us, but it has no rate limit to lower", "provider", label, "for", d)
+		return
+	}
+	max := rl.Max() / 2
+	if max < 1 {
+		max = 1
+	}
+	rl.SetMax(max)
+
+	c.mu.Lock()
+	if until := c.now().Add(d); until.After(c.throttledUntil) {
+		c.throttledUntil = until
+	}
+	c.mu.Unlock()
+	c.log.Warn("provider throttled us, lowering rate limit", "provider", label, "for", d, "max", max)
+}
+
+// rateLimiters returns the total cap, if any, followed by the providers'
+// own limiters
+func (c *Controller) rateLimiters() []*RateLimiter {
+	var limiters []*RateLimiter
+	if c.ratelimiter != nil {
+		limiters = append(limiters, c.ratelimiter)
+	}
+	for _, p := range c.pool.members {
+		if p.limiter != nil {
+			limiters = append(limiters, p.limiter)
+		}
+	}
+	return limiters
+}
+
+// rampRateLimits steps throttled rate limits back up towards their full
+// size, a quarter at a time, while no throttle signal is in effect
+func (c *Controller) rampRateLimits() {
+	limiters := c.rateLimiters()
+	ticker := c.clock.NewTicker(rampInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-c.ctx.Done():
+			return
+		}
+		c.mu.Lock()
+		throttled := c.now().Before(c.throttledUntil)
+		c.mu.Unlock()
+		if throttled {
+			continue
+		}
+		for _, rl := range limiters {
+			if max, full := rl.Max(), rl.fullMax(); max < full {
+				step := full / 4
+				if step < 1 {
+					step = 1
+				}
+				max += step
+				if max > full {
+					max = full
+				}
+				rl.SetMax(max)
+				c.log.Info("rate limit ramped back up", "max", max)
+			}
+		}
+	}
+}
+
+// newBackoff returns a backoff configured from the controller with its own
+// jitter source
+func (c *Controller) newBackoff() *Backoff {
+	return &Backoff{
+		Base:   c.backoffBase,
+		Max:    c.backoffMax,
+		Jitter: c.backoffJitter,
+		Rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// throttle blocks until rl grants weight tokens or the controller stops.
+// Retries are spaced by bo, but never sooner than the limiter says a token
+// can be available unless rl is reconfigured meanwhile. A nil rl grants
+// everything.
+func (c *Controller) throttle(rl *RateLimiter, bo *Backoff, label string, weight int) error {
+	if rl == nil {
+		return nil
+	}
+	if max := rl.Max(); weight > max {
+		c.log.Warn("send weight exceeds rate limit, waiting for a full bucket", "provider", label, "weight", weight, "max", max)
+	}
+	for {
+		changed := rl.reconfigured()
+		ok, wait := rl.reserveN(weight)
+		if ok {
+			return nil
+		}
+		if d := bo.Next(); d > wait {
+			wait = d
+		}
+		c.log.Debug("rate-limited", "provider", label, "retry_in", wait)
+		select {
+		case <-c.clock.After(wait):
+		case <-changed:
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
+
+// throttleProvider takes weight tokens from p's own limiter, then from the
+// total cap, blocking until both grant them or the controller stops
+func (c *Controller) throttleProvider(p *provider, bo *Backoff, weight int) error {
+	if err := c.throttle(p.limiter, bo, p.name, weight); err != nil {
+		return err
+	}
+	return c.throttle(c.ratelimiter, bo, p.name, weight)
+}
+
+// deliver rate-limits, encodes and sends batch to p as a single message, or
+// as chunk frames for a lone oversized event. Events of a BypassTypes type
+// take no tokens, though a batch mixing them with others still waits for
+// those. A batch that cannot be encoded is logged, reported as dropped and
+// answered with errUnencodable along with ws. It returns the connection in
+// use afterwards, or an error once the controller stops.
+// A batch that took longer than SendTimeout to write is given up on: the
+// connection, which may be congested, is replaced and errSendTimedOut
+// returned along with the new one.
+func (c *Controller) deliver(p *provider, ws Conn, bo *Backoff, batch []Event) (Conn, error) {
+	sent := batch
+	batch = c.compress(p.name, batch)
+	msgs, err := c.encodeBatch(p, codecOf(ws), batch)
+	if err != nil {
+		c.log.Error("dropping events that cannot be encoded", "provider", p.name, "events", len(batch), "err", err)
+		c.runUnencodableHook(sent)
+		return ws, errUnencodable
+	}
+	weight, bypassed := 0, 0
+	for _, event := range batch {
+		if c.bypass.types[event.Type] {
+			bypassed++
+			continue
+		}
+		weight += event.weight()
+		if c.typeLimiter == nil {
+			continue
+		}
+		if rl := c.typeLimiter.Limiter(event.Type); rl != nil {
+			if err := c.throttle(rl, bo, p.name, event.weight()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if weight > 0 {
+		if err := c.throttleProvider(p, bo, weight); err != nil {
+			return nil, err
+		}
+	}
+	ws, err = c.sendAll(p, ws, msgs)
+	if err == errSendTimedOut {
+		c.log.Warn("send timed out, giving up on the events and reconnecting", "provider", p.name, "events", len(batch), "timeout", c.cfg.SendTimeout)
+		if ws, err = c.reconnect(p, ws); err != nil {
+			return nil, err
+		}
+		return ws, errSendTimedOut
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.metrics.sent.WithLabelValues(p.name).Add(float64(len(batch)))
+	if bypassed > 0 {
+		c.countBypassed(p, bypassed)
+	}
+	c.runSentHook(p, sent)
+	return ws, nil
+}
+
+// compress returns a copy of batch with payloads above CompressThreshold
+// gzipped. Events that fail to compress are sent as they are.
+func (c *Controller) compress(label string, batch []Event) []Event {
+	if c.cfg.CompressThreshold <= 0 {
+		return batch
+	}
+	comp := Compressor{Threshold: c.cfg.CompressThreshold}
+	out := make([]Event, len(batch))
+	for i, event := range batch {
+		compressed, err := comp.Compress(event)
+		if err != nil {
+			c.log.Warn("sending event uncompressed", "provider", label, "event_id", event.ID, "err", err)
+			compressed = event
+		}
+		out[i] = compressed
+	}
+	return out
+}
+
+// batching reports whether workers group events into batch messages
+func (c *Controller) batching() bool {
+	return c.cfg.BatchSize > 1
+}
+
+// needsChunking reports whether event has to be sent as chunk frames
+func (c *Controller) needsChunking(event Event) bool {
+	return c.cfg.MaxChunkSize > 0 && len(event.Payload) > c.cfg.MaxChunkSize
+}
+
+// collectBatch extends batch with the next events queued for p until it
+// holds BatchSize events or FlushInterval has passed since it was started.
+// An event that needs chunking ends the batch and is left for the next
+// send. It returns the batch, the buffer indexes of its events, and whether
+// the controller is stopping.
+func (c *Controller) collectBatch(p *provider, feed <-chan struct{}, batch []Event, indexes []int) ([]Event, []int, bool) {
+	// Expired events are dropped on the way, see nextQueuedLocked
+	defer c.runDropHooks()
+	flushed := make(chan struct{})
+	flush := c.clock.AfterFunc(c.cfg.FlushInterval, func() { close(flushed) })
+	defer flush.Stop()
+	for len(batch) < c.cfg.BatchSize {
+		c.mu.Lock()
+		idx, event, ok := c.nextQueuedLocked(p, false)
+		chunked := ok && c.needsChunking(event)
+		// The batch goes out as a whole, its events count as in flight
+		held := p.paused || c.inFlightFullLocked(p, len(batch))
+		if ok && !chunked && !held {
+			c.nextQueuedLocked(p, true)
+		}
+		c.mu.Unlock()
+		if chunked || held {
+			break
+		}
+		if ok {
+			batch = append(batch, event)
+			indexes = append(indexes, idx)
+			continue
+		}
+
+		select {
+		case <-feed:
+		case <-flushed:
+			return batch, indexes, false
+		case <-c.ctx.Done():
+			return batch, indexes, true
+		}
+	}
+	return batch, indexes, false
+}
+
+// flushOnShutdown makes one last, unthrottled attempt to write batch so a
+// partially collected batch isn't left behind when the controller stops
+func (c *Controller) flushOnShutdown(p *provider, ws Conn, batch []Event) {
+	msgs, err := c.encodeBatch(p, codecOf(ws), c.compress(p.name, batch))
+	if err != nil {
+		c.log.Error("dropping events that cannot be encoded", "provider", p.name, "events", len(batch), "err", err)
+		c.runUnencodableHook(batch)
+		return
+	}
+	for _, msg := range msgs {
+		if c.cfg.WriteTimeout > 0 {
+			ws.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+		}
+		if err := ws.WriteMessage(c.messageType(ws), msg); err != nil {
+			c.log.Error("could not flush events on shutdown", "provider", p.name, "events", len(batch), "err", err)
+			return
+		}
+	}
+	c.metrics.sent.WithLabelValues(p.name).Add(float64(len(batch)))
+	c.runSentHook(p, batch)
+	c.log.Info("flushed events on shutdown", "provider", p.name, "events", len(batch))
+}
+
+// runWorker sends buffered events to p until the controller stops,
+// starting p.next, if any, once p has sent everything
+func (c *Controller) runWorker(p *provider) {
+	label := p.name
+	c.log.Info("worker started", "provider", label)
+	c.mu.Lock()
+	ws := p.conn
+	start := p.sentIndex
+	p.feed = make(chan struct{}, 1)
+	feed := p.feed
+	c.startLanesLocked(p)
+	c.mu.Unlock()
+	if start > 0 {
+		c.log.Info("worker resuming", "provider", label, "index", start)
+	}
+	if c.cfg.RequireAcks && c.cfg.AckTimeout > 0 {
+		c.goroutines.spawn("ack-watch", func() {
+			c.watchAcks(p)
+		})
+	}
+	bo := c.newBackoff()
+	var idle <-chan time.Time
+	var idleTicker Ticker
+	if c.cfg.HeartbeatInterval > 0 {
+		idleTicker = c.clock.NewTicker(c.cfg.HeartbeatInterval)
+		defer idleTicker.Stop()
+		idle = idleTicker.C()
+	}
+	var probe <-chan time.Time
+	if c.cfg.ProbeInterval > 0 {
+		probeTicker := c.clock.NewTicker(c.cfg.ProbeInterval)
+		defer probeTicker.Stop()
+		probe = probeTicker.C()
+	}
+	sent := func() {
+		bo.Reset()
+		if idleTicker != nil {
+			resetTicker(idleTicker, c.cfg.HeartbeatInterval)
+		}
+	}
+	finished := false
+	for {
+		idx, event, resend, err := c.waitForEvent(p, feed, idle, probe, !finished)
+		if err == errIdle {
+			if ws, err = c.heartbeat(p, ws, bo); err != nil {
+				c.log.Info("worker stopped", "provider", label, "err", err)
+				return
+			}
+			idleTicker.Reset(c.cfg.HeartbeatInterval)
+			continue
+		}
+		if err == errProbe {
+			if ws, err = c.probe(p, ws); err != nil {
+				c.log.Info("worker stopped", "provider", label, "err", err)
+				return
+			}
+			continue
+		}
+		if err == errReplay {
+			if ws, err = c.replay(p, ws, bo); err != nil {
+				c.log.Info("worker stopped", "provider", label, "err", err)
+				return
+			}
+			sent()
+			continue
+		}
+		if err == errConnLost {
+			c.log.Warn("provider connection lost, reconnecting", "provider", label)
+			if ws, err = c.reconnect(p, ws); err != nil {
+				c.log.Info("worker stopped", "provider", label, "err", err)
+				return
+			}
+			continue
+		}
+		if err == errStreamEnded {
+			// The app ended its stream and everything it sent went
+			// out. Stay subscribed so events from a reconnecting app
+			// are still forwarded.
+			c.log.Info("worker finished sending events", "provider", label)
+			if p.next != nil {
+				c.log.Info("triggering backup worker", "provider", label, "backup", p.next.name)
+				c.trigger(p.next, nil)
+			}
+			finished = true
+			continue
+		}
+		if err != nil {
+			c.log.Info("worker stopped", "provider", label, "err", err)
+			return
+		}
+		if resend {
+			batch := []Event{event}
+			c.mu.Lock()
+			c.stampLocked(p, batch, []int{idx})
+			c.mu.Unlock()
+			if ws, err = c.deliver(p, ws, bo, batch); err == errSendTimedOut {
+				c.abandonSend(p, batch, []int{idx})
+				continue
+			} else if err == errUnencodable {
+				c.skipUnencodable(p, batch, []int{idx})
+				continue
+			} else if err != nil {
+				c.log.Info("worker stopped", "provider", label, "err", err)
+				return
+			}
+			c.mu.Lock()
+			c.awaitAckLocked(p, idx, event.ID, c.now())
+			c.mu.Unlock()
+			c.log.Debug("event resent", "provider", label, "event_id", event.ID, "index", idx, "seq", batch[0].Seq)
+			sent()
+			continue
+		}
+
+		batch, indexes := []Event{event}, []int{idx}
+		if c.batching() && !c.needsChunking(event) {
+			var stopping bool
+			batch, indexes, stopping = c.collectBatch(p, feed, batch, indexes)
+			if stopping {
+				c.mu.Lock()
+				c.stampLocked(p, batch, indexes)
+				c.mu.Unlock()
+				c.flushOnShutdown(p, ws, batch)
+				return
+			}
+		}
+		c.mu.Lock()
+		c.stampLocked(p, batch, indexes)
+		c.mu.Unlock()
+		if c.handOff(p, batch, indexes) {
+			continue
+		}
+		if ws, err = c.deliver(p, ws, bo, batch); err == errSendTimedOut {
+			c.abandonSend(p, batch, indexes)
+			continue
+		} else if err == errUnencodable {
+			c.skipUnencodable(p, batch, indexes)
+			continue
+		} else if err != nil {
+			c.log.Info("worker stopped", "provider", label, "err", err)
+			return
+		}
+		c.finishSend(p, batch, indexes)
+		sent()
+	}
+}
+
+// finishSend records that batch, the events at indexes, was written to p
+func (c *Controller) finishSend(p *provider, batch []Event, indexes []int) {
+	c.mu.Lock()
+	c.observeLatencyLocked(p, batch)
+	c.markSentLocked(p, indexes, seqs(batch))
+	c.mu.Unlock()
+	for i, event := range batch {
+		c.log.Debug("event sent", "provider", p.name, "event_id", event.ID, "index", indexes[i], "seq", event.Seq)
+	}
+}
+
+// skipUnencodable moves p past batch, the events at indexes, which could
+// not be encoded for it, giving back the numbers stamped on them
+func (c *Controller) skipUnencodable(p *provider, batch []Event, indexes []int) {
+	c.mu.Lock()
+	c.unstampLocked(p, batch, indexes)
+	for _, idx := range indexes {
+		c.forgetLocked(p, idx)
+	}
+	c.markSentLocked(p, indexes, nil)
+	c.mu.Unlock()
+}
+
+// Handler serves the app endpoint on /app/ws, the status report on
+// /status, Prometheus metrics on /metrics, Drain on POST /drain, Replay on
+// POST /admin/replay, the dead letters on /admin/deadletter and their
+// requeueing on POST /admin/deadletter/requeue, Snapshot as NDJSON on
+// /admin/snapshot, PauseProvider and
+// ResumeProvider on POST /admin/pause and /admin/resume, the rate limit on
+// POST /admin/ratelimit for holders of the admin token and the /healthz and
+// /readyz probes, for mounting on the caller's server
+func (c *Controller) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/app/ws", c.handleAppConnection)
+	mux.HandleFunc("/status", c.handleStatus)
+	mux.HandleFunc("/drain", c.handleDrain)
+	mux.HandleFunc("/admin/replay", c.handleReplay)
+	mux.HandleFunc("/admin/deadletter", c.handleDeadLetter)
+	mux.HandleFunc("/admin/deadletter/requeue", c.handleRequeue)
+	mux.HandleFunc("/admin/snapshot", c.handleSnapshot)
+	mux.HandleFunc("/admin/pause", c.handlePause(false))
+	mux.HandleFunc("/admin/resume", c.handlePause(true))
+	mux.HandleFunc("/admin/ratelimit", c.handleRateLimit)
+	mux.HandleFunc("/healthz", c.handleHealthz)
+	mux.HandleFunc("/readyz", c.handleReadyz)
+	mux.Handle("/metrics", c.metrics.handler())
+	return mux
+}
+
+// ServerTLSConfig returns the TLS configuration built from ServerCertFile
+// and ServerKeyFile for the server the Handler is mounted on, or nil when
+// apps are served plain HTTP
+func (c *Controller) ServerTLSConfig() *tls.Config {
+	return c.serverTLS
+}
+
+// newLogger returns the default logger, text on stderr at level
+func newLogger(level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
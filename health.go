@@ -0,0 +1,31 @@
+package gochunker
+
+import "net/http"
+
+// handleHealthz answers the liveness probe: the process is up and serving
+func (c *Controller) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz answers the readiness probe. The controller is ready while
+// it accepts app connections, so not draining or stopping, and at least one
+// provider is connected to take their events. Whether an app is connected
+// right now doesn't matter: apps reach the controller through the traffic
+// readiness gates, so waiting for one would keep it unready for good. It
+// only reads atomics, so probes never wait on the controller's lock.
+func (c *Controller) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	var reason string
+	switch {
+	case c.ctx.Err() != nil:
+		reason = "stopping"
+	case c.draining.Load():
+		reason = "draining"
+	case c.providersUp.Load() == 0:
+		reason = "no provider connected"
+	}
+	if reason != "" {
+		http.Error(w, "not ready: "+reason, http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,67 @@
+package gochunker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// probe returns the status code GET path answers with
+func probe(t *testing.T, srv *httptest.Server, path string) int {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReadyzFollowsProviderConnectivity(t *testing.T) {
+	main := newFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.MainProviderURL, cfg.BackupProviderURL = main.url(), "ws://127.0.0.1:1/backup"
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+
+	if code := probe(t, srv, "/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz answered %d before start", code)
+	}
+	if code := probe(t, srv, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz answered %d with no provider connected", code)
+	}
+	c.Start()
+	if !waitUntil(2*time.Second, func() bool { return probe(t, srv, "/readyz") == http.StatusOK }) {
+		t.Fatal("/readyz not ready once the main provider connected")
+	}
+	main.kill()
+	if !waitUntil(2*time.Second, func() bool { return probe(t, srv, "/readyz") == http.StatusServiceUnavailable }) {
+		t.Fatal("/readyz still ready after the provider went away")
+	}
+	if code := probe(t, srv, "/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz answered %d while not ready", code)
+	}
+}
+
+func TestReadyzUnreadyWhileDraining(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	if !waitUntil(2*time.Second, func() bool { return probe(t, srv, "/readyz") == http.StatusOK }) {
+		t.Fatal("/readyz never ready")
+	}
+	if err := c.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := probe(t, srv, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz answered %d while draining", code)
+	}
+}
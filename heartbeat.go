@@ -0,0 +1,31 @@
+package gochunker
+
+import "errors"
+
+// errIdle is returned by waitForEvent when nothing was sent to a provider
+// for HeartbeatInterval
+var errIdle = errors.New("provider idle")
+
+// heartbeatMessage tells an idle provider the controller is still alive
+type heartbeatMessage struct {
+	Type string `json:"type"` // always "heartbeat"
+	TS   int64  `json:"ts"`   // Unix milliseconds
+}
+
+// heartbeat sends a heartbeat to p, taking a rate-limit token like any
+// event, and returns the connection it went out on
+func (c *Controller) heartbeat(p *provider, ws Conn, bo *Backoff) (Conn, error) {
+	msg, err := codecOf(ws).Marshal(heartbeatMessage{Type: "heartbeat", TS: c.now().UnixMilli()})
+	if err != nil {
+		return ws, err
+	}
+	if err := c.throttleProvider(p, bo, 1); err != nil {
+		return nil, err
+	}
+	if ws, err = c.send(p, ws, msg, nil); err != nil {
+		return nil, err
+	}
+	c.metrics.heartbeats.WithLabelValues(p.name).Inc()
+	c.log.Debug("sent heartbeat", "provider", p.name)
+	return ws, nil
+}
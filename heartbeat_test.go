@@ -0,0 +1,48 @@
+package gochunker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// heartbeats returns how many heartbeats fp received
+func heartbeats(fp *fakeProvider) int {
+	n := 0
+	for _, msg := range fp.messages() {
+		if strings.Contains(msg, `"type":"heartbeat"`) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestHeartbeatsOnlyWhenIdle(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.HeartbeatInterval = 50 * time.Millisecond
+	cfg.RateLimit = 10000
+	cfg.RateLimitInterval = time.Second
+	c := startController(t, cfg)
+	if !waitUntil(2*time.Second, func() bool { return heartbeats(main) >= 2 }) {
+		t.Fatal("no heartbeats while idle")
+	}
+
+	// An event well within every interval keeps heartbeats away
+	app := dialApp(t, c)
+	before := heartbeats(main)
+	for i := 0; i < 15; i++ {
+		sendEvents(t, app, fmt.Sprintf("e%d-", i), 1)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := heartbeats(main) - before; n > 1 {
+		t.Fatalf("%d heartbeats while events flowed", n)
+	}
+
+	// and they resume once the stream goes quiet
+	after := heartbeats(main)
+	if !waitUntil(2*time.Second, func() bool { return heartbeats(main) > after }) {
+		t.Fatal("heartbeats did not resume when idle again")
+	}
+}
@@ -0,0 +1,328 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeProvider is a WebSocket server standing in for a provider. It
+// records every message it receives and can reply through onMessage.
+type fakeProvider struct {
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	dials     int      // handshakes attempted, refused ones included
+	refuse    int      // handshakes still to be answered with 503
+	mute      bool     // ignore pings instead of answering them
+	protocols []string // subprotocols the provider is willing to speak
+	msgs      []string
+	types     []int         // frame type of each message in msgs
+	headers   []http.Header // handshake headers, one per connection
+	conns     []*websocket.Conn
+	closes    []int                                  // close codes connections were ended with by the controller
+	onMessage func(conn *websocket.Conn, msg []byte) // called for every message received, under mu
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	fp := &fakeProvider{}
+	fp.srv = httptest.NewUnstartedServer(http.HandlerFunc(fp.serve))
+	fp.srv.Start()
+	t.Cleanup(fp.kill)
+	return fp
+}
+
+func (fp *fakeProvider) serve(w http.ResponseWriter, r *http.Request) {
+	fp.mu.Lock()
+	fp.dials++
+	refused := fp.refuse > 0
+	if refused {
+		fp.refuse--
+	}
+	up := websocket.Upgrader{EnableCompression: true, Subprotocols: fp.protocols}
+	fp.mu.Unlock()
+	if refused {
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	fp.mu.Lock()
+	fp.conns = append(fp.conns, conn)
+	fp.headers = append(fp.headers, r.Header.Clone())
+	if fp.mute {
+		conn.SetPingHandler(func(string) error { return nil })
+	}
+	fp.mu.Unlock()
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				fp.mu.Lock()
+				fp.closes = append(fp.closes, ce.Code)
+				fp.mu.Unlock()
+			}
+			return
+		}
+		fp.mu.Lock()
+		fp.msgs = append(fp.msgs, string(msg))
+		fp.types = append(fp.types, mt)
+		if fp.onMessage != nil {
+			fp.onMessage(conn, msg)
+		}
+		fp.mu.Unlock()
+	}
+}
+
+// url returns the ws:// URL the provider listens on
+func (fp *fakeProvider) url() string {
+	return "ws" + strings.TrimPrefix(fp.srv.URL, "http")
+}
+
+// ackAll makes the provider acknowledge every event it receives
+func (fp *fakeProvider) ackAll() {
+	fp.onMessage = func(conn *websocket.Conn, msg []byte) {
+		var event Event
+		if json.Unmarshal(msg, &event) == nil && event.ID != "" {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"ack":"`+event.ID+`"}`))
+		}
+	}
+}
+
+// kill stops the server and drops every open connection
+func (fp *fakeProvider) kill() {
+	fp.srv.Close()
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	for _, conn := range fp.conns {
+		conn.Close()
+	}
+}
+
+// messages returns a copy of every message received so far
+func (fp *fakeProvider) messages() []string {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return append([]string(nil), fp.msgs...)
+}
+
+// count returns how many messages were received, heartbeats excluded
+func (fp *fakeProvider) count() int {
+	n := 0
+	for _, msg := range fp.messages() {
+		if !strings.Contains(msg, `"type":"heartbeat"`) {
+			n++
+		}
+	}
+	return n
+}
+
+// ids returns the IDs of the events received so far, in order
+func (fp *fakeProvider) ids() []string {
+	var ids []string
+	for _, msg := range fp.messages() {
+		var event Event
+		if json.Unmarshal([]byte(msg), &event) == nil && event.ID != "" {
+			ids = append(ids, event.ID)
+		}
+	}
+	return ids
+}
+
+// testConfig returns the default configuration sending to main and backup
+func testConfig(main, backup *fakeProvider) Config {
+	cfg := DefaultConfig()
+	cfg.MainProviderURL = main.url()
+	cfg.BackupProviderURL = backup.url()
+	return cfg
+}
+
+// quietLogger discards controller logs so test output stays readable
+var quietLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// startController builds and starts a controller that logs nowhere unless
+// opts say otherwise, closing it when the test ends
+func startController(t *testing.T, cfg Config, opts ...Option) *Controller {
+	t.Helper()
+	c, err := NewController(cfg, append([]Option{WithLogger(quietLogger)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.Close(ctx)
+	})
+	return c
+}
+
+// serveApps serves c's Handler and returns the URL of its app endpoint
+func serveApps(t *testing.T, c *Controller) string {
+	srv := httptest.NewServer(c.Handler())
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/app/ws"
+}
+
+// dialApp connects an app to c
+func dialApp(t *testing.T, c *Controller) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(serveApps(t, c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendEvents writes n events with IDs prefix0, prefix1, ... to conn
+func sendEvents(t *testing.T, conn *websocket.Conn, prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		msg := fmt.Sprintf(`{"id":"%s%d","payload":"x"}`, prefix, i)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitUntil reports whether cond came to hold within timeout
+func waitUntil(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// fakeClock is a Clock that only moves when a test advances it. Its
+// tickers, After channels and AfterFunc timers fire from Advance.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	pending []*fakeTimer
+}
+
+// fakeTimer is a pending After wait, an AfterFunc timer when fn is set,
+// or a ticker when period is
+type fakeTimer struct {
+	fc     *fakeClock
+	c      chan time.Time
+	fn     func()
+	at     time.Time
+	period time.Duration
+	done   bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1_000_000, 0)}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	return fc.add(d, 0, nil).c
+}
+
+func (fc *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fc.add(d, d, nil)
+}
+
+func (fc *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return fc.add(d, 0, f)
+}
+
+func (fc *fakeClock) add(d, period time.Duration, fn func()) *fakeTimer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	t := &fakeTimer{fc: fc, c: make(chan time.Time, 1), fn: fn, at: fc.now.Add(d), period: period}
+	fc.pending = append(fc.pending, t)
+	return t
+}
+
+// Advance moves the clock on by d, firing every timer and ticker due by
+// then. A ticker due several times over ticks once, as a time.Ticker with
+// a slow reader does. AfterFunc functions run once the clock is unlocked.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	fc.now = fc.now.Add(d)
+	var due []func()
+	live := fc.pending[:0]
+	for _, t := range fc.pending {
+		if t.done {
+			continue
+		}
+		if !t.at.After(fc.now) {
+			if t.fn != nil {
+				due = append(due, t.fn)
+			} else {
+				select {
+				case t.c <- fc.now:
+				default:
+				}
+			}
+			if t.period == 0 {
+				t.done = true
+				continue
+			}
+			for !t.at.After(fc.now) {
+				t.at = t.at.Add(t.period)
+			}
+		}
+		live = append(live, t)
+	}
+	fc.pending = live
+	fc.mu.Unlock()
+	for _, fn := range due {
+		go fn()
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() {
+	t.fc.mu.Lock()
+	defer t.fc.mu.Unlock()
+	t.done = true
+}
+
+func (t *fakeTimer) Reset(d time.Duration) {
+	t.fc.mu.Lock()
+	defer t.fc.mu.Unlock()
+	if t.done {
+		t.done = false
+		t.fc.pending = append(t.fc.pending, t)
+	}
+	t.at = t.fc.now.Add(d)
+	if t.period != 0 {
+		t.period = d
+	}
+}
+
+// withBackoffBase shortens the first retry delay so tests recover fast
+func withBackoffBase(d time.Duration) Option {
+	return func(c *Controller) {
+		c.backoffBase = d
+	}
+}
@@ -0,0 +1,84 @@
+package gochunker
+
+// Reasons OnDropped hooks are given for an event that was dropped
+const (
+	DropBufferFull   = "buffer full"   // a full buffer rejected the event, see RejectNewest
+	DropEvicted      = "evicted"       // evicted from a full buffer to make room, see DropOldest
+	DropStoreFailed  = "store failed"  // the store could not keep the event
+	DropUnencodable  = "unencodable"   // the event could not be encoded for a provider
+	DropDeadLettered = "dead-lettered" // a provider never acknowledged the event or sending it timed out, see Config.MaxSendAttempts and Config.SendTimeout
+	DropCoalesced    = "coalesced"     // a newer event with the same key replaced it before it was sent, see Config.CoalesceKey
+	DropExpired      = "expired"       // the event expired before it was sent to a provider, once for every provider it expired for
+	DropOutboundFull = "outbound full" // a provider's outbound queue was full under OutboundDrop, once for every such provider
+)
+
+// WithOnSent calls fn for every event once it was written to the provider
+// called provider, replayed ones included. fn runs on that provider's
+// worker, so a slow fn slows down sending to it.
+func WithOnSent(fn func(provider string, e Event)) Option {
+	return func(c *Controller) {
+		c.onSent = fn
+	}
+}
+
+// WithOnDropped calls fn for every event the controller gives up on, with
+// one of the Drop reasons. fn runs on the goroutine that dropped the event,
+// an app's reader, a caller of Enqueue or a provider's worker, so a slow fn
+// slows it down.
+func WithOnDropped(fn func(e Event, reason string)) Option {
+	return func(c *Controller) {
+		c.onDropped = fn
+	}
+}
+
+// droppedEvent is an event dropped under c.mu whose OnDropped hook has yet
+// to run
+type droppedEvent struct {
+	event  Event
+	reason string
+}
+
+// noteDropLocked records event as dropped for reason, for runDropHooks to
+// report. c.mu must be held.
+func (c *Controller) noteDropLocked(event Event, reason string) {
+	if c.onDropped != nil {
+		c.drops = append(c.drops, droppedEvent{event, reason})
+	}
+}
+
+// runDropHooks calls the OnDropped hook for the drops recorded so far. c.mu
+// must not be held, so the hook may call back into the controller.
+func (c *Controller) runDropHooks() {
+	if c.onDropped == nil {
+		return
+	}
+	c.mu.Lock()
+	drops := c.drops
+	c.drops = nil
+	c.mu.Unlock()
+	for _, d := range drops {
+		c.onDropped(d.event, d.reason)
+	}
+}
+
+// runSentHook calls the OnSent hook for every event of batch, just written
+// to p
+func (c *Controller) runSentHook(p *provider, batch []Event) {
+	if c.onSent == nil {
+		return
+	}
+	for _, event := range batch {
+		c.onSent(p.name, event)
+	}
+}
+
+// runUnencodableHook reports every event of batch, which could not be
+// encoded, as dropped
+func (c *Controller) runUnencodableHook(batch []Event) {
+	if c.onDropped == nil {
+		return
+	}
+	for _, event := range batch {
+		c.onDropped(event, DropUnencodable)
+	}
+}
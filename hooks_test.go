@@ -0,0 +1,126 @@
+package gochunker
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookLog records the calls made to the OnSent and OnDropped hooks
+type hookLog struct {
+	mu      sync.Mutex
+	sent    []string // provider/event ID
+	dropped []string // event ID/reason
+}
+
+func (h *hookLog) options(c **Controller) []Option {
+	return []Option{
+		WithOnSent(func(provider string, e Event) {
+			(*c).Status() // calling back in must not deadlock
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.sent = append(h.sent, provider+"/"+e.ID+"/"+string(e.Payload))
+		}),
+		WithOnDropped(func(e Event, reason string) {
+			(*c).Status()
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.dropped = append(h.dropped, e.ID+"/"+reason)
+		}),
+	}
+}
+
+func (h *hookLog) calls() (sent, dropped []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.sent...), append([]string(nil), h.dropped...)
+}
+
+func TestOnSentHook(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	var h hookLog
+	var c *Controller
+	c = startController(t, testConfig(main, backup), h.options(&c)...)
+	app := dialApp(t, c)
+	sendEvents(t, app, "e", 2)
+	// The backup only takes its turn once the app is gone
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %d events, want 2", main.count())
+	}
+	app.Close()
+
+	want := "[Main/e0/x Main/e1/x Backup/e0/x Backup/e1/x]"
+	if !waitUntil(2*time.Second, func() bool {
+		sent, _ := h.calls()
+		return fmt.Sprint(sent) == want
+	}) {
+		sent, _ := h.calls()
+		t.Fatalf("OnSent got %v, want %s", sent, want)
+	}
+	if _, dropped := h.calls(); len(dropped) != 0 {
+		t.Fatalf("OnDropped got %v without any drop", dropped)
+	}
+}
+
+func TestOnDroppedHook(t *testing.T) {
+	for _, tc := range []struct {
+		policy DropPolicy
+		want   string
+	}{
+		{RejectNewest, "[q2/buffer full]"},
+		{DropOldest, "[q0/evicted]"},
+	} {
+		// Nothing connects, so every event stays buffered
+		main, backup := newFakeProvider(t), newFakeProvider(t)
+		main.kill()
+		backup.kill()
+		cfg := testConfig(main, backup)
+		cfg.BufferSize = 2
+		cfg.DropPolicy = tc.policy
+		var h hookLog
+		var c *Controller
+		c = startController(t, cfg, h.options(&c)...)
+		for i := 0; i < 3; i++ {
+			c.Enqueue(Event{ID: fmt.Sprintf("q%d", i)})
+		}
+		if _, dropped := h.calls(); fmt.Sprint(dropped) != tc.want {
+			t.Errorf("%v: OnDropped got %v, want %s", tc.policy, dropped, tc.want)
+		}
+	}
+}
+
+func TestOnDroppedHookExpired(t *testing.T) {
+	main := newFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{main.url()}
+	var h hookLog
+	var c *Controller
+	c = startController(t, cfg, h.options(&c)...)
+	c.Enqueue(Event{ID: "stale", ExpiresAt: time.Unix(1, 0)})
+	c.Enqueue(Event{ID: "fresh"})
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatalf("main got %v, want fresh", main.ids())
+	}
+	if !waitUntil(2*time.Second, func() bool {
+		_, dropped := h.calls()
+		return fmt.Sprint(dropped) == "[stale/expired]"
+	}) {
+		_, dropped := h.calls()
+		t.Fatalf("OnDropped got %v, want [stale/expired]", dropped)
+	}
+}
+
+func TestOnDroppedHookOutboundFull(t *testing.T) {
+	var h hookLog
+	var c *Controller
+	// Only the drop hook, the sent one would call back before c is set
+	c, _ = startSlowOutbound(t, OutboundDrop, h.options(&c)[1])
+	for i := 1; i < 4; i++ {
+		c.Enqueue(Event{ID: fmt.Sprintf("e%d", i)})
+	}
+	// e1 and e2 fill the queue of 2
+	if _, dropped := h.calls(); fmt.Sprint(dropped) != "[e3/outbound full]" {
+		t.Fatalf("OnDropped got %v, want [e3/outbound full]", dropped)
+	}
+}
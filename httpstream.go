@@ -0,0 +1,279 @@
+package gochunker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// NDJSONContentType is the content type of the event stream POSTed to
+// http:// and https:// providers
+const NDJSONContentType = "application/x-ndjson"
+
+// errStreamClosed is returned by an httpStream used after it was closed
+var errStreamClosed = errors.New("http stream closed")
+
+// isHTTPProvider reports whether url names a provider reached over an
+// HTTP stream rather than a WebSocket
+func isHTTPProvider(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// httpStream is a Conn for providers that don't speak WebSocket. It POSTs
+// a single request whose chunked body carries one message per line, the
+// NDJSON stream, for as long as the connection lasts. Whatever the provider
+// answers with, acks and throttle requests, is read back from the response
+// body line by line, which takes a server that responds while it still
+// reads the request, such as one using http.ResponseController's
+// EnableFullDuplex. The stream has no pings of its own: pings are answered
+// at once for as long as the request is open. A close frame ends the
+// request body.
+type httpStream struct {
+	body   *io.PipeWriter
+	cancel context.CancelFunc
+	lines  chan []byte   // response lines, closed with readErr set once the response ends
+	done   chan struct{} // closed by Close
+	closer sync.Once
+
+	writeMu sync.Mutex
+
+	mu            sync.Mutex
+	readErr       error // why the response ended, read once lines is closed
+	readDeadline  time.Time
+	deadlineSet   chan struct{} // closed and replaced whenever readDeadline changes
+	writeDeadline time.Time
+	pong          func(string) error
+}
+
+// dialHTTPStream starts the streaming POST to url, returning once the
+// connection to the provider is established or failed. A provider
+// rejecting the request is noticed on the next read.
+func (c *Controller) dialHTTPStream(ctx context.Context, url string, header http.Header) (Conn, error) {
+	pr, pw := io.Pipe()
+	streamCtx, cancel := context.WithCancel(context.Background())
+	// Dialing is bound to ctx, the stream itself lasts until closed
+	stop := context.AfterFunc(ctx, cancel)
+	connected := make(chan struct{})
+	var once sync.Once
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { once.Do(func() { close(connected) }) },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(streamCtx, trace), http.MethodPost, url, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", NDJSONContentType)
+
+	s := &httpStream{
+		body:        pw,
+		cancel:      cancel,
+		lines:       make(chan []byte, 16),
+		done:        make(chan struct{}),
+		deadlineSet: make(chan struct{}),
+	}
+	failed := make(chan error, 1)
+	go func() {
+		resp, err := c.httpClient.Do(req)
+		if err == nil && resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			err = fmt.Errorf("provider answered %s", resp.Status)
+		}
+		if err != nil {
+			failed <- err
+			pr.CloseWithError(err)
+			s.endRead(err)
+			return
+		}
+		s.readResponse(resp.Body)
+	}()
+
+	var timeout <-chan time.Time
+	if c.cfg.HandshakeTimeout > 0 {
+		timer := time.NewTimer(c.cfg.HandshakeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-connected:
+		stop()
+		return s, nil
+	case err := <-failed:
+		cancel()
+		return nil, err
+	case <-timeout:
+		cancel()
+		return nil, fmt.Errorf("connecting to %s timed out", url)
+	case <-ctx.Done():
+		cancel()
+		return nil, ctx.Err()
+	}
+}
+
+// readResponse hands each line of the response body to ReadMessage
+func (s *httpStream) readResponse(body io.ReadCloser) {
+	defer body.Close()
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		if len(line) == 0 {
+			continue
+		}
+		select {
+		case s.lines <- line:
+		case <-s.done:
+			s.endRead(errStreamClosed)
+			return
+		}
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	s.endRead(err)
+}
+
+// endRead ends the response with err
+func (s *httpStream) endRead(err error) {
+	s.mu.Lock()
+	if s.readErr == nil {
+		s.readErr = err
+		close(s.lines)
+	}
+	s.mu.Unlock()
+}
+
+func (s *httpStream) ReadMessage() (int, []byte, error) {
+	for {
+		s.mu.Lock()
+		deadline, changed := s.readDeadline, s.deadlineSet
+		s.mu.Unlock()
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+		line, ok, err := s.nextLine(changed, expired)
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if ok {
+			return websocket.TextMessage, line, nil
+		}
+	}
+}
+
+// nextLine waits for the next response line, reporting false without an
+// error if the read deadline changed first
+func (s *httpStream) nextLine(changed <-chan struct{}, expired <-chan time.Time) ([]byte, bool, error) {
+	select {
+	case line, ok := <-s.lines:
+		if !ok {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return nil, false, s.readErr
+		}
+		return line, true, nil
+	case <-changed:
+		return nil, false, nil
+	case <-expired:
+		s.Close()
+		return nil, false, fmt.Errorf("http stream read: %w", context.DeadlineExceeded)
+	case <-s.done:
+		return nil, false, errStreamClosed
+	}
+}
+
+// WriteMessage writes data as one line of the request body. JSON encodes
+// without raw newlines, so every message fits on its line.
+func (s *httpStream) WriteMessage(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	deadline := s.writeDeadline
+	s.mu.Unlock()
+	if !deadline.IsZero() {
+		// A write blocks until the transport takes it, give up on the
+		// whole stream if that is too slow
+		timer := time.AfterFunc(time.Until(deadline), func() { s.Close() })
+		defer timer.Stop()
+	}
+	line := make([]byte, 0, len(data)+1)
+	line = append(append(line, data...), '\n')
+	_, err := s.body.Write(line)
+	return err
+}
+
+// WriteControl ends the request body for a close frame and answers a ping
+// right away while the stream is open
+func (s *httpStream) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	select {
+	case <-s.done:
+		return errStreamClosed
+	default:
+	}
+	switch messageType {
+	case websocket.CloseMessage:
+		// Safe alongside a blocked write, which then fails
+		return s.body.Close()
+	case websocket.PingMessage:
+		s.mu.Lock()
+		pong := s.pong
+		s.mu.Unlock()
+		if pong != nil {
+			return pong(string(data))
+		}
+	}
+	return nil
+}
+
+func (s *httpStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	close(s.deadlineSet)
+	s.deadlineSet = make(chan struct{})
+	return nil
+}
+
+func (s *httpStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline = t
+	return nil
+}
+
+func (s *httpStream) SetPongHandler(h func(appData string) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pong = h
+}
+
+func (s *httpStream) Subprotocol() string { return "" }
+
+// Close aborts the request, failing pending reads and writes
+func (s *httpStream) Close() error {
+	s.closer.Do(func() {
+		close(s.done)
+		s.body.CloseWithError(errStreamClosed)
+		s.cancel()
+	})
+	return nil
+}
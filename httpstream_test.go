@@ -0,0 +1,121 @@
+package gochunker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ndjsonProvider receives NDJSON event streams, acknowledging each event
+// on the response as it arrives. A stream ends after cut events if cut is
+// set, once.
+type ndjsonProvider struct {
+	cut int
+
+	mu      sync.Mutex
+	streams int
+	ids     []string
+	headers []http.Header
+	chunked []bool
+}
+
+func (np *ndjsonProvider) serve(w http.ResponseWriter, r *http.Request) {
+	http.NewResponseController(w).EnableFullDuplex()
+	np.mu.Lock()
+	np.streams++
+	cut := np.streams == 1 && np.cut > 0
+	np.headers = append(np.headers, r.Header.Clone())
+	np.chunked = append(np.chunked, len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked")
+	np.mu.Unlock()
+	w.Header().Set("Content-Type", NDJSONContentType)
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	scanner := bufio.NewScanner(r.Body)
+	n := 0
+	for scanner.Scan() {
+		var event Event
+		if json.Unmarshal(scanner.Bytes(), &event) != nil || event.ID == "" {
+			continue
+		}
+		np.mu.Lock()
+		np.ids = append(np.ids, event.ID)
+		np.mu.Unlock()
+		w.Write([]byte(`{"ack":"` + event.ID + `"}` + "\n"))
+		w.(http.Flusher).Flush()
+		if n++; cut && n == np.cut {
+			return
+		}
+	}
+}
+
+func (np *ndjsonProvider) received() []string {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	return append([]string(nil), np.ids...)
+}
+
+func startNDJSONProvider(t *testing.T, np *ndjsonProvider) string {
+	srv := httptest.NewServer(http.HandlerFunc(np.serve))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestHTTPStreamProvider(t *testing.T) {
+	np := &ndjsonProvider{}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{startNDJSONProvider(t, np) + "/events"}
+	cfg.RequireAcks = true
+	cfg.ProviderHeaders = map[string]string{"X-Tenant": "acme"}
+	c := startController(t, cfg)
+	sendEvents(t, dialApp(t, c), "e", 5)
+
+	if !waitUntil(2*time.Second, func() bool { return len(np.received()) == 5 }) {
+		t.Fatalf("HTTP provider got %v, want 5 events", np.received())
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Unacked == 0 }) {
+		t.Fatalf("%d events unacknowledged over the response stream", c.Status().Providers[0].Unacked)
+	}
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	if np.streams != 1 || !np.chunked[0] {
+		t.Fatalf("%d streams, chunked %v, want one chunked stream", np.streams, np.chunked)
+	}
+	if h := np.headers[0]; h.Get("Content-Type") != NDJSONContentType || h.Get("X-Tenant") != "acme" {
+		t.Fatalf("stream sent with headers %v", h)
+	}
+}
+
+func TestHTTPStreamReconnects(t *testing.T) {
+	np := &ndjsonProvider{cut: 2}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{startNDJSONProvider(t, np)}
+	cfg.RequireAcks = true
+	c := startController(t, cfg, withBackoffBase(time.Millisecond))
+	app := dialApp(t, c)
+	sendEvents(t, app, "a", 2)
+	if !waitUntil(2*time.Second, func() bool { return len(np.received()) == 2 }) {
+		t.Fatalf("HTTP provider got %v, want a0 a1", np.received())
+	}
+	sendEvents(t, app, "b", 3)
+	if !waitUntil(3*time.Second, func() bool {
+		np.mu.Lock()
+		defer np.mu.Unlock()
+		return np.streams >= 2 && c.Status().Providers[0].SentIndex == 5 && c.Status().Providers[0].Unacked == 0
+	}) {
+		t.Fatalf("HTTP provider got %v over %d streams, want every event after reconnecting", np.received(), np.streams)
+	}
+	got := make(map[string]bool)
+	for _, id := range np.received() {
+		got[id] = true
+	}
+	for _, id := range []string{"a0", "a1", "b0", "b1", "b2"} {
+		if !got[id] {
+			t.Fatalf("HTTP provider got %v, missing %s", np.received(), id)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package gochunker
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// idleTimer closes an app connection that sends nothing for
+// AppIdleTimeout. Pongs don't count as sending. A nil idleTimer does
+// nothing, which is what apps get with the timeout disabled.
+type idleTimer struct {
+	timer   Timer
+	timeout time.Duration
+}
+
+// startIdleTimer starts timing app's silence, nil if AppIdleTimeout is zero
+func (c *Controller) startIdleTimer(app *appConn) *idleTimer {
+	if c.cfg.AppIdleTimeout <= 0 {
+		return nil
+	}
+	timeout := c.cfg.AppIdleTimeout
+	return &idleTimer{
+		timer: c.clock.AfterFunc(timeout, func() {
+			c.log.Info("closing idle app connection", "remote", app.conn.RemoteAddr().String(), "idle_timeout", timeout)
+			closeConn(app.conn, app.readerDone, websocket.CloseNormalClosure, "idle timeout")
+		}),
+		timeout: timeout,
+	}
+}
+
+// reset starts the silence over, after the app sent a message
+func (it *idleTimer) reset() {
+	if it != nil {
+		it.timer.Reset(it.timeout)
+	}
+}
+
+// stop ends the timing once the connection closed for whatever reason
+func (it *idleTimer) stop() {
+	if it != nil {
+		it.timer.Stop()
+	}
+}
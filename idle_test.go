@@ -0,0 +1,67 @@
+package gochunker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIdleAppConnectionClosed(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.AppIdleTimeout = 200 * time.Millisecond
+	c := startController(t, cfg)
+	idle, active := dialApp(t, c), dialApp(t, c)
+
+	// The active app keeps sending for well past the timeout
+	for i := 0; i < 10; i++ {
+		msg := fmt.Sprintf(`{"id":"a%d","payload":"x"}`, i)
+		if err := active.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := c.Status().Apps; n != 1 {
+		t.Fatalf("%d apps connected after the idle timeout, want only the active one", n)
+	}
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := idle.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("idle app read %v, want a normal close", err)
+	}
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Text != "idle timeout" {
+		t.Fatalf("idle app closed with %v, want reason idle timeout", err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 10 }) {
+		t.Fatalf("main got %v, want every event of the active app", main.ids())
+	}
+
+	// Once it falls silent the active app is closed too
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 0 }) {
+		t.Fatal("silent app still connected past the idle timeout")
+	}
+}
+
+func TestIdleTimeoutFollowsClock(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	fc := newFakeClock()
+	cfg := testConfig(main, backup)
+	cfg.AppIdleTimeout = time.Hour
+	c := startController(t, cfg, WithClock(fc))
+	dialApp(t, c)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 1 }) {
+		t.Fatal("app never connected")
+	}
+
+	fc.Advance(time.Hour - time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if n := c.Status().Apps; n != 1 {
+		t.Fatalf("%d apps connected before the clock reached the idle timeout, want 1", n)
+	}
+	fc.Advance(time.Second)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 0 }) {
+		t.Fatal("app still connected once the clock passed the idle timeout")
+	}
+}
@@ -0,0 +1,120 @@
+package gochunker
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// IDGenerator returns a fresh ID for an event an app sent without one
+type IDGenerator func() string
+
+// WithIDGenerator makes gen assign IDs to events arriving without one
+// instead of the default ULIDs
+func WithIDGenerator(gen IDGenerator) Option {
+	return func(c *Controller) {
+		c.newID = gen
+	}
+}
+
+// idAssignment tells an app the ID the controller gave an event it sent
+// without one. Index counts the events the app sent over the connection
+// before that one, each line of an NDJSON frame as one, so it can tell
+// which of its events got which ID.
+type idAssignment struct {
+	Type  string `json:"type"` // always "id"
+	ID    string `json:"id"`
+	Index uint64 `json:"index"`
+}
+
+// crockford is the base32 alphabet of ULIDs, which sorts like the values it
+// encodes
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidSource hands out ULIDs: a 48 bit millisecond timestamp followed by 80
+// random bits. Within one millisecond, or should the clock step back, the
+// random part of the last ULID is incremented instead of drawn anew, so the
+// IDs from one source sort in the order they were made.
+type ulidSource struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+// newULIDGenerator returns an IDGenerator making ULIDs from the time now
+// reads
+func newULIDGenerator(now func() time.Time) IDGenerator {
+	s := &ulidSource{now: now}
+	return s.next
+}
+
+func (s *ulidSource) next() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := uint64(s.now().UnixMilli())
+	if ms <= s.lastMs && s.increment() {
+		ms = s.lastMs
+	} else {
+		rand.Read(s.entropy[:])
+		s.lastMs = ms
+	}
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(id[6:], s.entropy[:])
+	return encodeULID(id)
+}
+
+// increment adds one to the random part, reporting false if it overflowed
+func (s *ulidSource) increment() bool {
+	for i := len(s.entropy) - 1; i >= 0; i-- {
+		s.entropy[i]++
+		if s.entropy[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID writes the 128 bits of id as 26 base32 characters, the first
+// holding only the top 3 bits
+func encodeULID(id [16]byte) string {
+	var out [26]byte
+	var acc uint32
+	bits := 2 // pads the 128 bits to the 130 26 characters hold
+	n := 0
+	for _, b := range id {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[n] = crockford[(acc>>bits)&31]
+			n++
+		}
+	}
+	return string(out[:])
+}
+
+// assignID gives event an ID from the generator if it came without one,
+// reporting whether it did
+func (c *Controller) assignID(event *Event) bool {
+	if event.ID != "" {
+		return false
+	}
+	event.ID = c.newID()
+	return true
+}
+
+// sendAssignedID tells app the ID its index-th message got
+func (c *Controller) sendAssignedID(app *appConn, id string, index uint64) {
+	msg, err := app.codec.Marshal(idAssignment{Type: "id", ID: id, Index: index})
+	if err != nil {
+		return
+	}
+	if err := app.write(msg, c.cfg.WriteTimeout); err != nil {
+		c.log.Warn("telling app about assigned event ID failed", "event_id", id, "err", err)
+	}
+}
@@ -0,0 +1,103 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// countingIDs is an IDGenerator handing out gen-1, gen-2 and so on
+func countingIDs() IDGenerator {
+	n := 0
+	return func() string {
+		n++
+		return fmt.Sprintf("gen-%d", n)
+	}
+}
+
+func TestULIDsSortInOrder(t *testing.T) {
+	fc := newFakeClock()
+	gen := newULIDGenerator(fc.Now)
+	prev := ""
+	for i := 0; i < 1000; i++ {
+		if i%100 == 0 {
+			fc.Advance(time.Millisecond)
+		}
+		id := gen()
+		if len(id) != 26 || strings.Trim(id, crockford) != "" {
+			t.Fatalf("generated %q, want 26 base32 characters", id)
+		}
+		if id <= prev {
+			t.Fatalf("ID %d %s sorts before %s", i, id, prev)
+		}
+		prev = id
+	}
+}
+
+func TestULIDEncodesTimestamp(t *testing.T) {
+	var id [16]byte
+	id[5] = 1 // 1ms after the epoch
+	if got := encodeULID(id); got != "00000000010000000000000000" {
+		t.Fatalf("encoded %s", got)
+	}
+	for i := range id {
+		id[i] = 0xff
+	}
+	if got := encodeULID(id); got != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Fatalf("encoded %s", got)
+	}
+}
+
+func TestEventWithoutIDAssignedOne(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup), WithIDGenerator(countingIDs()))
+	app := dialApp(t, c)
+	for _, msg := range []string{`{"id":"own","payload":"a"}`, `{"payload":"b"}`} {
+		if err := app.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := app.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got idAssignment
+	if err := json.Unmarshal(msg, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (idAssignment{Type: "id", ID: "gen-1", Index: 1}); got != want {
+		t.Fatalf("app told %+v, want %+v", got, want)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v, want own gen-1", main.ids())
+	}
+	if ids := main.ids(); ids[0] != "own" || ids[1] != "gen-1" {
+		t.Fatalf("main got %v, want own gen-1", ids)
+	}
+}
+
+func TestEnqueueAssignsIDs(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	for _, e := range []Event{{}, {ID: "own"}, {}} {
+		if err := c.Enqueue(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %v, want 3 events", main.ids())
+	}
+	ids := main.ids()
+	if ids[1] != "own" {
+		t.Fatalf("main got %v, want the client's ID kept", ids)
+	}
+	if len(ids[0]) != 26 || len(ids[2]) != 26 || ids[0] >= ids[2] {
+		t.Fatalf("main got %v, want increasing ULIDs for the events without an ID", ids)
+	}
+}
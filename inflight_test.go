@@ -0,0 +1,124 @@
+package gochunker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ackEvent makes fp acknowledge event id over its latest connection
+func (fp *fakeProvider) ackEvent(t *testing.T, id string) {
+	t.Helper()
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	conn := fp.conns[len(fp.conns)-1]
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"ack":"`+id+`"}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxInFlightHoldsEventsUntilAcked(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.MaxInFlight = 2
+	c := startController(t, cfg)
+	for i := 0; i < 5; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("e%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v, want e0 e1", main.ids())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ids := main.ids(); len(ids) != 2 {
+		t.Fatalf("main got %v with 2 events unacknowledged, want no more", ids)
+	}
+	if st := c.Status().Providers[0]; st.Unacked != 2 {
+		t.Fatalf("%d events unacknowledged, want 2", st.Unacked)
+	}
+
+	main.ackEvent(t, "e0")
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %v after acking e0, want e2 next", main.ids())
+	}
+	main.ackEvent(t, "e1")
+	main.ackEvent(t, "e2")
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 5 }) {
+		t.Fatalf("main got %v after acking e1 e2, want the rest", main.ids())
+	}
+	if ids := main.ids(); ids[2] != "e2" || ids[3] != "e3" || ids[4] != "e4" {
+		t.Fatalf("main got %v, want the events in order", ids)
+	}
+}
+
+func TestMaxInFlightLimitsBatches(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.MaxInFlight = 3
+	cfg.BatchSize = 10
+	cfg.FlushInterval = 20 * time.Millisecond
+	c := startController(t, cfg)
+	for i := 0; i < 8; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("e%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Unacked == 3 }) {
+		t.Fatalf("%d events unacknowledged, want 3", c.Status().Providers[0].Unacked)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if st := c.Status().Providers[0]; st.Unacked != 3 || st.SentIndex != 3 {
+		t.Fatalf("sent %d events with %d unacknowledged, want a batch of 3 only", st.SentIndex, st.Unacked)
+	}
+}
+
+func TestMaxInFlightReleasedByDeadLetters(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	main.ackAllBut("bad")
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.AckTimeout = 30 * time.Millisecond
+	cfg.MaxSendAttempts = 2
+	cfg.MaxInFlight = 1
+	c := startController(t, cfg)
+	for _, id := range []string{"bad", "e1", "e2"} {
+		if err := c.Enqueue(Event{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A provider that never acks an event only holds the rest back until
+	// it is dead-lettered
+	if !waitUntil(2*time.Second, func() bool { return c.Status().DeadLettered == 1 }) {
+		t.Fatalf("main got %v, bad not dead-lettered", main.ids())
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 4 }) {
+		t.Fatalf("main got %v after bad was dead-lettered, want e1 e2", main.ids())
+	}
+	if ids := main.ids(); ids[0] != "bad" || ids[1] != "bad" || ids[2] != "e1" || ids[3] != "e2" {
+		t.Fatalf("main got %v, want e1 only after bad was given up on", ids)
+	}
+}
+
+func TestMaxInFlightNeedsAckTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxInFlight = 10
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("max in flight accepted without acks")
+	}
+	cfg.RequireAcks = true
+	cfg.AckTimeout = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("max in flight accepted without an ack timeout")
+	}
+	cfg.AckTimeout = time.Second
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
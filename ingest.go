@@ -0,0 +1,83 @@
+package gochunker
+
+import (
+	"fmt"
+	"time"
+)
+
+// IngestPolicy decides whether apps may send faster than providers take
+// their events
+type IngestPolicy int
+
+const (
+	IngestBuffer  IngestPolicy = iota // read apps as fast as they send, buffering what providers haven't taken yet
+	IngestCoupled                     // stop reading an app while IngestWindow events are pending, so apps send no faster than providers deliver
+)
+
+func (p IngestPolicy) String() string {
+	switch p {
+	case IngestBuffer:
+		return "buffer"
+	case IngestCoupled:
+		return "coupled"
+	}
+	return fmt.Sprintf("IngestPolicy(%d)", int(p))
+}
+
+// ParseIngestPolicy parses the String form of an IngestPolicy
+func ParseIngestPolicy(s string) (IngestPolicy, error) {
+	switch s {
+	case "buffer":
+		return IngestBuffer, nil
+	case "coupled":
+		return IngestCoupled, nil
+	}
+	return 0, fmt.Errorf("unknown ingest policy %q", s)
+}
+
+// waitIngest blocks, under IngestCoupled, while IngestWindow events are
+// pending for running providers, see pendingLocked. Since every event frees
+// a place only once it is sent, and acknowledged if acks are required,
+// apps are held to the providers' pace, rate limits included. waitIngest
+// gives up after IngestTimeout so a stalled provider slows apps down
+// rather than wedging them, leaving the event to the buffer as under
+// IngestBuffer.
+func (c *Controller) waitIngest() {
+	if c.cfg.IngestPolicy != IngestCoupled {
+		return
+	}
+	var timeout <-chan time.Time
+	if c.cfg.IngestTimeout > 0 {
+		timeout = c.clock.After(c.cfg.IngestTimeout)
+	}
+	for {
+		c.mu.Lock()
+		n, _ := c.pendingLocked()
+		if n < c.cfg.IngestWindow {
+			c.mu.Unlock()
+			return
+		}
+		if c.ingestRoom == nil {
+			c.ingestRoom = make(chan struct{})
+		}
+		room := c.ingestRoom
+		c.mu.Unlock()
+		select {
+		case <-room:
+		case <-timeout:
+			c.log.Warn("providers fell behind for longer than the ingest timeout, buffering the event", "pending", n, "window", c.cfg.IngestWindow, "timeout", c.cfg.IngestTimeout)
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// ingestedLocked wakes whatever waits in waitIngest after pending events
+// were let go of. c.mu must be held.
+func (c *Controller) ingestedLocked() {
+	if c.ingestRoom != nil {
+		close(c.ingestRoom)
+		c.ingestRoom = nil
+	}
+}
@@ -0,0 +1,114 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startIngest starts a controller under policy whose main provider holds
+// its acks back until ackHeld is called, and sends it n events
+func startIngest(t *testing.T, policy IngestPolicy, tweak func(*Config), n int) (c *Controller, main *fakeProvider, ackHeld func()) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	var held []string
+	main.onMessage = func(conn *websocket.Conn, msg []byte) {
+		var event Event
+		if json.Unmarshal(msg, &event) == nil && event.ID != "" {
+			held = append(held, event.ID)
+		}
+	}
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.AckTimeout = time.Minute
+	cfg.IngestPolicy = policy
+	cfg.IngestWindow = 3
+	if tweak != nil {
+		tweak(&cfg)
+	}
+	c = startController(t, cfg)
+	sendEvents(t, dialApp(t, c), "e", n)
+	ackHeld = func() {
+		main.mu.Lock()
+		defer main.mu.Unlock()
+		conn := main.conns[0]
+		for _, id := range held {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"ack":"`+id+`"}`))
+		}
+		main.ackAll()
+	}
+	return c, main, ackHeld
+}
+
+func TestIngestBufferTakesEverything(t *testing.T) {
+	c, main, _ := startIngest(t, IngestBuffer, nil, 10)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Buffered == 10 }) {
+		t.Fatalf("%d buffered, want all 10 with main not acknowledging", c.Status().Buffered)
+	}
+	if n := main.count(); n != 10 {
+		t.Fatalf("main got %d events, want them all sent ahead of its acks", n)
+	}
+}
+
+func TestIngestCoupledHoldsAppsToProviders(t *testing.T) {
+	c, main, ackHeld := startIngest(t, IngestCoupled, nil, 10)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Buffered == 3 }) {
+		t.Fatalf("%d buffered, want the ingest window of 3", c.Status().Buffered)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := c.Status().Buffered; n != 3 {
+		t.Fatalf("%d buffered while main acknowledged nothing, want 3", n)
+	}
+
+	ackHeld()
+	if !waitUntil(2*time.Second, func() bool {
+		p := c.Status().Providers[0]
+		return main.count() == 10 && p.Unacked == 0
+	}) {
+		t.Fatalf("main got %v once acknowledging, want all 10", main.ids())
+	}
+}
+
+func TestIngestCoupledTimesOut(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	start := time.Now()
+	c, _, _ := startIngest(t, IngestCoupled, func(cfg *Config) { cfg.IngestTimeout = timeout }, 6)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Buffered == 6 }) {
+		t.Fatalf("%d buffered, want every event once the ingest timeout passed", c.Status().Buffered)
+	}
+	// The three past the window each waited out the timeout
+	if took := time.Since(start); took < 3*timeout {
+		t.Fatalf("buffered everything in %s, want the app held back for each event past the window", took)
+	}
+}
+
+func TestIngestCoupledHoldsEnqueue(t *testing.T) {
+	c, main, ackHeld := startIngest(t, IngestCoupled, nil, 0)
+	for i := 0; i < 3; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("q%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Enqueue(Event{ID: "q3"}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Enqueue past the ingest window returned %v while main acknowledged nothing, want it to wait", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ackHeld()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Enqueue still waiting once main acknowledged")
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 4 }) {
+		t.Fatalf("main got %v, want all 4", main.ids())
+	}
+}
@@ -0,0 +1,138 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialCount returns how many handshakes fp was asked for
+func dialCount(fp *fakeProvider) int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.dials
+}
+
+func TestKeepaliveDropsSilentProvider(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	main.mute = true
+	cfg := testConfig(main, backup)
+	cfg.PingInterval = 50 * time.Millisecond
+	cfg.PongTimeout = 50 * time.Millisecond
+	c := startController(t, cfg, withBackoffBase(time.Millisecond))
+	if !waitUntil(2*time.Second, func() bool { return dialCount(main) >= 2 }) {
+		t.Fatal("provider that stopped ponging was never redialed")
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatal("provider not connected again")
+	}
+}
+
+func TestKeepaliveKeepsIdleProvider(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.PingInterval = 50 * time.Millisecond
+	cfg.PongTimeout = 50 * time.Millisecond
+	c := startController(t, cfg)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatal("main never connected")
+	}
+	// Quiet for many ping intervals, but answering every ping
+	time.Sleep(500 * time.Millisecond)
+	if n := dialCount(main); n != 1 {
+		t.Fatalf("main dialed %d times, want the first connection kept", n)
+	}
+}
+
+// stalledProvider is a provider that never reads its first connection,
+// so writes to it block once the socket buffers fill. Later connections
+// are read and the IDs of their events reported on ids.
+func stalledProvider(t *testing.T) (url string, ids <-chan string) {
+	release := make(chan struct{})
+	out := make(chan string, 100)
+	var mu sync.Mutex
+	conns := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mu.Lock()
+		conns++
+		first := conns == 1
+		mu.Unlock()
+		if first {
+			conn.UnderlyingConn().(*net.TCPConn).SetReadBuffer(4096)
+			<-release
+			return
+		}
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var event Event
+			if json.Unmarshal(msg, &event) == nil && event.ID != "" {
+				out <- event.ID
+			}
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		srv.CloseClientConnections()
+		srv.Close()
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), out
+}
+
+func TestWriteTimeoutReconnects(t *testing.T) {
+	url, ids := stalledProvider(t)
+	backup := newFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.MainProviderURL, cfg.BackupProviderURL = url, backup.url()
+	cfg.WriteTimeout = 200 * time.Millisecond
+	c, err := NewController(cfg, WithLogger(quietLogger), withBackoffBase(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Small socket buffers make the stalled connection block quickly
+	c.dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err == nil {
+			conn.(*net.TCPConn).SetWriteBuffer(4096)
+		}
+		return conn, err
+	}
+	c.Start()
+	defer c.Close(context.Background())
+
+	app := dialApp(t, c)
+	payload := strings.Repeat("x", 16<<10)
+	for i := 0; i < 30; i++ {
+		msg := fmt.Sprintf(`{"id":"e%d","payload":"%s"}`, i, payload)
+		if err := app.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case id := <-ids:
+			if id == "e29" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the last event never arrived over a new connection")
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package gochunker
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// lane is one of the extra connections to a provider opened when
+// Config.ProviderConnections is above 1. Its goroutine writes whatever the
+// provider's worker hands it while the worker is busy writing itself, so
+// one slow write no longer holds up every other event. Only the worker's
+// own connection carries heartbeats, resends and replays.
+type lane struct {
+	// guarded by Controller.mu
+	conn       Conn
+	readerDone chan struct{} // closed once conn's reader stops
+}
+
+// laneJob is a stamped batch handed from a worker to one of its lanes
+type laneJob struct {
+	batch   []Event
+	indexes []int
+}
+
+// startLanesLocked opens the extra connections to p Config.ProviderConnections
+// asks for, each written by a goroutine of its own. c.mu must be held.
+func (c *Controller) startLanesLocked(p *provider) {
+	if c.cfg.ProviderConnections <= 1 || p.jobs != nil {
+		return
+	}
+	p.jobs = make(chan laneJob)
+	for i := 1; i < c.cfg.ProviderConnections; i++ {
+		l := &lane{}
+		p.lanes = append(p.lanes, l)
+		c.workers.Add(1)
+		c.goroutines.spawn("lane-worker", func() {
+			defer c.workers.Done()
+			c.runLane(p, l)
+		})
+	}
+}
+
+// handOff gives the batch at indexes to an idle lane of p, reporting false
+// if none is waiting for one
+func (c *Controller) handOff(p *provider, batch []Event, indexes []int) bool {
+	if p.jobs == nil {
+		return false
+	}
+	select {
+	case p.jobs <- laneJob{batch: batch, indexes: indexes}:
+		return true
+	default:
+		return false
+	}
+}
+
+// runLane connects l and sends the batches p's worker hands it until the
+// controller stops
+func (c *Controller) runLane(p *provider, l *lane) {
+	ws, err := c.connectLane(p, l)
+	if err != nil {
+		return
+	}
+	bo := c.newBackoff()
+	for {
+		select {
+		case job := <-p.jobs:
+			if ws, err = c.deliver(p, ws, bo, job.batch); err == errSendTimedOut {
+				c.abandonSend(p, job.batch, job.indexes)
+				continue
+			} else if err == errUnencodable {
+				c.skipUnencodable(p, job.batch, job.indexes)
+				continue
+			} else if err != nil {
+				return
+			}
+			c.finishSend(p, job.batch, job.indexes)
+			bo.Reset()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// connectLane dials p for l and starts reading what the provider sends
+// back over it, acks included
+func (c *Controller) connectLane(p *provider, l *lane) (Conn, error) {
+	conn, err := c.connectProvider(p, false)
+	if err != nil {
+		return nil, err
+	}
+	readerDone := make(chan struct{})
+	c.mu.Lock()
+	l.conn = conn
+	l.readerDone = readerDone
+	c.mu.Unlock()
+	if c.ctx.Err() != nil {
+		closeConn(conn, nil, websocket.CloseNormalClosure, "shutting down")
+		return nil, c.ctx.Err()
+	}
+	c.log.Debug("provider lane connected", "provider", p.name)
+	c.goroutines.spawn("lane-reader", func() {
+		defer close(readerDone)
+		c.readProviderMessages(conn, p)
+	})
+	if c.cfg.PingInterval > 0 {
+		c.goroutines.spawn("lane-keepalive", func() {
+			c.keepAlive(conn, p.name, readerDone)
+		})
+	}
+	return conn, nil
+}
+
+// laneOf returns the lane of p whose connection is ws, nil if ws is the
+// worker's own
+func (c *Controller) laneOf(p *provider, ws Conn) *lane {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range p.lanes {
+		if l.conn == ws {
+			return l
+		}
+	}
+	return nil
+}
+
+// reconnectLane replaces l's failed connection ws like reconnect does the
+// worker's, returning the new one or an error once the controller stops
+func (c *Controller) reconnectLane(p *provider, l *lane, ws Conn) (Conn, error) {
+	ws.Close()
+	if c.providerDone(p) {
+		return nil, errProviderDone
+	}
+	ws, err := c.connectLane(p, l)
+	if err != nil {
+		return nil, err
+	}
+	c.metrics.reconnects.WithLabelValues(p.name).Inc()
+	c.mu.Lock()
+	n := c.resendUnackedLocked(p, c.now())
+	c.mu.Unlock()
+	if n > 0 {
+		c.log.Info("resending unacknowledged events", "provider", p.name, "events", n)
+	}
+	return ws, nil
+}
@@ -0,0 +1,111 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowConn is a memConn whose writes each take delay, as over a slow link
+type slowConn struct {
+	*memConn
+	delay time.Duration
+}
+
+func (sc slowConn) WriteMessage(typ int, data []byte) error {
+	time.Sleep(sc.delay)
+	return sc.memConn.WriteMessage(typ, data)
+}
+
+// slowProvider accepts any number of slowConn connections and records the
+// IDs of the events arriving over all of them
+type slowProvider struct {
+	delay time.Duration
+
+	mu    sync.Mutex
+	dials int
+	ids   []string
+}
+
+func (sp *slowProvider) dial(ctx context.Context, url string, header http.Header) (Conn, error) {
+	client, server := newMemPipe()
+	sp.mu.Lock()
+	sp.dials++
+	sp.mu.Unlock()
+	go func() {
+		for {
+			_, msg, err := server.ReadMessage()
+			if err != nil {
+				return
+			}
+			var event Event
+			if json.Unmarshal(msg, &event) == nil && event.ID != "" {
+				sp.mu.Lock()
+				sp.ids = append(sp.ids, event.ID)
+				sp.mu.Unlock()
+			}
+		}
+	}()
+	return slowConn{client, sp.delay}, nil
+}
+
+func (sp *slowProvider) received() []string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return append([]string(nil), sp.ids...)
+}
+
+// sendOver measures how long n events take to reach a provider whose
+// writes take 20ms each over conns connections
+func sendOver(t *testing.T, conns, n int) time.Duration {
+	t.Helper()
+	sp := &slowProvider{delay: 20 * time.Millisecond}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.ProviderConnections = conns
+	c := startController(t, cfg, WithDialFunc(sp.dial))
+	// Let every lane connect before the clock starts
+	if !waitUntil(time.Second, func() bool {
+		sp.mu.Lock()
+		defer sp.mu.Unlock()
+		return sp.dials == conns
+	}) {
+		t.Fatalf("controller dialed %d connections, want %d", sp.dials, conns)
+	}
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("e%02d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(5*time.Second, func() bool { return len(sp.received()) >= n }) {
+		t.Fatalf("provider got %d of %d events over %d connections", len(sp.received()), n, conns)
+	}
+	took := time.Since(start)
+
+	ids := sp.received()
+	sort.Strings(ids)
+	for i, id := range ids {
+		if want := fmt.Sprintf("e%02d", i); id != want {
+			t.Fatalf("provider got %v over %d connections, want each event once", ids, conns)
+		}
+	}
+	if st := c.Status().Providers[0]; st.SentIndex != n {
+		t.Fatalf("sent index %d over %d connections, want %d", st.SentIndex, conns, n)
+	}
+	return took
+}
+
+func TestProviderConnectionsSendConcurrently(t *testing.T) {
+	serial := sendOver(t, 1, 16)
+	parallel := sendOver(t, 4, 16)
+	if parallel > serial/2 {
+		t.Fatalf("16 events took %s over 4 connections and %s over 1, want at least twice as fast", parallel, serial)
+	}
+}
@@ -0,0 +1,52 @@
+package gochunker
+
+import (
+	"context"
+	"maps"
+	"sync"
+)
+
+// goroutines tracks the goroutines the controller starts by kind, so Close
+// can wait for every one of them and Status can tell which are running
+type goroutines struct {
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	running map[string]int // goroutines of each kind that haven't returned
+}
+
+// spawn runs fn in a goroutine of its own, counted under kind until fn
+// returns
+func (g *goroutines) spawn(kind string, fn func()) {
+	g.mu.Lock()
+	if g.running == nil {
+		g.running = make(map[string]int)
+	}
+	g.running[kind]++
+	g.mu.Unlock()
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.exited(kind)
+		fn()
+	}()
+}
+
+func (g *goroutines) exited(kind string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.running[kind]--; g.running[kind] == 0 {
+		delete(g.running, kind)
+	}
+}
+
+// counts returns how many goroutines of each kind are running
+func (g *goroutines) counts() map[string]int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return maps.Clone(g.running)
+}
+
+// wait waits for every spawned goroutine to return or until ctx is done
+func (g *goroutines) wait(ctx context.Context) error {
+	return waitGroup(ctx, &g.wg)
+}
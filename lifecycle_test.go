@@ -0,0 +1,84 @@
+package gochunker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMaxAppsRefusesPastTheLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxApps = 2
+	c := startController(t, cfg)
+	url := serveApps(t, c)
+	dial := func() (*websocket.Conn, *http.Response, error) {
+		conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+		return conn, resp, err
+	}
+	first, _, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := dial(); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 2 }) {
+		t.Fatalf("%d apps connected, want 2", c.Status().Apps)
+	}
+	_, resp, err := dial()
+	if err == nil {
+		t.Fatal("third app accepted past MaxApps 2")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("third app answered %v, want 503", resp)
+	}
+
+	first.Close()
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 1 }) {
+		t.Fatalf("%d apps connected after one left", c.Status().Apps)
+	}
+	if _, _, err := dial(); err != nil {
+		t.Fatalf("app refused once there was room again: %v", err)
+	}
+}
+
+func TestCloseWaitsForGoroutines(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	dialApp(t, c)
+	if !waitUntil(2*time.Second, func() bool {
+		running := c.Status().Goroutines
+		return running["app-reader"] == 1 && running["provider-reader"] == 1
+	}) {
+		t.Fatalf("running %v, want an app and a provider reader", c.Status().Goroutines)
+	}
+
+	release := make(chan struct{})
+	c.goroutines.spawn("stuck", func() { <-release })
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := c.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close returned %v with a goroutine still running, want it to wait", err)
+	}
+	if !waitUntil(2*time.Second, func() bool {
+		running := c.Status().Goroutines
+		return len(running) == 1 && running["stuck"] == 1
+	}) {
+		t.Fatalf("running %v after Close gave up, want only the stuck goroutine", c.Status().Goroutines)
+	}
+
+	close(release)
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if running := c.Status().Goroutines; len(running) != 0 {
+		t.Fatalf("running %v after Close, want none", running)
+	}
+}
@@ -0,0 +1,65 @@
+package gochunker
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureHandler is a slog.Handler keeping every record it is given
+type captureHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler      { return h }
+
+// find returns the attributes of the first record with message msg
+func (h *captureHandler) find(msg string) (map[string]slog.Value, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs := make(map[string]slog.Value)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		return attrs, true
+	}
+	return nil, false
+}
+
+func TestEventSentLogAttributes(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	h := &captureHandler{}
+	c := startController(t, testConfig(main, backup), WithLogger(slog.New(h)))
+	sendEvents(t, dialApp(t, c), "e", 1)
+	if !waitUntil(2*time.Second, func() bool { _, ok := h.find("event sent"); return ok }) {
+		t.Fatal("no event sent log")
+	}
+	attrs, _ := h.find("event sent")
+	if got := attrs["provider"].String(); got != "Main" {
+		t.Errorf("provider %q, want Main", got)
+	}
+	if got := attrs["event_id"].String(); got != "e0" {
+		t.Errorf("event_id %q, want e0", got)
+	}
+	if got := attrs["index"].Int64(); got != 0 {
+		t.Errorf("index %d, want 0", got)
+	}
+}
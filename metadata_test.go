@@ -0,0 +1,94 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var testMetadata = map[string]string{"tenant": "acme", "region": "eu-west-1"}
+
+func TestMetadataOmittedWhenEmpty(t *testing.T) {
+	data, err := json.Marshal(Event{ID: "e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "metadata") {
+		t.Fatalf("event without metadata encoded as %s", data)
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, MessagePackCodec{}} {
+		data, err := codec.Marshal(Event{ID: "e", Metadata: testMetadata})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Event
+		if err := codec.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Metadata, testMetadata) {
+			t.Fatalf("%T round trip gave metadata %v", codec, got.Metadata)
+		}
+	}
+}
+
+func TestMetadataSurvivesBatching(t *testing.T) {
+	c, main := startBatching(t, 2, time.Hour)
+	app := dialApp(t, c)
+	for _, msg := range []string{
+		`{"id":"e0","payload":"a","metadata":{"tenant":"acme","region":"eu-west-1"}}`,
+		`{"id":"e1","payload":"b"}`,
+	} {
+		if err := app.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return len(batches(main)) == 1 }) {
+		t.Fatalf("main got %v, want one batch", main.messages())
+	}
+	var batch batchMessage
+	if err := json.Unmarshal([]byte(main.messages()[0]), &batch); err != nil {
+		t.Fatal(err)
+	}
+	if got := batch.Events[0].Metadata; !reflect.DeepEqual(got, testMetadata) {
+		t.Fatalf("batched e0 carried metadata %v, want %v", got, testMetadata)
+	}
+	if got := batch.Events[1].Metadata; got != nil {
+		t.Fatalf("batched e1 carried metadata %v, want none", got)
+	}
+}
+
+func TestMetadataSurvivesChunking(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.MaxChunkSize = 4
+	c := startController(t, cfg)
+	if err := c.Enqueue(Event{ID: "big", Payload: []byte("0123456789"), Metadata: testMetadata}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %d messages, want 3 chunk frames", main.count())
+	}
+
+	var r Reassembler
+	var got *Event
+	for _, msg := range main.messages() {
+		var frame ChunkFrame
+		if err := json.Unmarshal([]byte(msg), &frame); err != nil {
+			t.Fatal(err)
+		}
+		if e, ok := r.Add(frame); ok {
+			got = e
+		}
+	}
+	if got == nil {
+		t.Fatal("event never reassembled")
+	}
+	if string(got.Payload) != "0123456789" || !reflect.DeepEqual(got.Metadata, testMetadata) {
+		t.Fatalf("reassembled %q with metadata %v", got.Payload, got.Metadata)
+	}
+}
@@ -0,0 +1,165 @@
+package gochunker
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors of one controller. They are
+// registered on a registry of their own so several controllers can live in
+// one process.
+type metrics struct {
+	registry *prometheus.Registry
+
+	received        prometheus.Counter
+	sent            *prometheus.CounterVec
+	dropped         prometheus.Counter
+	deduplicated    prometheus.Counter
+	coalesced       prometheus.Counter
+	rejected        prometheus.Counter
+	expired         *prometheus.CounterVec
+	reconnects      *prometheus.CounterVec
+	latency         *prometheus.HistogramVec
+	heartbeats      *prometheus.CounterVec
+	outOfOrderAcks  *prometheus.CounterVec
+	bypassed        *prometheus.CounterVec
+	deadLettered    *prometheus.CounterVec
+	outboundDropped *prometheus.CounterVec
+	breakerOpens    *prometheus.CounterVec
+	probes          *prometheus.CounterVec
+	providerState   *prometheus.GaugeVec
+}
+
+func newMetrics(c *Controller) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		received: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gochunker_events_received_total",
+			Help: "Events accepted from apps into the buffer.",
+		}),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochunker_events_sent_total",
+			Help: "Events written to a provider.",
+		}, []string{"provider"}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gochunker_events_dropped_total",
+			Help: "Events lost to a full buffer.",
+		}),
+		deduplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gochunker_events_deduplicated_total",
+			Help: "Events skipped because an event with the same ID was accepted recently.",
+		}),
+		coalesced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gochunker_events_coalesced_total",
+			Help: "Events replaced by a newer one with the same coalescing key before a provider sent them.",
+		}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gochunker_events_rejected_total",
+			Help: "App messages turned down as malformed, too large or failing validation.",
+		}),
+		expired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochunker_events_expired_total",
+			Help: "Events skipped for a provider because they expired before being sent.",
+		}, []string{"provider"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochunker_provider_reconnects_total",
+			Help: "Times a provider connection was re-established after failing.",
+		}, []string{"provider"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gochunker_event_send_latency_seconds",
+			Help:    "Time events spent buffered before being written to a provider.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10), // 1ms to about 4 minutes
+		}, []string{"provider"}),
+		heartbeats: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochunker_heartbeats_sent_total",
+			Help: "Heartbeats sent to idle providers.",
+		}, []string{"provider"}),
+		outOfOrderAcks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochunker_out_of_order_acks_total",
+			Help: "Acks whose sequence number did not move past the last one acknowledged.",
+		}, []string{"provider"}),
+		bypassed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochunker_events_bypassed_total",
+			Help: "Events of a BypassTypes type written to a provider without rate limiting.",
+		}, []string{"provider"}),
+		deadLettered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochunker_events_dead_lettered_total",
+			Help: "Events moved to the dead letters, by the provider that gave up on them, none for events failing validation.",
+		}, []string{"provider"}),
+		outboundDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochunker_outbound_dropped_total",
+			Help: "Events a provider skipped because its outbound queue was full under OutboundDrop.",
+		}, []string{"provider"}),
+		breakerOpens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochunker_breaker_opens_total",
+			Help: "Times a provider's circuit breaker opened after failed dials or probes.",
+		}, []string{"provider"}),
+		probes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochunker_probes_total",
+			Help: "Probes written to idle providers, by whether the write went through, ok or failed.",
+		}, []string{"provider", "result"}),
+		providerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gochunker_provider_state",
+			Help: "1 for the state each provider's connection is in, see ProviderState, 0 for the others.",
+		}, []string{"provider", "state"}),
+	}
+	for _, p := range c.providers() {
+		for _, state := range providerStates {
+			m.providerState.WithLabelValues(p.name, state.String()).Set(0)
+		}
+		m.providerState.WithLabelValues(p.name, p.State().String()).Set(1)
+	}
+	m.registry.MustRegister(
+		m.received,
+		m.sent,
+		m.dropped,
+		m.deduplicated,
+		m.coalesced,
+		m.rejected,
+		m.expired,
+		m.reconnects,
+		m.latency,
+		m.heartbeats,
+		m.outOfOrderAcks,
+		m.bypassed,
+		m.deadLettered,
+		m.outboundDropped,
+		m.breakerOpens,
+		m.probes,
+		m.providerState,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "gochunker_rate_limit_denials_total",
+			Help: "Token requests the global rate limiter turned down.",
+		}, func() float64 {
+			if c.ratelimiter == nil {
+				return 0
+			}
+			_, denied := c.ratelimiter.Stats()
+			return float64(denied)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gochunker_buffer_depth",
+			Help: "Events currently held in the buffer.",
+		}, func() float64 {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return float64(c.events.len())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gochunker_buffer_bytes",
+			Help: "Payload bytes of the events currently held in the buffer.",
+		}, func() float64 {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return float64(c.events.bytes())
+		}),
+	)
+	return m
+}
+
+// handler serves the metrics in the Prometheus exposition format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
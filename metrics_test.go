@@ -0,0 +1,103 @@
+package gochunker
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gather returns the metric family called name, nil if it has no samples
+func gather(t *testing.T, c *Controller, name string) *dto.MetricFamily {
+	t.Helper()
+	families, err := c.metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+	return nil
+}
+
+func TestSendLatencyUsesEnqueueTime(t *testing.T) {
+	main := newFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.MainProviderURL, cfg.BackupProviderURL = main.url(), main.url()
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	clock := newFakeClock()
+	c.now = clock.Now
+
+	c.mu.Lock()
+	c.bufferLocked(Event{ID: "a"})
+	c.mu.Unlock()
+	clock.Advance(3 * time.Second)
+	c.Start()
+	if !waitUntil(2*time.Second, func() bool { return gather(t, c, "gochunker_event_send_latency_seconds") != nil }) {
+		t.Fatal("no latency observed")
+	}
+
+	m := gather(t, c, "gochunker_event_send_latency_seconds").Metric[0]
+	if got := m.GetLabel()[0]; got.GetName() != "provider" || got.GetValue() != "Main" {
+		t.Errorf("observed for %s=%s, want provider=Main", got.GetName(), got.GetValue())
+	}
+	hist := m.GetHistogram()
+	if hist.GetSampleCount() != 1 || hist.GetSampleSum() != 3 {
+		t.Errorf("observed %d samples summing to %gs, want one of 3s", hist.GetSampleCount(), hist.GetSampleSum())
+	}
+	for _, b := range hist.GetBucket() {
+		want := uint64(0)
+		if b.GetUpperBound() >= 3 {
+			want = 1
+		}
+		if b.GetCumulativeCount() != want {
+			t.Errorf("bucket le=%g holds %d, want %d", b.GetUpperBound(), b.GetCumulativeCount(), want)
+		}
+	}
+}
+
+func TestMetricsScrape(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	sendEvents(t, dialApp(t, c), "e", 1)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatal("event not sent")
+	}
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Labelled families such as reconnects only show up once they have a sample
+	for _, family := range []string{
+		"gochunker_events_received_total counter",
+		"gochunker_events_sent_total counter",
+		"gochunker_events_dropped_total counter",
+		"gochunker_rate_limit_denials_total counter",
+		"gochunker_buffer_depth gauge",
+	} {
+		if !strings.Contains(string(body), "# TYPE "+family+"\n") {
+			t.Errorf("scrape lacks %s", family)
+		}
+	}
+	if !strings.Contains(string(body), `gochunker_events_sent_total{provider="Main"} 1`) {
+		t.Error("scrape lacks the event sent to Main")
+	}
+}
@@ -0,0 +1,374 @@
+package gochunker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// MessagePackCodec encodes messages as MessagePack. A value is laid out as
+// its JSON form would be, with the same field names, except that event
+// payloads and the chunks of chunk frames travel as raw bin data rather
+// than base64 text. Events, batches and chunk frames are encoded directly,
+// see marshalWire, anything else by way of its JSON form.
+type MessagePackCodec struct{}
+
+// Marshal encodes v, which must have a JSON form, as MessagePack
+func (MessagePackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if ok, err := marshalWire(&buf, v); ok {
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return marshalJSONForm(v)
+}
+
+// marshalJSONForm encodes v as MessagePack by way of its JSON form
+func marshalJSONForm(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var tree interface{}
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, rawPayloads(tree)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the MessagePack data into v as if it were the
+// equivalent JSON
+func (MessagePackCodec) Unmarshal(data []byte, v interface{}) error {
+	d := msgpackDecoder{data: data}
+	tree, err := d.decode()
+	if err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(data)-d.pos)
+	}
+	if ok, err := unmarshalWire(tree, v); ok {
+		return err
+	}
+	jsonForm, err := json.Marshal(markPayloads(tree))
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(jsonForm))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// rawPayloads replaces, throughout the JSON tree, base64 payloads of
+// events with their bytes so they are sent as bin data
+func rawPayloads(tree interface{}) interface{} {
+	switch t := tree.(type) {
+	case map[string]interface{}:
+		for k, v := range t {
+			t[k] = rawPayloads(v)
+		}
+		if payload, ok := t["payload"].(string); ok && t["payload_encoding"] == payloadBase64 {
+			if raw, err := base64.StdEncoding.DecodeString(payload); err == nil {
+				t["payload"] = raw
+				delete(t, "payload_encoding")
+			}
+		}
+	case []interface{}:
+		for i, v := range t {
+			t[i] = rawPayloads(v)
+		}
+	}
+	return tree
+}
+
+// markPayloads undoes rawPayloads: bin payloads are marked as base64,
+// which is how encoding/json writes byte slices
+func markPayloads(tree interface{}) interface{} {
+	switch t := tree.(type) {
+	case map[string]interface{}:
+		for k, v := range t {
+			t[k] = markPayloads(v)
+		}
+		if _, ok := t["payload"].([]byte); ok {
+			t["payload_encoding"] = payloadBase64
+		}
+	case []interface{}:
+		for i, v := range t {
+			t[i] = markPayloads(v)
+		}
+	}
+	return tree
+}
+
+// encodeMsgpack appends the MessagePack encoding of v, a tree as decoded
+// from JSON with json.Number for numbers and []byte for bin data
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if t {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			encodeInt(buf, n)
+		} else if u, err := strconv.ParseUint(string(t), 10, 64); err == nil {
+			writeUint(buf, u)
+		} else {
+			f, err := t.Float64()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		writeString(buf, t)
+	case []byte:
+		writeLength(buf, len(t), 0, 0, 0xc4, 0xc5, 0xc6)
+		buf.Write(t)
+	case []interface{}:
+		writeLength(buf, len(t), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, elem := range t {
+			if err := encodeMsgpack(buf, elem); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeLength(buf, len(t), 0x80, 16, 0, 0xde, 0xdf)
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeMsgpack(buf, k)
+			if err := encodeMsgpack(buf, t[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot encode %T", v)
+	}
+	return nil
+}
+
+// encodeInt writes n in the shortest integer format that holds it
+func encodeInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= 0x7f, n >= -32 && n < 0:
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// writeLength writes the header of a string, bin, array or map of n
+// elements: fix|n when n < fixMax, otherwise the 8, 16 or 32 bit form.
+// Kinds without a fix or 8 bit form pass 0 for it.
+func writeLength(buf *bytes.Buffer, n int, fix byte, fixMax int, b8, b16, b32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(b8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// msgpackDecoder decodes MessagePack into the tree encodeMsgpack takes,
+// with int64, uint64 and float64 for numbers. Map keys must be strings.
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads an n byte big-endian unsigned integer
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	head, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	c := head[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c & 0x0f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+		return u, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+	case 0xca:
+		u, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(u))), nil
+	case 0xcb:
+		u, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(u), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.take(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) array(n int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		// Every element takes at least a byte
+		return nil, errMsgpackShort
+	}
+	out := make([]interface{}, n)
+	for i := range out {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (d *msgpackDecoder) mapOf(n int) (interface{}, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	out := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key of type %T, want a string", k)
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,416 @@
+package gochunker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// The wire structs sent and received most are encoded and decoded directly
+// rather than through their JSON form. The bytes are the same the generic
+// path writes, a map with sorted keys, except that chunk frames carry their
+// chunk as bin data too.
+
+// marshalWire encodes v if it is one of the wire structs, reporting false
+// for the generic path to take it otherwise
+func marshalWire(buf *bytes.Buffer, v interface{}) (bool, error) {
+	switch m := v.(type) {
+	case Event:
+		return true, encodeEvent(buf, m)
+	case *Event:
+		return true, encodeEvent(buf, *m)
+	case batchMessage:
+		writeLength(buf, 2, 0x80, 16, 0, 0xde, 0xdf)
+		writeString(buf, "events")
+		writeLength(buf, len(m.Events), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range m.Events {
+			if err := encodeEvent(buf, e); err != nil {
+				return true, err
+			}
+		}
+		writeString(buf, "type")
+		writeString(buf, m.Type)
+		return true, nil
+	case ChunkFrame:
+		encodeChunkFrame(buf, m)
+		return true, nil
+	case *ChunkFrame:
+		encodeChunkFrame(buf, *m)
+		return true, nil
+	}
+	return false, nil
+}
+
+func encodeEvent(buf *bytes.Buffer, e Event) error {
+	var expires []byte
+	if !e.ExpiresAt.IsZero() {
+		text, err := e.ExpiresAt.MarshalText()
+		if err != nil {
+			return err
+		}
+		expires = text
+	}
+	writeMapHeader(buf, 2, e.Encoding != "", expires != nil, len(e.Metadata) > 0,
+		e.Priority != 0, e.Seq != 0, e.TraceParent != "", e.TraceState != "", e.Type != "", e.Weight != 0)
+	if e.Encoding != "" {
+		writeString(buf, "encoding")
+		writeString(buf, e.Encoding)
+	}
+	if expires != nil {
+		writeString(buf, "expires_at")
+		writeLength(buf, len(expires), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.Write(expires)
+	}
+	writeString(buf, "id")
+	writeString(buf, e.ID)
+	if len(e.Metadata) > 0 {
+		writeString(buf, "metadata")
+		writeStringMap(buf, e.Metadata)
+	}
+	writeString(buf, "payload")
+	writeLength(buf, len(e.Payload), 0, 0, 0xc4, 0xc5, 0xc6)
+	buf.Write(e.Payload)
+	if e.Priority != 0 {
+		writeString(buf, "priority")
+		encodeInt(buf, int64(e.Priority))
+	}
+	if e.Seq != 0 {
+		writeString(buf, "seq")
+		writeUint(buf, e.Seq)
+	}
+	if e.TraceParent != "" {
+		writeString(buf, "traceparent")
+		writeString(buf, e.TraceParent)
+	}
+	if e.TraceState != "" {
+		writeString(buf, "tracestate")
+		writeString(buf, e.TraceState)
+	}
+	if e.Type != "" {
+		writeString(buf, "type")
+		writeString(buf, e.Type)
+	}
+	if e.Weight != 0 {
+		writeString(buf, "weight")
+		encodeInt(buf, int64(e.Weight))
+	}
+	return nil
+}
+
+func encodeChunkFrame(buf *bytes.Buffer, f ChunkFrame) {
+	writeMapHeader(buf, 4, f.Encoding != "", f.EventSeq != 0, len(f.Metadata) > 0, f.Type != "")
+	writeString(buf, "chunk")
+	writeLength(buf, len(f.Chunk), 0, 0, 0xc4, 0xc5, 0xc6)
+	buf.Write(f.Chunk)
+	if f.Encoding != "" {
+		writeString(buf, "encoding")
+		writeString(buf, f.Encoding)
+	}
+	if f.EventSeq != 0 {
+		writeString(buf, "event_seq")
+		writeUint(buf, f.EventSeq)
+	}
+	writeString(buf, "id")
+	writeString(buf, f.ID)
+	if len(f.Metadata) > 0 {
+		writeString(buf, "metadata")
+		writeStringMap(buf, f.Metadata)
+	}
+	writeString(buf, "seq")
+	encodeInt(buf, int64(f.Seq))
+	writeString(buf, "total")
+	encodeInt(buf, int64(f.Total))
+	if f.Type != "" {
+		writeString(buf, "type")
+		writeString(buf, f.Type)
+	}
+}
+
+// writeMapHeader writes the header of a map of n fields always present and
+// those of the optional ones that are set
+func writeMapHeader(buf *bytes.Buffer, n int, optional ...bool) {
+	for _, set := range optional {
+		if set {
+			n++
+		}
+	}
+	writeLength(buf, n, 0x80, 16, 0, 0xde, 0xdf)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeLength(buf, len(s), 0xa0, 32, 0xd9, 0xda, 0xdb)
+	buf.WriteString(s)
+}
+
+// writeUint writes u as encodeInt does, or as uint 64 past math.MaxInt64
+func writeUint(buf *bytes.Buffer, u uint64) {
+	if u <= math.MaxInt64 {
+		encodeInt(buf, int64(u))
+		return
+	}
+	buf.WriteByte(0xcf)
+	var b [8]byte
+	for i := range b {
+		b[i] = byte(u >> (56 - 8*i))
+	}
+	buf.Write(b[:])
+}
+
+func writeStringMap(buf *bytes.Buffer, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	writeLength(buf, len(keys), 0x80, 16, 0, 0xde, 0xdf)
+	for _, k := range keys {
+		writeString(buf, k)
+		writeString(buf, m[k])
+	}
+}
+
+// unmarshalWire decodes tree into v if it is one of the wire structs,
+// reporting false for the generic path to take it otherwise. As with JSON,
+// fields tree lacks are left alone.
+func unmarshalWire(tree interface{}, v interface{}) (bool, error) {
+	switch m := v.(type) {
+	case *Event:
+		return true, decodeEvent(tree, m)
+	case *batchMessage:
+		fields, err := treeMap(tree)
+		if err != nil {
+			return true, err
+		}
+		for k, v := range fields {
+			switch k {
+			case "type":
+				m.Type, err = treeString(v)
+			case "events":
+				m.Events, err = decodeEvents(v)
+			}
+			if err != nil {
+				return true, fmt.Errorf("msgpack: %s: %w", k, err)
+			}
+		}
+		return true, nil
+	case *ChunkFrame:
+		return true, decodeChunkFrame(tree, m)
+	}
+	return false, nil
+}
+
+func decodeEvents(tree interface{}) ([]Event, error) {
+	if tree == nil {
+		return nil, nil
+	}
+	elems, ok := tree.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%T, want an array", tree)
+	}
+	events := make([]Event, len(elems))
+	for i, elem := range elems {
+		if err := decodeEvent(elem, &events[i]); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// decodeEvent fills e from tree as Event's UnmarshalJSON would from the
+// equivalent JSON, taking bin payloads as they are
+func decodeEvent(tree interface{}, e *Event) error {
+	fields, err := treeMap(tree)
+	if err != nil {
+		return err
+	}
+	var payload interface{}
+	var payloadEncoding string
+	for k, v := range fields {
+		var n int64
+		switch k {
+		case "id":
+			e.ID, err = treeString(v)
+		case "payload":
+			payload = v
+		case "payload_encoding":
+			payloadEncoding, err = treeString(v)
+		case "type":
+			e.Type, err = treeString(v)
+		case "weight":
+			n, err = treeInt(v)
+			e.Weight = int(n)
+		case "priority":
+			n, err = treeInt(v)
+			e.Priority = int(n)
+		case "encoding":
+			e.Encoding, err = treeString(v)
+		case "seq":
+			e.Seq, err = treeUint(v)
+		case "metadata":
+			e.Metadata, err = treeStringMap(v)
+		case "traceparent":
+			e.TraceParent, err = treeString(v)
+		case "tracestate":
+			e.TraceState, err = treeString(v)
+		case "expires_at":
+			err = treeTime(v, &e.ExpiresAt)
+		}
+		if err != nil {
+			return fmt.Errorf("msgpack: %s: %w", k, err)
+		}
+	}
+	switch p := payload.(type) {
+	case []byte:
+		e.Payload = p
+	case nil:
+		e.Payload = nil
+	case string:
+		switch payloadEncoding {
+		case "":
+			e.Payload = []byte(p)
+		case payloadBase64:
+			if e.Payload, err = base64.StdEncoding.DecodeString(p); err != nil {
+				return fmt.Errorf("decoding payload: %w", err)
+			}
+		default:
+			return fmt.Errorf("unsupported payload encoding %q", payloadEncoding)
+		}
+	default:
+		return fmt.Errorf("msgpack: payload: %T, want bin or a string", payload)
+	}
+	if e.Payload == nil {
+		e.Payload = []byte{}
+	}
+	return nil
+}
+
+func decodeChunkFrame(tree interface{}, f *ChunkFrame) error {
+	fields, err := treeMap(tree)
+	if err != nil {
+		return err
+	}
+	for k, v := range fields {
+		var n int64
+		switch k {
+		case "id":
+			f.ID, err = treeString(v)
+		case "seq":
+			n, err = treeInt(v)
+			f.Seq = int(n)
+		case "total":
+			n, err = treeInt(v)
+			f.Total = int(n)
+		case "chunk":
+			f.Chunk, err = treeBytes(v)
+		case "type":
+			f.Type, err = treeString(v)
+		case "encoding":
+			f.Encoding, err = treeString(v)
+		case "event_seq":
+			f.EventSeq, err = treeUint(v)
+		case "metadata":
+			f.Metadata, err = treeStringMap(v)
+		}
+		if err != nil {
+			return fmt.Errorf("msgpack: %s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func treeMap(tree interface{}) (map[string]interface{}, error) {
+	m, ok := tree.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("msgpack: %T, want a map", tree)
+	}
+	return m, nil
+}
+
+// The tree helpers below treat nil, a JSON null, as the zero value
+
+func treeString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	}
+	return "", fmt.Errorf("%T, want a string", v)
+}
+
+// treeBytes takes bin data as is and strings as base64, the way
+// encoding/json writes byte slices
+func treeBytes(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return t, nil
+	case string:
+		return base64.StdEncoding.DecodeString(t)
+	}
+	return nil, fmt.Errorf("%T, want bin or a string", v)
+}
+
+func treeInt(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return t, nil
+	case float64:
+		if t == math.Trunc(t) && t >= math.MinInt64 && t < math.MaxInt64 {
+			return int64(t), nil
+		}
+	}
+	return 0, fmt.Errorf("%v, want an integer", v)
+}
+
+func treeUint(v interface{}) (uint64, error) {
+	switch t := v.(type) {
+	case uint64:
+		return t, nil
+	case float64:
+		if t == math.Trunc(t) && t >= 0 && t < math.MaxUint64 {
+			return uint64(t), nil
+		}
+	}
+	n, err := treeInt(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%v, want an unsigned integer", v)
+	}
+	return uint64(n), nil
+}
+
+func treeStringMap(v interface{}) (map[string]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%T, want a map", v)
+	}
+	m := make(map[string]string, len(fields))
+	for k, fv := range fields {
+		s, err := treeString(fv)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		m[k] = s
+	}
+	return m, nil
+}
+
+func treeTime(v interface{}, t *time.Time) error {
+	if v == nil {
+		return nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%T, want a string", v)
+	}
+	return t.UnmarshalText([]byte(s))
+}
@@ -0,0 +1,27 @@
+package gochunker
+
+import "bytes"
+
+// splitNDJSON returns the lines of msg, an app message holding
+// newline-delimited JSON events, reporting false for a message carrying a
+// single event. Only JSON apps can send NDJSON, and only with AppNDJSON
+// set, as then a message with a line break in it can't be a pretty-printed
+// event. Lines are trimmed, blank ones are kept empty so the rest keep
+// their numbers.
+func (c *Controller) splitNDJSON(app *appConn, msg []byte) ([][]byte, bool) {
+	if !c.cfg.AppNDJSON {
+		return nil, false
+	}
+	if _, ok := app.codec.(JSONCodec); !ok {
+		return nil, false
+	}
+	msg = bytes.TrimRight(msg, " \t\r\n")
+	if bytes.IndexByte(msg, '\n') < 0 {
+		return nil, false
+	}
+	lines := bytes.Split(msg, []byte("\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimSpace(line)
+	}
+	return lines, true
+}
@@ -0,0 +1,83 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readRejections reads n eventRejection messages from app
+func readRejections(t *testing.T, app *websocket.Conn, n int) []eventRejection {
+	t.Helper()
+	var got []eventRejection
+	app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer app.SetReadDeadline(time.Time{})
+	for len(got) < n {
+		_, msg, err := app.ReadMessage()
+		if err != nil {
+			t.Fatalf("read %d rejections, want %d: %v", len(got), n, err)
+		}
+		var r eventRejection
+		if json.Unmarshal(msg, &r) == nil && r.Error != "" {
+			got = append(got, r)
+		}
+	}
+	return got
+}
+
+func TestNDJSONFrameSplitIntoEvents(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.AppNDJSON = true
+	c := startController(t, cfg, WithValidator(func(raw []byte, e Event) error {
+		if e.ID == "bad" {
+			return errors.New("not this one")
+		}
+		return nil
+	}))
+	app := dialApp(t, c)
+	frame := `{"id":"e0","payload":"a"}
+{"id":"e1",
+{"id":"bad","payload":"b"}
+
+{"id":"e2","payload":"c"}
+`
+	if err := app.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := readRejections(t, app, 2)
+	if rejected[0].Line != 2 || rejected[0].ID != "" {
+		t.Errorf("first rejection %+v, want the malformed line 2", rejected[0])
+	}
+	if rejected[1].Line != 3 || rejected[1].ID != "bad" {
+		t.Errorf("second rejection %+v, want bad on line 3", rejected[1])
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v, want e0 e2", main.ids())
+	}
+	if ids := main.ids(); ids[0] != "e0" || ids[1] != "e2" {
+		t.Fatalf("main got %v, want e0 e2", ids)
+	}
+	if n := c.Status().Rejected; n != 2 {
+		t.Fatalf("%d events rejected, want 2", n)
+	}
+}
+
+func TestNDJSONOffByDefault(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	app := dialApp(t, c)
+	if err := app.WriteMessage(websocket.TextMessage, []byte("{\"id\":\"e0\"}\n{\"id\":\"e1\"}")); err != nil {
+		t.Fatal(err)
+	}
+	if r := readRejections(t, app, 1)[0]; r.Line != 0 {
+		t.Fatalf("rejection %+v names a line without AppNDJSON", r)
+	}
+	if n := main.count(); n != 0 {
+		t.Fatalf("main got %d events from a frame it should have rejected", n)
+	}
+}
@@ -0,0 +1,93 @@
+package gochunker
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// notifyHeader asks for notifications about the app's events that never
+// reach a provider. The notify query parameter does the same for clients
+// that can't set headers.
+const notifyHeader = "X-Gochunker-Notify"
+
+// noticeQueueSize bounds the notifications waiting to be written to one
+// app, later ones are dropped while it is full
+const noticeQueueSize = 256
+
+// appNotice tells an app that asked for notifications that one of its
+// events expired before a provider got it or was dead-lettered
+type appNotice struct {
+	Type     string `json:"type"`               // "expired" or "deadletter"
+	ID       string `json:"id"`                 // of the event
+	Provider string `json:"provider,omitempty"` // that skipped or gave up on the event, none for events dead-lettered before reaching one
+	Reason   string `json:"reason,omitempty"`   // why the event was dead-lettered
+}
+
+// notifyOf reports whether r asks for notifications
+func notifyOf(r *http.Request) (bool, error) {
+	v := r.Header.Get(notifyHeader)
+	if v == "" {
+		v = r.URL.Query().Get("notify")
+	}
+	if v == "" {
+		return false, nil
+	}
+	notify, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("malformed %s %q", notifyHeader, v)
+	}
+	return notify, nil
+}
+
+// submitterLocked returns the submitter ID of events arriving over a new
+// app connection: that of its session, which outlives the connection, or
+// one of the connection's own for an app without one. c.mu must be held.
+func (c *Controller) submitterLocked(session string) string {
+	if session != "" {
+		return "session-" + session
+	}
+	c.appSeq++
+	return fmt.Sprintf("conn-%d", c.appSeq)
+}
+
+// notifyLocked queues notice about event for the app that submitted it, if
+// it is connected and asked for notifications. c.mu must be held.
+func (c *Controller) notifyLocked(event Event, notice appNotice) {
+	if event.Submitter == "" {
+		return
+	}
+	for _, app := range c.apps {
+		if app.notices == nil || app.submitter != event.Submitter {
+			continue
+		}
+		notice.ID = event.ID
+		msg, err := app.codec.Marshal(notice)
+		if err != nil {
+			return
+		}
+		select {
+		case app.notices <- msg:
+		default:
+			c.log.Warn("app notifications backed up, dropped one", "submitter", app.submitter, "event_id", event.ID, "type", notice.Type)
+		}
+		return
+	}
+}
+
+// writeNotices writes the notifications queued for app until its reader
+// stops or the controller does
+func (c *Controller) writeNotices(app *appConn) {
+	for {
+		select {
+		case msg := <-app.notices:
+			if err := app.write(msg, c.cfg.WriteTimeout); err != nil {
+				c.log.Warn("notifying app failed", "submitter", app.submitter, "err", err)
+			}
+		case <-app.readerDone:
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
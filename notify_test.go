@@ -0,0 +1,120 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readNotices reads n notifications from conn
+func readNotices(t *testing.T, conn *websocket.Conn, n int) []appNotice {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var notices []appNotice
+	for len(notices) < n {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("after %v: %v", notices, err)
+		}
+		var notice appNotice
+		if err := json.Unmarshal(msg, &notice); err != nil {
+			t.Fatal(err)
+		}
+		notices = append(notices, notice)
+	}
+	return notices
+}
+
+func TestNotificationsGoToTheSubmitter(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	route := func(e Event) []string {
+		if strings.HasPrefix(e.ID, "lost") {
+			return nil
+		}
+		return []string{"Main"}
+	}
+	c := startController(t, testConfig(main, backup), WithRouter(route))
+	url := serveApps(t, c)
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(url+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	a, b, quiet := dial("?notify=true"), dial("?notify=1"), dial("")
+	sendRaw(t, a, `{"id":"stale-a","expires_at":"2000-01-01T00:00:00Z"}`, `{"id":"lost-a"}`)
+	sendRaw(t, b, `{"id":"stale-b","expires_at":"2000-01-01T00:00:00Z"}`, `{"id":"fresh-b"}`)
+	sendRaw(t, quiet, `{"id":"stale-q","expires_at":"2000-01-01T00:00:00Z"}`)
+
+	got := readNotices(t, a, 2)
+	if got[0].Type == "expired" {
+		got[0], got[1] = got[1], got[0]
+	}
+	if n := got[0]; n.Type != "deadletter" || n.ID != "lost-a" || n.Provider != "" || !strings.Contains(n.Reason, "router") {
+		t.Errorf("a was told %+v, want lost-a dead-lettered", n)
+	}
+	if n := got[1]; n.Type != "expired" || n.ID != "stale-a" || n.Provider != "Main" {
+		t.Errorf("a was told %+v, want stale-a expired for Main", n)
+	}
+	if got := readNotices(t, b, 1); got[0].Type != "expired" || got[0].ID != "stale-b" {
+		t.Errorf("b was told %+v, want stale-b expired", got[0])
+	}
+
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Expired == 3 && main.count() == 1 }) {
+		t.Fatalf("%d expired and main got %v", c.Status().Expired, main.ids())
+	}
+	for name, conn := range map[string]*websocket.Conn{"a": a, "b": b, "quiet": quiet} {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, msg, err := conn.ReadMessage(); err == nil {
+			t.Errorf("%s was told %s as well", name, msg)
+		}
+	}
+}
+
+func TestNotificationsFollowTheSession(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	url := serveApps(t, c)
+	dial := func() *websocket.Conn {
+		header := http.Header{sessionHeader: {"s1"}, notifyHeader: {"true"}}
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	first := dial()
+	readNotices(t, first, 1) // the session greeting
+	sendRaw(t, first, `{"id":"e0"}`)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatalf("main got %v", main.ids())
+	}
+	second := dial()
+	readNotices(t, second, 1)
+
+	// Dead-lettered after the connection it came over was replaced
+	c.mu.Lock()
+	c.deadLetterLocked("Main", Event{ID: "e0", Submitter: "session-s1"}, "never acknowledged")
+	c.mu.Unlock()
+	if got := readNotices(t, second, 1); got[0].Type != "deadletter" || got[0].ID != "e0" || got[0].Reason != "never acknowledged" {
+		t.Fatalf("resumed session was told %+v", got[0])
+	}
+}
+
+func TestNotifyMalformed(t *testing.T) {
+	c := startController(t, DefaultConfig())
+	_, resp, err := websocket.DefaultDialer.Dial(serveApps(t, c)+"?notify=sometimes", nil)
+	if err == nil {
+		t.Fatal("malformed notify accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("malformed notify answered %v", resp)
+	}
+}
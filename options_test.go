@@ -0,0 +1,83 @@
+package gochunker
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// newTestController builds a controller that isn't started, closing it
+// when the test ends
+func newTestController(t *testing.T, opts ...Option) *Controller {
+	t.Helper()
+	c, err := NewController(DefaultConfig(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close(context.Background()) })
+	return c
+}
+
+func TestNewControllerDefaults(t *testing.T) {
+	c := newTestController(t)
+	if got := c.ratelimiter.Max(); got != 100 {
+		t.Errorf("rate limit %d, want 100", got)
+	}
+	if c.ratelimiter.interval != time.Hour {
+		t.Errorf("rate limit interval %s, want 1h", c.ratelimiter.interval)
+	}
+	if c.events.size != 10000 {
+		t.Errorf("buffer size %d, want 10000", c.events.size)
+	}
+	if c.typeLimiter != nil {
+		t.Error("type limits set without any configured")
+	}
+	members := c.pool.members
+	if len(members) != 2 || members[0].url != "ws://provider/main" || members[1].url != "ws://provider/backup" {
+		t.Errorf("%d providers, want the default main and backup", len(members))
+	}
+	if c.log == nil {
+		t.Error("no default logger")
+	}
+}
+
+func TestOptionsApplied(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c := newTestController(t,
+		WithRateLimit(5, time.Second),
+		WithTypeRateLimits(map[string]int{"click": 2}),
+		WithBufferSize(7),
+		WithLogger(logger),
+		WithProviders("ws://a/x", "ws://b/y", "ws://c/z"),
+	)
+	if got := c.ratelimiter.Max(); got != 5 || c.ratelimiter.interval != time.Second {
+		t.Errorf("rate limit %d per %s, want 5 per 1s", got, c.ratelimiter.interval)
+	}
+	if rl := c.typeLimiter.Limiter("click"); rl == nil || rl.Max() != 2 {
+		t.Error("click events not limited to 2")
+	}
+	if c.events.size != 7 {
+		t.Errorf("buffer size %d, want 7", c.events.size)
+	}
+	if c.log != logger {
+		t.Error("logger not used")
+	}
+	if n := len(c.pool.members); n != 3 || c.pool.members[2].url != "ws://c/z" {
+		t.Errorf("%d providers, want ws://a/x, ws://b/y and ws://c/z", n)
+	}
+}
+
+func TestOptionsAreValidated(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"empty buffer": WithBufferSize(0),
+		"ftp provider": WithProviders("ftp://x"),
+		"zero rate":    WithRateLimit(0, time.Second),
+	} {
+		if c, err := NewController(DefaultConfig(), opt); err == nil {
+			c.Close(context.Background())
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package gochunker
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// originMatcher decides whether an Origin header is on the allow-list
+// compiled from Config.AllowedOrigins. A pattern is "*" for any origin, a
+// full origin such as https://app.example.com, or a bare host such as
+// app.example.com that matches over any scheme. The leftmost label of the
+// host may be "*" to match one level of subdomains, so *.example.com
+// matches a.example.com but neither example.com nor a.b.example.com. Hosts
+// compare case-insensitively and include the port, which a pattern without
+// a port therefore only matches when the origin has none either.
+type originMatcher struct {
+	any       bool
+	exact     map[string]struct{} // scheme://host, or //host for any scheme
+	wildcards []originWildcard
+}
+
+type originWildcard struct {
+	scheme string // empty for any
+	suffix string // ".example.com"
+}
+
+// compileOrigins builds the matcher for patterns, rejecting malformed ones
+func compileOrigins(patterns []string) (*originMatcher, error) {
+	m := &originMatcher{exact: make(map[string]struct{})}
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			m.any = true
+			continue
+		}
+		scheme, host := "", pattern
+		if i := strings.Index(pattern, "://"); i >= 0 {
+			scheme, host = strings.ToLower(pattern[:i]), pattern[i+3:]
+			if scheme == "" {
+				return nil, fmt.Errorf("origin pattern %q has an empty scheme", pattern)
+			}
+		}
+		host = strings.ToLower(host)
+		if host == "" || strings.ContainsAny(host, "/?#@") {
+			return nil, fmt.Errorf("origin pattern %q is not a scheme and host", pattern)
+		}
+		if strings.HasPrefix(host, "*.") {
+			suffix := host[1:]
+			if len(suffix) < 2 || strings.Contains(suffix, "*") {
+				return nil, fmt.Errorf("origin pattern %q has a malformed wildcard", pattern)
+			}
+			m.wildcards = append(m.wildcards, originWildcard{scheme: scheme, suffix: suffix})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("origin pattern %q may only use * as its leftmost label", pattern)
+		}
+		m.exact[scheme+"//"+host] = struct{}{}
+	}
+	return m, nil
+}
+
+// match reports whether origin is allowed, or why not
+func (m *originMatcher) match(origin string) (bool, string) {
+	if m.any {
+		return true, ""
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false, "malformed Origin header"
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	if _, ok := m.exact[scheme+"//"+host]; ok {
+		return true, ""
+	}
+	if _, ok := m.exact["//"+host]; ok {
+		return true, ""
+	}
+	for _, w := range m.wildcards {
+		if w.scheme != "" && w.scheme != scheme {
+			continue
+		}
+		label, ok := strings.CutSuffix(host, w.suffix)
+		if ok && label != "" && !strings.Contains(label, ".") {
+			return true, ""
+		}
+	}
+	return false, "origin not on the allow-list"
+}
@@ -0,0 +1,68 @@
+package gochunker
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestOriginMatcher(t *testing.T) {
+	m, err := compileOrigins([]string{"https://app.example.com", "*.dash.io", "http://*.local.test:8080", "Plain.Example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for origin, want := range map[string]bool{
+		// exact
+		"https://app.example.com":      true,
+		"https://APP.example.com":      true,
+		"http://app.example.com":       false,
+		"https://app.example.com:8443": false,
+		"ws://plain.example":           true,
+		// wildcard
+		"https://a.dash.io":         true,
+		"http://b.dash.io":          true,
+		"http://x.local.test:8080":  true,
+		"https://x.local.test:8080": false,
+		"http://x.local.test":       false,
+		// rejected
+		"https://dash.io":            false,
+		"https://a.b.dash.io":        false,
+		"https://evildash.io":        false,
+		"https://x.dash.io.evil.com": false,
+		"null":                       false,
+		"%zz":                        false,
+	} {
+		if got, reason := m.match(origin); got != want {
+			t.Errorf("%s: allowed %v (%s), want %v", origin, got, reason, want)
+		}
+	}
+}
+
+func TestMalformedOriginPatterns(t *testing.T) {
+	for _, bad := range []string{"*.", "a.*.com", "https://", "://x", "a/b", "**.x"} {
+		if _, err := compileOrigins([]string{bad}); err == nil {
+			t.Errorf("%q compiled", bad)
+		}
+	}
+}
+
+func TestOriginRejectedWith403(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AllowedOrigins = []string{"*.dash.io"}
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	url := serveApps(t, c)
+	for origin, want := range map[string]int{
+		"https://a.dash.io":   http.StatusSwitchingProtocols,
+		"https://evil.com":    http.StatusForbidden,
+		"not a url":           http.StatusForbidden,
+		"https://a.b.dash.io": http.StatusForbidden,
+	} {
+		if got := handshakeStatus(t, url, http.Header{"Origin": {origin}}); got != want {
+			t.Errorf("%s: answered %d, want %d", origin, got, want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package gochunker
+
+import "fmt"
+
+// OutboundPolicy decides what happens to an event for a provider whose
+// outbound queue already holds OutboundQueueSize events
+type OutboundPolicy int
+
+const (
+	OutboundBlock OutboundPolicy = iota // hold the app until the provider catches up
+	OutboundDrop                        // skip the event for that provider only
+)
+
+func (p OutboundPolicy) String() string {
+	switch p {
+	case OutboundBlock:
+		return "block"
+	case OutboundDrop:
+		return "drop"
+	}
+	return fmt.Sprintf("OutboundPolicy(%d)", int(p))
+}
+
+// ParseOutboundPolicy parses the String form of an OutboundPolicy
+func ParseOutboundPolicy(s string) (OutboundPolicy, error) {
+	switch s {
+	case "block":
+		return OutboundBlock, nil
+	case "drop":
+		return OutboundDrop, nil
+	}
+	return 0, fmt.Errorf("unknown outbound policy %q", s)
+}
+
+// outboundFullLocked reports whether p's worker is running with
+// OutboundQueueSize events queued. Queues of workers yet to start grow as
+// needed: under BackupAfterMain a backup only starts once the apps are
+// gone, so holding them up for it would never end. c.mu must be held.
+func (c *Controller) outboundFullLocked(p *provider) bool {
+	return c.cfg.OutboundQueueSize > 0 && p.feed != nil && len(p.queue) >= c.cfg.OutboundQueueSize
+}
+
+// waitOutbound blocks, under OutboundBlock, until no running worker event
+// is queued for has a full queue, or the controller stops. Routed events
+// wait for the providers they are routed to alone, any other for every
+// member of the pool, including those a pool that doesn't replicate won't
+// pick for it: one provider falling behind then holds up every app.
+func (c *Controller) waitOutbound(event Event) {
+	if c.cfg.OutboundQueueSize <= 0 || c.cfg.OutboundPolicy != OutboundBlock {
+		return
+	}
+	for {
+		c.mu.Lock()
+		targets := c.routeLocked(event)
+		var full *provider
+		for _, p := range c.providers() {
+			if (targets == nil || targets[p]) && c.outboundFullLocked(p) {
+				full = p
+				break
+			}
+		}
+		if full == nil {
+			c.mu.Unlock()
+			return
+		}
+		if c.outboundRoom == nil {
+			c.outboundRoom = make(chan struct{})
+			c.log.Debug("outbound queue full, holding events back", "provider", full.name, "queued", len(full.queue))
+		}
+		room := c.outboundRoom
+		c.mu.Unlock()
+		select {
+		case <-room:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// outboundTakenLocked wakes whoever waits in waitOutbound after a worker
+// took an event off its queue. c.mu must be held.
+func (c *Controller) outboundTakenLocked() {
+	if c.outboundRoom != nil {
+		close(c.outboundRoom)
+		c.outboundRoom = nil
+	}
+}
+
+// outboundDropLocked skips the event at idx for p, whose queue is full
+// under OutboundDrop. c.mu must be held.
+func (c *Controller) outboundDropLocked(p *provider, idx int, event Event) {
+	c.metrics.outboundDropped.WithLabelValues(p.name).Inc()
+	c.log.Warn("outbound queue full, skipped event for provider", "provider", p.name, "event_id", event.ID, "queued", len(p.queue))
+	c.noteDropLocked(event, DropOutboundFull)
+	c.passLocked(p, idx)
+}
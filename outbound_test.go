@@ -0,0 +1,112 @@
+package gochunker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startSlowOutbound starts a controller sending to a single provider whose
+// writes take 50ms, with outbound queues of 2 under policy, and enqueues
+// an event the worker takes right away
+func startSlowOutbound(t *testing.T, policy OutboundPolicy, opts ...Option) (*Controller, *slowProvider) {
+	t.Helper()
+	sp := &slowProvider{delay: 50 * time.Millisecond}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.OutboundQueueSize = 2
+	cfg.OutboundPolicy = policy
+	c := startController(t, cfg, append([]Option{WithDialFunc(sp.dial)}, opts...)...)
+	if err := c.Enqueue(Event{ID: "e0"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	return c, sp
+}
+
+func TestOutboundBlockHoldsEnqueue(t *testing.T) {
+	c, sp := startSlowOutbound(t, OutboundBlock)
+	start := time.Now()
+	for i := 1; i < 6; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("e%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// e1 and e2 fill the queue, e3 to e5 each wait for a write to finish
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Fatalf("enqueueing into a full outbound queue took only %s, want it to block", took)
+	}
+	if !waitUntil(2*time.Second, func() bool { return len(sp.received()) == 6 }) {
+		t.Fatalf("provider got %v, want every event", sp.received())
+	}
+	if got := fmt.Sprint(sp.received()); got != "[e0 e1 e2 e3 e4 e5]" {
+		t.Fatalf("provider got %s", got)
+	}
+}
+
+func TestOutboundDropSkipsEvents(t *testing.T) {
+	c, sp := startSlowOutbound(t, OutboundDrop)
+	start := time.Now()
+	for i := 1; i < 6; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("e%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if took := time.Since(start); took > 40*time.Millisecond {
+		t.Fatalf("enqueueing took %s, want no waiting under OutboundDrop", took)
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].SentIndex == 6 }) {
+		t.Fatalf("sent index %d, want dropped events skipped too", c.Status().Providers[0].SentIndex)
+	}
+	if !waitUntil(time.Second, func() bool { return len(sp.received()) == 3 }) {
+		t.Fatalf("provider got %v, want the 3 events before the queue filled", sp.received())
+	}
+	if got := fmt.Sprint(sp.received()); got != "[e0 e1 e2]" {
+		t.Fatalf("provider got %s, want the events before the queue filled", got)
+	}
+	if mf := gather(t, c, "gochunker_outbound_dropped_total"); mf == nil || mf.GetMetric()[0].GetCounter().GetValue() != 3 {
+		t.Fatalf("outbound dropped metric %v, want 3", mf)
+	}
+	if n := c.Status().Buffered; n != 0 {
+		t.Fatalf("%d events still buffered", n)
+	}
+}
+
+func TestOutboundBlockWaitsOnRoutedProvidersOnly(t *testing.T) {
+	slow, fast := &slowProvider{delay: 100 * time.Millisecond}, &slowProvider{}
+	dial := func(ctx context.Context, url string, header http.Header) (Conn, error) {
+		if url == "ws://slow.invalid" {
+			return slow.dial(ctx, url, header)
+		}
+		return fast.dial(ctx, url, header)
+	}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://slow.invalid", "ws://fast.invalid"}
+	cfg.PoolStrategy = RoundRobin
+	cfg.OutboundQueueSize = 1
+	route := WithRouter(func(e Event) []string { return []string{e.Type} })
+	c := startController(t, cfg, WithDialFunc(dial), route)
+	// One event in the slow provider's write, one filling its queue
+	for i := 0; i < 2; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("s%d", i), Type: "provider-0"}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("f%d", i), Type: "provider-1"}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if took := time.Since(start); took > 80*time.Millisecond {
+		t.Fatalf("enqueueing for the fast provider took %s, want it not held up by the slow one", took)
+	}
+	if !waitUntil(2*time.Second, func() bool { return len(fast.received()) == 3 && len(slow.received()) == 2 }) {
+		t.Fatalf("providers got %v and %v", slow.received(), fast.received())
+	}
+}
@@ -0,0 +1,98 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// PauseProvider stops sending to the provider called name, for maintenance
+// windows. Its connection stays open and keeps being pinged, and the events
+// it has yet to send stay buffered until ResumeProvider is called. A batch
+// already being written still goes out. It returns ErrUnknownProvider for a
+// name not in the pool.
+func (c *Controller) PauseProvider(name string) error {
+	return c.setPaused(name, true)
+}
+
+// ResumeProvider sends to the provider called name again after
+// PauseProvider, starting with the oldest event it was held back from. It
+// returns ErrUnknownProvider for a name not in the pool.
+func (c *Controller) ResumeProvider(name string) error {
+	return c.setPaused(name, false)
+}
+
+func (c *Controller) setPaused(name string, paused bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var p *provider
+	for _, member := range c.providers() {
+		if member.name == name {
+			p = member
+			break
+		}
+	}
+	if p == nil {
+		return fmt.Errorf("%w %q", ErrUnknownProvider, name)
+	}
+	if p.paused == paused {
+		return nil
+	}
+	p.paused = paused
+	if paused {
+		c.log.Info("provider paused, holding its events", "provider", name, "sent_index", p.sentIndex)
+		return nil
+	}
+	c.log.Info("provider resumed", "provider", name, "sent_index", p.sentIndex, "queued", len(p.queue))
+	if p.feed != nil {
+		select {
+		case p.feed <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// pauseRequest names the provider POST /admin/pause and /admin/resume act on
+type pauseRequest struct {
+	Provider string `json:"provider"`
+}
+
+// handlePause pauses or, with resume set, resumes the provider a
+// pauseRequest body names and reports its status. It is an admin
+// endpoint, see authorizeAdmin.
+func (c *Controller) handlePause(resume bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if !c.authorizeAdmin(w, r) {
+			return
+		}
+		var req pauseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "malformed pause request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		set := c.PauseProvider
+		if resume {
+			set = c.ResumeProvider
+		}
+		if err := set(req.Provider); errors.Is(err, ErrUnknownProvider) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		for _, st := range c.Status().Providers {
+			if st.Name == req.Provider {
+				w.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(w).Encode(st); err != nil {
+					c.log.Warn("writing provider status failed", "err", err)
+				}
+				return
+			}
+		}
+	}
+}
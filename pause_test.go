@@ -0,0 +1,86 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postPause posts body to path with the admin token and decodes the
+// provider status it answers with
+func postPause(t *testing.T, srv *httptest.Server, path, body string) (int, ProviderStatus) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st ProviderStatus
+	json.NewDecoder(resp.Body).Decode(&st)
+	return resp.StatusCode, st
+}
+
+func TestPauseProviderHoldsEventsUntilResumed(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.AdminToken = "s3cret"
+	c := startController(t, cfg)
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	app := dialApp(t, c)
+	sendEvents(t, app, "a", 3)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %v, want a0 a1 a2", main.ids())
+	}
+
+	status, st := postPause(t, srv, "/admin/pause", `{"provider":"Main"}`)
+	if status != http.StatusOK || !st.Paused || st.Name != "Main" {
+		t.Fatalf("pause answered %d with %+v", status, st)
+	}
+	sendEvents(t, app, "b", 4)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Buffered == 7 }) {
+		t.Fatalf("%d events buffered, want all 7", c.Status().Buffered)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := main.count(); n != 3 {
+		t.Fatalf("paused main got %d events, want still 3", n)
+	}
+	if st := c.Status().Providers[0]; !st.Connected || st.SentIndex != 3 {
+		t.Fatalf("paused main is %+v, want it connected with sent index 3", st)
+	}
+
+	status, st = postPause(t, srv, "/admin/resume", `{"provider":"Main"}`)
+	if status != http.StatusOK || st.Paused {
+		t.Fatalf("resume answered %d with %+v", status, st)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 7 }) {
+		t.Fatalf("main got %v after resuming, want 7 events", main.ids())
+	}
+	if got := strings.Join(main.ids(), " "); got != "a0 a1 a2 b0 b1 b2 b3" {
+		t.Fatalf("main got %s, want every event once, in order", got)
+	}
+}
+
+func TestPauseUnknownProvider(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.AdminToken = "s3cret"
+	c := startController(t, cfg)
+	if err := c.PauseProvider("Elsewhere"); !errors.Is(err, ErrUnknownProvider) {
+		t.Fatalf("pausing an unknown provider returned %v, want ErrUnknownProvider", err)
+	}
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	if status, _ := postPause(t, srv, "/admin/resume", `{"provider":"Elsewhere"}`); status != http.StatusNotFound {
+		t.Fatalf("resuming an unknown provider answered %d, want 404", status)
+	}
+	if status, _ := postPause(t, srv, "/admin/pause", `{`); status != http.StatusBadRequest {
+		t.Fatalf("malformed pause request answered %d, want 400", status)
+	}
+}
@@ -0,0 +1,232 @@
+package gochunker
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+// PoolStrategy decides which members of a ProviderPool get each event
+type PoolStrategy int
+
+const (
+	// BackupAfterMain sends every event to every member, starting each
+	// member once the one before it has sent everything
+	BackupAfterMain PoolStrategy = iota
+	// RoundRobin hands each event to the next connected member in turn
+	RoundRobin
+	// LeastRecentlyUsed hands each event to the connected member that was
+	// handed one longest ago
+	LeastRecentlyUsed
+	// PrimaryFailover hands every event to the first connected member,
+	// the primary. When it goes down the next member in order is promoted,
+	// and once an earlier member is back it takes over again.
+	PrimaryFailover
+)
+
+func (s PoolStrategy) String() string {
+	switch s {
+	case BackupAfterMain:
+		return "backup-after-main"
+	case RoundRobin:
+		return "round-robin"
+	case LeastRecentlyUsed:
+		return "least-recently-used"
+	case PrimaryFailover:
+		return "primary-failover"
+	}
+	return fmt.Sprintf("PoolStrategy(%d)", int(s))
+}
+
+// ParsePoolStrategy parses the String form of a PoolStrategy
+func ParsePoolStrategy(s string) (PoolStrategy, error) {
+	for _, strategy := range []PoolStrategy{BackupAfterMain, RoundRobin, LeastRecentlyUsed, PrimaryFailover} {
+		if s == strategy.String() {
+			return strategy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown pool strategy %q", s)
+}
+
+// ProviderPool holds the providers the controller sends to and picks which
+// of them each event goes to. Guarded by Controller.mu.
+type ProviderPool struct {
+	Strategy PoolStrategy
+
+	members []*provider
+	primary *provider // first connected member under PrimaryFailover, nil until one connects
+	turn    int       // next member in round-robin order
+	used    []uint64  // when each member was last handed an event, in picks
+	picks   uint64
+}
+
+func newProviderPool(strategy PoolStrategy, members []*provider) *ProviderPool {
+	return &ProviderPool{Strategy: strategy, members: members, used: make([]uint64, len(members))}
+}
+
+// replicates reports whether every member gets every event
+func (pool *ProviderPool) replicates() bool {
+	return pool.Strategy == BackupAfterMain
+}
+
+// pick returns the member the next event goes to. Members whose
+// connection is down are passed over while any other is up, so new events
+// flow around a dead provider; events already handed to it wait for it to
+// reconnect.
+func (pool *ProviderPool) pick() *provider {
+	candidates := make([]int, 0, len(pool.members))
+	for i, p := range pool.members {
+		if p.connected() {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range pool.members {
+			candidates = append(candidates, i)
+		}
+	}
+
+	chosen := candidates[0]
+	switch pool.Strategy {
+	case RoundRobin:
+		for _, i := range candidates {
+			if i >= pool.turn {
+				chosen = i
+				break
+			}
+		}
+		pool.turn = chosen + 1
+	case LeastRecentlyUsed:
+		for _, i := range candidates {
+			if pool.used[i] < pool.used[chosen] {
+				chosen = i
+			}
+		}
+	}
+	pool.picks++
+	pool.used[chosen] = pool.picks
+	return pool.members[chosen]
+}
+
+// rehomeLocked hands the events p, whose connection just went down, has
+// yet to send or get acknowledged to the members pick chooses instead, so
+// they fail over rather than wait for p to come back. An event p's worker
+// was writing may reach both if p returns. Events stay with p while no
+// other member is connected. Replicating pools leave p's events alone,
+// p.next takes over from it, as do routed ones, see WithRouter. c.mu must
+// be held.
+func (c *Controller) rehomeLocked(p *provider) {
+	if c.pool.replicates() || c.router != nil || c.ctx.Err() != nil {
+		return
+	}
+	// Everything p still owes: queued, taken by its worker but not yet
+	// written, or written but not acknowledged
+	var indexes []int
+	for idx := p.sentIndex; idx < c.events.next(); idx++ {
+		if _, sent := p.sentAbove[idx]; !sent {
+			indexes = append(indexes, idx)
+		}
+	}
+	for idx := range p.unacked {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	moved := 0
+	for _, idx := range indexes {
+		event, ok := c.events.get(idx)
+		if !ok {
+			continue
+		}
+		to := c.pool.pick()
+		if to == p || !to.connected() {
+			break
+		}
+		at := event.EnqueuedAt
+		if at.IsZero() {
+			at = c.now()
+		}
+		c.forgetLocked(p, idx)
+		to.reclaimLocked(idx)
+		heap.Push(&to.queue, queuedEvent{index: idx, rank: c.rank(event, at)})
+		c.passLocked(p, idx)
+		moved++
+	}
+	if moved == 0 {
+		return
+	}
+	kept := p.queue[:0]
+	for _, qe := range p.queue {
+		if _, open := p.sentAbove[qe.index]; !open && qe.index >= p.sentIndex {
+			kept = append(kept, qe)
+		}
+	}
+	p.queue = kept
+	heap.Init(&p.queue)
+	c.releaseLocked()
+	c.fanOutLocked()
+	c.log.Warn("provider down, moved its events to other pool members", "provider", p.name, "events", moved)
+}
+
+// reclaimLocked makes p owe the event at idx again after it was passed to
+// another member, so the buffer holds it until p has sent it. c.mu must be
+// held.
+func (p *provider) reclaimLocked(idx int) {
+	if p.sentAbove == nil {
+		p.sentAbove = make(map[int]struct{})
+	}
+	for i := idx + 1; i < p.sentIndex; i++ {
+		p.sentAbove[i] = struct{}{}
+	}
+	if idx < p.sentIndex {
+		p.sentIndex = idx
+	}
+	if idx < p.ackedIndex {
+		p.ackedIndex = idx
+	}
+	delete(p.sentAbove, idx)
+}
+
+// updatePrimaryLocked makes the first connected member the primary of a
+// PrimaryFailover pool after a member connected or went down. While no
+// member is connected the last primary is kept. c.mu must be held.
+func (c *Controller) updatePrimaryLocked() {
+	if c.pool.Strategy != PrimaryFailover {
+		return
+	}
+	for _, p := range c.pool.members {
+		if !p.connected() {
+			continue
+		}
+		if prev := c.pool.primary; p != prev {
+			c.pool.primary = p
+			if prev != nil {
+				c.log.Warn("promoted provider to primary", "provider", p.name, "previous", prev.name)
+			}
+		}
+		return
+	}
+}
+
+// poolMembers builds the providers named in cfg: ProviderURLs when set,
+// the main provider followed by the backups otherwise
+func poolMembers(cfg Config) []*provider {
+	if len(cfg.ProviderURLs) == 0 {
+		members := []*provider{{name: "Main", url: cfg.MainProviderURL}}
+		if len(cfg.BackupProviderURLs) == 0 {
+			return append(members, &provider{name: "Backup", url: cfg.BackupProviderURL})
+		}
+		for i, url := range cfg.BackupProviderURLs {
+			name := "Backup"
+			if i > 0 {
+				name = fmt.Sprintf("Backup-%d", i+1)
+			}
+			members = append(members, &provider{name: name, url: url})
+		}
+		return members
+	}
+	members := make([]*provider, len(cfg.ProviderURLs))
+	for i, url := range cfg.ProviderURLs {
+		members[i] = &provider{name: fmt.Sprintf("provider-%d", i), url: url}
+	}
+	return members
+}
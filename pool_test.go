@@ -0,0 +1,269 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startPool starts a controller sending to fps under strategy and waits for
+// every member to connect
+func startPool(t *testing.T, strategy PoolStrategy, fps []*fakeProvider, tweak func(*Config)) (*Controller, *websocket.Conn) {
+	t.Helper()
+	cfg := DefaultConfig()
+	for _, fp := range fps {
+		cfg.ProviderURLs = append(cfg.ProviderURLs, fp.url())
+	}
+	cfg.PoolStrategy = strategy
+	if tweak != nil {
+		tweak(&cfg)
+	}
+	c := startController(t, cfg)
+	if !waitUntil(2*time.Second, func() bool { return int(c.providersUp.Load()) == len(fps) }) {
+		t.Fatal("pool members never connected")
+	}
+	return c, dialApp(t, c)
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	fps := []*fakeProvider{newFakeProvider(t), newFakeProvider(t), newFakeProvider(t)}
+	c, app := startPool(t, RoundRobin, fps, nil)
+	sendEvents(t, app, "e", 9)
+	total := func() int { return fps[0].count() + fps[1].count() + fps[2].count() }
+	if !waitUntil(2*time.Second, func() bool { return total() == 9 }) {
+		t.Fatalf("pool got %d events, want 9", total())
+	}
+	for i, fp := range fps {
+		if n := fp.count(); n != 3 {
+			t.Errorf("member %d got %d events, want 3", i, n)
+		}
+	}
+	if !waitUntil(time.Second, func() bool { return c.Status().Buffered == 0 }) {
+		t.Fatal("sent events kept buffered")
+	}
+}
+
+func TestPoolPrimaryFailoverRoutesNewEvents(t *testing.T) {
+	fps := []*fakeProvider{newFakeProvider(t), newFakeProvider(t)}
+	c, app := startPool(t, PrimaryFailover, fps, nil)
+	sendEvents(t, app, "a", 3)
+	if !waitUntil(2*time.Second, func() bool { return fps[0].count() == 3 }) {
+		t.Fatalf("primary got %d events, want 3", fps[0].count())
+	}
+	fps[0].kill()
+	if !waitUntil(2*time.Second, func() bool { return !c.Status().Providers[0].Connected }) {
+		t.Fatal("primary still connected")
+	}
+	sendEvents(t, app, "b", 3)
+	if !waitUntil(2*time.Second, func() bool { return fps[1].count() == 3 }) {
+		t.Fatalf("secondary got %d events, want 3", fps[1].count())
+	}
+}
+
+func TestPoolFailoverMovesQueuedEvents(t *testing.T) {
+	fps := []*fakeProvider{newFakeProvider(t), newFakeProvider(t)}
+	c, app := startPool(t, PrimaryFailover, fps, func(cfg *Config) {
+		// Keeps most events queued for the primary when it dies
+		cfg.RateLimit = 1
+		cfg.RateLimitInterval = 100 * time.Millisecond
+	})
+	sendEvents(t, app, "e", 6)
+	if !waitUntil(2*time.Second, func() bool { return fps[0].count() >= 1 }) {
+		t.Fatal("primary got nothing")
+	}
+	fps[0].kill()
+
+	want := []string{"e0", "e1", "e2", "e3", "e4", "e5"}
+	delivered := func() bool {
+		got := make(map[string]bool)
+		for _, fp := range fps {
+			for _, id := range fp.ids() {
+				got[id] = true
+			}
+		}
+		return len(got) == len(want)
+	}
+	if !waitUntil(5*time.Second, delivered) {
+		t.Fatalf("events stranded on the dead primary: primary got %v, secondary %v", fps[0].ids(), fps[1].ids())
+	}
+	secondary := fps[1].ids()
+	if !sort.StringsAreSorted(secondary) {
+		t.Errorf("moved events out of order: %v", secondary)
+	}
+	if !waitUntil(time.Second, func() bool { return c.Status().Buffered == 0 }) {
+		t.Fatalf("moved events kept buffered: %d", c.Status().Buffered)
+	}
+}
+
+// takeDown drops fp's connections and refuses redials until bringUp
+func takeDown(fp *fakeProvider) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.refuse = 1 << 30
+	for _, conn := range fp.conns {
+		conn.Close()
+	}
+}
+
+// bringUp lets fp accept redials again
+func bringUp(fp *fakeProvider) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.refuse = 0
+}
+
+func TestBackupsPromotedInOrder(t *testing.T) {
+	main := newFakeProvider(t)
+	backups := []*fakeProvider{newFakeProvider(t), newFakeProvider(t), newFakeProvider(t)}
+	cfg := DefaultConfig()
+	cfg.MainProviderURL = main.url()
+	for _, fp := range backups {
+		cfg.BackupProviderURLs = append(cfg.BackupProviderURLs, fp.url())
+	}
+	cfg.PoolStrategy = PrimaryFailover
+	c := startController(t, cfg, withBackoffBase(5*time.Millisecond))
+	if !waitUntil(2*time.Second, func() bool { return c.providersUp.Load() == 4 }) {
+		t.Fatal("pool members never connected")
+	}
+	app := dialApp(t, c)
+	all := append([]*fakeProvider{main}, backups...)
+	promoted := func(want string) {
+		t.Helper()
+		if !waitUntil(2*time.Second, func() bool { return c.Status().Primary == want }) {
+			t.Fatalf("primary is %q, want %s", c.Status().Primary, want)
+		}
+	}
+
+	promoted("Main")
+	sendEvents(t, app, "m", 2)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v", main.ids())
+	}
+	steps := []struct {
+		down *fakeProvider
+		want string
+		next *fakeProvider
+	}{
+		{main, "Backup", backups[0]},
+		{backups[0], "Backup-2", backups[1]},
+		{backups[1], "Backup-3", backups[2]},
+	}
+	for i, step := range steps {
+		takeDown(step.down)
+		promoted(step.want)
+		prefix := string(rune('a' + i))
+		sendEvents(t, app, prefix, 2)
+		if !waitUntil(2*time.Second, func() bool { return step.next.count() >= 2 }) {
+			t.Fatalf("%s got %v after its promotion", step.want, step.next.ids())
+		}
+		for _, id := range step.next.ids() {
+			if id[:1] != prefix {
+				t.Fatalf("%s got %s, sent before its promotion", step.want, id)
+			}
+		}
+	}
+
+	bringUp(main)
+	promoted("Main")
+	sendEvents(t, app, "z", 2)
+	delivered := func() bool {
+		got := make(map[string]bool)
+		for _, fp := range all {
+			for _, id := range fp.ids() {
+				got[id] = true
+			}
+		}
+		return len(got) == 10
+	}
+	if !waitUntil(2*time.Second, delivered) {
+		t.Fatal("events lost during promotion")
+	}
+	if ids := main.ids(); ids[len(ids)-1] != "z1" {
+		t.Fatalf("recovered main got %v, want it to take over again", ids)
+	}
+}
+
+func TestParsePoolStrategy(t *testing.T) {
+	for _, s := range []PoolStrategy{BackupAfterMain, RoundRobin, LeastRecentlyUsed, PrimaryFailover} {
+		got, err := ParsePoolStrategy(s.String())
+		if err != nil || got != s {
+			t.Errorf("ParsePoolStrategy(%q) = %v, %v", s.String(), got, err)
+		}
+	}
+	if _, err := ParsePoolStrategy("random"); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+func TestBackupTakesOverFromFailedMain(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	dropAfter(main, 3, true)
+	backup.ackAll()
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	c := startController(t, cfg, withBackoffBase(time.Second))
+	sendEvents(t, dialApp(t, c), "e", 6)
+
+	// Main acknowledged e0 to e2 before its connection went, backup
+	// starts right away and delivers the rest
+	if !waitUntil(2*time.Second, func() bool { return len(backup.ids()) >= 3 }) {
+		t.Fatalf("backup got %v, want the events after e2", backup.ids())
+	}
+	got := backup.ids()
+	if got[0] == "e0" || got[0] == "e1" {
+		t.Fatalf("backup got %v, want it to skip what main acknowledged", got)
+	}
+	if tail := got[len(got)-3:]; tail[0] != "e3" || tail[1] != "e4" || tail[2] != "e5" {
+		t.Fatalf("backup got %v, want it to end with e3 e4 e5", got)
+	}
+}
+
+func TestStrictFailoverResumesAtFirstUnacked(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			main, backup := newFakeProvider(t), newFakeProvider(t)
+			// Main acknowledges e0, e1 and e3 but not e2, then fails mid-batch
+			got := 0
+			main.onMessage = func(conn *websocket.Conn, msg []byte) {
+				var event Event
+				if json.Unmarshal(msg, &event) != nil || got == 5 {
+					return
+				}
+				got++
+				if event.ID != "e2" {
+					conn.WriteMessage(websocket.TextMessage, []byte(`{"ack":"`+event.ID+`"}`))
+				}
+				if got == 5 {
+					conn.Close()
+				}
+			}
+			backup.ackAll()
+			cfg := testConfig(main, backup)
+			cfg.RequireAcks = true
+			cfg.StrictFailover = strict
+			c := startController(t, cfg, withBackoffBase(time.Second))
+			sendEvents(t, dialApp(t, c), "e", 8)
+
+			if !waitUntil(2*time.Second, func() bool {
+				ids := backup.ids()
+				return len(ids) > 0 && ids[len(ids)-1] == "e7"
+			}) {
+				t.Fatalf("backup got %v, want it to end with e7", backup.ids())
+			}
+			time.Sleep(50 * time.Millisecond)
+			ids := strings.Join(backup.ids(), " ")
+			if strict && ids != "e2 e3 e4 e5 e6 e7" {
+				t.Fatalf("backup got %s, want e2 to e7 in order", ids)
+			}
+			// Otherwise backup goes by what main acknowledged, past the gap too
+			if !strict && strings.Contains(ids, "e3") {
+				t.Fatalf("backup got %s, want it to skip e3", ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package gochunker
+
+import (
+	"container/heap"
+	"time"
+)
+
+// queuedEvent is a buffered event a provider has yet to send
+type queuedEvent struct {
+	index int   // absolute buffer index
+	rank  int64 // place in line, lower ranks go first
+}
+
+// eventQueue is a heap of the events a provider has yet to send, highest
+// priority first and FIFO within a priority
+type eventQueue []queuedEvent
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].rank != q[j].rank {
+		return q[i].rank < q[j].rank
+	}
+	return q[i].index < q[j].index
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x any) { *q = append(*q, x.(queuedEvent)) }
+
+func (q *eventQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// rank places e in line when it is buffered at now. With PriorityAging set
+// a waiting event gains one priority level per PriorityAging, so low
+// priorities can't starve. Whether p1 + (now-t1)/A beats p2 + (now-t2)/A
+// doesn't depend on now, so ranking by t - p*A ages events without ever
+// reordering the heap.
+func (c *Controller) rank(e Event, now time.Time) int64 {
+	if c.cfg.StrictFailover {
+		// Buffer order, so a backup resuming at an index sends what
+		// follows in order
+		return 0
+	}
+	if c.cfg.PriorityAging <= 0 {
+		return -int64(e.Priority)
+	}
+	return now.UnixNano() - int64(e.Priority)*int64(c.cfg.PriorityAging)
+}
+
+// enqueueLocked queues the event at idx for every provider, or for the one
+// the pool picks when it doesn't replicate events. Routed events, those
+// with targets from routeLocked, are queued for the targets alone. c.mu
+// must be held.
+func (c *Controller) enqueueLocked(idx int, event Event, targets map[*provider]bool) {
+	qe := queuedEvent{index: idx, rank: c.rank(event, c.now())}
+	var chosen *provider
+	if targets == nil && !c.pool.replicates() {
+		chosen = c.pool.pick()
+	}
+	for _, p := range c.providers() {
+		if (chosen != nil && p != chosen) || (targets != nil && !targets[p]) {
+			c.passLocked(p, idx)
+			continue
+		}
+		if c.cfg.OutboundPolicy == OutboundDrop && c.outboundFullLocked(p) {
+			// OutboundBlock waited for room before buffering, and may
+			// overshoot by an event per app racing for it
+			c.outboundDropLocked(p, idx, event)
+			continue
+		}
+		heap.Push(&p.queue, qe)
+		if len(p.queue) > 2*c.events.size {
+			c.pruneQueueLocked(p)
+		}
+	}
+}
+
+// passLocked records that the event at idx was handed to another provider
+// than p. c.mu must be held.
+func (c *Controller) passLocked(p *provider, idx int) {
+	if p.sentAbove == nil {
+		p.sentAbove = make(map[int]struct{})
+	}
+	if idx >= p.sentIndex {
+		p.sentAbove[idx] = struct{}{}
+	}
+	c.advanceSentLocked(p)
+	advanceAckedLocked(p)
+}
+
+// takeOverLocked makes p skip every event from has sent, and had
+// acknowledged if acks are required, so p picks up where from left off.
+// Under StrictFailover p skips the events from had acknowledged in order
+// alone, resuming at its first unacknowledged event and sending again
+// whatever was acknowledged past it. c.mu must be held.
+func (c *Controller) takeOverLocked(p, from *provider) {
+	done := make(map[int]struct{})
+	if c.cfg.StrictFailover {
+		for idx := p.sentIndex; idx < from.ackedIndex; idx++ {
+			done[idx] = struct{}{}
+		}
+		c.skipLocked(p, done)
+		c.log.Info("taking over from provider at its first unacknowledged event", "provider", p.name, "from", from.name, "index", from.ackedIndex)
+		return
+	}
+	for idx := p.sentIndex; idx < from.sentIndex; idx++ {
+		if _, open := from.unacked[idx]; !open {
+			done[idx] = struct{}{}
+		}
+	}
+	for idx := range from.sentAbove {
+		if _, open := from.unacked[idx]; !open && idx >= p.sentIndex {
+			done[idx] = struct{}{}
+		}
+	}
+	c.skipLocked(p, done)
+	c.log.Info("taking over from provider", "provider", p.name, "from", from.name, "skipped", len(done))
+}
+
+// skipLocked takes the events at indexes done off p's queue, counting them
+// as handed to another provider. c.mu must be held.
+func (c *Controller) skipLocked(p *provider, done map[int]struct{}) {
+	kept := p.queue[:0]
+	for _, qe := range p.queue {
+		if _, skip := done[qe.index]; !skip {
+			kept = append(kept, qe)
+		}
+	}
+	p.queue = kept
+	heap.Init(&p.queue)
+	for idx := range done {
+		c.passLocked(p, idx)
+	}
+	c.releaseLocked()
+}
+
+// pruneQueueLocked removes events dropped from the buffer from p's queue,
+// which otherwise only skips them once they reach the front, so the queue
+// of a provider that isn't sending stays bounded. c.mu must be held.
+func (c *Controller) pruneQueueLocked(p *provider) {
+	kept := p.queue[:0]
+	for _, qe := range p.queue {
+		if qe.index >= c.events.first {
+			kept = append(kept, qe)
+		}
+	}
+	p.queue = kept
+	heap.Init(&p.queue)
+}
+
+// nextQueuedLocked returns the event at the front of p's queue together
+// with its index, removing it from the queue if take is set. Events dropped
+// from the buffer or expired are discarded on the way and count as sent.
+// c.mu must be held.
+func (c *Controller) nextQueuedLocked(p *provider, take bool) (int, Event, bool) {
+	skipped := 0
+	defer func() {
+		if skipped > 0 {
+			c.log.Warn("skipped events dropped from the buffer before they were sent", "provider", p.name, "events", skipped)
+		}
+	}()
+	for len(p.queue) > 0 {
+		idx := p.queue[0].index
+		event, ok := c.events.get(idx)
+		if ok && !c.expiredLocked(p, event) {
+			if take {
+				heap.Pop(&p.queue)
+				c.outboundTakenLocked()
+			}
+			return idx, event, true
+		}
+		if !ok {
+			skipped++
+		}
+		heap.Pop(&p.queue)
+		c.outboundTakenLocked()
+		c.markSentLocked(p, []int{idx}, nil)
+	}
+	return 0, Event{}, false
+}
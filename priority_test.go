@@ -0,0 +1,72 @@
+package gochunker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// drain takes every event queued for c's first provider, in the order the
+// worker would, marking each sent
+func drain(c *Controller) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.pool.members[0]
+	var order string
+	for {
+		idx, event, ok := c.nextQueuedLocked(p, true)
+		if !ok {
+			return order
+		}
+		order += event.ID
+		c.markSentLocked(p, []int{idx}, nil)
+	}
+}
+
+// newPriorityController returns an unstarted controller aging priorities by
+// aging on a fake clock
+func newPriorityController(t *testing.T, aging time.Duration) (*Controller, *fakeClock) {
+	cfg := DefaultConfig()
+	cfg.PriorityAging = aging
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close(context.Background()) })
+	clock := newFakeClock()
+	c.now = clock.Now
+	return c, clock
+}
+
+func TestPriorityOrdering(t *testing.T) {
+	c, _ := newPriorityController(t, 0)
+	c.mu.Lock()
+	for i, priority := range []int{0, 0, 5, 1, 5} {
+		c.bufferLocked(Event{ID: string(rune('a' + i)), Priority: priority})
+	}
+	c.mu.Unlock()
+	// Highest first, FIFO within a level
+	if got := drain(c); got != "cedab" {
+		t.Fatalf("sent in order %s, want cedab", got)
+	}
+	p := c.pool.members[0]
+	if p.sentIndex != 5 || len(p.sentAbove) != 0 {
+		t.Fatalf("sent index %d with %d sent ahead, want 5 and none", p.sentIndex, len(p.sentAbove))
+	}
+}
+
+func TestPriorityAging(t *testing.T) {
+	c, clock := newPriorityController(t, time.Second)
+	c.mu.Lock()
+	c.bufferLocked(Event{ID: "a", Priority: 0})
+	c.mu.Unlock()
+	// Ten seconds in line are worth ten levels
+	clock.Advance(10 * time.Second)
+	c.mu.Lock()
+	c.bufferLocked(Event{ID: "b", Priority: 5})
+	c.bufferLocked(Event{ID: "c", Priority: 20})
+	c.mu.Unlock()
+	if got := drain(c); got != "cab" {
+		t.Fatalf("sent in order %s, want cab", got)
+	}
+}
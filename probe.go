@@ -0,0 +1,76 @@
+package gochunker
+
+import (
+	"errors"
+	"time"
+)
+
+// errProbe is returned by waitForEvent when a probe of the provider is due
+// while there is nothing to send, see Config.ProbeInterval
+var errProbe = errors.New("provider probe due")
+
+// probeMessage checks that writes to a provider go through
+type probeMessage struct {
+	Type string `json:"type"` // always "probe"
+	TS   int64  `json:"ts"`   // Unix milliseconds
+}
+
+// probe writes a probe to p over ws, without rate limiting or retrying,
+// and records whether it went through. A connection that stays open but
+// fails ProbeFailures probes in a row gets p marked failed, and ws is
+// replaced once p's circuit breaker lets it be dialed again. probe returns
+// the connection to go on with.
+func (c *Controller) probe(p *provider, ws Conn) (Conn, error) {
+	err := c.writeProbe(ws)
+	c.mu.Lock()
+	failed := c.probedLocked(p, err)
+	failures := p.probeFailures
+	c.mu.Unlock()
+	if err == nil {
+		c.metrics.probes.WithLabelValues(p.name, "ok").Inc()
+		c.log.Debug("probe went through", "provider", p.name)
+		return ws, nil
+	}
+	c.metrics.probes.WithLabelValues(p.name, "failed").Inc()
+	if !failed {
+		c.log.Warn("probe failed", "provider", p.name, "failures", failures, "err", err)
+		return ws, nil
+	}
+	c.log.Warn("probes keep failing, marking provider failed", "provider", p.name, "failures", c.cfg.ProbeFailures, "cooldown", c.cfg.BreakerCooldown, "err", err)
+	return c.reconnect(p, ws)
+}
+
+// writeProbe writes one probe to ws
+func (c *Controller) writeProbe(ws Conn) error {
+	msg, err := codecOf(ws).Marshal(probeMessage{Type: "probe", TS: c.now().UnixMilli()})
+	if err != nil {
+		return err
+	}
+	if c.cfg.WriteTimeout > 0 {
+		ws.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+	}
+	return ws.WriteMessage(c.messageType(ws), msg)
+}
+
+// probedLocked counts the outcome err of a probe of p. After ProbeFailures
+// failures in a row it moves a connected p to ProviderFailed, opening its
+// breaker so it stays failed for BreakerCooldown, and reports true. p.conn
+// is let go of so its reader leaves the state alone when the connection
+// closes. c.mu must be held.
+func (c *Controller) probedLocked(p *provider, err error) bool {
+	if err == nil {
+		p.probeFailures = 0
+		return false
+	}
+	p.probeFailures++
+	if p.probeFailures < c.cfg.ProbeFailures || p.State() != ProviderConnected {
+		return false
+	}
+	p.probeFailures = 0
+	p.breaker.state = BreakerOpen
+	p.breaker.openedAt = c.now()
+	c.metrics.breakerOpens.WithLabelValues(p.name).Inc()
+	p.conn = nil
+	c.setStateLocked(p, ProviderFailed)
+	return true
+}
@@ -0,0 +1,99 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rejectingConn is a connection that stays open but whose writes all fail
+type rejectingConn struct {
+	*memConn
+}
+
+func (c *rejectingConn) WriteMessage(int, []byte) error {
+	return errors.New("write rejected")
+}
+
+func TestProbesReachHealthyProvider(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.ProbeInterval = 10 * time.Millisecond
+	c := startController(t, cfg)
+	probes := func() int {
+		n := 0
+		for _, msg := range main.messages() {
+			var m probeMessage
+			if json.Unmarshal([]byte(msg), &m) == nil && m.Type == "probe" {
+				n++
+			}
+		}
+		return n
+	}
+	if !waitUntil(2*time.Second, func() bool { return probes() >= 3 }) {
+		t.Fatalf("main got %v, want probes", main.messages())
+	}
+	if st := c.Status().Providers[0]; st.State != "connected" || st.ProbeFailures != 0 {
+		t.Fatalf("probed provider %s with %d failures, want connected with none", st.State, st.ProbeFailures)
+	}
+}
+
+func TestProbesFailProviderRejectingWrites(t *testing.T) {
+	var mu sync.Mutex
+	var dials int
+	var peers []*memConn // the provider's ends, kept open
+	dial := func(ctx context.Context, url string, header http.Header) (Conn, error) {
+		client, server := newMemPipe()
+		mu.Lock()
+		defer mu.Unlock()
+		dials++
+		peers = append(peers, server)
+		return &rejectingConn{client}, nil
+	}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.ProbeInterval = 10 * time.Millisecond
+	cfg.ProbeFailures = 3
+	cfg.BreakerCooldown = time.Hour
+	c := startController(t, cfg, WithDialFunc(dial))
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].State == "failed" }) {
+		t.Fatalf("provider %s while its writes fail, want failed", c.Status().Providers[0].State)
+	}
+	if code := probe(t, srv, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz answered %d with the only provider failed", code)
+	}
+	if got := gatherValue(t, c, "gochunker_probes_total", "failed"); got < 3 {
+		t.Fatalf("%v failed probes counted, want at least 3", got)
+	}
+	// The breaker holds the redial back, the state stays failed
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	n := dials
+	mu.Unlock()
+	if st := c.Status().Providers[0]; st.State != "failed" || n != 1 {
+		t.Fatalf("provider %s after %d dials, want failed after one", st.State, n)
+	}
+}
+
+// gatherValue sums the counters of the metric name whose result label is
+// result
+func gatherValue(t *testing.T, c *Controller, name, result string) float64 {
+	t.Helper()
+	var sum float64
+	for _, m := range gather(t, c, name).GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "result" && l.GetValue() == result {
+				sum += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return sum
+}
@@ -0,0 +1,68 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SetRateLimit changes the total rate limit to max events per interval
+// while events flow, keeping the tokens already granted. It returns
+// ErrNoRateLimit when the controller was started with providers' own
+// limits only.
+func (c *Controller) SetRateLimit(max int, interval time.Duration) error {
+	if c.ratelimiter == nil {
+		return ErrNoRateLimit
+	}
+	if max <= 0 {
+		return fmt.Errorf("rate limit must be positive, got %d", max)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("rate limit interval must be positive, got %s", interval)
+	}
+	c.ratelimiter.Reconfigure(max, interval)
+	c.log.Info("rate limit changed", "max", max, "interval", interval)
+	return nil
+}
+
+// rateLimitRequest is the body of POST /admin/ratelimit, and what it
+// answers with
+type rateLimitRequest struct {
+	Max        int   `json:"max"`
+	IntervalMS int64 `json:"interval_ms"`
+}
+
+// handleRateLimit applies the total rate limit a rateLimitRequest body
+// asks for and reports the settings now in effect. It is an admin
+// endpoint, see authorizeAdmin.
+func (c *Controller) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+	var req rateLimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "malformed rate limit request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := c.SetRateLimit(req.Max, time.Duration(req.IntervalMS)*time.Millisecond)
+	switch {
+	case errors.Is(err, ErrNoRateLimit):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	resp := rateLimitRequest{Max: c.ratelimiter.Max(), IntervalMS: c.ratelimiter.Interval().Milliseconds()}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		c.log.Warn("writing rate limit response failed", "err", err)
+	}
+}
@@ -0,0 +1,431 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWaitUnblocksWithinRefillInterval(t *testing.T) {
+	rl := NewRateLimiter(1, 50*time.Millisecond)
+	defer rl.Stop()
+	if !rl.Allow() {
+		t.Fatal("fresh bucket denied a token")
+	}
+	start := time.Now()
+	if err := rl.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > 150*time.Millisecond {
+		t.Fatalf("Wait took %s, refill interval is 50ms", waited)
+	}
+}
+
+func TestWaitReturnsOnCancelledContext(t *testing.T) {
+	rl := NewRateLimiter(1, time.Hour)
+	defer rl.Stop()
+	rl.Allow()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := rl.Wait(ctx); err != context.Canceled {
+		t.Fatalf("Wait returned %v, want %v", err, context.Canceled)
+	}
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Fatalf("Wait took %s on a cancelled context", waited)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := rl.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestMultiRateLimiterBudgets(t *testing.T) {
+	m := NewMultiRateLimiter(map[string]int{"bulk": 1, DefaultEventType: 2}, time.Hour)
+	defer m.Stop()
+	if !m.Allow("bulk") || m.Allow("bulk") {
+		t.Error("bulk budget of 1 not enforced")
+	}
+	if !m.Allow("a") || !m.Allow("b") || m.Allow("c") {
+		t.Error("shared budget of 2 not enforced across untyped events")
+	}
+	unlimited := NewMultiRateLimiter(map[string]int{"bulk": 1}, time.Hour)
+	defer unlimited.Stop()
+	if unlimited.Limiter("other") != nil {
+		t.Error("type without a budget is limited")
+	}
+}
+
+func TestTypeRateLimitsThrottleDelivery(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.RateLimit = 1000
+	cfg.RateLimitInterval = 500 * time.Millisecond
+	cfg.TypeRateLimits = map[string]int{"bulk": 1}
+	c := startController(t, cfg)
+	app := dialApp(t, c)
+	for i := 0; i < 3; i++ {
+		msg := fmt.Sprintf(`{"id":"b%d","type":"bulk","payload":"x"}`, i)
+		if err := app.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() >= 1 }) {
+		t.Fatal("first bulk event never sent")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := main.count(); n != 1 {
+		t.Fatalf("main got %d bulk events within one interval, want 1", n)
+	}
+	if !waitUntil(5*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %d bulk events, want 3", main.count())
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := parseRateLimits("bulk:5, *:10", "type")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits["bulk"] != 5 || limits[DefaultEventType] != 10 || len(limits) != 2 {
+		t.Errorf("got %v", limits)
+	}
+	for _, bad := range []string{"bulk", "bulk:x", ":5"} {
+		if _, err := parseRateLimits(bad, "type"); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.TypeRateLimits = map[string]int{"bulk": 0}
+	if err := cfg.Validate(); err == nil {
+		t.Error("zero type rate limit accepted")
+	}
+}
+
+func TestRefillIsIncremental(t *testing.T) {
+	rl := NewRateLimiter(100, 400*time.Millisecond)
+	defer rl.Stop()
+	for rl.Allow() {
+	}
+	time.Sleep(200 * time.Millisecond)
+	n := 0
+	for rl.Allow() {
+		n++
+	}
+	if n < 35 || n > 65 {
+		t.Fatalf("%d tokens refilled over half the interval, want about 50", n)
+	}
+}
+
+func TestStopEndsRefillGoroutine(t *testing.T) {
+	before := runtime.NumGoroutine()
+	limiters := make([]*RateLimiter, 20)
+	for i := range limiters {
+		limiters[i] = NewRateLimiter(10, time.Second)
+	}
+	if n := runtime.NumGoroutine(); n < before+len(limiters) {
+		t.Fatalf("%d goroutines with %d limiters, started with %d", n, len(limiters), before)
+	}
+	for _, rl := range limiters {
+		rl.Stop()
+		rl.Stop() // safe to repeat
+	}
+	if !waitUntil(time.Second, func() bool { return runtime.NumGoroutine() <= before }) {
+		t.Fatalf("%d goroutines left after Stop, started with %d", runtime.NumGoroutine(), before)
+	}
+}
+
+func TestAllowNPartialConsumption(t *testing.T) {
+	rl := NewRateLimiter(10, time.Hour)
+	defer rl.Stop()
+	if !rl.AllowN(4) || !rl.AllowN(4) {
+		t.Fatal("8 of 10 tokens denied")
+	}
+	if rl.AllowN(4) {
+		t.Fatal("4 tokens granted with 2 left")
+	}
+	if !rl.AllowN(2) {
+		t.Fatal("denied the 2 tokens left, a denied request must not consume any")
+	}
+	if rl.Allow() {
+		t.Fatal("empty bucket granted a token")
+	}
+}
+
+func TestAllowNOversizedNeedsFullBucket(t *testing.T) {
+	rl := NewRateLimiter(10, time.Hour)
+	defer rl.Stop()
+	if !rl.AllowN(15) {
+		t.Fatal("oversized request denied on a full bucket")
+	}
+	if rl.Allow() {
+		t.Fatal("oversized request left tokens behind")
+	}
+
+	rl = NewRateLimiter(10, time.Hour)
+	defer rl.Stop()
+	rl.Allow()
+	if rl.AllowN(15) {
+		t.Fatal("oversized request granted on a bucket that isn't full")
+	}
+}
+
+func TestEventWeight(t *testing.T) {
+	if w := (Event{}).weight(); w != 1 {
+		t.Errorf("unweighted event weighs %d, want 1", w)
+	}
+	if w := (Event{Weight: 7}).weight(); w != 7 {
+		t.Errorf("event of weight 7 weighs %d", w)
+	}
+}
+
+func TestProviderThrottleHalvesRateLimit(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	main.onMessage = func(conn *websocket.Conn, msg []byte) {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"throttle_ms":60000}`))
+	}
+	cfg := testConfig(main, backup)
+	cfg.RateLimit = 40
+	c := startController(t, cfg)
+	sendEvents(t, dialApp(t, c), "e", 1)
+	if !waitUntil(2*time.Second, func() bool { return c.ratelimiter.Max() < 40 }) {
+		t.Fatal("throttle message left the rate limit alone")
+	}
+	if max := c.ratelimiter.Max(); max != 20 {
+		t.Fatalf("rate limit is %d after one throttle, want 20", max)
+	}
+	c.mu.Lock()
+	until := c.throttledUntil
+	c.mu.Unlock()
+	if time.Until(until) < 50*time.Second {
+		t.Fatalf("throttled until %s, want about a minute from now", until)
+	}
+}
+
+func TestRateLimiterCounters(t *testing.T) {
+	rl := NewRateLimiter(4, time.Hour)
+	defer rl.Stop()
+	rl.Allow()   // granted, 3 left
+	rl.AllowN(2) // granted, 1 left
+	rl.AllowN(2) // denied
+	rl.Reserve() // granted, 0 left
+	rl.Allow()   // denied
+	rl.Reserve() // denied
+	if granted, denied := rl.Stats(); granted != 3 || denied != 3 {
+		t.Errorf("Stats() = %d granted, %d denied, want 3 and 3", granted, denied)
+	}
+	if calls := rl.Calls(); calls != 6 {
+		t.Errorf("Calls() = %d, want 6", calls)
+	}
+	if u := rl.Utilization(); u != 1 {
+		t.Errorf("Utilization() = %g with the bucket empty, want 1", u)
+	}
+}
+
+// startRateLimitedPool starts a round-robin controller over two providers
+// with the given total cap and per-provider limits, and enqueues n events
+// once both are connected
+func startRateLimitedPool(t *testing.T, total int, limits map[string]int, n int) (*Controller, *fakeProvider, *fakeProvider) {
+	t.Helper()
+	a, b := newFakeProvider(t), newFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{a.url(), b.url()}
+	cfg.PoolStrategy = RoundRobin
+	cfg.RateLimit = total
+	cfg.ProviderRateLimits = limits
+	c := startController(t, cfg)
+	if !waitUntil(2*time.Second, func() bool {
+		st := c.Status()
+		return st.Providers[0].Connected && st.Providers[1].Connected
+	}) {
+		t.Fatal("providers did not connect")
+	}
+	for i := 0; i < n; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("e%d", i), Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c, a, b
+}
+
+func TestProviderRateLimitsAreIndependent(t *testing.T) {
+	c, a, b := startRateLimitedPool(t, 0, map[string]int{"provider-0": 2, "provider-1": 100}, 10)
+	if !waitUntil(2*time.Second, func() bool { return b.count() == 5 }) {
+		t.Fatalf("unthrottled provider got %d of its 5 events", b.count())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := a.count(); n != 2 {
+		t.Fatalf("provider limited to 2 got %d events", n)
+	}
+	st := c.Status()
+	if st.Providers[0].RateLimitUsage != 1 || st.Providers[1].RateLimitUsage >= 0.1 {
+		t.Fatalf("provider rate limit utilization %v and %v, want 1 and 0.05", st.Providers[0].RateLimitUsage, st.Providers[1].RateLimitUsage)
+	}
+}
+
+func TestProviderRateLimitsWithinTotalCap(t *testing.T) {
+	_, a, b := startRateLimitedPool(t, 6, map[string]int{"provider-0": 5, "provider-1": 5}, 12)
+	if !waitUntil(2*time.Second, func() bool { return a.count()+b.count() == 6 }) {
+		t.Fatalf("providers got %d and %d events, want 6 in total", a.count(), b.count())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n, m := a.count(), b.count(); n+m != 6 || n > 5 || m > 5 {
+		t.Fatalf("providers got %d and %d events, want 6 in total and at most 5 each", n, m)
+	}
+}
+
+func TestProviderRateLimitsValidated(t *testing.T) {
+	cfg := DefaultConfig()
+	for name, limits := range map[string]map[string]int{
+		"unknown provider": {"Elsewhere": 5},
+		"zero limit":       {"Main": 0},
+	} {
+		cfg.ProviderRateLimits = limits
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	cfg.RateLimit = 0
+	cfg.ProviderRateLimits = nil
+	if err := cfg.Validate(); err == nil {
+		t.Error("no rate limit at all accepted")
+	}
+	cfg.ProviderRateLimits = map[string]int{"Main": 5}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("no total cap with a provider limit rejected: %v", err)
+	}
+}
+
+func TestReconfigureKeepsTokensAndRefillsAtNewRate(t *testing.T) {
+	rl := NewRateLimiter(4, time.Hour)
+	defer rl.Stop()
+	rl.AllowN(3) // 1 left
+	rl.Reconfigure(100, time.Hour)
+	if u := rl.Utilization(); u != 0.99 {
+		t.Fatalf("Utilization() = %g after reconfiguring, want the 1 token kept", u)
+	}
+	rl.Reconfigure(100, time.Second)
+	if max, interval := rl.Max(), rl.Interval(); max != 100 || interval != time.Second {
+		t.Fatalf("reconfigured to %d per %s, want 100 per 1s", max, interval)
+	}
+	// The old 15 minute tick would hold this Wait back, the new one a few ms
+	rl.Allow()
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := rl.WaitN(ctx, 2); err != nil {
+		t.Fatalf("WaitN at the new rate: %v", err)
+	}
+	if waited := time.Since(start); waited > 200*time.Millisecond {
+		t.Fatalf("WaitN took %s at 100 per second", waited)
+	}
+
+	rl.Reconfigure(2, time.Hour)
+	if max := rl.Max(); max != 2 {
+		t.Fatalf("max %d after shrinking, want 2", max)
+	}
+	if u := rl.Utilization(); u < 0 || u > 1 {
+		t.Fatalf("Utilization() = %g after shrinking, want tokens capped at 2", u)
+	}
+}
+
+func TestReconfigureConcurrentWithAllow(t *testing.T) {
+	rl := NewRateLimiter(10, 10*time.Millisecond)
+	defer rl.Stop()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					rl.Allow()
+					rl.Reserve()
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 50; i++ {
+		rl.Reconfigure(i, time.Duration(i)*time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	if max := rl.Max(); max != 50 {
+		t.Fatalf("max %d after the last reconfigure, want 50", max)
+	}
+}
+
+func TestAdminRateLimitEndpoint(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.AdminToken = "s3cret"
+	cfg.RateLimit = 1
+	cfg.RateLimitInterval = time.Hour
+	c := startController(t, cfg)
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	app := dialApp(t, c)
+	sendEvents(t, app, "e", 5)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatalf("main got %v, want one event per hour", main.ids())
+	}
+
+	post := func(body string) (int, rateLimitRequest) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/admin/ratelimit", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var got rateLimitRequest
+		json.NewDecoder(resp.Body).Decode(&got)
+		return resp.StatusCode, got
+	}
+	status, got := post(`{"max":100,"interval_ms":1000}`)
+	if status != http.StatusOK || got.Max != 100 || got.IntervalMS != 1000 {
+		t.Fatalf("rate limit answered %d with %+v", status, got)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 5 }) {
+		t.Fatalf("main got %v after raising the rate limit, want all 5", main.ids())
+	}
+
+	if status, _ := post(`{"max":0,"interval_ms":1000}`); status != http.StatusBadRequest {
+		t.Fatalf("zero rate limit answered %d, want 400", status)
+	}
+	if status, _ := post(`{"max":`); status != http.StatusBadRequest {
+		t.Fatalf("malformed request answered %d, want 400", status)
+	}
+	resp, err := http.Get(srv.URL + "/admin/ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET answered %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestSetRateLimitWithoutTotalCap(t *testing.T) {
+	c, _, _ := startRateLimitedPool(t, 0, map[string]int{"provider-0": 2, "provider-1": 2}, 0)
+	if err := c.SetRateLimit(10, time.Second); !errors.Is(err, ErrNoRateLimit) {
+		t.Fatalf("SetRateLimit without a total cap returned %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dropAfter makes fp close its first connection once it received n events,
+// acknowledging them first if ack is set. It returns the IDs received on each
+// connection, in order of connection.
+func dropAfter(fp *fakeProvider, n int, ack bool) func() [][]string {
+	var mu sync.Mutex
+	var perConn [][]string
+	index := make(map[*websocket.Conn]int)
+	fp.onMessage = func(conn *websocket.Conn, msg []byte) {
+		var event Event
+		json.Unmarshal(msg, &event)
+		mu.Lock()
+		i, ok := index[conn]
+		if !ok {
+			i = len(perConn)
+			index[conn] = i
+			perConn = append(perConn, nil)
+		}
+		if i == 0 && len(perConn[0]) == n {
+			// Messages read ahead before the close are lost with it
+			mu.Unlock()
+			return
+		}
+		perConn[i] = append(perConn[i], event.ID)
+		got := len(perConn[i])
+		mu.Unlock()
+		if ack {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"ack":"`+event.ID+`"}`))
+		}
+		if i == 0 && got == n {
+			conn.Close()
+		}
+	}
+	return func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		out := make([][]string, len(perConn))
+		for i := range perConn {
+			out[i] = append([]string(nil), perConn[i]...)
+		}
+		return out
+	}
+}
+
+func TestReconnectAfterProviderDrop(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	received := dropAfter(main, 3, true)
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.AckTimeout = 0 // unacked events are only resent on reconnect
+	cfg.RateLimit = 10000
+	cfg.RateLimitInterval = time.Second
+	c := startController(t, cfg, withBackoffBase(time.Millisecond))
+	sendEvents(t, dialApp(t, c), "e", 8)
+
+	delivered := func() bool {
+		seen := make(map[string]bool)
+		for _, ids := range received() {
+			for _, id := range ids {
+				seen[id] = true
+			}
+		}
+		return len(seen) == 8
+	}
+	if !waitUntil(5*time.Second, delivered) {
+		t.Fatalf("not every event delivered across the reconnect: %v", received())
+	}
+	conns := received()
+	if len(conns) != 2 {
+		t.Fatalf("events arrived over %d connections, want 2: %v", len(conns), conns)
+	}
+	for _, id := range conns[1] {
+		for _, acked := range conns[0][:2] {
+			if id == acked {
+				t.Fatalf("acknowledged event %s sent again after reconnecting: %v", id, conns)
+			}
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Unacked == 0 }) {
+		t.Fatalf("%d events left unacknowledged", c.Status().Providers[0].Unacked)
+	}
+}
+
+func TestReconnectResumesAtSentIndex(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	received := dropAfter(main, 3, false)
+	c := startController(t, testConfig(main, backup), withBackoffBase(time.Millisecond))
+	app := dialApp(t, c)
+	sendEvents(t, app, "e", 3)
+	redialed := func() bool {
+		main.mu.Lock()
+		defer main.mu.Unlock()
+		return main.dials == 2 && c.Status().Providers[0].Connected
+	}
+	if !waitUntil(2*time.Second, redialed) {
+		t.Fatal("provider not redialed after dropping the connection")
+	}
+	if n := c.Status().Providers[0].SentIndex; n != 3 {
+		t.Fatalf("sent index %d after 3 events, want 3", n)
+	}
+
+	sendEvents(t, app, "f", 2)
+	if !waitUntil(2*time.Second, func() bool { return len(received()) == 2 && len(received()[1]) == 2 }) {
+		t.Fatalf("events after the reconnect: %v", received())
+	}
+	if got := received()[1]; got[0] != "f0" || got[1] != "f1" {
+		t.Fatalf("second connection got %v, want it to start at index 3 with f0", got)
+	}
+	if n := c.Status().Providers[0].SentIndex; n != 5 {
+		t.Fatalf("sent index %d, want 5", n)
+	}
+}
@@ -0,0 +1,222 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ReplayRequest picks buffered events to send to a provider once more,
+// either the index range From to To, both included, or the events with the
+// given IDs
+type ReplayRequest struct {
+	From     *int     `json:"from,omitempty"`
+	To       *int     `json:"to,omitempty"`
+	IDs      []string `json:"ids,omitempty"`
+	Provider string   `json:"provider,omitempty"` // pool member name, the first connected one when empty
+}
+
+// replayJob is a ReplayRequest handed to a provider's worker
+type replayJob struct {
+	indexes []int
+	sent    int           // written so far, read once done is closed
+	done    chan struct{} // closed once the worker went through indexes
+}
+
+// errReplay is returned by waitForEvent when events were queued for replay
+var errReplay = errors.New("events queued for replay")
+
+// Replay sends the events req picks to a provider again, through its
+// worker and rate limiter like any other send. It doesn't touch what the
+// provider counts as sent or acknowledged. Every picked event must still be
+// buffered. Replay returns how many events were written once all were, or
+// an error if ctx is done first, in which case the rest are still sent.
+// It returns ErrInvalidReplay for a malformed req, ErrNotBuffered if an
+// event it picks is gone, ErrUnknownProvider or ErrNotConnected if there
+// is no provider to send to and ErrClosed once the controller stops.
+func (c *Controller) Replay(ctx context.Context, req ReplayRequest) (int, error) {
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		return 0, ErrClosed
+	}
+	p, err := c.replayTargetLocked(req.Provider)
+	if err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	indexes, err := c.replayIndexesLocked(req)
+	if err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	job := &replayJob{indexes: indexes, done: make(chan struct{})}
+	p.replays = append(p.replays, job)
+	select {
+	case p.feed <- struct{}{}:
+	default:
+	}
+	c.mu.Unlock()
+	c.log.Info("replaying events", "provider", p.name, "events", len(indexes))
+
+	select {
+	case <-job.done:
+		return job.sent, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.ctx.Done():
+		return 0, ErrClosed
+	}
+}
+
+// replayTargetLocked returns the pool member called name, or the first
+// connected one when name is empty. Its worker must be running. c.mu must
+// be held.
+func (c *Controller) replayTargetLocked(name string) (*provider, error) {
+	var target *provider
+	for _, p := range c.providers() {
+		if (name == "" && p.connected()) || (name != "" && p.name == name) {
+			target = p
+			break
+		}
+	}
+	switch {
+	case target == nil && name == "":
+		return nil, ErrNotConnected
+	case target == nil:
+		return nil, fmt.Errorf("%w %q", ErrUnknownProvider, name)
+	case target.feed == nil:
+		return nil, fmt.Errorf("%w: %s has not started", ErrNotConnected, target.name)
+	}
+	return target, nil
+}
+
+// replayIndexesLocked resolves req to buffer indexes, lowest first. c.mu
+// must be held.
+func (c *Controller) replayIndexesLocked(req ReplayRequest) ([]int, error) {
+	first, next := c.events.first, c.events.next()
+	if len(req.IDs) > 0 {
+		if req.From != nil || req.To != nil {
+			return nil, fmt.Errorf("%w: give either a range or IDs", ErrInvalidReplay)
+		}
+		want := make(map[string]bool, len(req.IDs))
+		for _, id := range req.IDs {
+			want[id] = true
+		}
+		var indexes []int
+		for idx := first; idx < next; idx++ {
+			if event, ok := c.events.get(idx); ok && want[event.ID] {
+				indexes = append(indexes, idx)
+				delete(want, event.ID)
+			}
+		}
+		if len(want) > 0 {
+			return nil, fmt.Errorf("%w: %d of the %d IDs not found", ErrNotBuffered, len(want), len(req.IDs))
+		}
+		return indexes, nil
+	}
+	if req.From == nil || req.To == nil {
+		return nil, fmt.Errorf("%w: give from and to, or IDs", ErrInvalidReplay)
+	}
+	from, to := *req.From, *req.To
+	if from > to {
+		return nil, fmt.Errorf("%w: from %d is past to %d", ErrInvalidReplay, from, to)
+	}
+	if from < first || to >= next {
+		return nil, fmt.Errorf("%w: asked for %d to %d, the buffer holds %d to %d", ErrNotBuffered, from, to, first, next-1)
+	}
+	indexes := make([]int, 0, to-from+1)
+	for idx := from; idx <= to; idx++ {
+		indexes = append(indexes, idx)
+	}
+	return indexes, nil
+}
+
+// replay writes the events of every replay job queued for p, skipping any
+// dropped from the buffer since, and returns the connection in use
+// afterwards or an error once the controller stops
+func (c *Controller) replay(p *provider, ws Conn, bo *Backoff) (Conn, error) {
+	c.mu.Lock()
+	jobs := p.replays
+	p.replays = nil
+	c.mu.Unlock()
+	for _, job := range jobs {
+		for _, idx := range job.indexes {
+			c.mu.Lock()
+			event, ok := c.events.get(idx)
+			batch := []Event{event}
+			if ok {
+				c.stampLocked(p, batch, []int{idx})
+			}
+			c.mu.Unlock()
+			if !ok {
+				c.log.Warn("event dropped from the buffer before it could be replayed", "provider", p.name, "index", idx)
+				continue
+			}
+			var err error
+			if ws, err = c.deliver(p, ws, bo, batch); err == errSendTimedOut {
+				// Already handled before, replaying it is not worth a dead letter
+				c.log.Warn("replaying event timed out, skipping it", "provider", p.name, "event_id", event.ID)
+				c.mu.Lock()
+				c.unstampLocked(p, batch, []int{idx})
+				c.mu.Unlock()
+				continue
+			} else if err == errUnencodable {
+				c.mu.Lock()
+				c.unstampLocked(p, batch, []int{idx})
+				c.mu.Unlock()
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			job.sent++
+			c.log.Debug("event replayed", "provider", p.name, "event_id", event.ID, "index", idx, "seq", batch[0].Seq)
+		}
+		close(job.done)
+	}
+	return ws, nil
+}
+
+// replayResponse is what POST /admin/replay answers with
+type replayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+// handleReplay replays the events a ReplayRequest body picks and reports
+// how many were sent. It is an admin endpoint, see authorizeAdmin.
+func (c *Controller) handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+	var req ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "malformed replay request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := c.Replay(r.Context(), req)
+	switch {
+	case errors.Is(err, ErrInvalidReplay):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrNotBuffered), errors.Is(err, ErrUnknownProvider):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrNotConnected):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, "replay incomplete: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(replayResponse{Replayed: n}); err != nil {
+		c.log.Warn("writing replay response failed", "err", err)
+	}
+}
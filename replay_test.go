@@ -0,0 +1,128 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postReplay posts body to c's /admin/replay with the admin token and
+// returns the response status and body
+func postReplay(t *testing.T, srv *httptest.Server, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/admin/replay", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+// startReplaying starts a controller whose backup holds back, so every
+// event main was sent stays buffered, and sends it n events
+func startReplaying(t *testing.T, n int, tweak func(*Config)) (*Controller, *fakeProvider) {
+	t.Helper()
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.AdminToken = "s3cret"
+	if tweak != nil {
+		tweak(&cfg)
+	}
+	c := startController(t, cfg)
+	sendEvents(t, dialApp(t, c), "e", n)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == n }) {
+		t.Fatalf("main got %d events, want %d", main.count(), n)
+	}
+	return c, main
+}
+
+func TestReplayRange(t *testing.T) {
+	c, main := startReplaying(t, 5, nil)
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+
+	status, body := postReplay(t, srv, `{"from":1,"to":3}`)
+	if status != http.StatusOK {
+		t.Fatalf("replay answered %d %s", status, body)
+	}
+	var resp replayResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil || resp.Replayed != 3 {
+		t.Fatalf("replay reported %s, want 3 replayed", body)
+	}
+	waitUntil(time.Second, func() bool { return main.count() == 8 })
+	if got := fmt.Sprint(main.ids()); got != "[e0 e1 e2 e3 e4 e1 e2 e3]" {
+		t.Fatalf("main received %s", got)
+	}
+	if n := c.Status().Providers[0].SentIndex; n != 5 {
+		t.Fatalf("sent index %d after the replay, want 5", n)
+	}
+
+	n, err := c.Replay(context.Background(), ReplayRequest{IDs: []string{"e4", "e0"}})
+	if err != nil || n != 2 {
+		t.Fatalf("replaying by ID = %d, %v", n, err)
+	}
+	if !waitUntil(time.Second, func() bool { return main.count() == 10 }) {
+		t.Fatalf("main received %v", main.ids())
+	}
+	if ids := main.ids(); ids[8] != "e0" || ids[9] != "e4" {
+		t.Fatalf("replayed by ID in order %v, want buffer order", ids[8:])
+	}
+}
+
+func TestReplayOutOfRange(t *testing.T) {
+	c, main := startReplaying(t, 3, nil)
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"from":2,"to":5}`, http.StatusNotFound},
+		{`{"ids":["e1","gone"]}`, http.StatusNotFound},
+		{`{"from":2,"to":1}`, http.StatusBadRequest},
+		{`{"from":1}`, http.StatusBadRequest},
+		{`{"from":0,"to":1,"provider":"Elsewhere"}`, http.StatusNotFound},
+		{`{"from":`, http.StatusBadRequest},
+	} {
+		if status, body := postReplay(t, srv, tc.body); status != tc.want {
+			t.Errorf("replay of %s answered %d %s, want %d", tc.body, status, body, tc.want)
+		}
+	}
+	if n := main.count(); n != 3 {
+		t.Fatalf("main got %d events, want nothing replayed", n)
+	}
+}
+
+func TestReplayRespectsRateLimit(t *testing.T) {
+	c, main := startReplaying(t, 3, func(cfg *Config) {
+		cfg.RateLimit = 4
+		cfg.RateLimitInterval = time.Hour
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	from, to := 0, 2
+	if _, err := c.Replay(ctx, ReplayRequest{From: &from, To: &to}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("replay beyond the rate limit returned %v, want it to wait past the deadline", err)
+	}
+	waitUntil(time.Second, func() bool { return main.count() == 4 })
+	if n := main.count(); n != 4 {
+		t.Fatalf("main got %d events, want 3 sent and the 1 replay the limiter allowed", n)
+	}
+	if _, denied := c.ratelimiter.Stats(); denied == 0 {
+		t.Fatal("replay never asked the rate limiter")
+	}
+}
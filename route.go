@@ -0,0 +1,43 @@
+package gochunker
+
+// Router names the providers an event goes to, by their pool names. It
+// runs under the controller's lock on every buffered event, and again for
+// every wait under OutboundBlock, so it must be
+// quick and must not call back into the controller.
+type Router func(e Event) []string
+
+// WithRouter sends each event to the providers fn names for it rather than
+// where the pool strategy would, every one of them getting it. Names not
+// in the pool are ignored, and an event fn names no provider of the pool
+// for is dead-lettered. Routed events wait for the providers they were
+// routed to instead of failing over to other members.
+func WithRouter(fn Router) Option {
+	return func(c *Controller) {
+		c.router = fn
+	}
+}
+
+// routeLocked returns the members event is routed to, nil without a
+// router and empty when it names none of them. c.mu must be held.
+func (c *Controller) routeLocked(event Event) map[*provider]bool {
+	if c.router == nil {
+		return nil
+	}
+	names := c.router(event)
+	targets := make(map[*provider]bool, len(names))
+	for _, name := range names {
+		for _, p := range c.providers() {
+			if p.name == name {
+				targets[p] = true
+			}
+		}
+	}
+	return targets
+}
+
+// deadLetterUnroutedLocked dead-letters event, which the router sent to no
+// provider of the pool. c.mu must be held.
+func (c *Controller) deadLetterUnroutedLocked(event Event) {
+	c.deadLetterLocked("", event, "the router named no provider of the pool for it")
+	c.noteDropLocked(event, DropDeadLettered)
+}
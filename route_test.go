@@ -0,0 +1,101 @@
+package gochunker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// routeByType sends orders to provider-0, audit events to provider-1,
+// alerts to both and nothing else anywhere
+func routeByType(e Event) []string {
+	switch e.Type {
+	case "orders":
+		return []string{"provider-0"}
+	case "audit":
+		return []string{"provider-1"}
+	case "alert":
+		return []string{"provider-0", "provider-1", "Nope"}
+	}
+	return nil
+}
+
+// startRoutedPool starts a controller over two providers routing with fn
+func startRoutedPool(t *testing.T, strategy PoolStrategy, fn Router) (*Controller, *fakeProvider, *fakeProvider) {
+	t.Helper()
+	a, b := newFakeProvider(t), newFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{a.url(), b.url()}
+	cfg.PoolStrategy = strategy
+	c := startController(t, cfg, WithRouter(fn))
+	if !waitUntil(2*time.Second, func() bool {
+		st := c.Status()
+		return st.Providers[0].Connected && st.Providers[1].Connected
+	}) {
+		t.Fatal("providers did not connect")
+	}
+	return c, a, b
+}
+
+func TestRouterSendsEventsByType(t *testing.T) {
+	for _, strategy := range []PoolStrategy{RoundRobin, PrimaryFailover} {
+		t.Run(strategy.String(), func(t *testing.T) {
+			c, a, b := startRoutedPool(t, strategy, routeByType)
+			for i, eventType := range []string{"orders", "audit", "orders", "alert", "audit"} {
+				if err := c.Enqueue(Event{ID: fmt.Sprintf("%s%d", eventType, i), Type: eventType}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !waitUntil(2*time.Second, func() bool { return a.count() == 3 && b.count() == 3 }) {
+				t.Fatalf("providers got %v and %v", a.ids(), b.ids())
+			}
+			if got := fmt.Sprint(a.ids()); got != "[orders0 orders2 alert3]" {
+				t.Errorf("provider-0 got %s", got)
+			}
+			if got := fmt.Sprint(b.ids()); got != "[audit1 alert3 audit4]" {
+				t.Errorf("provider-1 got %s", got)
+			}
+			if !waitUntil(2*time.Second, func() bool { return c.Status().Buffered == 0 }) {
+				t.Fatalf("%d events still buffered", c.Status().Buffered)
+			}
+		})
+	}
+}
+
+func TestRouterDeadLettersUnroutedEvents(t *testing.T) {
+	c, a, b := startRoutedPool(t, RoundRobin, routeByType)
+	for _, e := range []Event{{ID: "lost", Type: "metrics"}, {ID: "o", Type: "orders"}} {
+		if err := c.Enqueue(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return a.count() == 1 }) {
+		t.Fatalf("provider-0 got %v, want o", a.ids())
+	}
+	letters := c.DeadLetters()
+	if len(letters) != 1 || letters[0].Event.ID != "lost" || letters[0].Reason != "the router named no provider of the pool for it" {
+		t.Fatalf("dead letters %+v, want lost for having no route", letters)
+	}
+	if st := c.Status(); st.Buffered != 0 || b.count() != 0 {
+		t.Fatalf("unrouted event buffered %d, provider-1 got %v", st.Buffered, b.ids())
+	}
+}
+
+func TestRouterKeysOnMetadata(t *testing.T) {
+	byRegion := func(e Event) []string {
+		if e.Metadata["region"] == "eu" {
+			return []string{"provider-1"}
+		}
+		return []string{"provider-0"}
+	}
+	c, a, b := startRoutedPool(t, RoundRobin, byRegion)
+	for i, region := range []string{"eu", "us", "eu"} {
+		e := Event{ID: fmt.Sprintf("%s%d", region, i), Metadata: map[string]string{"region": region}}
+		if err := c.Enqueue(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return a.count() == 1 && b.count() == 2 }) {
+		t.Fatalf("providers got %v and %v, want us1 and eu0 eu2", a.ids(), b.ids())
+	}
+}
@@ -0,0 +1,103 @@
+package gochunker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// WithSeedFile has Start enqueue the events in the NDJSON file at path, one
+// per line, before it returns, so they are buffered ahead of anything apps
+// send once the Handler is served. Each goes through Enqueue once the
+// buffer has room for it, so Start waits on providers to deliver what the
+// buffer can't hold. Lines that don't decode or whose event fails
+// validation are logged and skipped.
+func WithSeedFile(path string) Option {
+	return func(c *Controller) {
+		c.seedFile = path
+	}
+}
+
+// checkSeedFile reports an error unless the seed file, if any, is there to
+// read, so a wrong path fails NewController rather than seeding nothing
+func checkSeedFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("seed file: %w", err)
+	}
+	return nil
+}
+
+// seed enqueues the events of the seed file, returning how many it
+// enqueued and skipped
+func (c *Controller) seed() (enqueued, skipped int) {
+	f, err := os.Open(c.seedFile)
+	if err != nil {
+		c.log.Error("opening seed file failed", "path", c.seedFile, "err", err)
+		return 0, 0
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		raw, err := r.ReadBytes('\n')
+		if raw = bytes.TrimSpace(raw); len(raw) > 0 {
+			var event Event
+			if derr := json.Unmarshal(raw, &event); derr != nil {
+				c.log.Warn("skipping malformed seed event", "path", c.seedFile, "line", line, "err", derr)
+				skipped++
+			} else if eerr := c.enqueueSeed(event); errors.Is(eerr, ErrInvalidEvent) {
+				c.log.Warn("skipping invalid seed event", "path", c.seedFile, "line", line, "event_id", event.ID, "err", eerr)
+				skipped++
+			} else if eerr != nil {
+				c.log.Warn("seeding stopped", "path", c.seedFile, "line", line, "err", eerr)
+				return enqueued, skipped
+			} else {
+				enqueued++
+			}
+		}
+		if err == io.EOF {
+			return enqueued, skipped
+		}
+		if err != nil {
+			c.log.Error("reading seed file failed", "path", c.seedFile, "line", line, "err", err)
+			return enqueued, skipped
+		}
+	}
+}
+
+// enqueueSeed enqueues e once the buffer has room for it and apps aren't
+// paused, so seeded events are neither dropped nor evict one another. It
+// returns any error of Enqueue's other than ErrBufferFull.
+func (c *Controller) enqueueSeed(e Event) error {
+	bo := c.newBackoff()
+	for {
+		c.mu.Lock()
+		resume := c.resume
+		full := !c.events.fits(e) && !c.events.tooLarge(e)
+		c.mu.Unlock()
+		if resume == nil && !full {
+			err := c.Enqueue(e)
+			if !errors.Is(err, ErrBufferFull) {
+				return err
+			}
+		}
+		var retry <-chan time.Time
+		if resume == nil {
+			// Look again once workers had a chance to make room
+			retry = c.clock.After(bo.Next())
+		}
+		select {
+		case <-resume:
+		case <-retry:
+		case <-c.ctx.Done():
+			return ErrClosed
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package gochunker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSeed writes lines to a seed file and returns its path
+func writeSeed(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "seed.ndjson")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSeedFileDelivered(t *testing.T) {
+	path := writeSeed(t,
+		`{"id":"e0","payload":"x"}`,
+		``,
+		`{"id":"broken",`,
+		`{"id":"bad","payload":"x"}`,
+		`{"id":"e1","payload":"eA==","payload_encoding":"base64"}`,
+		`{"id":"e2","payload":"x"}`,
+	)
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	reject := func(raw []byte, e Event) error {
+		if e.ID == "bad" {
+			return errors.New("bad event")
+		}
+		return nil
+	}
+	c := startController(t, testConfig(main, backup), WithSeedFile(path), WithValidator(reject))
+	if st := c.Status(); st.Rejected != 1 {
+		t.Fatalf("%d rejected once Start returned, want bad", st.Rejected)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %v, want the seeded events", main.ids())
+	}
+	if got := main.ids(); !reflect.DeepEqual(got, []string{"e0", "e1", "e2"}) {
+		t.Fatalf("main got %v, want e0, e1 and e2", got)
+	}
+}
+
+func TestSeedFileWaitsForRoom(t *testing.T) {
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf(`{"id":"e%d","payload":"x"}`, i))
+	}
+	main := newFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{main.url()}
+	cfg.BufferSize = 2
+	cfg.DropPolicy = RejectNewest
+	c := startController(t, cfg, WithSeedFile(writeSeed(t, lines...)), withBackoffBase(time.Millisecond))
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 10 }) {
+		t.Fatalf("main got %v, want all 10 seeded events", main.ids())
+	}
+	if st := c.Status(); st.Dropped != 0 {
+		t.Fatalf("%d seeded events dropped", st.Dropped)
+	}
+}
+
+func TestSeedFileMissing(t *testing.T) {
+	_, err := NewController(DefaultConfig(), WithSeedFile(filepath.Join(t.TempDir(), "none.ndjson")))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("NewController returned %v, want the missing seed file", err)
+	}
+}
@@ -0,0 +1,443 @@
+package gochunker
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Segment file names: the sequence number, zero padded so they sort, and
+// the suffix saying whether the segment was gzipped once sealed
+const (
+	segmentSuffix   = ".wal"
+	segmentGzSuffix = ".wal.gz"
+	segmentTmp      = ".tmp"
+)
+
+// SegmentStore is a Store keeping its write-ahead log in a directory of
+// segments, in the record format of FileStore. Appends and acks go to the
+// active segment until it reaches the segment size, when it is sealed,
+// gzipped if asked, and a new one started. Sealed segments whose events
+// have all been consumed are deleted, oldest first, keeping the newest
+// retain of them. A segment is only written while active and only
+// replaced by renaming a complete file over it, so a crash leaves every
+// segment either as it was or whole.
+type SegmentStore struct {
+	dir         string
+	segmentSize int64
+	compress    bool
+	retain      int
+	sync        bool // fsync after every record
+
+	mu        sync.Mutex
+	f         *os.File
+	active    int           // sequence number of the active segment
+	size      int64         // bytes written to it
+	sealed    []int         // sealed segments, oldest first
+	live      map[int]int   // unconsumed events by the segment they were appended to
+	events    map[int]Event // appended but not acked, by index
+	segmentOf map[int]int   // segment each event in events was appended to
+	first     int           // no event below this index is unconsumed
+	next      int           // index the next appended event gets
+}
+
+// OpenSegmentStore opens or creates the segmented log in dir, rotating to
+// a new segment once the active one holds segmentSize bytes. The events it
+// still holds are compacted into a fresh segment, numbered from 0, that
+// supersedes the others. With compress set sealed segments are gzipped,
+// and retain fully consumed sealed segments are kept rather than deleted.
+// sync is as for OpenFileStore.
+func OpenSegmentStore(dir string, segmentSize int64, compress bool, retain int, sync bool) (*SegmentStore, error) {
+	if segmentSize <= 0 {
+		return nil, fmt.Errorf("segment size must be positive, got %d", segmentSize)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &SegmentStore{
+		dir:         dir,
+		segmentSize: segmentSize,
+		compress:    compress,
+		retain:      retain,
+		sync:        sync,
+		live:        make(map[int]int),
+		events:      make(map[int]Event),
+		segmentOf:   make(map[int]int),
+	}
+	segments, err := s.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	events, err := s.recover(segments)
+	if err != nil {
+		return nil, err
+	}
+	last := 0
+	if len(segments) > 0 {
+		last = segments[len(segments)-1]
+	}
+	if err := s.compact(last+1, events); err != nil {
+		return nil, err
+	}
+	for _, seq := range segments {
+		if err := s.removeSegment(seq); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// segmentPath returns the path of segment seq, gzipped or not
+func (s *SegmentStore) segmentPath(seq int, gzipped bool) string {
+	name := fmt.Sprintf("%012d", seq)
+	if gzipped {
+		return filepath.Join(s.dir, name+segmentGzSuffix)
+	}
+	return filepath.Join(s.dir, name+segmentSuffix)
+}
+
+// listSegments returns the sequence numbers of the segments in the
+// directory, in order. Files left half written by a crash are removed, as
+// are plain segments whose gzipped copy was completed.
+func (s *SegmentStore) listSegments() ([]int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[int]bool)
+	gzipped := make(map[int]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, segmentTmp) {
+			if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		base, gz := strings.CutSuffix(name, segmentGzSuffix)
+		if !gz {
+			var ok bool
+			if base, ok = strings.CutSuffix(name, segmentSuffix); !ok {
+				continue
+			}
+		}
+		seq, err := strconv.Atoi(base)
+		if err != nil {
+			continue
+		}
+		found[seq] = true
+		if gz {
+			gzipped[seq] = true
+		}
+	}
+	var segments []int
+	for seq := range found {
+		if gzipped[seq] {
+			if err := os.Remove(s.segmentPath(seq, false)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		segments = append(segments, seq)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// openSegment opens segment seq for reading, gunzipping a gzipped one
+func (s *SegmentStore) openSegment(seq int) (io.ReadCloser, error) {
+	f, err := os.Open(s.segmentPath(seq, true))
+	if errors.Is(err, os.ErrNotExist) {
+		return os.Open(s.segmentPath(seq, false))
+	}
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// recover reads the unconsumed events out of segments, in order. A reset
+// record, which starts a compacted segment, supersedes everything before
+// it.
+func (s *SegmentStore) recover(segments []int) ([]Event, error) {
+	events := make(map[int]Event)
+	var order []int
+	for _, seq := range segments {
+		r, err := s.openSegment(seq)
+		if err != nil {
+			return nil, err
+		}
+		err = readRecords(r, func(rec walRecord) {
+			switch rec.Op {
+			case "reset":
+				events = make(map[int]Event)
+				order = nil
+			case "append":
+				if rec.Event != nil {
+					if _, dup := events[rec.Index]; !dup {
+						order = append(order, rec.Index)
+					}
+					events[rec.Index] = *rec.Event
+				}
+			case "ack":
+				delete(events, rec.Index)
+			}
+		})
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading segment %d: %w", seq, err)
+		}
+	}
+	var live []Event
+	for _, idx := range order {
+		if e, ok := events[idx]; ok {
+			live = append(live, e)
+			delete(events, idx)
+		}
+	}
+	return live, nil
+}
+
+// compact writes events, numbered from 0, to segment seq after a reset
+// record and makes it the active segment
+func (s *SegmentStore) compact(seq int, events []Event) error {
+	path := s.segmentPath(seq, false)
+	f, err := os.OpenFile(path+segmentTmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	size, err := writeRecord(w, walRecord{Op: "reset"})
+	for i := 0; err == nil && i < len(events); i++ {
+		var n int
+		n, err = writeRecord(w, walRecord{Op: "append", Index: i, Event: &events[i]})
+		size += n
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(path+segmentTmp, path); err != nil {
+		return err
+	}
+	if s.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return err
+	}
+	s.active = seq
+	s.size = int64(size)
+	for i, e := range events {
+		s.events[i] = e
+		s.segmentOf[i] = seq
+	}
+	s.live[seq] = len(events)
+	s.next = len(events)
+	return nil
+}
+
+// rotateLocked seals the active segment and starts the next one
+func (s *SegmentStore) rotateLocked() error {
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+	sealed := s.active
+	f, err := os.OpenFile(s.segmentPath(sealed+1, false), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.active = sealed + 1
+	s.size = 0
+	s.sealed = append(s.sealed, sealed)
+	if s.compress {
+		// A segment left plain reads back just the same, so the store
+		// stays usable if this fails
+		if err := s.gzipSegment(sealed); err != nil {
+			return fmt.Errorf("compressing segment %d: %w", sealed, err)
+		}
+	}
+	return s.cleanupLocked()
+}
+
+// gzipSegment replaces sealed segment seq with a gzipped copy. The copy is
+// complete on disk before the plain segment goes.
+func (s *SegmentStore) gzipSegment(seq int) error {
+	src, err := os.Open(s.segmentPath(seq, false))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	path := s.segmentPath(seq, true)
+	dst, err := os.OpenFile(path+segmentTmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + segmentTmp)
+		return err
+	}
+	if err := os.Rename(path+segmentTmp, path); err != nil {
+		return err
+	}
+	return os.Remove(s.segmentPath(seq, false))
+}
+
+// cleanupLocked deletes the oldest sealed segments once every event
+// appended to them has been consumed, keeping the newest retain of those.
+// Only a run from the oldest on goes: a later segment may hold the acks of
+// events appended to an earlier one.
+func (s *SegmentStore) cleanupLocked() error {
+	done := 0
+	for done < len(s.sealed) && s.live[s.sealed[done]] == 0 {
+		done++
+	}
+	for done > s.retain {
+		seq := s.sealed[0]
+		if err := s.removeSegment(seq); err != nil {
+			return err
+		}
+		delete(s.live, seq)
+		s.sealed = s.sealed[1:]
+		done--
+	}
+	return nil
+}
+
+// removeSegment deletes segment seq, gzipped or not
+func (s *SegmentStore) removeSegment(seq int) error {
+	for _, gz := range []bool{true, false} {
+		if err := os.Remove(s.segmentPath(seq, gz)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append records e in the active segment, rotating first if it is full
+func (s *SegmentStore) Append(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if s.size >= s.segmentSize {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if err := s.writeLocked(walRecord{Op: "append", Index: s.next, Event: &e}); err != nil {
+		return err
+	}
+	s.events[s.next] = e
+	s.segmentOf[s.next] = s.active
+	s.live[s.active]++
+	s.next++
+	return nil
+}
+
+// Ack records that the event at index was consumed, deleting the sealed
+// segments that leaves fully consumed
+func (s *SegmentStore) Ack(index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.events[index]; !ok {
+		return nil
+	}
+	if err := s.writeLocked(walRecord{Op: "ack", Index: index}); err != nil {
+		return err
+	}
+	s.live[s.segmentOf[index]]--
+	delete(s.events, index)
+	delete(s.segmentOf, index)
+	for _, ok := s.events[s.first]; !ok && s.first < s.next; _, ok = s.events[s.first] {
+		s.first++
+	}
+	return s.cleanupLocked()
+}
+
+func (s *SegmentStore) writeLocked(rec walRecord) error {
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	n, err := writeRecord(s.f, rec)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if s.sync {
+		return s.f.Sync()
+	}
+	return nil
+}
+
+// Range calls fn with the unconsumed events from index from on, read from
+// memory
+func (s *SegmentStore) Range(from int, fn func(Event) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if from < s.first {
+		from = s.first
+	}
+	for i := from; i < s.next; i++ {
+		e, ok := s.events[i]
+		if !ok {
+			continue
+		}
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close closes the active segment
+func (s *SegmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -0,0 +1,230 @@
+package gochunker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openSegments opens the segmented log in dir with 256 byte segments,
+// closing it when the test ends
+func openSegments(t *testing.T, dir string, compress bool, retain int) *SegmentStore {
+	t.Helper()
+	s, err := OpenSegmentStore(dir, 256, compress, retain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// segmentFiles lists the files in dir, sorted
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// appendLetters appends events named a, b, c and so on, n of them
+func appendLetters(t *testing.T, s Store, n int) string {
+	t.Helper()
+	var ids string
+	for i := 0; i < n; i++ {
+		id := string(rune('a' + i))
+		if err := s.Append(Event{ID: id, Payload: []byte("payload " + id)}); err != nil {
+			t.Fatal(err)
+		}
+		ids += id
+	}
+	return ids
+}
+
+func TestSegmentStoreRotatesAndRecoversInOrder(t *testing.T) {
+	dir := t.TempDir()
+	s := openSegments(t, dir, false, 0)
+	want := appendLetters(t, s, 20)
+	files := segmentFiles(t, dir)
+	if len(files) < 3 {
+		t.Fatalf("20 events in 256 byte segments left %v, want several", files)
+	}
+	s.Ack(0)
+	s.Ack(7)
+
+	// Reopened without closing, as after a crash
+	replayed := openSegments(t, dir, false, 0)
+	if got, want := storedIDs(t, replayed), strings.Replace(strings.Replace(want, "a", "", 1), "h", "", 1); got != want {
+		t.Fatalf("replayed %s, want %s", got, want)
+	}
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Fatalf("reopening left %v, want the compacted segment only", files)
+	}
+	// Renumbered from 0, new events continue after them and survive the
+	// next restart too
+	replayed.Append(Event{ID: "z"})
+	replayed.Ack(0)
+	if got := storedIDs(t, openSegments(t, dir, false, 0)); got != "cdefgijklmnopqrstz" {
+		t.Fatalf("replayed %s after the second restart", got)
+	}
+}
+
+func TestSegmentStoreGzipsSealedSegments(t *testing.T) {
+	dir := t.TempDir()
+	s := openSegments(t, dir, true, 0)
+	want := appendLetters(t, s, 20)
+	files := segmentFiles(t, dir)
+	for _, name := range files[:len(files)-1] {
+		if !strings.HasSuffix(name, segmentGzSuffix) {
+			t.Fatalf("sealed segment %s among %v not gzipped", name, files)
+		}
+	}
+	if active := files[len(files)-1]; !strings.HasSuffix(active, segmentSuffix) {
+		t.Fatalf("active segment %s gzipped", active)
+	}
+	replayed := openSegments(t, dir, true, 0)
+	if got := storedIDs(t, replayed); got != want {
+		t.Fatalf("replayed %s across gzipped segments, want %s", got, want)
+	}
+	var first Event
+	replayed.Range(0, func(e Event) bool { first = e; return false })
+	if string(first.Payload) != "payload a" {
+		t.Fatalf("replayed %+v, want a intact", first)
+	}
+}
+
+func TestSegmentStoreDeletesConsumedSegments(t *testing.T) {
+	for _, retain := range []int{0, 1} {
+		t.Run(fmt.Sprint("retain ", retain), func(t *testing.T) {
+			dir := t.TempDir()
+			s := openSegments(t, dir, true, retain)
+			appendLetters(t, s, 20)
+			before := len(segmentFiles(t, dir))
+			// Consuming a later segment's events first frees nothing, the
+			// oldest still holds a
+			for i := 19; i >= 1; i-- {
+				s.Ack(i)
+			}
+			if n := len(segmentFiles(t, dir)); n != before {
+				t.Fatalf("%d segments left with a unconsumed, want all %d", n, before)
+			}
+			s.Ack(0)
+			if files := segmentFiles(t, dir); len(files) != 1+retain {
+				t.Fatalf("segments %v left with everything consumed, want the active one and %d more", files, retain)
+			}
+			if got := storedIDs(t, openSegments(t, dir, true, retain)); got != "" {
+				t.Fatalf("replayed %s, want nothing", got)
+			}
+		})
+	}
+}
+
+func TestSegmentStoreIgnoresCrashLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	s := openSegments(t, dir, true, 0)
+	want := appendLetters(t, s, 10)
+	s.Close()
+	files := segmentFiles(t, dir)
+	sealed := files[0]
+	// A crash while gzipping the next segment, and one after gzipping the
+	// first but before removing its plain copy
+	if err := os.WriteFile(filepath.Join(dir, strings.Replace(files[1], segmentGzSuffix, segmentGzSuffix+segmentTmp, 1)), []byte("half a gzip"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, strings.TrimSuffix(sealed, ".gz")), []byte("stale"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedIDs(t, openSegments(t, dir, true, 0)); got != want {
+		t.Fatalf("replayed %s, want %s", got, want)
+	}
+	for _, name := range segmentFiles(t, dir) {
+		if strings.HasSuffix(name, segmentTmp) {
+			t.Fatalf("leftover %s not removed", name)
+		}
+	}
+}
+
+func TestSegmentStoreRotatesUnderLoad(t *testing.T) {
+	dir := t.TempDir()
+	s := openSegments(t, dir, true, 0)
+	var mu sync.Mutex
+	next := 0
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				mu.Lock()
+				if err := s.Append(Event{ID: "e"}); err != nil {
+					mu.Unlock()
+					t.Error(err)
+					return
+				}
+				idx := next
+				next++
+				mu.Unlock()
+				if idx%2 == 0 {
+					if err := s.Ack(idx); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := len(storedIDs(t, openSegments(t, dir, true, 0))); got != 200 {
+		t.Fatalf("replayed %d events after concurrent appends and acks, want the 200 unacked", got)
+	}
+}
+
+func TestControllerReplaysSegmentedWAL(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.WALPath = filepath.Join(t.TempDir(), "wal")
+	cfg.WALSegmentSize = 128
+	cfg.WALCompress = true
+	crashed, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed.mu.Lock()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		crashed.bufferLocked(Event{ID: id})
+	}
+	crashed.mu.Unlock()
+	crashed.cancel()
+	crashed.ratelimiter.Stop()
+
+	startController(t, cfg)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 4 }) {
+		t.Fatalf("main got %v after the restart, want a b c d", main.ids())
+	}
+	if got := fmt.Sprint(main.ids()); got != "[a b c d]" {
+		t.Fatalf("main got %s", got)
+	}
+}
+
+func TestWALSegmentOptionsNeedSegmentSize(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.WALCompress = true
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("compressed segments accepted without a segment size")
+	}
+	cfg.WALSegmentSize = 1 << 20
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
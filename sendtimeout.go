@@ -0,0 +1,61 @@
+package gochunker
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// errSendTimedOut is returned by deliver, along with the connection that
+// replaced the one it gave up on, for a batch that took longer than
+// SendTimeout to write. The caller abandons the batch with abandonSend.
+var errSendTimedOut = errors.New("send timed out")
+
+// sendGuard closes a connection a send has been writing to for longer than
+// SendTimeout, failing the stuck write
+type sendGuard struct {
+	timer   Timer
+	expired atomic.Bool
+}
+
+// guardSend starts guarding a send over ws, returning nil when SendTimeout
+// is off
+func (c *Controller) guardSend(ws Conn) *sendGuard {
+	if c.cfg.SendTimeout <= 0 {
+		return nil
+	}
+	g := &sendGuard{}
+	g.timer = c.clock.AfterFunc(c.cfg.SendTimeout, func() {
+		g.expired.Store(true)
+		ws.Close()
+	})
+	return g
+}
+
+// fired reports whether the guarded send took too long
+func (g *sendGuard) fired() bool {
+	return g != nil && g.expired.Load()
+}
+
+// stop ends the guard once the send is done
+func (g *sendGuard) stop() {
+	if g != nil {
+		g.timer.Stop()
+	}
+}
+
+// abandonSend dead-letters batch, the events at indexes, after writing it
+// to p timed out, and moves on past them for p
+func (c *Controller) abandonSend(p *provider, batch []Event, indexes []int) {
+	c.mu.Lock()
+	c.unstampLocked(p, batch, indexes)
+	reason := fmt.Sprintf("sending it to %s took longer than %s", p.name, c.cfg.SendTimeout)
+	for i, event := range batch {
+		c.deadLetterLocked(p.name, event, reason)
+		c.noteDropLocked(event, DropDeadLettered)
+		c.forgetLocked(p, indexes[i])
+	}
+	c.markSentLocked(p, indexes, nil)
+	c.mu.Unlock()
+	c.runDropHooks()
+}
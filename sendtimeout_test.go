@@ -0,0 +1,121 @@
+package gochunker
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stallConn is a memConn whose writes of events carrying stall hang until
+// the connection is closed, as on a congested link
+type stallConn struct {
+	*memConn
+	stall []byte
+}
+
+func (sc *stallConn) WriteMessage(typ int, data []byte) error {
+	if bytes.Contains(data, sc.stall) {
+		<-sc.done
+		return net.ErrClosed
+	}
+	return sc.memConn.WriteMessage(typ, data)
+}
+
+func TestSendTimeoutDeadLettersSlowEvent(t *testing.T) {
+	md := newMemDialer()
+	dial := func(ctx context.Context, url string, header http.Header) (Conn, error) {
+		conn, err := md.dial(ctx, url, header)
+		if err != nil {
+			return nil, err
+		}
+		return &stallConn{memConn: conn.(*memConn), stall: []byte(`"id":"slow"`)}, nil
+	}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.SendTimeout = 100 * time.Millisecond
+	c := startController(t, cfg, WithDialFunc(dial), withBackoffBase(time.Millisecond))
+	first := md.accept(t)
+	for _, id := range []string{"slow", "e1"} {
+		if err := c.Enqueue(Event{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The stuck write gives up the connection and e1 goes out on a new one
+	second := md.accept(t)
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := second.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(msg), `"id":"e1"`) {
+		t.Fatalf("new connection got %s, want e1", msg)
+	}
+	select {
+	case <-first.done:
+	default:
+		t.Fatal("connection the send timed out on left open")
+	}
+
+	st := c.Status()
+	if st.DeadLettered != 1 {
+		t.Fatalf("%d events dead-lettered, want slow", st.DeadLettered)
+	}
+	letters := c.DeadLetters()
+	if len(letters) != 1 || letters[0].Event.ID != "slow" || !strings.Contains(letters[0].Reason, "took longer than 100ms") {
+		t.Fatalf("dead letters %+v, want slow for timing out", letters)
+	}
+}
+
+func TestSendTimeoutFollowsClock(t *testing.T) {
+	md := newMemDialer()
+	dial := func(ctx context.Context, url string, header http.Header) (Conn, error) {
+		conn, err := md.dial(ctx, url, header)
+		if err != nil {
+			return nil, err
+		}
+		return &stallConn{memConn: conn.(*memConn), stall: []byte(`"id":"slow"`)}, nil
+	}
+	fc := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.SendTimeout = time.Hour
+	c := startController(t, cfg, WithDialFunc(dial), WithClock(fc))
+	first := md.accept(t)
+	if err := c.Enqueue(Event{ID: "slow"}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	fc.Advance(time.Hour - time.Second)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-first.done:
+		t.Fatal("send gave up before the clock reached SendTimeout")
+	default:
+	}
+	fc.Advance(time.Second)
+	select {
+	case <-first.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stuck send still going once the clock passed SendTimeout")
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().DeadLettered == 1 }) {
+		t.Fatalf("%d events dead-lettered, want slow", c.Status().DeadLettered)
+	}
+}
+
+func TestSendTimeoutDefaultsAndValidation(t *testing.T) {
+	if DefaultConfig().SendTimeout < time.Minute {
+		t.Fatalf("default send timeout %s, want a generous one", DefaultConfig().SendTimeout)
+	}
+	cfg := DefaultConfig()
+	cfg.SendTimeout = -time.Second
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("negative send timeout accepted")
+	}
+}
@@ -0,0 +1,88 @@
+package gochunker
+
+// Every event written to a provider carries a sequence number, counted per
+// provider from 1 in the order events go out. The count lives with the
+// provider rather than its connection, so after a reconnect the sequence
+// picks up where it left off and a provider seeing a jump knows it missed
+// events. An event sent again, because it went unacknowledged or was
+// replayed, keeps the number it was first sent with. Numbers stamped on a
+// batch that could not be written are given back, see unstampLocked.
+
+// stampLocked numbers the events of batch, about to be written to p, in
+// place. indexes holds their buffer indexes. c.mu must be held.
+func (c *Controller) stampLocked(p *provider, batch []Event, indexes []int) {
+	for i := range batch {
+		if seq, ok := p.seqs[indexes[i]]; ok {
+			batch[i].Seq = seq
+			continue
+		}
+		p.seq++
+		batch[i].Seq = p.seq
+	}
+}
+
+// unstampLocked gives back the numbers newly stamped on batch, the events
+// at indexes, once writing it to p failed, so the events sent next take
+// them over. Numbers another lane stamped since stay taken, leaving a gap.
+// c.mu must be held.
+func (c *Controller) unstampLocked(p *provider, batch []Event, indexes []int) {
+	for i := len(batch) - 1; i >= 0; i-- {
+		if _, sent := p.seqs[indexes[i]]; sent {
+			continue
+		}
+		if batch[i].Seq != p.seq {
+			return
+		}
+		p.seq--
+	}
+}
+
+// recordSeqsLocked notes the numbers the events at indexes were written to
+// p with, for sending them again under the same ones. c.mu must be held.
+func recordSeqsLocked(p *provider, indexes []int, seqs []uint64) {
+	if p.seqs == nil {
+		p.seqs = make(map[int]uint64)
+	}
+	for i, idx := range indexes {
+		p.seqs[idx] = seqs[i]
+	}
+}
+
+// forgetSeqsLocked drops the numbers recorded for the event at idx, which
+// leaves the buffer. c.mu must be held.
+func (c *Controller) forgetSeqsLocked(idx int) {
+	for _, p := range c.providers() {
+		delete(p.seqs, idx)
+	}
+}
+
+// seqs returns the sequence numbers stamped on batch
+func seqs(batch []Event) []uint64 {
+	out := make([]uint64, len(batch))
+	for i, event := range batch {
+		out[i] = event.Seq
+	}
+	return out
+}
+
+// checkAckSeq verifies that an ack from p referencing seq moves its
+// acknowledged sequence forward, logging and counting acks that go
+// backwards or name a number never sent
+func (c *Controller) checkAckSeq(p *provider, seq uint64) {
+	c.mu.Lock()
+	acked, sent := p.ackedSeq, p.seq
+	ok := seq > acked && seq <= sent
+	if ok {
+		p.ackedSeq = seq
+	}
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+	c.metrics.outOfOrderAcks.WithLabelValues(p.name).Inc()
+	if seq > sent {
+		c.log.Warn("ack references a sequence number never sent", "provider", p.name, "seq", seq, "last_sent", sent)
+		return
+	}
+	c.log.Warn("out-of-order ack", "provider", p.name, "seq", seq, "acked", acked)
+}
@@ -0,0 +1,179 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// seqsByID returns the sequence numbers fp received each event ID with, in
+// order of arrival
+func seqsByID(fp *fakeProvider) map[string][]uint64 {
+	out := make(map[string][]uint64)
+	for _, msg := range fp.messages() {
+		var event Event
+		if json.Unmarshal([]byte(msg), &event) == nil && event.ID != "" {
+			out[event.ID] = append(out[event.ID], event.Seq)
+		}
+	}
+	return out
+}
+
+func TestSeqContinuesAcrossReconnect(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	received := dropAfter(main, 3, false)
+	c := startController(t, testConfig(main, backup), withBackoffBase(time.Millisecond))
+	app := dialApp(t, c)
+	sendEvents(t, app, "e", 3)
+	redialed := func() bool {
+		main.mu.Lock()
+		defer main.mu.Unlock()
+		return main.dials == 2 && c.Status().Providers[0].Connected
+	}
+	if !waitUntil(2*time.Second, redialed) {
+		t.Fatal("provider not redialed after dropping the connection")
+	}
+	sendEvents(t, app, "f", 2)
+	if !waitUntil(2*time.Second, func() bool { return len(received()) == 2 && len(received()[1]) == 2 }) {
+		t.Fatalf("events after the reconnect: %v", received())
+	}
+
+	var got []uint64
+	for _, msg := range main.messages() {
+		var event Event
+		json.Unmarshal([]byte(msg), &event)
+		got = append(got, event.Seq)
+	}
+	if fmt.Sprint(got) != "[1 2 3 4 5]" {
+		t.Fatalf("sequence numbers %v across the reconnect, want 1 to 5 without a gap", got)
+	}
+	if seq := c.Status().Providers[0].Seq; seq != 5 {
+		t.Fatalf("status reports seq %d, want 5", seq)
+	}
+}
+
+func TestResentEventsKeepTheirSeq(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	received := dropAfter(main, 3, true)
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.AckTimeout = 0 // unacked events are only resent on reconnect
+	cfg.RateLimit = 10000
+	cfg.RateLimitInterval = time.Second
+	c := startController(t, cfg, withBackoffBase(time.Millisecond))
+	sendEvents(t, dialApp(t, c), "e", 8)
+	if !waitUntil(5*time.Second, func() bool { return len(seqsByID(main)) == 8 }) {
+		t.Fatalf("not every event delivered across the reconnect: %v", received())
+	}
+
+	seen := make(map[uint64]string)
+	for id, seqs := range seqsByID(main) {
+		for _, seq := range seqs[1:] {
+			if seq != seqs[0] {
+				t.Fatalf("event %s sent with sequence numbers %v, want the first one kept", id, seqs)
+			}
+		}
+		if other, dup := seen[seqs[0]]; dup {
+			t.Fatalf("events %s and %s share sequence number %d", id, other, seqs[0])
+		}
+		seen[seqs[0]] = id
+	}
+	for seq := uint64(1); seq <= 8; seq++ {
+		if _, ok := seen[seq]; !ok {
+			t.Fatalf("sequence number %d missing: %v", seq, seqsByID(main))
+		}
+	}
+}
+
+func TestOutOfOrderAckCounted(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	var held []Event
+	main.onMessage = func(conn *websocket.Conn, msg []byte) {
+		var event Event
+		json.Unmarshal(msg, &event)
+		held = append(held, event)
+		if len(held) < 2 {
+			return
+		}
+		for i := len(held) - 1; i >= 0; i-- {
+			ack := fmt.Sprintf(`{"ack":%q,"seq":%d}`, held[i].ID, held[i].Seq)
+			conn.WriteMessage(websocket.TextMessage, []byte(ack))
+		}
+	}
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	c := startController(t, cfg)
+	sendEvents(t, dialApp(t, c), "e", 2)
+
+	counted := func() bool {
+		mf := gather(t, c, "gochunker_out_of_order_acks_total")
+		return mf != nil && mf.GetMetric()[0].GetCounter().GetValue() == 1
+	}
+	if !waitUntil(2*time.Second, counted) {
+		t.Fatalf("out-of-order acks: %v", gather(t, c, "gochunker_out_of_order_acks_total"))
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Unacked == 0 }) {
+		t.Fatal("out-of-order acks were not applied")
+	}
+}
+
+func TestSeqGivenBackAfterFailedWrite(t *testing.T) {
+	md := newMemDialer()
+	dial := func(ctx context.Context, url string, header http.Header) (Conn, error) {
+		conn, err := md.dial(ctx, url, header)
+		if err != nil {
+			return nil, err
+		}
+		return &stallConn{memConn: conn.(*memConn), stall: []byte(`"id":"slow"`)}, nil
+	}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.SendTimeout = 100 * time.Millisecond
+	c := startController(t, cfg, WithDialFunc(dial), withBackoffBase(time.Millisecond))
+	md.accept(t)
+	for _, id := range []string{"slow", "e1"} {
+		if err := c.Enqueue(Event{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The write of slow fails, e1 goes out on the new connection with the
+	// number slow never got through with
+	second := md.accept(t)
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := second.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event Event
+	if err := json.Unmarshal(msg, &event); err != nil || event.ID != "e1" {
+		t.Fatalf("new connection got %s, want e1", msg)
+	}
+	if event.Seq != 1 {
+		t.Fatalf("e1 sent with sequence number %d after the failed write, want 1 without a gap", event.Seq)
+	}
+	if seq := c.Status().Providers[0].Seq; seq != 1 {
+		t.Fatalf("status reports seq %d, want 1", seq)
+	}
+}
+
+func TestReplayedEventsKeepTheirSeq(t *testing.T) {
+	c, main := startReplaying(t, 3, nil)
+	if _, err := c.Replay(context.Background(), ReplayRequest{IDs: []string{"e1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(time.Second, func() bool { return main.count() == 4 }) {
+		t.Fatalf("main received %v", main.ids())
+	}
+	if got := fmt.Sprint(seqsByID(main)["e1"]); got != "[2 2]" {
+		t.Fatalf("e1 sent with sequence numbers %s, want the first kept on replay", got)
+	}
+	if seq := c.Status().Providers[0].Seq; seq != 3 {
+		t.Fatalf("status reports seq %d after the replay, want 3", seq)
+	}
+}
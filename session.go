@@ -0,0 +1,166 @@
+package gochunker
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionHeader names the session an app connection feeds. The session
+// query parameter does the same for clients that can't set headers.
+const sessionHeader = "X-Gochunker-Session"
+
+// maxSessionIDLen bounds the session IDs apps may pick
+const maxSessionIDLen = 128
+
+// appSession is what the controller remembers of an app that connected
+// with a session ID, so it can reconnect and carry on where it left off.
+// Guarded by Controller.mu.
+type appSession struct {
+	id       string
+	app      *appConn // connection feeding the session, nil while it awaits resumption
+	accepted uint64   // events accepted through the session, duplicates included
+	lastID   string   // ID of the last of them to carry one
+	expiry   Timer    // forgets the session unless it is resumed in time, nil while connected
+}
+
+// sessionMessage tells an app which session its connection feeds and how
+// many of its events the controller already has, so it can resend only
+// what came after LastID
+type sessionMessage struct {
+	Type     string `json:"type"` // always "session"
+	Session  string `json:"session"`
+	Resumed  bool   `json:"resumed"` // the session existed before this connection
+	Accepted uint64 `json:"accepted"`
+	LastID   string `json:"last_id,omitempty"`
+}
+
+// sessionOf returns the session ID r asks for, empty if none
+func sessionOf(r *http.Request) (string, error) {
+	id := r.Header.Get(sessionHeader)
+	if id == "" {
+		id = r.URL.Query().Get("session")
+	}
+	if len(id) > maxSessionIDLen {
+		return "", fmt.Errorf("session ID longer than %d bytes", maxSessionIDLen)
+	}
+	for _, ch := range id {
+		if ch < 0x21 || ch > 0x7e {
+			return "", fmt.Errorf("session ID may only hold printable ASCII")
+		}
+	}
+	return id, nil
+}
+
+// attachSession makes app the connection feeding session id, creating the
+// session unless it is resumed. It returns the connection that fed the
+// session before, if it is still open, for the caller to hand over from
+// with takeOverSession before reading app: one session is read by one
+// goroutine at a time.
+func (c *Controller) attachSession(app *appConn, id string) (old *appConn, resumed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions == nil {
+		c.sessions = make(map[string]*appSession)
+	}
+	s, resumed := c.sessions[id]
+	if !resumed {
+		s = &appSession{id: id}
+		c.sessions[id] = s
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	old = s.app
+	s.app = app
+	app.session = s
+	return old, resumed
+}
+
+// greetSession tells app how far its session got, once nothing else feeds
+// it any more
+func (c *Controller) greetSession(app *appConn, resumed bool) {
+	c.mu.Lock()
+	s := app.session
+	hello := sessionMessage{Type: "session", Session: s.id, Resumed: resumed, Accepted: s.accepted, LastID: s.lastID}
+	c.mu.Unlock()
+	msg, err := app.codec.Marshal(hello)
+	if err != nil {
+		return
+	}
+	if err := app.write(msg, c.cfg.WriteTimeout); err != nil {
+		c.log.Warn("sending session to app failed", "session", s.id, "err", err)
+	}
+}
+
+// takeOverSession closes old, the connection that fed app's session so
+// far, and waits for its reader to stop
+func (c *Controller) takeOverSession(app, old *appConn) {
+	c.log.Info("app session resumed on a new connection, closing the old one", "session", app.session.id)
+	closeConn(old.conn, old.readerDone, websocket.CloseGoingAway, "session resumed elsewhere")
+	select {
+	case <-old.readerDone:
+	case <-c.ctx.Done():
+	}
+}
+
+// detachSessionLocked notes that app, which is going away, no longer feeds
+// its session. The session then awaits resumption for SessionTTL. c.mu must
+// be held.
+func (c *Controller) detachSessionLocked(app *appConn) {
+	s := app.session
+	if s == nil || s.app != app {
+		return
+	}
+	s.app = nil
+	if c.cfg.SessionTTL <= 0 {
+		delete(c.sessions, s.id)
+		return
+	}
+	s.expiry = c.clock.AfterFunc(c.cfg.SessionTTL, func() { c.expireSession(s) })
+}
+
+// expireSession forgets s, which was not resumed within SessionTTL. With no
+// app left to resume anything the stream then counts as ended.
+func (c *Controller) expireSession(s *appSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.app != nil || c.sessions[s.id] != s {
+		return
+	}
+	delete(c.sessions, s.id)
+	c.log.Info("app session expired", "session", s.id, "accepted", s.accepted)
+	if len(c.apps) == 0 && !c.appEnded && !c.awaitingResumeLocked() {
+		c.appEnded = true
+		c.fanOutLocked()
+	}
+}
+
+// awaitingResumeLocked reports whether a disconnected app's session may
+// still be resumed, in which case its stream hasn't ended yet. Nothing is
+// resumed once the controller drains. c.mu must be held.
+func (c *Controller) awaitingResumeLocked() bool {
+	if c.draining.Load() {
+		return false
+	}
+	for _, s := range c.sessions {
+		if s.app == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionAcceptedLocked counts event, just accepted from app, towards
+// app's session if it has one. c.mu must be held.
+func sessionAcceptedLocked(app *appConn, event Event) {
+	if app.session == nil {
+		return
+	}
+	app.session.accepted++
+	if event.ID != "" {
+		app.session.lastID = event.ID
+	}
+}
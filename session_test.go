@@ -0,0 +1,155 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialSession connects an app to url feeding session id and returns it with
+// the session message the controller greets it with
+func dialSession(t *testing.T, url, id string) (*websocket.Conn, sessionMessage) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{sessionHeader: {id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	var hello sessionMessage
+	if err := json.Unmarshal(msg, &hello); err != nil || hello.Type != "session" {
+		t.Fatalf("got %s, want a session message", msg)
+	}
+	return conn, hello
+}
+
+func TestAppReconnectsAfterDisconnect(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	url := serveApps(t, c)
+
+	first, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendEvents(t, first, "a", 2)
+	first.Close()
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 0 }) {
+		t.Fatal("app still counted as connected after disconnecting")
+	}
+
+	second, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	sendEvents(t, second, "b", 2)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 4 }) {
+		t.Fatalf("main got %v, want the events of both connections", main.ids())
+	}
+}
+
+func TestAppSessionResumes(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	url := serveApps(t, c)
+
+	app, hello := dialSession(t, url, "s1")
+	if hello.Session != "s1" || hello.Resumed || hello.Accepted != 0 {
+		t.Fatalf("new session greeted with %+v", hello)
+	}
+	sendEvents(t, app, "e", 3)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %v, want e0 e1 e2", main.ids())
+	}
+	app.Close()
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 0 }) {
+		t.Fatal("app still counted as connected after disconnecting")
+	}
+
+	app, hello = dialSession(t, url, "s1")
+	if !hello.Resumed || hello.Accepted != 3 || hello.LastID != "e2" {
+		t.Fatalf("resumed session greeted with %+v, want 3 accepted up to e2", hello)
+	}
+	if err := app.WriteMessage(websocket.TextMessage, []byte(`{"id":"e3","payload":"x"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 4 }) {
+		t.Fatalf("main got %v, want e3 after resuming", main.ids())
+	}
+	if n := backup.count(); n != 0 {
+		t.Fatalf("backup got %d events while the session could be resumed", n)
+	}
+
+	// Another session starts from scratch
+	_, hello = dialSession(t, url, "s2")
+	if hello.Resumed || hello.Accepted != 0 {
+		t.Fatalf("second session greeted with %+v", hello)
+	}
+}
+
+func TestAppSessionTakeOverClosesOldConnection(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	url := serveApps(t, c)
+
+	old, _ := dialSession(t, url, "s1")
+	sendEvents(t, old, "e", 2)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v, want e0 e1", main.ids())
+	}
+	app, hello := dialSession(t, url, "s1")
+	if !hello.Resumed || hello.Accepted != 2 {
+		t.Fatalf("taken over session greeted with %+v", hello)
+	}
+	old.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := old.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("old connection read %v, want a going-away close", err)
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Apps == 1 }) {
+		t.Fatalf("%d apps connected, want only the new one", c.Status().Apps)
+	}
+	sendEvents(t, app, "f", 1)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %v, want f0 from the new connection", main.ids())
+	}
+}
+
+func TestAppSessionExpiryEndsStream(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.SessionTTL = 300 * time.Millisecond
+	c := startController(t, cfg)
+	app, _ := dialSession(t, serveApps(t, c), "s1")
+	sendEvents(t, app, "e", 2)
+	app.Close()
+
+	// The backup only takes over once the session can't be resumed
+	time.Sleep(150 * time.Millisecond)
+	if n := backup.count(); n != 0 {
+		t.Fatalf("backup got %d events before the session expired", n)
+	}
+	if !waitUntil(2*time.Second, func() bool { return backup.count() == 2 }) {
+		t.Fatalf("backup got %v after the session expired, want e0 e1", backup.ids())
+	}
+}
+
+func TestAppSessionIDChecked(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	_, resp, err := websocket.DefaultDialer.Dial(serveApps(t, c), http.Header{sessionHeader: {"not ok"}})
+	if err == nil {
+		t.Fatal("session ID with a space accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad session ID answered %v, want 400", resp)
+	}
+}
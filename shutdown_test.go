@@ -0,0 +1,215 @@
+package gochunker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCloseIsPromptAndLeakFree(t *testing.T) {
+	before := runtime.NumGoroutine()
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.PingInterval = 50 * time.Millisecond
+	cfg.ReadTimeout = time.Second
+	c, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	app, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/app/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	sendEvents(t, app, "e", 3)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 3 }) {
+		t.Fatalf("main got %d events, want 3", main.count())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Close took %s", d)
+	}
+	// The app is told the controller went away
+	if _, _, err := app.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("app read %v, want a normal closure", err)
+	}
+
+	app.Close()
+	srv.Close()
+	main.kill()
+	backup.kill()
+	if !waitUntil(2*time.Second, func() bool { return runtime.NumGoroutine() <= before }) {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("%d goroutines left, %d before:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestContextCancelStopsGoroutines(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.PingInterval = 50 * time.Millisecond
+	cfg.ReadTimeout = time.Second
+	cfg.RequireAcks = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := NewController(cfg, WithLogger(quietLogger), WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	app := dialApp(t, c)
+	// Unacknowledged, so the ack watcher is running too
+	sendEvents(t, app, "e", 2)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %d events, want 2", main.count())
+	}
+	if n := c.Status().Goroutines["parent-watch"]; n != 1 {
+		t.Fatalf("%d parent context watchers running, want 1", n)
+	}
+
+	cancel()
+	wait, stop := context.WithTimeout(context.Background(), 2*time.Second)
+	defer stop()
+	if err := c.goroutines.wait(wait); err != nil {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("goroutines still running after cancel:\n%s", buf[:runtime.Stack(buf, true)])
+	}
+	if _, _, err := app.ReadMessage(); err == nil {
+		t.Fatal("app connection left open")
+	}
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatalf("Close after cancel: %v", err)
+	}
+}
+
+func TestCloseSendsNormalClosureToProviders(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c, err := NewController(testConfig(main, backup), WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatal("main never connected")
+	}
+	start := time.Now()
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= closeWait {
+		t.Fatalf("Close took %s although the provider answered the close frame", d)
+	}
+	closed := func() bool {
+		main.mu.Lock()
+		defer main.mu.Unlock()
+		return len(main.closes) == 1 && main.closes[0] == websocket.CloseNormalClosure
+	}
+	if !waitUntil(time.Second, closed) {
+		t.Fatalf("provider saw close codes %v, want one normal closure", main.closes)
+	}
+}
+
+func TestCloseGivesUpOnSilentPeer(t *testing.T) {
+	md := newMemDialer()
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	c, err := NewController(cfg, WithLogger(quietLogger), WithDialFunc(md.dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	md.accept(t) // never read, so the close frame goes unanswered
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatal("provider never connected")
+	}
+	start := time.Now()
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < closeWait || d > closeWait+500*time.Millisecond {
+		t.Fatalf("Close took %s, want it to wait %s for the close reply", d, closeWait)
+	}
+}
+
+func TestCloseForcesStuckWorkers(t *testing.T) {
+	md := newMemDialer()
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.RequireAcks = true
+	cfg.WriteTimeout = 0
+	cfg.ShutdownTimeout = 200 * time.Millisecond
+	cfg.WALPath = filepath.Join(t.TempDir(), "wal")
+	c, err := NewController(cfg, WithLogger(quietLogger), WithDialFunc(md.dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	md.accept(t)
+	// The provider reads nothing, the connection takes 64 events before
+	// the worker's write blocks
+	for i := 0; i < 70; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("e%02d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Unacked == 64 }) {
+		t.Fatalf("%d events unacknowledged, want 64", c.Status().Providers[0].Unacked)
+	}
+
+	start := time.Now()
+	if err := c.Close(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close returned %v, want it to give up", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Close took %s with a shutdown timeout of %s", d, cfg.ShutdownTimeout)
+	}
+	letters := c.DeadLetters()
+	if len(letters) != 64 || letters[0].Event.ID != "e00" || letters[63].Event.ID != "e63" {
+		t.Fatalf("%d dead letters, want e00 to e63", len(letters))
+	}
+
+	// Nothing was acknowledged, so everything is replayed after a restart
+	restarted, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close(context.Background())
+	if n := restarted.Status().Buffered; n != 70 {
+		t.Fatalf("%d events replayed, want all 70", n)
+	}
+}
+
+func TestDrainGivesUpAfterShutdownTimeout(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.ShutdownTimeout = 200 * time.Millisecond
+	c := startController(t, cfg)
+	if err := c.Enqueue(Event{ID: "e0"}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := c.Drain(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Drain returned %v without acks, want it to give up", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Drain took %s with a shutdown timeout of %s", d, cfg.ShutdownTimeout)
+	}
+}
@@ -0,0 +1,91 @@
+package gochunker
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"net/http"
+)
+
+// Snapshot returns a copy of the buffered events some provider has yet to
+// get through, oldest first: events it hasn't sent and, when acks are
+// required, those it sent and is still awaiting an ack for. Providers whose
+// worker hasn't started, such as a backup waiting for main, are left out
+// unless none has.
+func (c *Controller) Snapshot() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var waiting []*provider
+	for _, p := range c.providers() {
+		if p.feed != nil {
+			waiting = append(waiting, p)
+		}
+	}
+	if len(waiting) == 0 {
+		waiting = c.providers()
+	}
+	var events []Event
+	idx := c.events.first
+	err := c.events.store.Range(idx, func(e Event) bool {
+		if idx >= c.events.next() {
+			return false
+		}
+		for _, p := range waiting {
+			if !settledLocked(p, idx) {
+				events = append(events, copyEvent(e))
+				break
+			}
+		}
+		idx++
+		return true
+	})
+	if err != nil {
+		c.log.Error("reading buffered events failed", "err", err)
+	}
+	return events
+}
+
+// settledLocked reports whether p is done with the event at idx: sent, and
+// acknowledged if acks are required, or handed to another provider.
+// c.mu must be held.
+func settledLocked(p *provider, idx int) bool {
+	if idx < p.ackedIndex {
+		return true
+	}
+	if _, open := p.unacked[idx]; open {
+		return false
+	}
+	_, sent := p.sentAbove[idx]
+	return sent || idx < p.sentIndex
+}
+
+// copyEvent returns e with its payload and metadata copied, so changing
+// one leaves the other alone
+func copyEvent(e Event) Event {
+	if e.Payload != nil {
+		e.Payload = bytes.Clone(e.Payload)
+	}
+	e.Metadata = maps.Clone(e.Metadata)
+	return e
+}
+
+// handleSnapshot streams Snapshot as NDJSON, one event per line. It is an
+// admin endpoint, see authorizeAdmin.
+func (c *Controller) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, event := range c.Snapshot() {
+		if err := enc.Encode(event); err != nil {
+			c.log.Warn("writing snapshot failed", "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package gochunker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// snapshotIDs returns the IDs of events
+func snapshotIDs(events []Event) []string {
+	ids := []string{}
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestSnapshotHoldsUnsentEvents(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	main.ackAllBut("stuck")
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	cfg.AckTimeout = time.Minute
+	cfg.AdminToken = "s3cret"
+	c := startController(t, cfg)
+	for _, id := range []string{"e0", "stuck", "e1"} {
+		if err := c.Enqueue(Event{ID: id, Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Unacked == 1 && main.count() == 3 }) {
+		t.Fatalf("main got %v, status %+v", main.ids(), c.Status().Providers[0])
+	}
+	if err := c.PauseProvider("Main"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"e2", "e3"} {
+		if err := c.Enqueue(Event{ID: id, Payload: []byte("x"), Metadata: map[string]string{"tenant": "a"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Acknowledged e0 and e1 are left out, whatever the buffer still holds
+	snap := c.Snapshot()
+	if got := snapshotIDs(snap); !reflect.DeepEqual(got, []string{"stuck", "e2", "e3"}) {
+		t.Fatalf("snapshot %v, want stuck, e2 and e3", got)
+	}
+	snap[0].Payload[0] = 'y'
+	snap[2].Metadata["tenant"] = "b"
+	again := c.Snapshot()
+	if string(again[0].Payload) != "x" || again[2].Metadata["tenant"] != "a" {
+		t.Fatalf("changing a snapshot changed the buffer: %+v", again)
+	}
+
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/snapshot", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("snapshot served as %q", ct)
+	}
+	var streamed []Event
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		var e Event
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", lines.Text(), err)
+		}
+		streamed = append(streamed, e)
+	}
+	if got := snapshotIDs(streamed); !reflect.DeepEqual(got, []string{"stuck", "e2", "e3"}) {
+		t.Fatalf("streamed %v, want stuck, e2 and e3", got)
+	}
+
+	resp, err = http.Get(srv.URL + "/admin/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("snapshot without the admin token answered %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,129 @@
+package gochunker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ProviderState is where a provider's connection stands
+type ProviderState int32
+
+const (
+	ProviderDisconnected ProviderState = iota // not dialed yet, or its connection went away
+	ProviderConnecting                        // being dialed, backing off between attempts
+	ProviderConnected                         // open and being sent to
+	ProviderDraining                          // open while the controller drains or shuts down
+	ProviderFailed                            // dials or probes keep failing, the circuit breaker holds dials back
+)
+
+func (s ProviderState) String() string {
+	switch s {
+	case ProviderDisconnected:
+		return "disconnected"
+	case ProviderConnecting:
+		return "connecting"
+	case ProviderConnected:
+		return "connected"
+	case ProviderDraining:
+		return "draining"
+	case ProviderFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("ProviderState(%d)", int(s))
+}
+
+// up reports whether a provider in state s has its connection open
+func (s ProviderState) up() bool {
+	return s == ProviderConnected || s == ProviderDraining
+}
+
+// providerStates lists every ProviderState, for the state gauge
+var providerStates = []ProviderState{ProviderDisconnected, ProviderConnecting, ProviderConnected, ProviderDraining, ProviderFailed}
+
+// stateTransitions lists the states each state may move to
+var stateTransitions = map[ProviderState][]ProviderState{
+	ProviderDisconnected: {ProviderConnecting},
+	ProviderConnecting:   {ProviderConnected, ProviderDraining, ProviderFailed, ProviderDisconnected},
+	ProviderConnected:    {ProviderDraining, ProviderDisconnected, ProviderFailed},
+	ProviderDraining:     {ProviderDisconnected},
+	ProviderFailed:       {ProviderConnecting, ProviderDisconnected},
+}
+
+// errInvalidTransition is returned by setStateLocked for a move the state
+// machine doesn't allow
+var errInvalidTransition = errors.New("invalid provider state transition")
+
+// validTransition reports whether a provider may move from one state to
+// another
+func validTransition(from, to ProviderState) bool {
+	for _, next := range stateTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns where p's connection stands. It may be read without
+// Controller.mu, changes go through setStateLocked.
+func (p *provider) State() ProviderState {
+	return ProviderState(p.state.Load())
+}
+
+// connected reports whether p's connection is open
+func (p *provider) connected() bool {
+	return p.State().up()
+}
+
+// setStateLocked moves p to state to, the one place provider states
+// change. It keeps the state gauge, providersUp for the readiness probe
+// and the pool's primary in step, and hands p's events to other members
+// once its connection goes down. Moving to the current state does nothing.
+// c.mu must be held.
+func (c *Controller) setStateLocked(p *provider, to ProviderState) error {
+	from := p.State()
+	if from == to {
+		return nil
+	}
+	if !validTransition(from, to) {
+		err := fmt.Errorf("%w from %s to %s", errInvalidTransition, from, to)
+		c.log.Error("provider state not changed", "provider", p.name, "err", err)
+		return err
+	}
+	p.state.Store(int32(to))
+	c.metrics.providerState.WithLabelValues(p.name, from.String()).Set(0)
+	c.metrics.providerState.WithLabelValues(p.name, to.String()).Set(1)
+	c.log.Debug("provider state changed", "provider", p.name, "from", from, "to", to)
+	if from.up() == to.up() {
+		return nil
+	}
+	if to.up() {
+		c.providersUp.Add(1)
+	} else {
+		c.providersUp.Add(-1)
+		c.rehomeLocked(p)
+	}
+	c.updatePrimaryLocked()
+	return nil
+}
+
+// ProviderState returns where the connection to the provider called name
+// stands, or ErrUnknownProvider for a name not in the pool
+func (c *Controller) ProviderState(name string) (ProviderState, error) {
+	for _, p := range c.providers() {
+		if p.name == name {
+			return p.State(), nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q", ErrUnknownProvider, name)
+}
+
+// drainProvidersLocked moves every connected provider to ProviderDraining
+// as the controller drains or shuts down. c.mu must be held.
+func (c *Controller) drainProvidersLocked() {
+	for _, p := range c.providers() {
+		if p.State() == ProviderConnected {
+			c.setStateLocked(p, ProviderDraining)
+		}
+	}
+}
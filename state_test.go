@@ -0,0 +1,132 @@
+package gochunker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProviderStateTransitions(t *testing.T) {
+	c, err := NewController(DefaultConfig(), WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	p := c.pool.members[0]
+	if s := p.State(); s != ProviderDisconnected {
+		t.Fatalf("new provider %s, want disconnected", s)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, step := range []struct {
+		to ProviderState
+		ok bool
+	}{
+		{ProviderConnected, false}, // never dialed
+		{ProviderConnecting, true},
+		{ProviderFailed, true},
+		{ProviderConnected, false}, // a failed provider is dialed again first
+		{ProviderConnecting, true},
+		{ProviderConnected, true},
+		{ProviderFailed, true}, // its probes keep failing
+		{ProviderConnecting, true},
+		{ProviderConnected, true},
+		{ProviderConnecting, false}, // dropped before it redials
+		{ProviderDraining, true},
+		{ProviderConnected, false}, // draining is for good
+		{ProviderDisconnected, true},
+	} {
+		from := p.State()
+		err := c.setStateLocked(p, step.to)
+		if step.ok && err != nil {
+			t.Fatalf("%s to %s: %v", from, step.to, err)
+		}
+		if !step.ok {
+			if !errors.Is(err, errInvalidTransition) {
+				t.Fatalf("%s to %s returned %v, want it rejected", from, step.to, err)
+			}
+			if p.State() != from {
+				t.Fatalf("rejected move from %s left the provider %s", from, p.State())
+			}
+		}
+		if up := c.providersUp.Load() == 1; up != p.State().up() {
+			t.Fatalf("%s with %d providers up", p.State(), c.providersUp.Load())
+		}
+	}
+}
+
+func TestProviderStateFollowsConnection(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup), withBackoffBase(time.Hour))
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].State == "connected" }) {
+		t.Fatalf("main %s, want connected", c.Status().Providers[0].State)
+	}
+	if s, err := c.ProviderState("Backup"); err != nil || s != ProviderDisconnected {
+		t.Fatalf("backup %v %v before main finished, want disconnected", s, err)
+	}
+	if _, err := c.ProviderState("Nope"); !errors.Is(err, ErrUnknownProvider) {
+		t.Fatalf("unknown provider returned %v", err)
+	}
+	mf := gather(t, c, "gochunker_provider_state")
+	for _, m := range mf.GetMetric() {
+		var provider, state string
+		for _, l := range m.GetLabel() {
+			switch l.GetName() {
+			case "provider":
+				provider = l.GetValue()
+			case "state":
+				state = l.GetValue()
+			}
+		}
+		want := 0.0
+		if (provider == "Main" && state == "connected") || (provider == "Backup" && state == "disconnected") {
+			want = 1
+		}
+		if got := m.GetGauge().GetValue(); got != want {
+			t.Errorf("%s %s gauge %v, want %v", provider, state, got, want)
+		}
+	}
+
+	// The redial backs off for an hour, leaving main connecting
+	main.kill()
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].State == "connecting" }) {
+		t.Fatalf("main %s after its connection was lost, want connecting", c.Status().Providers[0].State)
+	}
+	if c.Status().Providers[0].Connected {
+		t.Fatal("main still reported connected")
+	}
+}
+
+func TestProviderStateFailedWhileBreakerOpen(t *testing.T) {
+	fd := &flakyDialer{fail: 100, release: make(chan struct{})}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.BreakerFailures = 2
+	cfg.BreakerCooldown = time.Hour
+	c := startController(t, cfg, WithDialFunc(fd.dial), withBackoffBase(time.Millisecond))
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].State == "failed" }) {
+		t.Fatalf("provider %s after failing dials, want failed", c.Status().Providers[0].State)
+	}
+}
+
+func TestProviderStateDraining(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	c := startController(t, cfg)
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatal("main never connected")
+	}
+	if err := c.Enqueue(Event{ID: "e0"}); err != nil {
+		t.Fatal(err)
+	}
+	// Main never acks, so the drain doesn't finish
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c.Drain(ctx)
+	if st := c.Status().Providers[0]; st.State != "draining" || !st.Connected {
+		t.Fatalf("main %s connected %v while draining, want draining and connected", st.State, st.Connected)
+	}
+}
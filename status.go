@@ -0,0 +1,106 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Status is a point-in-time view of the controller served by /status
+type Status struct {
+	AppConnected   bool             `json:"app_connected"`
+	Apps           int              `json:"apps"`                 // app connections currently open
+	Goroutines     map[string]int   `json:"goroutines,omitempty"` // running goroutines the controller started, by kind
+	Draining       bool             `json:"draining"`
+	Paused         bool             `json:"paused"` // apps were told to pause until the buffer drains
+	Providers      []ProviderStatus `json:"providers"`
+	Primary        string           `json:"primary,omitempty"` // pool member PrimaryFailover currently sends to
+	Buffered       int              `json:"buffered"`
+	BufferedBytes  int              `json:"buffered_bytes"` // payload bytes of the buffered events, see Config.MaxBufferBytes
+	Dropped        uint64           `json:"dropped"`
+	Deduplicated   uint64           `json:"deduplicated"`
+	Coalesced      uint64           `json:"coalesced"` // events a newer one with the same key replaced for some provider, see Config.CoalesceKey
+	Rejected       uint64           `json:"rejected"`
+	Expired        uint64           `json:"expired"`
+	DeadLettered   uint64           `json:"dead_lettered"`
+	RateLimitUsage float64          `json:"rate_limit_utilization"`
+}
+
+// ProviderStatus describes one provider connection
+type ProviderStatus struct {
+	Name      string `json:"name"`
+	Connected bool   `json:"connected"`
+	State     string `json:"state"` // see ProviderState
+	SentIndex int    `json:"sent_index"`
+	Seq       uint64 `json:"seq"`               // sequence number of the last event sent
+	Unacked   int    `json:"unacked"`           // events sent but not yet acknowledged
+	Paused    bool   `json:"paused"`            // held back by PauseProvider
+	Breaker   string `json:"breaker,omitempty"` // circuit breaker state, see BreakerState; empty without BreakerFailures
+
+	LastCloseCode int `json:"last_close_code,omitempty"` // code of the provider's last close frame, see Config.FinalCloseCodes
+	ProbeFailures int `json:"probe_failures,omitempty"`  // probes in a row that failed, see Config.ProbeInterval
+	WriteErrors   int `json:"write_errors,omitempty"`    // writes in a row that failed, see Config.WriteErrorThreshold
+
+	RateLimitUsage float64 `json:"rate_limit_utilization,omitempty"` // of its own limit, see Config.ProviderRateLimits
+}
+
+// Status snapshots the controller's connection and buffer state
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	st := Status{
+		AppConnected:  len(c.apps) > 0,
+		Apps:          len(c.apps),
+		Draining:      c.draining.Load(),
+		Paused:        c.resume != nil,
+		Buffered:      c.events.len(),
+		BufferedBytes: c.events.bytes(),
+		Dropped:       c.dropped,
+		Deduplicated:  c.deduplicated,
+		Coalesced:     c.coalesced,
+		Rejected:      c.rejected,
+		Expired:       c.expired,
+		DeadLettered:  c.deadLettered,
+		Goroutines:    c.goroutines.counts(),
+	}
+	if c.pool.primary != nil {
+		st.Primary = c.pool.primary.name
+	}
+	for _, p := range c.providers() {
+		ps := ProviderStatus{
+			Name:      p.name,
+			Connected: p.connected(),
+			State:     p.State().String(),
+			SentIndex: p.sentIndex,
+			Seq:       p.seq,
+			Unacked:   len(p.unacked),
+			Paused:    p.paused,
+
+			LastCloseCode: p.lastCloseCode,
+			ProbeFailures: p.probeFailures,
+			WriteErrors:   int(p.writeErrors.Load()),
+		}
+		if c.cfg.BreakerFailures > 0 {
+			ps.Breaker = p.breaker.state.String()
+		}
+		if p.limiter != nil {
+			ps.RateLimitUsage = p.limiter.Utilization()
+		}
+		st.Providers = append(st.Providers, ps)
+	}
+	c.mu.Unlock()
+	if c.ratelimiter != nil {
+		st.RateLimitUsage = c.ratelimiter.Utilization()
+	}
+	return st
+}
+
+func (c *Controller) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.Status()); err != nil {
+		c.log.Warn("writing status failed", "err", err)
+	}
+}
@@ -0,0 +1,61 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatusEndpoint(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	sendEvents(t, dialApp(t, c), "e", 2)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %d events, want 2", main.count())
+	}
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("content type %q", ct)
+	}
+	var st Status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if !st.AppConnected || st.Apps != 1 {
+		t.Errorf("app connected %v with %d apps, want one", st.AppConnected, st.Apps)
+	}
+	// Backup only starts once main is done, so both events stay buffered
+	if st.Buffered != 2 {
+		t.Errorf("buffered %d, want 2", st.Buffered)
+	}
+	if len(st.Providers) != 2 {
+		t.Fatalf("%d providers reported, want 2", len(st.Providers))
+	}
+	if p := st.Providers[0]; !p.Connected || p.SentIndex != 2 {
+		t.Errorf("main connected %v at sent index %d, want connected at 2", p.Connected, p.SentIndex)
+	}
+	if p := st.Providers[1]; p.Connected || p.SentIndex != 0 {
+		t.Errorf("backup connected %v at sent index %d, want idle at 0", p.Connected, p.SentIndex)
+	}
+	if st.RateLimitUsage <= 0 {
+		t.Errorf("rate limit utilization %v after sending", st.RateLimitUsage)
+	}
+
+	post, err := http.Post(srv.URL+"/status", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /status answered %s", post.Status)
+	}
+}
@@ -0,0 +1,293 @@
+package gochunker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// Store persists buffered events so they survive a restart. Events are
+// addressed by the index Append gave them, counting from 0. A store
+// reopened after a restart renumbers the events it still holds from 0, in
+// order, so new appends continue after them.
+type Store interface {
+	// Append durably records e as the next event
+	Append(e Event) error
+	// Range calls fn with every unconsumed event from index from on, in
+	// order, until fn returns false. fn must not call back into the store.
+	Range(from int, fn func(Event) bool) error
+	// Ack marks the event at index consumed so it is never replayed
+	Ack(index int) error
+	Close() error
+}
+
+// walCompactSize is how large a write-ahead log may grow before it is
+// truncated the next time every event in it has been consumed
+const walCompactSize = 16 << 20
+
+// walRecord is one entry of the write-ahead log
+type walRecord struct {
+	Op    string `json:"op"` // "append", "ack" or "reset", which starts a compacted SegmentStore segment
+	Index int    `json:"index"`
+	Event *Event `json:"event,omitempty"`
+}
+
+// FileStore is a Store backed by an append-only write-ahead log. Each
+// record is framed by its length and CRC so a partial or corrupt record,
+// as left by a crash mid-write, is detected on recovery and discarded
+// together with anything after it. Unconsumed events are also kept in
+// memory so Range never reads the log back.
+type FileStore struct {
+	path string
+	sync bool // fsync after every record
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	events map[int]Event // appended but not acked, by index
+	first  int           // no event below this index is unconsumed
+	next   int           // index the next appended event gets
+}
+
+// OpenFileStore opens or creates the log at path. The events it still
+// holds are compacted into a fresh log, numbered from 0. With sync set
+// every record is flushed to disk before Append or Ack returns, otherwise
+// records survive a crash of the process but not of the machine.
+func OpenFileStore(path string, sync bool) (*FileStore, error) {
+	events, err := recoverLog(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{path: path, sync: sync, events: make(map[int]Event)}
+	if err := s.rewrite(events); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// recoverLog reads the unconsumed events out of the log at path, which may
+// not exist yet
+func recoverLog(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := make(map[int]Event)
+	var order []int
+	err = readRecords(f, func(rec walRecord) {
+		switch rec.Op {
+		case "append":
+			if rec.Event != nil {
+				if _, dup := events[rec.Index]; !dup {
+					order = append(order, rec.Index)
+				}
+				events[rec.Index] = *rec.Event
+			}
+		case "ack":
+			delete(events, rec.Index)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	var live []Event
+	for _, idx := range order {
+		if e, ok := events[idx]; ok {
+			live = append(live, e)
+			delete(events, idx)
+		}
+	}
+	return live, nil
+}
+
+// readRecords calls fn with each intact record of r in order. It stops
+// quietly at the first truncated or corrupt record and only fails if r
+// can't be read.
+func readRecords(r io.Reader, fn func(walRecord)) error {
+	br := bufio.NewReader(r)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		n := binary.BigEndian.Uint32(header[:4])
+		sum := binary.BigEndian.Uint32(header[4:])
+		if n > maxRecordSize {
+			return nil
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(br, body); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		if crc32.ChecksumIEEE(body) != sum {
+			return nil
+		}
+		var rec walRecord
+		if json.Unmarshal(body, &rec) != nil {
+			return nil
+		}
+		fn(rec)
+	}
+}
+
+// maxRecordSize bounds the length read from a record header, so a corrupt
+// header doesn't make recovery allocate gigabytes
+const maxRecordSize = 256 << 20
+
+// rewrite replaces the log with one holding just events, numbered from 0
+func (s *FileStore) rewrite(events []Event) error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var size int64
+	for i := range events {
+		n, err := writeRecord(w, walRecord{Op: "append", Index: i, Event: &events[i]})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		size += int64(n)
+		s.events[i] = events[i]
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.size = size
+	s.next = len(events)
+	return nil
+}
+
+// writeRecord frames rec and writes it to w, returning the bytes written
+func writeRecord(w io.Writer, rec walRecord) (int, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 8+len(body))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+	copy(buf[8:], body)
+	return w.Write(buf)
+}
+
+// Append records e at the end of the log
+func (s *FileStore) Append(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeLocked(walRecord{Op: "append", Index: s.next, Event: &e}); err != nil {
+		return err
+	}
+	s.events[s.next] = e
+	s.next++
+	return nil
+}
+
+// Ack records that the event at index was consumed. Once nothing in the
+// log is left unconsumed and it has grown past walCompactSize it is
+// truncated.
+func (s *FileStore) Ack(index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.events[index]; !ok {
+		return nil
+	}
+	if err := s.writeLocked(walRecord{Op: "ack", Index: index}); err != nil {
+		return err
+	}
+	delete(s.events, index)
+	for _, ok := s.events[s.first]; !ok && s.first < s.next; _, ok = s.events[s.first] {
+		s.first++
+	}
+	if len(s.events) == 0 && s.size > walCompactSize {
+		if err := s.f.Truncate(0); err != nil {
+			return err
+		}
+		s.size = 0
+	}
+	return nil
+}
+
+func (s *FileStore) writeLocked(rec walRecord) error {
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	n, err := writeRecord(s.f, rec)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if s.sync {
+		return s.f.Sync()
+	}
+	return nil
+}
+
+// Range calls fn with the unconsumed events from index from on, read from
+// memory
+func (s *FileStore) Range(from int, fn func(Event) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if from < s.first {
+		from = s.first
+	}
+	for i := from; i < s.next; i++ {
+		e, ok := s.events[i]
+		if !ok {
+			continue
+		}
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close closes the log file
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
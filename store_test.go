@@ -0,0 +1,132 @@
+package gochunker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storedIDs returns the IDs of the unconsumed events in s, in order
+func storedIDs(t *testing.T, s Store) string {
+	t.Helper()
+	var ids string
+	if err := s.Range(0, func(e Event) bool {
+		ids += e.ID
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// openStore opens the log at path, closing it when the test ends
+func openStore(t *testing.T, path string) *FileStore {
+	t.Helper()
+	s, err := OpenFileStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	s := openStore(t, path)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := s.Append(Event{ID: id, Payload: []byte("p" + id), Priority: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Ack(0)
+	s.Ack(2)
+
+	// Reopened without closing, as after a crash
+	replayed := openStore(t, path)
+	if got := storedIDs(t, replayed); got != "bd" {
+		t.Fatalf("replayed %s, want bd", got)
+	}
+	var first Event
+	replayed.Range(0, func(e Event) bool { first = e; return false })
+	if string(first.Payload) != "pb" || first.Priority != 2 {
+		t.Fatalf("replayed %+v, want b intact", first)
+	}
+	// Renumbered from 0, new events continue after them
+	replayed.Append(Event{ID: "e"})
+	replayed.Ack(0)
+	if got := storedIDs(t, openStore(t, path)); got != "de" {
+		t.Fatalf("replayed %s, want de", got)
+	}
+}
+
+func TestFileStoreTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	s := openStore(t, path)
+	s.Append(Event{ID: "a"})
+	s.Append(Event{ID: "b"})
+	s.Close()
+	// A crash part way through the next record
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 50, 1, 2, 3, 4, '{', '"'})
+	f.Close()
+
+	if got := storedIDs(t, openStore(t, path)); got != "ab" {
+		t.Fatalf("replayed %s, want ab", got)
+	}
+}
+
+func TestFileStoreCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	s := openStore(t, path)
+	s.Append(Event{ID: "a"})
+	s.Append(Event{ID: "b"})
+	s.Append(Event{ID: "c"})
+	s.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte in the body of the second record
+	first := 8 + int(data[0])<<24 + int(data[1])<<16 + int(data[2])<<8 + int(data[3])
+	data[first+10] ^= 0xff
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing after a corrupt record can be trusted
+	if got := storedIDs(t, openStore(t, path)); got != "a" {
+		t.Fatalf("replayed %s, want a", got)
+	}
+}
+
+func TestControllerReplaysWAL(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := testConfig(main, backup)
+	cfg.WALPath = filepath.Join(t.TempDir(), "wal")
+	crashed, err := NewController(cfg, WithLogger(quietLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed.mu.Lock()
+	crashed.bufferLocked(Event{ID: "a"})
+	crashed.bufferLocked(Event{ID: "b"})
+	crashed.mu.Unlock()
+	// Never closed, so its log is left as a crash would leave it
+	crashed.cancel()
+	crashed.ratelimiter.Stop()
+
+	c := startController(t, cfg)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v after the restart, want a b", main.ids())
+	}
+	if got := main.ids(); got[0] != "a" || got[1] != "b" {
+		t.Fatalf("main got %v, want a b", got)
+	}
+	if n := c.Status().Buffered; n != 2 {
+		t.Fatalf("buffered %d, want the replayed events held for backup", n)
+	}
+}
@@ -0,0 +1,68 @@
+package gochunker
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// checkSubprotocols reports an error unless every name can go in a
+// Sec-WebSocket-Protocol header
+func checkSubprotocols(names []string) error {
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t,;\"()<>@:/[]?={}\\") {
+			return fmt.Errorf("malformed subprotocol %q", name)
+		}
+	}
+	return nil
+}
+
+// dialSubprotocols returns the subprotocols providers are dialed with,
+// ProviderSubprotocols if set and those of the codec otherwise
+func dialSubprotocols(cfg Config) []string {
+	if len(cfg.ProviderSubprotocols) > 0 {
+		return cfg.ProviderSubprotocols
+	}
+	return offeredSubprotocols(cfg.Codec)
+}
+
+// checkNegotiated reports an error unless the provider at url selected one
+// of ProviderSubprotocols for conn. HTTP streams have no handshake to
+// select one in and are let through.
+func (c *Controller) checkNegotiated(url string, conn Conn) error {
+	want := c.cfg.ProviderSubprotocols
+	if len(want) == 0 || isHTTPProvider(url) || slices.Contains(want, conn.Subprotocol()) {
+		return nil
+	}
+	if got := conn.Subprotocol(); got != "" {
+		return fmt.Errorf("provider selected subprotocol %q, want one of %s", got, strings.Join(want, ", "))
+	}
+	return fmt.Errorf("provider selected no subprotocol, want one of %s", strings.Join(want, ", "))
+}
+
+// appSubprotocols returns the subprotocols the app upgrader offers,
+// AppSubprotocols if set and those of the codecs otherwise
+func (c *Controller) appSubprotocols() []string {
+	if len(c.cfg.AppSubprotocols) > 0 {
+		return c.cfg.AppSubprotocols
+	}
+	return []string{subprotocolMessagePack, subprotocolJSON}
+}
+
+// checkAppSubprotocol reports an error unless the app connecting with r
+// offers one of AppSubprotocols, when any are set
+func (c *Controller) checkAppSubprotocol(r *http.Request) error {
+	want := c.cfg.AppSubprotocols
+	if len(want) == 0 {
+		return nil
+	}
+	for _, offered := range websocket.Subprotocols(r) {
+		if slices.Contains(want, offered) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no acceptable subprotocol offered, want one of %s", strings.Join(want, ", "))
+}
@@ -0,0 +1,94 @@
+package gochunker
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestProviderSubprotocolNegotiated(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	main.protocols = []string{"v1.feed"}
+	cfg := testConfig(main, backup)
+	cfg.ProviderSubprotocols = []string{"v2.feed", "v1.feed"}
+	c := startController(t, cfg)
+	sendEvents(t, dialApp(t, c), "e", 2)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("main got %v, want e0 and e1", main.ids())
+	}
+	main.mu.Lock()
+	defer main.mu.Unlock()
+	if got := main.conns[0].Subprotocol(); got != "v1.feed" {
+		t.Fatalf("negotiated %q, want v1.feed", got)
+	}
+	if got := main.headers[0].Get("Sec-WebSocket-Protocol"); got != "v2.feed, v1.feed" {
+		t.Fatalf("offered %q, want v2.feed, v1.feed", got)
+	}
+}
+
+func TestProviderSubprotocolMismatch(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	main.protocols = []string{"other"}
+	cfg := testConfig(main, backup)
+	cfg.ProviderSubprotocols = []string{"v1.feed"}
+	c := startController(t, cfg, withBackoffBase(10*time.Millisecond))
+	sendEvents(t, dialApp(t, c), "e", 1)
+	if !waitUntil(2*time.Second, func() bool {
+		main.mu.Lock()
+		defer main.mu.Unlock()
+		return main.dials >= 2
+	}) {
+		t.Fatal("main was never redialed after selecting no acceptable subprotocol")
+	}
+	if c.Status().Providers[0].Connected {
+		t.Fatal("main connected without an acceptable subprotocol")
+	}
+	if main.count() != 0 {
+		t.Fatalf("main got %v over a connection that should have failed", main.ids())
+	}
+}
+
+func TestAppSubprotocolRequired(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AppSubprotocols = []string{"events.v1"}
+	c := startController(t, cfg)
+	url := serveApps(t, c)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"events.v0", "events.v1"}}
+	app, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	if got := app.Subprotocol(); got != "events.v1" {
+		t.Fatalf("app handshake selected %q, want events.v1", got)
+	}
+
+	for _, offered := range [][]string{nil, {"events.v0", subprotocolJSON}} {
+		dialer := websocket.Dialer{Subprotocols: offered}
+		_, resp, err := dialer.Dial(url, nil)
+		if err == nil {
+			t.Fatalf("app offering %v accepted", offered)
+		}
+		if resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("app offering %v answered %v, want 400", offered, resp)
+		}
+	}
+}
+
+func TestValidateSubprotocols(t *testing.T) {
+	for _, names := range [][]string{{""}, {"v1 feed"}, {"v1,feed"}} {
+		cfg := DefaultConfig()
+		cfg.ProviderSubprotocols = names
+		if cfg.Validate() == nil {
+			t.Errorf("provider subprotocols %q accepted", names)
+		}
+		cfg = DefaultConfig()
+		cfg.AppSubprotocols = names
+		if cfg.Validate() == nil {
+			t.Errorf("app subprotocols %q accepted", names)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package gochunker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// WithTLSConfig dials providers with tc instead of one built from the
+// TLSCAFile, TLSCertFile and TLSKeyFile settings
+func WithTLSConfig(tc *tls.Config) Option {
+	return func(c *Controller) {
+		c.tlsConfig = tc
+	}
+}
+
+// providerTLSConfig builds the TLS configuration providers are dialed with
+// from cfg, or returns nil if cfg sets nothing TLS related so the system
+// defaults apply. Files are read right away so a bad path or certificate
+// fails at startup rather than on the first dial.
+func providerTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TLSCAFile == "" && cfg.TLSCertFile == "" && !cfg.TLSInsecureSkipVerify {
+		return nil, nil
+	}
+	tc := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	}
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s holds no PEM certificates", cfg.TLSCAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// serverTLSConfig builds the TLS configuration the app-facing server runs
+// under, or returns nil to serve plain HTTP when no certificate is set
+func serverTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.ServerCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.ServerCertFile, cfg.ServerKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %w", err)
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}, nil
+}
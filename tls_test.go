@@ -0,0 +1,80 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTLSFakeProvider is a fakeProvider served over TLS, together with a CA
+// bundle holding its certificate
+func newTLSFakeProvider(t *testing.T) (fp *fakeProvider, caFile string) {
+	fp = &fakeProvider{}
+	fp.srv = httptest.NewUnstartedServer(http.HandlerFunc(fp.serve))
+	fp.srv.StartTLS()
+	t.Cleanup(fp.kill)
+	caFile = filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: fp.srv.Certificate().Raw}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fp, caFile
+}
+
+func TestTLSProvider(t *testing.T) {
+	main, ca := newTLSFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.MainProviderURL, cfg.BackupProviderURL = main.url(), main.url()
+	cfg.TLSCAFile = ca
+	sendEvents(t, dialApp(t, startController(t, cfg)), "e", 2)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 2 }) {
+		t.Fatalf("TLS provider got %d events, want 2", main.count())
+	}
+}
+
+func TestTLSVerification(t *testing.T) {
+	fp, _ := newTLSFakeProvider(t)
+	for _, tc := range []struct {
+		name     string
+		insecure bool
+		ok       bool
+	}{
+		{"unknown CA", false, false},
+		{"skip verify", true, true},
+	} {
+		cfg := DefaultConfig()
+		cfg.TLSInsecureSkipVerify = tc.insecure
+		c, err := NewController(cfg, WithLogger(quietLogger))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, _, err := c.dialer.Dial(fp.url(), nil)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: dial returned %v", tc.name, err)
+		}
+		c.Close(context.Background())
+	}
+}
+
+func TestTLSBadFilesFailFast(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	for name, tweak := range map[string]func(*Config){
+		"CA bundle":          func(cfg *Config) { cfg.TLSCAFile = missing },
+		"client certificate": func(cfg *Config) { cfg.TLSCertFile, cfg.TLSKeyFile = missing, missing },
+		"server certificate": func(cfg *Config) { cfg.ServerCertFile, cfg.ServerKeyFile = missing, missing },
+	} {
+		cfg := DefaultConfig()
+		tweak(&cfg)
+		if _, err := NewController(cfg, WithLogger(quietLogger)); err == nil {
+			t.Errorf("missing %s accepted", name)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package gochunker
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans the controller creates
+const tracerName = "github.com/andranikasd/gochunker"
+
+// WithTracerProvider records each event's way through the controller as
+// OpenTelemetry spans from tp. A gochunker.event span runs from the event
+// being buffered until it leaves the buffer, with one gochunker.send child
+// per provider from the event being written until the provider acks it.
+// An event carrying a traceparent continues that trace. Without this
+// option no spans are created.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *Controller) {
+		c.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// eventCarrier exposes an event's trace context to a propagator
+type eventCarrier struct{ e *Event }
+
+func (ec eventCarrier) Get(key string) string {
+	switch key {
+	case "traceparent":
+		return ec.e.TraceParent
+	case "tracestate":
+		return ec.e.TraceState
+	}
+	return ""
+}
+
+func (ec eventCarrier) Set(key, value string) {
+	switch key {
+	case "traceparent":
+		ec.e.TraceParent = value
+	case "tracestate":
+		ec.e.TraceState = value
+	}
+}
+
+func (ec eventCarrier) Keys() []string { return []string{"traceparent", "tracestate"} }
+
+// traceBufferedLocked starts the span of the event just buffered at idx.
+// c.mu must be held.
+func (c *Controller) traceBufferedLocked(idx int, event Event) {
+	if c.tracer == nil {
+		return
+	}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), eventCarrier{&event})
+	_, span := c.tracer.Start(ctx, "gochunker.event",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("gochunker.event.id", event.ID),
+			attribute.String("gochunker.event.type", event.Type),
+			attribute.Int("gochunker.event.priority", event.Priority),
+			attribute.Int("gochunker.event.index", idx),
+		))
+	if c.spans == nil {
+		c.spans = make(map[int]trace.Span)
+	}
+	c.spans[idx] = span
+}
+
+// traceSentLocked records that event, at idx, was written to p, or
+// skipped by it when expired. The send span stays open until p acks the
+// event when awaitingAck is set. c.mu must be held.
+func (c *Controller) traceSentLocked(p *provider, idx int, event Event, expired, awaitingAck bool) {
+	parent, ok := c.spans[idx]
+	if !ok {
+		return
+	}
+	if expired {
+		parent.AddEvent("expired", trace.WithAttributes(attribute.String("gochunker.provider", p.name)))
+		return
+	}
+	_, span := c.tracer.Start(trace.ContextWithSpan(context.Background(), parent), "gochunker.send",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("gochunker.event.id", event.ID),
+			attribute.String("gochunker.provider", p.name),
+		))
+	if !awaitingAck {
+		span.End()
+		return
+	}
+	if p.spans == nil {
+		p.spans = make(map[int]trace.Span)
+	}
+	p.spans[idx] = span
+}
+
+// traceResentLocked notes on the open send span that the event at idx went
+// to p again. c.mu must be held.
+func (c *Controller) traceResentLocked(p *provider, idx int) {
+	if span, ok := p.spans[idx]; ok {
+		span.AddEvent("resent")
+	}
+}
+
+// traceAckedLocked ends p's send span of the event at idx, successfully if
+// p acked it. c.mu must be held.
+func (c *Controller) traceAckedLocked(p *provider, idx int, acked bool) {
+	span, ok := p.spans[idx]
+	if !ok {
+		return
+	}
+	delete(p.spans, idx)
+	if !acked {
+		span.SetStatus(codes.Error, "given up before an ack arrived")
+	}
+	span.End()
+}
+
+// traceDoneLocked ends the span of the event at idx as it leaves the
+// buffer, with an error status if reason is set. c.mu must be held.
+func (c *Controller) traceDoneLocked(idx int, reason string) {
+	span, ok := c.spans[idx]
+	if !ok {
+		return
+	}
+	delete(c.spans, idx)
+	if reason != "" {
+		span.SetStatus(codes.Error, reason)
+	}
+	span.End()
+}
+
+// traceCloseLocked ends every open span as the controller shuts down.
+// Events still buffered keep their place in the store but their spans end
+// here. c.mu must be held.
+func (c *Controller) traceCloseLocked() {
+	for _, p := range c.providers() {
+		for idx := range p.spans {
+			c.traceAckedLocked(p, idx, false)
+		}
+	}
+	for idx, span := range c.spans {
+		delete(c.spans, idx)
+		span.AddEvent("controller closed")
+		span.End()
+	}
+}
@@ -0,0 +1,75 @@
+package gochunker
+
+import (
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// attr returns the string attribute key of span, empty if it has none
+func attr(span tracetest.SpanStub, key attribute.Key) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestEventSpans(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	main.ackAll()
+	backup.ackAll()
+	cfg := testConfig(main, backup)
+	cfg.RequireAcks = true
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	c := startController(t, cfg, WithTracerProvider(tp))
+	app := dialApp(t, c)
+	sendRaw(t, app, `{"id":"e","payload":"x","traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}`)
+	// Closing the app lets the backup run, after which the event is done
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatal("event not sent to main")
+	}
+	app.Close()
+	if !waitUntil(2*time.Second, func() bool { return len(exporter.GetSpans()) == 3 }) {
+		t.Fatalf("%d spans ended, want an event span and two sends", len(exporter.GetSpans()))
+	}
+
+	var event tracetest.SpanStub
+	sends := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		switch span.Name {
+		case "gochunker.event":
+			event = span
+		case "gochunker.send":
+			sends[attr(span, "gochunker.provider")] = span
+		}
+	}
+	if got := event.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("event span in trace %s, want the app's", got)
+	}
+	if got := event.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("event span parented by %s, want the app's span", got)
+	}
+	if got := attr(event, "gochunker.event.id"); got != "e" {
+		t.Errorf("event span for event %q, want e", got)
+	}
+	for _, name := range []string{"Main", "Backup"} {
+		send, ok := sends[name]
+		if !ok {
+			t.Errorf("no send span for %s", name)
+			continue
+		}
+		if send.Parent.SpanID() != event.SpanContext.SpanID() {
+			t.Errorf("%s send span not a child of the event span", name)
+		}
+		if send.Status.Code == codes.Error || attr(send, "gochunker.event.id") != "e" {
+			t.Errorf("%s send span for %q ended with %v", name, attr(send, "gochunker.event.id"), send.Status)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Transform encodes an event into the message a provider receives, for
+// providers expecting an envelope of their own. It sees the event as it is
+// sent, Seq stamped and its payload compressed if CompressThreshold says
+// so.
+type Transform func(e Event) ([]byte, error)
+
+// WithTransform sends events to the provider called provider as fn encodes
+// them instead of in the configured codec. Each event then goes out in a
+// message of its own: fn decides the whole wire format, so events are not
+// wrapped in batch messages nor split into chunk frames for that provider,
+// though they are still collected into batches under BatchSize. Other
+// providers are unaffected.
+func WithTransform(provider string, fn Transform) Option {
+	return func(c *Controller) {
+		if c.transforms == nil {
+			c.transforms = make(map[string]Transform)
+		}
+		c.transforms[provider] = fn
+	}
+}
+
+// Envelope returns a Transform wrapping each event, in its JSON form, in an
+// object under field, as in {"data":{...}}
+func Envelope(field string) Transform {
+	return func(e Event) ([]byte, error) {
+		return json.Marshal(map[string]Event{field: e})
+	}
+}
+
+// checkTransforms returns an error if a transform names a provider not in
+// the pool
+func (c *Controller) checkTransforms() error {
+	for name := range c.transforms {
+		found := false
+		for _, p := range c.providers() {
+			found = found || p.name == name
+		}
+		if !found {
+			return fmt.Errorf("transform for unknown provider %q", name)
+		}
+	}
+	return nil
+}
+
+// transformBatch encodes each event of batch with fn, one message apiece
+func transformBatch(fn Transform, batch []Event) ([][]byte, error) {
+	msgs := make([][]byte, len(batch))
+	for i, event := range batch {
+		msg, err := fn(event)
+		if err != nil {
+			return nil, fmt.Errorf("transforming event %q: %w", event.ID, err)
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
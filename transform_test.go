@@ -0,0 +1,106 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTransformPool starts a round-robin pool over two providers, the
+// first sending with transform, and enqueues n events
+func startTransformPool(t *testing.T, cfg Config, transform Transform, n int) (*Controller, *fakeProvider, *fakeProvider) {
+	t.Helper()
+	a, b := newFakeProvider(t), newFakeProvider(t)
+	cfg.ProviderURLs = []string{a.url(), b.url()}
+	cfg.PoolStrategy = RoundRobin
+	c := startController(t, cfg, WithTransform("provider-0", transform))
+	if !waitUntil(2*time.Second, func() bool {
+		st := c.Status()
+		return st.Providers[0].Connected && st.Providers[1].Connected
+	}) {
+		t.Fatal("providers did not connect")
+	}
+	for i := 0; i < n; i++ {
+		if err := c.Enqueue(Event{ID: fmt.Sprintf("e%d", i), Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c, a, b
+}
+
+func TestTransformPerProvider(t *testing.T) {
+	_, a, b := startTransformPool(t, DefaultConfig(), Envelope("data"), 4)
+	if !waitUntil(2*time.Second, func() bool { return a.count() == 2 && b.count() == 2 }) {
+		t.Fatalf("providers got %v and %v, want two events each", a.messages(), b.messages())
+	}
+	for _, msg := range a.messages() {
+		var wrapped struct {
+			Data Event `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(msg), &wrapped); err != nil || wrapped.Data.ID == "" || string(wrapped.Data.Payload) != "x" {
+			t.Fatalf("transformed provider got %s, want the event under data", msg)
+		}
+	}
+	// The default path is the event's own JSON form
+	if ids := b.ids(); len(ids) != 2 {
+		t.Fatalf("untransformed provider got %v, want plain events", b.messages())
+	}
+}
+
+func TestTransformSendsBatchesEventByEvent(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BatchSize = 3
+	cfg.FlushInterval = 50 * time.Millisecond
+	flat := func(e Event) ([]byte, error) { return []byte(e.ID + ":" + string(e.Payload)), nil }
+	_, a, b := startTransformPool(t, cfg, flat, 6)
+	if !waitUntil(2*time.Second, func() bool { return a.count() == 3 && len(batches(b)) == 1 }) {
+		t.Fatalf("providers got %v and %v, want 3 messages and a batch", a.messages(), b.messages())
+	}
+	if got := fmt.Sprint(a.messages()); got != "[e0:x e2:x e4:x]" {
+		t.Fatalf("transformed provider got %s", got)
+	}
+}
+
+func TestTransformFailureDropsEvent(t *testing.T) {
+	var mu sync.Mutex
+	var dropped []string
+	a, b := newFakeProvider(t), newFakeProvider(t)
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{a.url(), b.url()}
+	fail := func(e Event) ([]byte, error) {
+		if e.ID == "bad" {
+			return nil, errors.New("no envelope for it")
+		}
+		return json.Marshal(e)
+	}
+	c := startController(t, cfg, WithTransform("provider-0", fail), WithOnDropped(func(e Event, reason string) {
+		mu.Lock()
+		defer mu.Unlock()
+		dropped = append(dropped, e.ID+" "+reason)
+	}))
+	for _, id := range []string{"bad", "good"} {
+		if err := c.Enqueue(Event{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return a.count() == 1 }) {
+		t.Fatalf("provider got %v, want good only", a.ids())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := fmt.Sprint(dropped); got != "[bad unencodable]" {
+		t.Fatalf("dropped %s", got)
+	}
+}
+
+func TestTransformForUnknownProvider(t *testing.T) {
+	c, err := NewController(DefaultConfig(), WithTransform("Nope", Envelope("data")))
+	if err == nil {
+		c.Close(context.Background())
+		t.Fatal("transform for an unknown provider accepted")
+	}
+}
@@ -0,0 +1,57 @@
+package gochunker
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Conn is a message-oriented connection to a provider, the subset of
+// *websocket.Conn the controller relies on. Message types are those of
+// gorilla/websocket: TextMessage, BinaryMessage, and the CloseMessage,
+// PingMessage and PongMessage control frames.
+//
+// As with *websocket.Conn, at most one goroutine reads and one writes at a
+// time; WriteControl and Close may be called concurrently with either.
+type Conn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Subprotocol() string // negotiated in the handshake, empty if none
+	Close() error
+}
+
+// DialFunc opens a connection to the provider at url, sending header with
+// the handshake. It returns once the connection is ready for messages or
+// ctx is done.
+type DialFunc func(ctx context.Context, url string, header http.Header) (Conn, error)
+
+// WithDialFunc makes the controller connect to providers with dial instead
+// of gorilla/websocket's dialer and the HTTP stream. The TLS, proxy and
+// compression settings from Config only apply to the defaults.
+func WithDialFunc(dial DialFunc) Option {
+	return func(c *Controller) {
+		c.dialFunc = dial
+	}
+}
+
+// dial connects to the provider at url through the DialFunc, if one was
+// given, as an HTTP stream for http:// and https:// URLs and with the
+// WebSocket dialer otherwise
+func (c *Controller) dial(ctx context.Context, url string, header http.Header) (Conn, error) {
+	if c.dialFunc != nil {
+		return c.dialFunc(ctx, url, header)
+	}
+	if isHTTPProvider(url) {
+		return c.dialHTTPStream(ctx, url, header)
+	}
+	conn, _, err := c.dialer.DialContext(ctx, url, header)
+	if err != nil {
+		// Keep a nil *websocket.Conn out of the interface
+		return nil, err
+	}
+	return conn, nil
+}
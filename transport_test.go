@@ -0,0 +1,239 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// memMessage is a message in flight between the ends of a memPipe
+type memMessage struct {
+	typ  int
+	data []byte
+}
+
+// memConn is one end of an in-memory connection implementing Conn. Pings
+// are answered with pongs and a close frame ends the peer's reads, as over
+// a real WebSocket.
+type memConn struct {
+	in   chan memMessage
+	peer *memConn
+	done chan struct{} // closed when either end closes
+	once *sync.Once
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	pong          func(string) error
+	closeErr      error // set from the close frame the peer sent
+}
+
+// newMemPipe returns the two connected ends of a new in-memory connection
+func newMemPipe() (*memConn, *memConn) {
+	done, once := make(chan struct{}), &sync.Once{}
+	a := &memConn{in: make(chan memMessage, 64), done: done, once: once}
+	b := &memConn{in: make(chan memMessage, 64), done: done, once: once}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+// deadline returns a channel firing at t, nil for the zero time
+func deadline(t time.Time) (<-chan time.Time, func()) {
+	if t.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer.C, func() { timer.Stop() }
+}
+
+func (mc *memConn) ReadMessage() (int, []byte, error) {
+	for {
+		mc.mu.Lock()
+		expired, stop := deadline(mc.readDeadline)
+		mc.mu.Unlock()
+		var msg memMessage
+		select {
+		case msg = <-mc.in:
+		case <-mc.done:
+			stop()
+			mc.mu.Lock()
+			defer mc.mu.Unlock()
+			if mc.closeErr != nil {
+				return 0, nil, mc.closeErr
+			}
+			return 0, nil, net.ErrClosed
+		case <-expired:
+			mc.Close()
+			return 0, nil, errors.New("read deadline exceeded")
+		}
+		stop()
+		switch msg.typ {
+		case websocket.PingMessage:
+			mc.peer.deliver(memMessage{typ: websocket.PongMessage, data: msg.data}, time.Time{})
+		case websocket.PongMessage:
+			mc.mu.Lock()
+			pong := mc.pong
+			mc.mu.Unlock()
+			if pong != nil {
+				pong(string(msg.data))
+			}
+		case websocket.CloseMessage:
+			closeErr := &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+			if len(msg.data) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(msg.data))
+				closeErr.Text = string(msg.data[2:])
+			}
+			mc.mu.Lock()
+			mc.closeErr = closeErr
+			mc.mu.Unlock()
+			mc.Close()
+		default:
+			return msg.typ, msg.data, nil
+		}
+	}
+}
+
+// deliver queues msg for the peer reading mc.in, waiting until by for room
+func (mc *memConn) deliver(msg memMessage, by time.Time) error {
+	expired, stop := deadline(by)
+	defer stop()
+	select {
+	case <-mc.done:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case mc.in <- msg:
+		return nil
+	case <-mc.done:
+		return net.ErrClosed
+	case <-expired:
+		return errors.New("write deadline exceeded")
+	}
+}
+
+func (mc *memConn) WriteMessage(typ int, data []byte) error {
+	mc.mu.Lock()
+	by := mc.writeDeadline
+	mc.mu.Unlock()
+	return mc.peer.deliver(memMessage{typ: typ, data: append([]byte(nil), data...)}, by)
+}
+
+func (mc *memConn) WriteControl(typ int, data []byte, by time.Time) error {
+	return mc.peer.deliver(memMessage{typ: typ, data: append([]byte(nil), data...)}, by)
+}
+
+func (mc *memConn) SetReadDeadline(t time.Time) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.readDeadline = t
+	return nil
+}
+
+func (mc *memConn) SetWriteDeadline(t time.Time) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.writeDeadline = t
+	return nil
+}
+
+func (mc *memConn) SetPongHandler(h func(string) error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.pong = h
+}
+
+// Subprotocol reports no subprotocol, so the controller speaks JSON
+func (mc *memConn) Subprotocol() string { return "" }
+
+func (mc *memConn) Close() error {
+	mc.once.Do(func() { close(mc.done) })
+	return nil
+}
+
+// memDialer hands the controller one end of a new memPipe per dial and
+// passes the other end to accepted
+type memDialer struct {
+	accepted chan *memConn
+}
+
+func newMemDialer() *memDialer {
+	return &memDialer{accepted: make(chan *memConn, 8)}
+}
+
+func (md *memDialer) dial(ctx context.Context, url string, header http.Header) (Conn, error) {
+	client, server := newMemPipe()
+	select {
+	case md.accepted <- server:
+		return client, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// accept returns the provider end of the next connection dialed
+func (md *memDialer) accept(t *testing.T) *memConn {
+	t.Helper()
+	select {
+	case conn := <-md.accepted:
+		return conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("controller never dialed the provider")
+		return nil
+	}
+}
+
+func TestSendCycleOverMemTransport(t *testing.T) {
+	md := newMemDialer()
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.RequireAcks = true
+	c := startController(t, cfg, WithDialFunc(md.dial))
+	provider := md.accept(t)
+
+	c.mu.Lock()
+	for _, id := range []string{"e0", "e1", "e2"} {
+		c.bufferLocked(Event{ID: id, Payload: []byte("payload " + id)})
+	}
+	c.mu.Unlock()
+
+	var acks [][]byte
+	for i := 0; i < 3; i++ {
+		_, msg, err := provider.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var event Event
+		if err := json.Unmarshal(msg, &event); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("e%d", i); event.ID != want || string(event.Payload) != "payload "+want {
+			t.Fatalf("message %d is %s %q, want %s", i, event.ID, event.Payload, want)
+		}
+		if event.Seq != uint64(i+1) {
+			t.Fatalf("event %s has seq %d, want %d", event.ID, event.Seq, i+1)
+		}
+		ack, _ := json.Marshal(providerMessage{Ack: event.ID, Seq: event.Seq})
+		acks = append(acks, ack)
+	}
+	if st := c.Status(); st.Buffered != 3 {
+		t.Fatalf("%d events buffered before any ack, want 3", st.Buffered)
+	}
+	for _, ack := range acks {
+		if err := provider.WriteMessage(websocket.TextMessage, ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Buffered == 0 }) {
+		t.Fatalf("acknowledged events still buffered: %+v", c.Status())
+	}
+}
@@ -0,0 +1,92 @@
+package gochunker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Validator vets an event from an app before it is buffered. raw is the
+// message as the app sent it. A non-nil error rejects the event and is
+// reported back to the app.
+type Validator func(raw []byte, event Event) error
+
+// WithValidator rejects events fn returns an error for. It runs after the
+// EventSchemaFile check, if any.
+func WithValidator(fn Validator) Option {
+	return func(c *Controller) {
+		c.validator = fn
+	}
+}
+
+// compileSchema loads the JSON Schema app messages are checked against, or
+// returns nil when cfg names none
+func compileSchema(cfg Config) (*jsonschema.Schema, error) {
+	if cfg.EventSchemaFile == "" {
+		return nil, nil
+	}
+	schema, err := jsonschema.Compile(cfg.EventSchemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading event schema: %w", err)
+	}
+	return schema, nil
+}
+
+// validateEvent checks the app message raw, decoded with codec into event,
+// against the schema and the validator. Messages in another format than
+// JSON are checked in their JSON form.
+func (c *Controller) validateEvent(codec Codec, raw []byte, event Event) error {
+	if c.schema != nil {
+		var doc interface{}
+		if _, ok := codec.(JSONCodec); ok {
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.UseNumber() // keep large integers exact for the schema
+			if err := dec.Decode(&doc); err != nil {
+				return err
+			}
+		} else if err := codec.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		if err := c.schema.Validate(doc); err != nil {
+			return err
+		}
+	}
+	if c.validator != nil {
+		return c.validator(raw, event)
+	}
+	return nil
+}
+
+// eventRejection is sent back to an app for an event it sent that was not
+// accepted
+type eventRejection struct {
+	Error  string `json:"error"`
+	ID     string `json:"id,omitempty"`
+	Line   int    `json:"line,omitempty"` // of the NDJSON frame the event came on, see Config.AppNDJSON
+	Detail string `json:"detail"`
+}
+
+// rejectEvent counts an app message that was malformed, too large or
+// failed validation and tells the app why. line is the NDJSON line the
+// event came on, zero for a message of its own.
+func (c *Controller) rejectEvent(app *appConn, id string, line int, reason error) {
+	c.countRejected(id, reason)
+	msg, err := app.codec.Marshal(eventRejection{Error: "invalid event", ID: id, Line: line, Detail: reason.Error()})
+	if err != nil {
+		return
+	}
+	if err := app.write(msg, c.cfg.WriteTimeout); err != nil {
+		c.log.Warn("telling app about rejected event failed", "event_id", id, "err", err)
+	}
+}
+
+// countRejected counts an event that was not accepted for reason
+func (c *Controller) countRejected(id string, reason error) {
+	c.mu.Lock()
+	c.rejected++
+	c.mu.Unlock()
+	c.metrics.rejected.Inc()
+	c.log.Warn("rejected invalid event", "event_id", id, "err", reason)
+}
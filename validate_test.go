@@ -0,0 +1,110 @@
+package gochunker
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readNack reads the next message the controller sent the app, which must
+// be a rejection
+func readNack(t *testing.T, app *websocket.Conn) eventRejection {
+	t.Helper()
+	app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := app.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nack eventRejection
+	if err := json.Unmarshal(msg, &nack); err != nil || nack.Error != "invalid event" {
+		t.Fatalf("got %s, want a rejection", msg)
+	}
+	return nack
+}
+
+// schemaConfig returns a test configuration checking events against a
+// schema that requires a type of click or view
+func schemaConfig(t *testing.T, main, backup *fakeProvider) Config {
+	schema := filepath.Join(t.TempDir(), "event.json")
+	err := os.WriteFile(schema, []byte(`{
+		"type": "object",
+		"required": ["id", "type"],
+		"properties": {"type": {"enum": ["click", "view"]}}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(main, backup)
+	cfg.EventSchemaFile = schema
+	return cfg
+}
+
+func TestSchemaValidation(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, schemaConfig(t, main, backup))
+	app := dialApp(t, c)
+	sendRaw(t, app, `{"id":"valid","type":"click","payload":"x"}`)
+	sendRaw(t, app, `{"id":"invalid","type":"scroll","payload":"x"}`)
+	readNack(t, app)
+	sendRaw(t, app, `{"id":"malformed"`)
+	readNack(t, app)
+
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatalf("main got %v, want the valid event", main.ids())
+	}
+	if got := main.ids(); got[0] != "valid" {
+		t.Fatalf("main got %v, want the valid event", got)
+	}
+	if n := c.Status().Rejected; n != 2 {
+		t.Fatalf("rejected %d, want 2", n)
+	}
+}
+
+func TestSchemaFileMustLoad(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EventSchemaFile = filepath.Join(t.TempDir(), "missing.json")
+	if _, err := NewController(cfg, WithLogger(quietLogger)); err == nil {
+		t.Fatal("missing schema accepted")
+	}
+}
+
+func TestNackPerRejectionReason(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	cfg := schemaConfig(t, main, backup)
+	cfg.MaxMessageBytes = 256
+	noBad := func(raw []byte, event Event) error {
+		if event.ID == "bad" {
+			return errors.New("bad is not a valid ID")
+		}
+		return nil
+	}
+	c := startController(t, cfg, WithValidator(noBad))
+	app := dialApp(t, c)
+	for _, tc := range []struct {
+		reason string
+		msg    string
+		id     string
+		detail string
+	}{
+		{"malformed", `{"id":`, "", "malformed event"},
+		{"schema", `{"id":"s","type":"scroll"}`, "s", "/type"},
+		{"validator", `{"id":"bad","type":"view"}`, "bad", "bad is not a valid ID"},
+		// Last, the connection is closed after it
+		{"size", `{"id":"big","type":"view","payload":"` + strings.Repeat("x", 256) + `"}`, "", "exceeds 256 bytes"},
+	} {
+		sendRaw(t, app, tc.msg)
+		nack := readNack(t, app)
+		if nack.ID != tc.id || !strings.Contains(nack.Detail, tc.detail) {
+			t.Errorf("%s: nack for %q with detail %q, want %q with %q", tc.reason, nack.ID, nack.Detail, tc.id, tc.detail)
+		}
+	}
+	if n := c.Status().Rejected; n != 4 {
+		t.Fatalf("rejected %d, want 4", n)
+	}
+}
@@ -0,0 +1,110 @@
+package gochunker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEventsAppendedWhileWorkerRuns(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	app := dialApp(t, c)
+	sendEvents(t, app, "a", 5)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 5 }) {
+		t.Fatalf("main got %d events, want 5", main.count())
+	}
+	// The worker has caught up and waits for more
+	sendEvents(t, app, "b", 5)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 10 }) {
+		t.Fatalf("main got %d events, want 10", main.count())
+	}
+	want := []string{"a0", "a1", "a2", "a3", "a4", "b0", "b1", "b2", "b3", "b4"}
+	if got := fmt.Sprint(main.ids()); got != fmt.Sprint(want) {
+		t.Fatalf("main got %s, want %v", got, want)
+	}
+}
+
+func TestAppConnectsWhileWorkerRuns(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].Connected }) {
+		t.Fatal("main never connected")
+	}
+	// Apps come and go under a running worker
+	for i := 0; i < 3; i++ {
+		app := dialApp(t, c)
+		sendEvents(t, app, fmt.Sprintf("app%d-", i), 2)
+		want := 2 * (i + 1)
+		if !waitUntil(2*time.Second, func() bool { return main.count() == want }) {
+			t.Fatalf("main got %d events, want %d", main.count(), want)
+		}
+		app.Close()
+	}
+}
+
+func TestBothProvidersActive(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	first := dialApp(t, c)
+	sendEvents(t, first, "a", 3)
+	first.Close()
+	// Once the first app is gone main finishes and backup catches up
+	if !waitUntil(2*time.Second, func() bool { return backup.count() == 3 }) {
+		t.Fatalf("backup got %d events, want 3", backup.count())
+	}
+
+	// With both workers running, the next app's events reach both
+	sendEvents(t, dialApp(t, c), "b", 3)
+	both := func() bool { return main.count() == 6 && backup.count() == 6 }
+	if !waitUntil(2*time.Second, both) {
+		t.Fatalf("main got %d and backup %d events, want 6 each", main.count(), backup.count())
+	}
+	if m, b := fmt.Sprint(main.ids()), fmt.Sprint(backup.ids()); m != b {
+		t.Fatalf("main got %s, backup %s", m, b)
+	}
+}
+
+func TestTriggeringBackupAgainNeverBlocks(t *testing.T) {
+	main, backup := newFakeProvider(t), newFakeProvider(t)
+	c := startController(t, testConfig(main, backup))
+	for i := 0; i < 2; i++ {
+		// Each app leaving makes main finish and trigger backup once more
+		app := dialApp(t, c)
+		sendEvents(t, app, fmt.Sprintf("app%d-", i), 2)
+		app.Close()
+		want := 2 * (i + 1)
+		if !waitUntil(2*time.Second, func() bool { return main.count() == want && backup.count() == want }) {
+			t.Fatalf("main got %d and backup %d events, want %d each", main.count(), backup.count(), want)
+		}
+	}
+	// Losing its connection triggers backup yet again
+	main.mu.Lock()
+	for _, conn := range main.conns {
+		conn.Close()
+	}
+	main.mu.Unlock()
+	sendEvents(t, dialApp(t, c), "late", 1)
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 5 }) {
+		t.Fatalf("main got %d events after reconnecting, want 5", main.count())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("close with the backup triggered repeatedly: %v", err)
+	}
+	// With backup's worker gone, triggering it still returns
+	done := make(chan struct{})
+	go func() {
+		c.trigger(c.pool.members[1], nil)
+		c.trigger(c.pool.members[1], c.pool.members[0])
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("triggering the exited backup worker blocked")
+	}
+}
@@ -0,0 +1,79 @@
+package gochunker
+
+import "time"
+
+// writeFailed counts a failed write to p and reports whether the streak of
+// them reached WriteErrorThreshold, so the next attempt waits a cooldown
+// first
+func (c *Controller) writeFailed(p *provider) bool {
+	n := p.writeErrors.Add(1)
+	return c.cfg.WriteErrorThreshold > 0 && int(n) >= c.cfg.WriteErrorThreshold
+}
+
+// writeSucceeded ends p's streak of failed writes
+func (c *Controller) writeSucceeded(p *provider) {
+	p.writeErrors.Store(0)
+}
+
+// writeCooldown returns the pause after the n-th failed write in a row:
+// WriteCooldown once n reaches WriteErrorThreshold, doubling with every
+// further failure up to WriteMaxCooldown. A probe failing doesn't count, the
+// write retried over the connection replacing it does.
+func (c *Controller) writeCooldown(n int) time.Duration {
+	d := c.cfg.WriteCooldown
+	for i := c.cfg.WriteErrorThreshold; i < n && d < c.cfg.WriteMaxCooldown; i++ {
+		d *= 2
+	}
+	return min(d, c.cfg.WriteMaxCooldown)
+}
+
+// readerDoneLocked returns the channel closed once the reader of ws, p's
+// own connection or one of its lanes', stops. c.mu must be held.
+func (c *Controller) readerDoneLocked(p *provider, ws Conn) <-chan struct{} {
+	if p.conn == ws {
+		return p.readerDone
+	}
+	for _, l := range p.lanes {
+		if l.conn == ws {
+			return l.readerDone
+		}
+	}
+	return nil
+}
+
+// pauseWrites holds sends to p over ws back once WriteErrorThreshold
+// writes in a row failed, for the cooldown the streak calls for, see
+// writeCooldown, and then probes ws. It returns nil once the probe goes
+// through, as it may over a transport whose write errors pass. A failed
+// probe returns errConnLost for ws to be replaced: a *websocket.Conn fails
+// every write after its first failure, so waiting on it longer would never
+// end. Likewise errConnLost if ws's reader stops meanwhile, errSendTimedOut
+// once guard fires and the context's error when the controller stops.
+func (c *Controller) pauseWrites(p *provider, ws Conn, guard *sendGuard) error {
+	c.mu.Lock()
+	lost := c.readerDoneLocked(p, ws)
+	c.mu.Unlock()
+	n := int(p.writeErrors.Load())
+	wait := c.writeCooldown(n)
+	c.log.Warn("writes keep failing, pausing sends", "provider", p.name, "errors", n, "cooldown", wait)
+	select {
+	case <-c.clock.After(wait):
+	case <-lost:
+		if guard.fired() {
+			return errSendTimedOut
+		}
+		return errConnLost
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+	if guard.fired() {
+		return errSendTimedOut
+	}
+	if err := c.writeProbe(ws); err != nil {
+		c.log.Debug("provider still failing writes", "provider", p.name, "err", err)
+		return errConnLost
+	}
+	c.writeSucceeded(p)
+	c.log.Info("provider takes writes again, resuming sends", "provider", p.name)
+	return nil
+}
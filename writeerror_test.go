@@ -0,0 +1,179 @@
+package gochunker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// failingWrites opens connections that stay up while their writes fail
+// as long as failing is set, recording what was written otherwise
+type failingWrites struct {
+	failing atomic.Bool
+
+	mu      sync.Mutex
+	dials   int
+	written []string
+	peers   []*memConn // the provider's ends, kept open
+}
+
+func (fw *failingWrites) dial(ctx context.Context, url string, header http.Header) (Conn, error) {
+	client, server := newMemPipe()
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.dials++
+	fw.peers = append(fw.peers, server)
+	return &failingConn{client, fw}, nil
+}
+
+func (fw *failingWrites) state() (dials int, written []string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.dials, append([]string(nil), fw.written...)
+}
+
+type failingConn struct {
+	*memConn
+	fw *failingWrites
+}
+
+func (c *failingConn) WriteMessage(typ int, data []byte) error {
+	if c.fw.failing.Load() {
+		return errors.New("write failed")
+	}
+	c.fw.mu.Lock()
+	c.fw.written = append(c.fw.written, string(data))
+	c.fw.mu.Unlock()
+	return c.memConn.WriteMessage(typ, data)
+}
+
+func TestWriteErrorsPauseAndRecover(t *testing.T) {
+	fw := &failingWrites{}
+	fw.failing.Store(true)
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.WriteErrorThreshold = 3
+	cfg.WriteCooldown = 10 * time.Millisecond
+	cfg.WriteMaxCooldown = 40 * time.Millisecond
+	c := startController(t, cfg, WithDialFunc(fw.dial), withBackoffBase(time.Millisecond))
+	if err := c.Enqueue(Event{ID: "e0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two failed writes reconnect at once, from the third on each retry
+	// pauses, probes and reconnects as the probe fails too
+	if !waitUntil(2*time.Second, func() bool { return c.Status().Providers[0].WriteErrors > 4 }) {
+		t.Fatalf("provider %+v, want a streak of failed writes", c.Status().Providers[0])
+	}
+	if dials, _ := fw.state(); dials < 5 {
+		t.Fatalf("dialed %d times, want a redial after every failed probe", dials)
+	}
+
+	fw.failing.Store(false)
+	if !waitUntil(2*time.Second, func() bool {
+		_, written := fw.state()
+		return len(written) == 2
+	}) {
+		_, written := fw.state()
+		t.Fatalf("provider got %v once writes went through, want a probe and e0", written)
+	}
+	_, written := fw.state()
+	var probe probeMessage
+	var event Event
+	if json.Unmarshal([]byte(written[0]), &probe) != nil || probe.Type != "probe" {
+		t.Fatalf("first write %s, want a probe", written[0])
+	}
+	if json.Unmarshal([]byte(written[1]), &event) != nil || event.ID != "e0" {
+		t.Fatalf("second write %s, want e0", written[1])
+	}
+	if n := c.Status().Providers[0].WriteErrors; n != 0 {
+		t.Fatalf("%d write errors after recovering, want the streak reset", n)
+	}
+}
+
+// expiringDials dials real websocket connections, the first of them with
+// its write deadline always in the past, so every write over it fails
+type expiringDials struct {
+	dials atomic.Int32
+}
+
+func (d *expiringDials) dial(ctx context.Context, url string, header http.Header) (Conn, error) {
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	if d.dials.Add(1) == 1 {
+		return expiredConn{ws}, nil
+	}
+	return ws, nil
+}
+
+type expiredConn struct {
+	*websocket.Conn
+}
+
+func (c expiredConn) SetWriteDeadline(time.Time) error {
+	return c.Conn.SetWriteDeadline(time.Now().Add(-time.Second))
+}
+
+func TestWriteErrorsRedialRealConn(t *testing.T) {
+	main := newFakeProvider(t)
+	d := &expiringDials{}
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{main.url()}
+	cfg.WriteTimeout = time.Second
+	cfg.WriteErrorThreshold = 1
+	cfg.WriteCooldown = 10 * time.Millisecond
+	cfg.WriteMaxCooldown = 10 * time.Millisecond
+	c := startController(t, cfg, WithDialFunc(d.dial), withBackoffBase(time.Millisecond))
+	if err := c.Enqueue(Event{ID: "e0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first connection's reader stays up while its writes fail for good
+	if !waitUntil(2*time.Second, func() bool { return main.count() == 1 }) {
+		t.Fatalf("provider got %v over %d dials, want e0 after a redial", main.ids(), d.dials.Load())
+	}
+	if n := d.dials.Load(); n != 2 {
+		t.Fatalf("dialed %d times, want 2", n)
+	}
+}
+
+func TestWriteErrorsCooldownGrows(t *testing.T) {
+	fw := &failingWrites{}
+	fw.failing.Store(true)
+	fc := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.ProviderURLs = []string{"ws://provider.invalid"}
+	cfg.WriteErrorThreshold = 1
+	cfg.WriteCooldown = time.Second
+	cfg.WriteMaxCooldown = 4 * time.Second
+	c := startController(t, cfg, WithDialFunc(fw.dial), WithClock(fc))
+	if err := c.Enqueue(Event{ID: "e0"}); err != nil {
+		t.Fatal(err)
+	}
+	streak := func() int { return c.Status().Providers[0].WriteErrors }
+	if !waitUntil(2*time.Second, func() bool { return streak() == 1 }) {
+		t.Fatalf("%d write errors, want the first to pause", streak())
+	}
+	// Each failed retry doubles the pause: 1s, 2s, 4s, then 4s again
+	for i, wait := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		time.Sleep(20 * time.Millisecond)
+		fc.Advance(wait - time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		if n := streak(); n != i+1 {
+			t.Fatalf("probed early, %d write errors before pause %d ended", n, i+1)
+		}
+		fc.Advance(time.Millisecond)
+		if !waitUntil(2*time.Second, func() bool { return streak() == i+2 }) {
+			t.Fatalf("%d write errors after pause %d, want a failed probe", streak(), i+1)
+		}
+	}
+}